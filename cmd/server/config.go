@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/services"
 	"gopkg.in/yaml.v3"
 )
@@ -13,13 +19,68 @@ import (
 type llmConfig interface {
 	llm(string, *slog.Logger) (handlers.LLM, error)
 	titleGen(string, *slog.Logger) (handlers.TitleGenerator, error)
+	base() BaseLLMConfig
 }
 
 // BaseLLMConfig contains the common fields for all LLM configurations.
 type BaseLLMConfig struct {
-	Provider   string                 `yaml:"provider"`
-	Model      string                 `yaml:"model"`
-	Parameters services.LLMParameters `yaml:"parameters"`
+	Provider   string               `yaml:"provider"`
+	Model      string               `yaml:"model"`
+	Parameters models.LLMParameters `yaml:"parameters"`
+	Retry      *retryConfig         `yaml:"retry"`
+	// Extra are the vendor-specific fields added to the requests of the provider, as is.
+	Extra map[string]any `yaml:"extra"`
+}
+
+// retryConfig overrides the default retry policy of the transient errors of an LLM provider. The unset
+// fields keep their default value.
+type retryConfig struct {
+	MaxRetries     *int          `yaml:"maxRetries"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+}
+
+// retryPolicy returns the retry policy of the LLM, the default one overridden by the retry config.
+func (b BaseLLMConfig) retryPolicy() services.RetryPolicy {
+	policy := services.DefaultRetryPolicy
+	if b.Retry == nil {
+		return policy
+	}
+	if b.Retry.MaxRetries != nil {
+		policy.MaxRetries = *b.Retry.MaxRetries
+	}
+	policy.InitialBackoff = cmp.Or(b.Retry.InitialBackoff, policy.InitialBackoff)
+	policy.MaxBackoff = cmp.Or(b.Retry.MaxBackoff, policy.MaxBackoff)
+	return policy
+}
+
+func (b BaseLLMConfig) base() BaseLLMConfig {
+	return b
+}
+
+// providerParameters are the names of the LLM parameters supported by each provider.
+var providerParameters = map[string][]string{
+	"ollama":           services.OllamaParameters,
+	"anthropic":        services.AnthropicParameters,
+	"openai":           services.OpenAIParameters,
+	"openrouter":       services.OpenRouterParameters,
+	"gemini":           services.GeminiParameters,
+	"bedrock":          services.BedrockParameters,
+	"azureOpenAI":      services.OpenAIParameters,
+	"openaiCompatible": services.OpenAIParameters,
+}
+
+// unsupportedParameters returns the names of the parameters of the LLM that its provider doesn't support,
+// and ignores.
+func (b BaseLLMConfig) unsupportedParameters() []string {
+	supported := providerParameters[b.Provider]
+	var unsupported []string
+	for _, name := range b.Parameters.Names() {
+		if !slices.Contains(supported, name) {
+			unsupported = append(unsupported, name)
+		}
+	}
+	return unsupported
 }
 
 type config struct {
@@ -28,21 +89,64 @@ type config struct {
 	LogMode              string                          `yaml:"logMode"`
 	SystemPrompt         string                          `yaml:"systemPrompt"`
 	TitleGeneratorPrompt string                          `yaml:"titleGeneratorPrompt"`
+	SummarizeContext     bool                            `yaml:"summarizeContext"`
+	SummaryPrompt        string                          `yaml:"summaryPrompt"`
 	LLM                  llmConfig                       `yaml:"llm"`
+	LLMs                 []llmProfileConfig              `yaml:"llms"`
 	GenTitleLLM          llmConfig                       `yaml:"genTitleLLM"`
+	Personas             []personaConfig                 `yaml:"personas"`
+	Prices               map[string]models.Price         `yaml:"prices"`
+	Store                storeConfig                     `yaml:"store"`
 	MCPSSEServers        map[string]mcpSSEServerConfig   `yaml:"mcpSSEServers"`
 	MCPStdIOServers      map[string]mcpStdIOServerConfig `yaml:"mcpStdIOServers"`
 }
 
+// llmProfileConfig is a named LLM that users can select for a chat. The profiles are parsed from the llm
+// and llms sections, and the first one is the default LLM.
+type llmProfileConfig struct {
+	Name string
+	// Model is the model of the LLM, used to look up its price and detect its capabilities.
+	Model string
+	// ContextWindow is the context window of the LLM in tokens, zero if it's not configured.
+	ContextWindow int
+	// Fallbacks are the names of the profiles that answer, in order, when the LLM fails.
+	Fallbacks []string
+	// Capabilities override the detected capabilities of the models of the LLM.
+	Capabilities services.ConfiguredCapabilities
+	// TextToolCalls lets the models without native tool calls call the tools in text. It only applies to the
+	// models whose tools are detected as unsupported, or configured false in Capabilities.
+	TextToolCalls bool
+	LLM           llmConfig
+}
+
+const defaultLLMProfileName = "Default"
+
+// personaConfig is a persona available to every chat, besides the personas created from the UI.
+type personaConfig struct {
+	Name         string               `yaml:"name"`
+	SystemPrompt string               `yaml:"systemPrompt"`
+	Tools        []string             `yaml:"tools"`
+	Parameters   models.LLMParameters `yaml:"parameters"`
+}
+
 type ollamaConfig struct {
 	BaseLLMConfig `yaml:",inline"`
 	Host          string `yaml:"host"`
 }
 
 type anthropicConfig struct {
-	BaseLLMConfig `yaml:",inline"`
-	APIKey        string `yaml:"apiKey"`
-	MaxTokens     int    `yaml:"maxTokens"`
+	BaseLLMConfig  `yaml:",inline"`
+	APIKey         string                 `yaml:"apiKey"`
+	Endpoint       string                 `yaml:"endpoint"`
+	MaxTokens      int                    `yaml:"maxTokens"`
+	ThinkingBudget int                    `yaml:"thinkingBudget"`
+	PromptCaching  anthropicCachingConfig `yaml:"promptCaching"`
+}
+
+type anthropicCachingConfig struct {
+	SystemPrompt bool `yaml:"systemPrompt"`
+	Tools        bool `yaml:"tools"`
+	History      bool `yaml:"history"`
 }
 
 type openaiConfig struct {
@@ -56,6 +160,50 @@ type openrouterConfig struct {
 	APIKey        string `yaml:"apiKey"`
 }
 
+type geminiConfig struct {
+	BaseLLMConfig `yaml:",inline"`
+	APIKey        string `yaml:"apiKey"`
+	Endpoint      string `yaml:"endpoint"`
+}
+
+type bedrockConfig struct {
+	BaseLLMConfig   `yaml:",inline"`
+	Region          string `yaml:"region"`
+	AccessKeyID     string `yaml:"accessKeyID"`
+	SecretAccessKey string `yaml:"secretAccessKey"`
+	SessionToken    string `yaml:"sessionToken"`
+	APIKey          string `yaml:"apiKey"`
+	Endpoint        string `yaml:"endpoint"`
+}
+
+type azureOpenAIConfig struct {
+	BaseLLMConfig `yaml:",inline"`
+	APIKey        string `yaml:"apiKey"`
+	Endpoint      string `yaml:"endpoint"`
+	Deployment    string `yaml:"deployment"`
+	APIVersion    string `yaml:"apiVersion"`
+}
+
+// openaiCompatibleConfig is a server that speaks the OpenAI protocol, with the switches for its deviations
+// from the OpenAI API.
+type openaiCompatibleConfig struct {
+	BaseLLMConfig `yaml:",inline"`
+	BaseURL       string            `yaml:"baseURL"`
+	APIKey        string            `yaml:"apiKey"`
+	Headers       map[string]string `yaml:"headers"`
+	// Tools and StreamToolArgs default to true, as in the OpenAI API.
+	Tools          *bool `yaml:"tools"`
+	StreamToolArgs *bool `yaml:"streamToolArgs"`
+	SystemAsUser   bool  `yaml:"systemAsUser"`
+}
+
+type storeConfig struct {
+	Type        string `yaml:"type"`
+	Path        string `yaml:"path"`
+	URL         string `yaml:"url"`
+	MigrateFrom string `yaml:"migrateFrom"`
+}
+
 type mcpSSEServerConfig struct {
 	URL            string `yaml:"url"`
 	MaxPayloadSize int    `yaml:"maxPayloadSize"`
@@ -73,8 +221,14 @@ func (c *config) UnmarshalYAML(value *yaml.Node) error {
 		LogMode              string                          `yaml:"logMode"`
 		SystemPrompt         string                          `yaml:"systemPrompt"`
 		TitleGeneratorPrompt string                          `yaml:"titleGeneratorPrompt"`
+		SummarizeContext     bool                            `yaml:"summarizeContext"`
+		SummaryPrompt        string                          `yaml:"summaryPrompt"`
 		LLM                  map[string]any                  `yaml:"llm"`
+		LLMs                 []map[string]any                `yaml:"llms"`
 		GenTitleLLM          map[string]any                  `yaml:"genTitleLLM"`
+		Personas             []personaConfig                 `yaml:"personas"`
+		Prices               map[string]models.Price         `yaml:"prices"`
+		Store                storeConfig                     `yaml:"store"`
 		MCPSSEServers        map[string]mcpSSEServerConfig   `yaml:"mcpSSEServers"`
 		MCPStdIOServers      map[string]mcpStdIOServerConfig `yaml:"mcpStdIOServers"`
 	}
@@ -88,23 +242,186 @@ func (c *config) UnmarshalYAML(value *yaml.Node) error {
 	c.LogMode = rawConfig.LogMode
 	c.SystemPrompt = rawConfig.SystemPrompt
 	c.TitleGeneratorPrompt = rawConfig.TitleGeneratorPrompt
+	c.SummarizeContext = rawConfig.SummarizeContext
+	c.SummaryPrompt = rawConfig.SummaryPrompt
 
-	llmProvider, ok := rawConfig.LLM["provider"].(string)
-	if !ok {
-		return fmt.Errorf("llm provider is required")
+	var profiles []llmProfileConfig
+	if rawConfig.LLM != nil || len(rawConfig.LLMs) == 0 {
+		llm, err := parseLLMConfig(rawConfig.LLM)
+		if err != nil {
+			return err
+		}
+		name, _ := rawConfig.LLM["name"].(string)
+		if name == "" {
+			name = defaultLLMProfileName
+		}
+		profile, err := newLLMProfileConfig(name, rawConfig.LLM, llm)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, profile)
+	}
+	for i, rawLLM := range rawConfig.LLMs {
+		name, _ := rawLLM["name"].(string)
+		if name == "" {
+			return fmt.Errorf("llms[%d]: name is required", i)
+		}
+		if slices.ContainsFunc(profiles, func(p llmProfileConfig) bool { return p.Name == name }) {
+			return fmt.Errorf("llms[%d]: duplicate llm name: %s", i, name)
+		}
+		llm, err := parseLLMConfig(rawLLM)
+		if err != nil {
+			return fmt.Errorf("llms[%d]: %w", i, err)
+		}
+		profile, err := newLLMProfileConfig(name, rawLLM, llm)
+		if err != nil {
+			return fmt.Errorf("llms[%d]: %w", i, err)
+		}
+		profiles = append(profiles, profile)
+	}
+	for _, profile := range profiles {
+		for _, fallback := range profile.Fallbacks {
+			if fallback == profile.Name {
+				return fmt.Errorf("llm %s: fallback to itself", profile.Name)
+			}
+			if !slices.ContainsFunc(profiles, func(p llmProfileConfig) bool { return p.Name == fallback }) {
+				return fmt.Errorf("llm %s: unknown fallback llm: %s", profile.Name, fallback)
+			}
+		}
 	}
 
-	llmRawYAML, err := yaml.Marshal(rawConfig.LLM)
-	if err != nil {
-		return err
+	// The title generator uses the default LLM unless its own provider is configured.
+	genTitleLLM := profiles[0].LLM
+	if _, ok := rawConfig.GenTitleLLM["provider"]; ok {
+		var err error
+		genTitleLLM, err = parseLLMConfig(rawConfig.GenTitleLLM)
+		if err != nil {
+			return fmt.Errorf("genTitleLLM: %w", err)
+		}
 	}
-	genTitleLLMRawYAML, err := yaml.Marshal(rawConfig.GenTitleLLM)
-	if err != nil {
-		return err
+
+	c.LLM = profiles[0].LLM
+	c.LLMs = profiles
+	c.GenTitleLLM = genTitleLLM
+
+	for i, persona := range rawConfig.Personas {
+		if persona.Name == "" {
+			return fmt.Errorf("personas[%d]: name is required", i)
+		}
+		if slices.ContainsFunc(rawConfig.Personas[:i], func(p personaConfig) bool { return p.Name == persona.Name }) {
+			return fmt.Errorf("personas[%d]: duplicate persona name: %s", i, persona.Name)
+		}
+	}
+	c.Personas = rawConfig.Personas
+	c.Prices = rawConfig.Prices
+	c.Store = rawConfig.Store
+	c.MCPSSEServers = rawConfig.MCPSSEServers
+	c.MCPStdIOServers = rawConfig.MCPStdIOServers
+
+	return nil
+}
+
+// parameterWarnings returns a warning for each configured LLM with parameters that its provider doesn't
+// support, to be logged at startup, as the unsupported parameters are ignored instead of failing the chats.
+func (c config) parameterWarnings() []string {
+	var warnings []string
+	warn := func(name string, llm llmConfig) {
+		base := llm.base()
+		if unsupported := base.unsupportedParameters(); len(unsupported) > 0 {
+			warnings = append(warnings, fmt.Sprintf("llm %s: the %s provider ignores the unsupported parameters: %s",
+				name, base.Provider, strings.Join(unsupported, ", ")))
+		}
+	}
+	for _, profile := range c.LLMs {
+		warn(profile.Name, profile.LLM)
+	}
+	if !slices.ContainsFunc(c.LLMs, func(p llmProfileConfig) bool { return p.LLM == c.GenTitleLLM }) {
+		warn("genTitleLLM", c.GenTitleLLM)
+	}
+	return warnings
+}
+
+// personas returns the personas of the configuration. Their IDs are derived from their names, so chats keep
+// their persona across restarts.
+func (c config) personas() []models.Persona {
+	personas := make([]models.Persona, len(c.Personas))
+	for i, p := range c.Personas {
+		personas[i] = models.Persona{
+			ID:           "config:" + p.Name,
+			Name:         p.Name,
+			SystemPrompt: p.SystemPrompt,
+			Tools:        p.Tools,
+			Parameters:   p.Parameters,
+		}
+	}
+	return personas
+}
+
+// newLLMProfileConfig returns the profile of the LLM parsed from the raw configuration.
+func newLLMProfileConfig(name string, raw map[string]any, llm llmConfig) (llmProfileConfig, error) {
+	model, _ := raw["model"].(string)
+	contextWindow, ok := raw["contextWindow"].(int)
+	if _, set := raw["contextWindow"]; set && !ok {
+		return llmProfileConfig{}, fmt.Errorf("llm %s: contextWindow must be an integer", name)
+	}
+	textToolCalls, ok := raw["textToolCalls"].(bool)
+	if _, set := raw["textToolCalls"]; set && !ok {
+		return llmProfileConfig{}, fmt.Errorf("llm %s: textToolCalls must be a boolean", name)
+	}
+	profile := llmProfileConfig{
+		Name:          name,
+		Model:         model,
+		ContextWindow: contextWindow,
+		TextToolCalls: textToolCalls,
+		LLM:           llm,
+	}
+
+	if rawFallbacks, ok := raw["fallbacks"]; ok {
+		fallbacks, ok := rawFallbacks.([]any)
+		if !ok {
+			return llmProfileConfig{}, fmt.Errorf("fallbacks must be a list of llm names")
+		}
+		for _, f := range fallbacks {
+			fallback, ok := f.(string)
+			if !ok || fallback == "" {
+				return llmProfileConfig{}, fmt.Errorf("fallbacks must be a list of llm names")
+			}
+			profile.Fallbacks = append(profile.Fallbacks, fallback)
+		}
+	}
+
+	if rawCapabilities, ok := raw["capabilities"]; ok {
+		capabilities, ok := rawCapabilities.(map[string]any)
+		if !ok {
+			return llmProfileConfig{}, fmt.Errorf("capabilities must be a map of the tools and vision capabilities")
+		}
+		for name, rawValue := range capabilities {
+			value, ok := rawValue.(bool)
+			if !ok {
+				return llmProfileConfig{}, fmt.Errorf("capabilities.%s must be a boolean", name)
+			}
+			switch name {
+			case "tools":
+				profile.Capabilities.Tools = &value
+			case "vision":
+				profile.Capabilities.Vision = &value
+			default:
+				return llmProfileConfig{}, fmt.Errorf("unknown capability: %s", name)
+			}
+		}
+	}
+	return profile, nil
+}
+
+// parseLLMConfig parses the configuration of an LLM, whose fields depend on its provider.
+func parseLLMConfig(raw map[string]any) (llmConfig, error) {
+	provider, ok := raw["provider"].(string)
+	if !ok {
+		return nil, fmt.Errorf("llm provider is required")
 	}
 
 	var llm llmConfig
-	switch llmProvider {
+	switch provider {
 	case "ollama":
 		llm = &ollamaConfig{}
 	case "anthropic":
@@ -113,43 +430,47 @@ func (c *config) UnmarshalYAML(value *yaml.Node) error {
 		llm = &openaiConfig{}
 	case "openrouter":
 		llm = &openrouterConfig{}
+	case "gemini":
+		llm = &geminiConfig{}
+	case "bedrock":
+		llm = &bedrockConfig{}
+	case "azureOpenAI":
+		llm = &azureOpenAIConfig{}
+	case "openaiCompatible":
+		llm = &openaiCompatibleConfig{}
 	default:
-		return fmt.Errorf("unknown llm provider: %s", llmProvider)
+		return nil, fmt.Errorf("unknown llm provider: %s", provider)
 	}
 
-	if err := yaml.Unmarshal(llmRawYAML, llm); err != nil {
-		return err
+	rawYAML, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, err
 	}
-
-	var genTitleLLM llmConfig
-	useSameLLM := true
-	genTitleLLM = llm
-	genTitleLLMProvider, ok := rawConfig.GenTitleLLM["provider"].(string)
-	if ok {
-		useSameLLM = false
-		switch genTitleLLMProvider {
-		case "ollama":
-			genTitleLLM = &ollamaConfig{}
-		case "anthropic":
-			genTitleLLM = &anthropicConfig{}
-		case "openai":
-			genTitleLLM = &openaiConfig{}
-		case "openrouter":
-			genTitleLLM = &openrouterConfig{}
-		}
+	if err := yaml.Unmarshal(rawYAML, llm); err != nil {
+		return nil, err
 	}
-
-	if !useSameLLM {
-		if err := yaml.Unmarshal(genTitleLLMRawYAML, genTitleLLM); err != nil {
-			return err
-		}
+	if err := validateParameterNames(raw["parameters"]); err != nil {
+		return nil, err
 	}
+	return llm, nil
+}
 
-	c.LLM = llm
-	c.GenTitleLLM = genTitleLLM
-	c.MCPSSEServers = rawConfig.MCPSSEServers
-	c.MCPStdIOServers = rawConfig.MCPStdIOServers
-
+// validateParameterNames returns an error if the raw parameters of an LLM have an unknown name, as a
+// misspelled parameter would be ignored otherwise.
+func validateParameterNames(raw any) error {
+	if raw == nil {
+		return nil
+	}
+	rawYAML, err := yaml.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(rawYAML))
+	dec.KnownFields(true)
+	var params models.LLMParameters
+	if err := dec.Decode(&params); err != nil {
+		return fmt.Errorf("invalid parameters: %w", err)
+	}
 	return nil
 }
 
@@ -162,7 +483,8 @@ func (o ollamaConfig) newOllama(systemPrompt string, logger *slog.Logger) (servi
 	if host == "" {
 		host = os.Getenv("OLLAMA_HOST")
 	}
-	return services.NewOllama(host, o.Model, systemPrompt, o.Parameters, logger), nil
+	return services.NewOllama(host, o.Model, systemPrompt, o.Parameters, logger).
+		WithRetry(o.retryPolicy()).WithExtra(o.Extra), nil
 }
 
 func (o ollamaConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
@@ -173,24 +495,35 @@ func (o ollamaConfig) titleGen(systemPrompt string, logger *slog.Logger) (handle
 	return o.newOllama(systemPrompt, logger)
 }
 
-func (a anthropicConfig) newAnthropic(systemPrompt string, _ *slog.Logger) (services.Anthropic, error) {
+func (a anthropicConfig) newAnthropic(systemPrompt string, logger *slog.Logger) (services.Anthropic, error) {
 	if a.Model == "" {
 		return services.Anthropic{}, fmt.Errorf("model is required")
 	}
 	if a.MaxTokens == 0 {
 		return services.Anthropic{}, fmt.Errorf("max_tokens is required")
 	}
+	if a.ThinkingBudget >= a.MaxTokens {
+		return services.Anthropic{}, fmt.Errorf("thinkingBudget must be lower than maxTokens")
+	}
 
 	apiKey := a.APIKey
 	if apiKey == "" {
 		apiKey = os.Getenv("ANTHROPIC_API_KEY")
 	}
 
-	return services.NewAnthropic(apiKey, a.Model, systemPrompt, a.MaxTokens, a.Parameters), nil
+	return services.NewAnthropic(apiKey, a.Model, systemPrompt, a.Endpoint, a.MaxTokens, a.Parameters, logger).
+		WithRetry(a.retryPolicy()).WithExtra(a.Extra), nil
 }
 
 func (a anthropicConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
-	return a.newAnthropic(systemPrompt, logger)
+	llm, err := a.newAnthropic(systemPrompt, logger)
+	if err != nil {
+		return nil, err
+	}
+	if a.ThinkingBudget > 0 {
+		llm = llm.WithThinking(a.ThinkingBudget)
+	}
+	return llm.WithPromptCaching(services.AnthropicCaching(a.PromptCaching)), nil
 }
 
 func (a anthropicConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
@@ -206,7 +539,8 @@ func (o openaiConfig) newOpenAI(systemPrompt string, logger *slog.Logger) (servi
 	if apiKey == "" {
 		apiKey = os.Getenv("OPENAI_API_KEY")
 	}
-	return services.NewOpenAI(apiKey, o.Model, systemPrompt, o.Endpoint, o.Parameters, logger), nil
+	return services.NewOpenAI(apiKey, o.Model, systemPrompt, o.Endpoint, o.Parameters, logger).
+		WithRetry(o.retryPolicy()).WithExtra(o.Extra), nil
 }
 
 func (o openaiConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
@@ -226,7 +560,8 @@ func (o openrouterConfig) newOpenRouter(systemPrompt string, logger *slog.Logger
 	if apiKey == "" {
 		apiKey = os.Getenv("OPENROUTER_API_KEY")
 	}
-	return services.NewOpenRouter(apiKey, o.Model, systemPrompt, o.Parameters, logger), nil
+	return services.NewOpenRouter(apiKey, o.Model, systemPrompt, o.Parameters, logger).
+		WithRetry(o.retryPolicy()).WithExtra(o.Extra), nil
 }
 
 func (o openrouterConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
@@ -236,3 +571,115 @@ func (o openrouterConfig) llm(systemPrompt string, logger *slog.Logger) (handler
 func (o openrouterConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
 	return o.newOpenRouter(systemPrompt, logger)
 }
+
+func (g geminiConfig) newGemini(systemPrompt string, logger *slog.Logger) (services.Gemini, error) {
+	if g.Model == "" {
+		return services.Gemini{}, fmt.Errorf("model is required")
+	}
+
+	apiKey := g.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("GEMINI_API_KEY")
+	}
+	return services.NewGemini(apiKey, g.Model, systemPrompt, g.Endpoint, g.Parameters, logger).
+		WithRetry(g.retryPolicy()).WithExtra(g.Extra), nil
+}
+
+func (g geminiConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
+	return g.newGemini(systemPrompt, logger)
+}
+
+func (g geminiConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
+	return g.newGemini(systemPrompt, logger)
+}
+
+func (b bedrockConfig) newBedrock(systemPrompt string, logger *slog.Logger) (services.Bedrock, error) {
+	if b.Model == "" {
+		return services.Bedrock{}, fmt.Errorf("model is required")
+	}
+	region := cmp.Or(b.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+	if region == "" {
+		return services.Bedrock{}, fmt.Errorf("region is required")
+	}
+
+	// The credentials of the configuration take precedence over the ones of the environment, and the
+	// access key is only read from the environment if there's no API key.
+	credentials := services.AWSCredentials{
+		AccessKeyID:     b.AccessKeyID,
+		SecretAccessKey: b.SecretAccessKey,
+		SessionToken:    b.SessionToken,
+		APIKey:          b.APIKey,
+	}
+	if credentials.AccessKeyID == "" && credentials.APIKey == "" {
+		credentials.APIKey = os.Getenv("AWS_BEARER_TOKEN_BEDROCK")
+	}
+	if credentials.AccessKeyID == "" && credentials.APIKey == "" {
+		credentials.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		credentials.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		credentials.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if credentials.APIKey == "" && (credentials.AccessKeyID == "" || credentials.SecretAccessKey == "") {
+		return services.Bedrock{}, fmt.Errorf("apiKey, or accessKeyID and secretAccessKey are required")
+	}
+
+	return services.NewBedrock(region, b.Model, systemPrompt, b.Endpoint, credentials, b.Parameters, logger).
+		WithRetry(b.retryPolicy()).WithExtra(b.Extra), nil
+}
+
+func (b bedrockConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
+	return b.newBedrock(systemPrompt, logger)
+}
+
+func (b bedrockConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
+	return b.newBedrock(systemPrompt, logger)
+}
+
+func (a azureOpenAIConfig) newAzureOpenAI(systemPrompt string, logger *slog.Logger) (services.OpenAI, error) {
+	// The deployment defaults to the model, as the deployments are usually named after their model.
+	deployment := cmp.Or(a.Deployment, a.Model)
+	if deployment == "" {
+		return services.OpenAI{}, fmt.Errorf("deployment or model is required")
+	}
+	endpoint := cmp.Or(a.Endpoint, os.Getenv("AZURE_OPENAI_ENDPOINT"))
+	if endpoint == "" {
+		return services.OpenAI{}, fmt.Errorf("endpoint is required")
+	}
+
+	apiKey := cmp.Or(a.APIKey, os.Getenv("AZURE_OPENAI_API_KEY"))
+	return services.NewAzureOpenAI(apiKey, endpoint, deployment, a.APIVersion, systemPrompt, a.Parameters, logger).
+		WithRetry(a.retryPolicy()).WithExtra(a.Extra), nil
+}
+
+func (a azureOpenAIConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
+	return a.newAzureOpenAI(systemPrompt, logger)
+}
+
+func (a azureOpenAIConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
+	return a.newAzureOpenAI(systemPrompt, logger)
+}
+
+func (o openaiCompatibleConfig) newOpenAICompatible(systemPrompt string, logger *slog.Logger) (services.OpenAI, error) {
+	if o.Model == "" {
+		return services.OpenAI{}, fmt.Errorf("model is required")
+	}
+	if o.BaseURL == "" {
+		return services.OpenAI{}, fmt.Errorf("baseURL is required")
+	}
+
+	compat := services.OpenAICompatibility{
+		Headers:            o.Headers,
+		DisableTools:       o.Tools != nil && !*o.Tools,
+		CumulativeToolArgs: o.StreamToolArgs != nil && !*o.StreamToolArgs,
+		SystemAsUser:       o.SystemAsUser,
+	}
+	return services.NewOpenAICompatible(o.APIKey, o.BaseURL, o.Model, systemPrompt, compat, o.Parameters, logger).
+		WithRetry(o.retryPolicy()).WithExtra(o.Extra), nil
+}
+
+func (o openaiCompatibleConfig) llm(systemPrompt string, logger *slog.Logger) (handlers.LLM, error) {
+	return o.newOpenAICompatible(systemPrompt, logger)
+}
+
+func (o openaiCompatibleConfig) titleGen(systemPrompt string, logger *slog.Logger) (handlers.TitleGenerator, error) {
+	return o.newOpenAICompatible(systemPrompt, logger)
+}
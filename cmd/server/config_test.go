@@ -0,0 +1,204 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfigParameterNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "known parameters",
+			yaml: `
+llm:
+  provider: ollama
+  model: llama3
+  parameters:
+    temperature: 0.5
+    repetitionPenalty: 1.1
+`,
+		},
+		{
+			name: "misspelled parameter",
+			yaml: `
+llm:
+  provider: ollama
+  model: llama3
+  parameters:
+    temprature: 0.5
+`,
+			wantErr: "field temprature not found",
+		},
+		{
+			name: "misspelled parameter of a profile",
+			yaml: `
+llms:
+  - name: local
+    provider: ollama
+    model: llama3
+  - name: claude
+    provider: anthropic
+    model: claude-test
+    parameters:
+      max_tokens: 1024
+`,
+			wantErr: "llms[1]: invalid parameters",
+		},
+		{
+			name: "misspelled parameter of the title generator",
+			yaml: `
+llm:
+  provider: ollama
+  model: llama3
+genTitleLLM:
+  provider: openai
+  model: gpt-4o-mini
+  parameters:
+    topp: 0.9
+`,
+			wantErr: "genTitleLLM: invalid parameters",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			err := yaml.Unmarshal([]byte(tt.yaml), &cfg)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Unmarshal() error = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Unmarshal() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigProfileFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "valid fields",
+			yaml: `
+llms:
+  - name: local
+    provider: ollama
+    model: llama3
+    contextWindow: 8192
+    textToolCalls: true
+`,
+		},
+		{
+			name: "context window of the wrong type",
+			yaml: `
+llms:
+  - name: local
+    provider: ollama
+    model: llama3
+    contextWindow: 8k
+`,
+			wantErr: "llms[0]: llm local: contextWindow must be an integer",
+		},
+		{
+			name: "text tool calls of the wrong type",
+			yaml: `
+llm:
+  provider: ollama
+  model: llama3
+  textToolCalls: "yes please"
+`,
+			wantErr: "llm Default: textToolCalls must be a boolean",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			err := yaml.Unmarshal([]byte(tt.yaml), &cfg)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Unmarshal() error = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Unmarshal() error = %v, want %q", err, tt.wantErr)
+			}
+			if tt.wantErr == "" && (cfg.LLMs[0].ContextWindow != 8192 || !cfg.LLMs[0].TextToolCalls) {
+				t.Errorf("profile = %+v, want the context window and the text tool calls", cfg.LLMs[0])
+			}
+		})
+	}
+}
+
+func TestConfigParameterWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{
+			name: "supported parameters",
+			yaml: `
+llm:
+  provider: openrouter
+  model: openai/gpt-4o
+  parameters:
+    topA: 0.3
+    minP: 0.05
+`,
+		},
+		{
+			name: "unsupported parameters",
+			yaml: `
+llms:
+  - name: local
+    provider: ollama
+    model: llama3
+    parameters:
+      temperature: 0.5
+      topA: 0.3
+      logprobs: true
+  - name: bedrock
+    provider: bedrock
+    model: anthropic.claude-test
+    parameters:
+      topK: 40
+`,
+			want: []string{
+				"llm local: the ollama provider ignores the unsupported parameters: topA, logprobs",
+				"llm bedrock: the bedrock provider ignores the unsupported parameters: topK",
+			},
+		},
+		{
+			name: "unsupported parameters of the title generator",
+			yaml: `
+llm:
+  provider: anthropic
+  model: claude-test
+genTitleLLM:
+  provider: openaiCompatible
+  model: local-model
+  parameters:
+    topK: 40
+`,
+			want: []string{"llm genTitleLLM: the openaiCompatible provider ignores the unsupported parameters: topK"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.yaml), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.parameterWarnings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parameterWarnings() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -27,15 +27,53 @@ func main() {
 
 	logger, logFile := initLogger(cfg, cfgDir)
 	defer logFile.Close()
+	for _, warning := range cfg.parameterWarnings() {
+		logger.Warn(warning)
+	}
 
 	sysPrompt := cfg.SystemPrompt
 	if sysPrompt == "" {
 		sysPrompt = "You are a helpful assistant."
 	}
-	llm, err := cfg.LLM.llm(sysPrompt, logger)
-	if err != nil {
-		panic(err)
+	llms := make(map[string]handlers.LLM, len(cfg.LLMs))
+	for _, profile := range cfg.LLMs {
+		llm, err := profile.LLM.llm(sysPrompt, logger)
+		if err != nil {
+			panic(fmt.Errorf("failed to create llm %s: %w", profile.Name, err))
+		}
+		llms[profile.Name] = llm
 	}
+	// The chats are adapted to the capabilities of the model of each LLM, including when it's a fallback.
+	adapted := make(map[string]handlers.LLM, len(cfg.LLMs))
+	for _, profile := range cfg.LLMs {
+		capabilities := services.NewCapabilities(llms[profile.Name], profile.Model, profile.Capabilities, logger)
+		if profile.TextToolCalls {
+			capabilities = capabilities.WithTextTools(sysPrompt)
+		}
+		adapted[profile.Name] = capabilities
+	}
+	llmProfiles := make([]handlers.LLMProfile, len(cfg.LLMs))
+	for i, profile := range cfg.LLMs {
+		llm := adapted[profile.Name]
+		if len(profile.Fallbacks) > 0 {
+			chain := []services.FallbackLLM{{Name: profile.Name, LLM: llm}}
+			for _, fallback := range profile.Fallbacks {
+				chain = append(chain, services.FallbackLLM{Name: fallback, LLM: adapted[fallback]})
+			}
+			llm = services.NewFallback(chain, logger)
+		}
+		llmProfiles[i] = handlers.LLMProfile{
+			Name:          profile.Name,
+			LLM:           llm,
+			Price:         cfg.Prices[profile.Model],
+			ContextWindow: profile.ContextWindow,
+		}
+		// The models are managed on the server of the profile itself, not on its fallbacks.
+		if manager, ok := llms[profile.Name].(handlers.ModelManager); ok {
+			llmProfiles[i].Models = manager
+		}
+	}
+	llm := llmProfiles[0].LLM
 	titleGenPrompt := cfg.TitleGeneratorPrompt
 	if titleGenPrompt == "" {
 		titleGenPrompt = "Generate a title for this chat with only one sentence with maximum 5 words."
@@ -45,11 +83,11 @@ func main() {
 		panic(err)
 	}
 
-	dbPath := filepath.Join(cfgDir, "/mcpwebui/store.db")
-	boltDB, err := services.NewBoltDB(dbPath)
+	db, err := cfg.Store.store(cfgDir, logger)
 	if err != nil {
 		panic(err)
 	}
+	defer db.Close()
 
 	mcpClientInfo := mcp.Info{
 		Name:    "mcp-web-ui",
@@ -76,7 +114,22 @@ func main() {
 		logger.Info("Connected to MCP server", slog.String("name", mcpClients[i].ServerInfo().Name))
 	}
 
-	m, err := handlers.NewMain(llm, titleGen, boltDB, mcpClis, logger)
+	opts := append(mainOptions(db, logger), handlers.WithLLMProfiles(llmProfiles...),
+		handlers.WithPersonas(cfg.personas()...))
+	if cfg.SummarizeContext {
+		summaryPrompt := cfg.SummaryPrompt
+		if summaryPrompt == "" {
+			summaryPrompt = "Summarize this conversation concisely, keeping the facts, decisions and open questions " +
+				"needed to continue it."
+		}
+		// The summaries are generated by the title generator LLM, as it's usually a smaller and cheaper one.
+		summarizer, err := cfg.GenTitleLLM.llm(summaryPrompt, logger)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, handlers.WithSummarizer(summarizer))
+	}
+	m, err := handlers.NewMain(llm, titleGen, db, mcpClis, logger, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -93,9 +146,26 @@ func main() {
 	mux.Handle("/static/", http.StripPrefix("/static/", fileServer))
 	mux.HandleFunc("/", m.HandleHome)
 	mux.HandleFunc("/chats", m.HandleChats)
+	mux.HandleFunc("/chats/list", m.HandleChatList)
+	mux.HandleFunc("/messages", m.HandleMessages)
 	mux.HandleFunc("/refresh-title", m.HandleRefreshTitle)
+	mux.HandleFunc("/chats/retry", m.HandleRetryMessage)
+	mux.HandleFunc("/chats/continue", m.HandleContinueMessage)
+	mux.HandleFunc("/chats/update", m.HandleUpdateChat)
+	mux.HandleFunc("/chats/parameters", m.HandleChatParameters)
+	mux.HandleFunc("/chats/usage", m.HandleChatUsage)
+	mux.HandleFunc("/personas", m.HandlePersonas)
+	mux.HandleFunc("/personas/delete", m.HandleDeletePersona)
+	mux.HandleFunc("/search", m.HandleSearch)
+	mux.HandleFunc("/usage", m.HandleUsage)
+	mux.HandleFunc("/models", m.HandleModels)
+	mux.HandleFunc("/models/details", m.HandleModelDetails)
+	mux.HandleFunc("/models/pull", m.HandlePullModel)
+	mux.HandleFunc("/export", m.HandleExport)
+	mux.HandleFunc("/import", m.HandleImport)
 	mux.HandleFunc("/sse/messages", m.HandleSSE)
 	mux.HandleFunc("/sse/chats", m.HandleSSE)
+	mux.HandleFunc("/sse/models", m.HandleSSE)
 
 	// Create custom server
 	srv := &http.Server{
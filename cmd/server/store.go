@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/services"
+)
+
+type store interface {
+	handlers.Store
+	Close() error
+}
+
+func (s storeConfig) store(cfgDir string, logger *slog.Logger) (store, error) {
+	switch s.Type {
+	case "", "bolt":
+		path := s.Path
+		if path == "" {
+			path = filepath.Join(cfgDir, "/mcpwebui/store.db")
+		}
+		return services.NewBoltDB(path)
+	case "sqlite":
+		path := s.Path
+		if path == "" {
+			path = filepath.Join(cfgDir, "/mcpwebui/store.sqlite")
+		}
+		db, err := services.NewSQLite(path)
+		if err != nil {
+			return nil, err
+		}
+		return s.migrate(db, logger)
+	case "postgres":
+		url := s.URL
+		if url == "" {
+			url = os.Getenv("DATABASE_URL")
+		}
+		if url == "" {
+			return nil, fmt.Errorf("url is required for postgres store")
+		}
+		db, err := services.NewPostgres(context.Background(), url)
+		if err != nil {
+			return nil, err
+		}
+		return s.migrate(db, logger)
+	default:
+		return nil, fmt.Errorf("unknown store type: %s", s.Type)
+	}
+}
+
+func (s storeConfig) migrate(db store, logger *slog.Logger) (store, error) {
+	if s.MigrateFrom == "" {
+		return db, nil
+	}
+	if err := migrateFromBolt(context.Background(), s.MigrateFrom, db, logger); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// mainOptions returns the handlers options required by the store. The Postgres store may be shared by
+// several replicas, so the SSE messages are distributed through the database.
+func mainOptions(db store, logger *slog.Logger) []handlers.MainOption {
+	if pg, ok := db.(services.Postgres); ok {
+		return []handlers.MainOption{handlers.WithSSEProvider(services.NewPostgresSSE(pg, logger))}
+	}
+	return nil
+}
+
+// migrateFromBolt copies all chats and messages from the Bolt file at boltPath into dst. The migration
+// only runs when dst is still empty, so the migrateFrom option can be left in the config after the first
+// start without duplicating the chats. The Bolt file is opened read-only and left untouched, so its
+// records aren't upgraded to the current schema version first.
+func migrateFromBolt(ctx context.Context, boltPath string, dst handlers.Store, logger *slog.Logger) error {
+	chats, _, err := dst.ChatsPage(ctx, models.ChatsQuery{Limit: 1})
+	if err != nil {
+		return fmt.Errorf("failed to check destination store: %w", err)
+	}
+	if len(chats) > 0 {
+		logger.Info("Store is not empty, skipping migration", slog.String("from", boltPath))
+		return nil
+	}
+
+	src, err := services.OpenBoltDBReadOnly(boltPath)
+	if err != nil {
+		return fmt.Errorf("failed to open migration source: %w", err)
+	}
+	defer src.Close()
+
+	count, err := migrateStore(ctx, src, dst)
+	if err != nil {
+		return fmt.Errorf("failed to migrate store: %w", err)
+	}
+	logger.Info("Migrated chats from bolt store", slog.String("from", boltPath), slog.Int("chats", count))
+	return nil
+}
+
+// migrateStore copies all chats, messages and personas from src to dst, keeping their IDs and order, and
+// returns the number of migrated chats. The chats stored without creation and update times by the older
+// versions get the timestamps of their first and last messages, like the Bolt migration does.
+func migrateStore(ctx context.Context, src, dst handlers.Store) (int, error) {
+	chats, err := src.Chats(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get chats: %w", err)
+	}
+
+	// Chats are returned from the most recent one, but they must be added from the oldest one so the
+	// destination store orders them in the same way.
+	slices.Reverse(chats)
+	for _, chat := range chats {
+		messages, err := src.Messages(ctx, chat.ID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get messages of chat %s: %w", chat.ID, err)
+		}
+		if chat.CreatedAt.IsZero() && len(messages) > 0 {
+			chat.CreatedAt = messages[0].Timestamp
+			chat.UpdatedAt = messages[len(messages)-1].Timestamp
+		}
+		chatID, err := dst.AddChat(ctx, chat)
+		if err != nil {
+			return 0, fmt.Errorf("failed to add chat %s: %w", chat.ID, err)
+		}
+		for _, msg := range messages {
+			if _, err := dst.AddMessage(ctx, chatID, msg); err != nil {
+				return 0, fmt.Errorf("failed to add message %s: %w", msg.ID, err)
+			}
+		}
+	}
+
+	personas, err := src.Personas(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get personas: %w", err)
+	}
+	for _, persona := range personas {
+		if err := dst.SavePersona(ctx, persona); err != nil {
+			return 0, fmt.Errorf("failed to save persona %s: %w", persona.ID, err)
+		}
+	}
+	return len(chats), nil
+}
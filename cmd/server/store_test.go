@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/services"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMigrateFromBolt(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	boltPath := filepath.Join(dir, "store.db")
+	start := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	src, err := services.NewBoltDB(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type chatMessages struct {
+		chat     models.Chat
+		messages []models.Message
+	}
+	var want []chatMessages
+	for i, title := range []string{"First chat", "Second chat"} {
+		chat := models.Chat{ID: "chat", Title: title, Folders: []string{"work"}, LLMProfile: "local"}
+		chat.ID, err = src.AddChat(ctx, chat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm := chatMessages{chat: chat}
+		for j, role := range []models.Role{models.RoleUser, models.RoleAssistant} {
+			msg := models.Message{
+				ID:        "msg",
+				Role:      role,
+				Contents:  []models.Content{{Type: models.ContentTypeText, Text: title + " message"}},
+				Timestamp: start.Add(time.Duration(i*10+j) * time.Minute),
+			}
+			if role == models.RoleAssistant {
+				msg.Usage = models.Usage{InputTokens: 10, OutputTokens: 20, Cost: 0.5}
+			}
+			msg.ID, err = src.AddMessage(ctx, chat.ID, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cm.messages = append(cm.messages, msg)
+		}
+		want = append(want, cm)
+	}
+	persona := models.Persona{ID: "reviewer", Name: "Reviewer", SystemPrompt: "Review the code."}
+	if err := src.SavePersona(ctx, persona); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := readFile(t, boltPath)
+
+	dst := newSQLiteStore(t)
+	if err := migrateFromBolt(ctx, boltPath, dst, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	chats, err := dst.Chats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The chats are listed from the most recent one, like in the Bolt store.
+	slices.Reverse(chats)
+	if len(chats) != len(want) {
+		t.Fatalf("got %d chats, want %d", len(chats), len(want))
+	}
+	for i, chat := range chats {
+		if chat.ID != want[i].chat.ID || chat.Title != want[i].chat.Title ||
+			!slices.Equal(chat.Folders, want[i].chat.Folders) || chat.LLMProfile != want[i].chat.LLMProfile {
+			t.Errorf("chat %d = %+v, want %+v", i, chat, want[i].chat)
+		}
+		messages, err := dst.Messages(ctx, chat.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != len(want[i].messages) {
+			t.Fatalf("chat %s has %d messages, want %d", chat.ID, len(messages), len(want[i].messages))
+		}
+		for j, msg := range messages {
+			wantMsg := want[i].messages[j]
+			if msg.ID != wantMsg.ID || msg.Role != wantMsg.Role || msg.Contents[0].Text != wantMsg.Contents[0].Text ||
+				!msg.Timestamp.Equal(wantMsg.Timestamp) || msg.Usage != wantMsg.Usage {
+				t.Errorf("message %d of chat %s = %+v, want %+v", j, chat.ID, msg, wantMsg)
+			}
+		}
+	}
+	personas, err := dst.Personas(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(personas) != 1 || personas[0].ID != persona.ID || personas[0].SystemPrompt != persona.SystemPrompt {
+		t.Errorf("personas = %+v, want %+v", personas, persona)
+	}
+
+	// The destination isn't empty anymore, so a restart with the same config doesn't copy the chats again.
+	if err := migrateFromBolt(ctx, boltPath, dst, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	chats, err = dst.Chats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != len(want) {
+		t.Errorf("got %d chats after the second migration, want %d", len(chats), len(want))
+	}
+
+	assertUntouched(t, boltPath, before)
+}
+
+func TestMigrateFromBoltOldSchema(t *testing.T) {
+	ctx := context.Background()
+	boltPath := filepath.Join(t.TempDir(), "store.db")
+	first := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	last := first.Add(time.Hour)
+
+	// The Bolt files of the versions without a schema version have no times on their chats, and no
+	// personas bucket.
+	db, err := bolt.Open(boltPath, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		chats, err := tx.CreateBucket([]byte("chats"))
+		if err != nil {
+			return err
+		}
+		chat := mustMarshal(t, map[string]string{"ID": "1-old", "Title": "Old chat"})
+		if err := chats.Put([]byte("1-old"), chat); err != nil {
+			return err
+		}
+		messages, err := tx.CreateBucket([]byte("chat-1-old"))
+		if err != nil {
+			return err
+		}
+		for i, ts := range []time.Time{first, last} {
+			msg := models.Message{
+				ID:        []string{"1-question", "2-answer"}[i],
+				Role:      []models.Role{models.RoleUser, models.RoleAssistant}[i],
+				Contents:  []models.Content{{Type: models.ContentTypeText, Text: "Hello"}},
+				Timestamp: ts,
+			}
+			if err := messages.Put([]byte(msg.ID), mustMarshal(t, msg)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := readFile(t, boltPath)
+
+	dst := newSQLiteStore(t)
+	if err := migrateFromBolt(ctx, boltPath, dst, discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	chat, err := dst.Chat(ctx, "1-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Title != "Old chat" || !chat.CreatedAt.Equal(first) || !chat.UpdatedAt.Equal(last) {
+		t.Errorf("chat = %+v, want the title Old chat, created at %s and updated at %s", chat, first, last)
+	}
+	messages, err := dst.Messages(ctx, chat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != "1-question" || messages[1].ID != "2-answer" {
+		t.Errorf("messages = %+v, want the question and the answer", messages)
+	}
+
+	assertUntouched(t, boltPath, before)
+}
+
+func TestMigrateFromBoltMissingFile(t *testing.T) {
+	boltPath := filepath.Join(t.TempDir(), "missing.db")
+	if err := migrateFromBolt(context.Background(), boltPath, newSQLiteStore(t), discardLogger()); err == nil {
+		t.Error("migrateFromBolt() succeeded, want an error for a missing Bolt file")
+	}
+	if _, err := os.Stat(boltPath); !os.IsNotExist(err) {
+		t.Errorf("the missing Bolt file was created: %v", err)
+	}
+}
+
+func newSQLiteStore(t *testing.T) services.SQLite {
+	t.Helper()
+
+	db, err := services.NewSQLite(filepath.Join(t.TempDir(), "store.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// assertUntouched checks that the Bolt file still has the given content, and that it wasn't backed up
+// for a migration.
+func assertUntouched(t *testing.T, boltPath string, before []byte) {
+	t.Helper()
+
+	if !bytes.Equal(readFile(t, boltPath), before) {
+		t.Error("the Bolt file was modified by the migration")
+	}
+	backups, err := filepath.Glob(boltPath + "*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) > 0 {
+		t.Errorf("the Bolt file was backed up to %v", backups)
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
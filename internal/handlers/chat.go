@@ -3,9 +3,12 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,10 +19,18 @@ import (
 )
 
 type chat struct {
-	ID    string
-	Title string
+	ID       string
+	Title    string
+	Pinned   bool
+	Archived bool
+	Folders  []string
 
 	Active bool
+	// FilterQuery is the URL query of the chat list filter, so the chat link keeps the filter.
+	FilterQuery string
+	// SwapOOB is the hx-swap-oob attribute value of the rendered chat, used to update a single chat of
+	// the list through SSE.
+	SwapOOB string
 }
 
 type message struct {
@@ -27,10 +38,24 @@ type message struct {
 	Role      string
 	Content   string
 	Timestamp time.Time
+	Usage     models.Usage
+	// ContextTrim records the earlier messages left out of the LLM calls of an AI message.
+	ContextTrim models.ContextTrim
+	// FallbackLLM is the name of the fallback LLM that answered instead of the LLM of the chat.
+	FallbackLLM string
+	// Error records why the LLM failed to generate an AI message, which can be retried.
+	Error models.MessageError
+	// Finish records the LLM that answered an AI message and why it stopped, which can be continued if
+	// the answer was truncated.
+	Finish models.Finish
 
 	StreamingState string
 }
 
+// continuePrompt asks the LLM to continue its truncated answer.
+const continuePrompt = "Your previous answer was cut off. Continue it exactly where it stopped, " +
+	"without repeating anything or adding any preamble."
+
 // SSE event types for real-time updates.
 var (
 	chatsSSEType    = sse.Type("chats")
@@ -62,6 +87,10 @@ func callToolError(err error) json.RawMessage {
 // it creates a new chat session. For new chats, it asynchronously generates a title
 // based on the first message or prompt.
 //
+// The optional "llm_profile" and "persona_id" fields select the LLM profile the chat is sent to, and the
+// persona of the chat, an empty "persona_id" removing the persona. They are saved on the chat, so the
+// following messages use the same settings until other ones are selected.
+//
 // The function handles different rendering strategies based on whether it's a new chat
 // (complete chatbox template) or an existing chat (individual message templates). For
 // all chats, it adds messages to the database and initiates asynchronous AI response
@@ -81,13 +110,35 @@ func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 	chatID := r.FormValue("chat_id")
 	isNewChat := false
 
+	settings := chatSettingsFromRequest(r)
+	if settings.llmProfile != "" && !m.hasLLMProfile(settings.llmProfile) {
+		m.logger.Error("Unknown LLM profile", slog.String("llmProfile", settings.llmProfile))
+		http.Error(w, "Unknown LLM profile", http.StatusBadRequest)
+		return
+	}
+	if settings.personaID != "" {
+		_, ok, err := m.persona(r.Context(), settings.personaID)
+		if err != nil {
+			m.logger.Error("Failed to get persona", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			m.logger.Error("Unknown persona", slog.String("personaID", settings.personaID))
+			http.Error(w, "Unknown persona", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var ch models.Chat
 	if chatID == "" {
-		chatID, err = m.newChat()
+		ch, err = m.newChat(settings)
 		if err != nil {
 			m.logger.Error("Failed to create new chat", slog.String(errLoggerKey, err.Error()))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		chatID = ch.ID
 		isNewChat = true
 	} else {
 		if err := m.continueChat(r.Context(), chatID); err != nil {
@@ -95,6 +146,12 @@ func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		ch, err = m.updateChatSettings(r.Context(), chatID, settings)
+		if err != nil {
+			m.logger.Error("Failed to update chat settings", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	var userMessages []models.Message
@@ -195,12 +252,28 @@ func (m Main) HandleChats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !isNewChat {
+		// The new messages made the chat the most recently updated one, so it's moved to the top of the
+		// chat list. The chat was already listed, and the messages don't change the lists it belongs to.
+		go func() {
+			prev, err := m.store.Chat(context.Background(), chatID)
+			if err != nil {
+				m.logger.Error("Failed to get chat", slog.String(errLoggerKey, err.Error()))
+				return
+			}
+			if err := m.publishChat(chatID, prev, true); err != nil {
+				m.logger.Error("Failed to publish chat",
+					slog.String(errLoggerKey, err.Error()))
+			}
+		}()
+	}
+
 	// Start async processes for chat response and title generation
-	go m.chat(chatID, messages)
+	go m.chat(ch, messages, false)
 
 	if isNewChat {
 		go m.generateChatTitle(chatID, firstMessageForTitle)
-		m.renderNewChatResponse(w, chatID, messages, aiMsgID)
+		m.renderNewChatResponse(r.Context(), w, ch, messages, aiMsgID)
 		return
 	}
 
@@ -274,11 +347,8 @@ func (m Main) HandleRefreshTitle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	updatedChat := models.Chat{
-		ID:    chatID,
-		Title: title,
-	}
-	if err := m.store.UpdateChat(r.Context(), updatedChat); err != nil {
+	prev, err := m.updateChatTitle(r.Context(), chatID, title)
+	if err != nil {
 		m.logger.Error("Failed to update chat title",
 			slog.String(errLoggerKey, err.Error()))
 		http.Error(w, "Failed to update chat title", http.StatusInternalServerError)
@@ -287,25 +357,297 @@ func (m Main) HandleRefreshTitle(w http.ResponseWriter, r *http.Request) {
 
 	// Update all clients via SSE asynchronously
 	go func() {
-		divs, err := m.chatDivs(chatID)
-		if err != nil {
-			m.logger.Error("Failed to generate chat divs",
-				slog.String(errLoggerKey, err.Error()))
-			return
-		}
-
-		msg := sse.Message{
-			Type: chatsSSEType,
-		}
-		msg.AppendData(divs)
-		if err := m.sseSrv.Publish(&msg, chatsSSETopic); err != nil {
-			m.logger.Error("Failed to publish chats",
+		if err := m.publishChat(chatID, prev, false); err != nil {
+			m.logger.Error("Failed to publish chat",
 				slog.String(errLoggerKey, err.Error()))
 		}
 	}()
 
 	// Return just the title text for HTMX to insert into the span
-	fmt.Fprintf(w, "%s", title)
+	fmt.Fprint(w, html.EscapeString(title))
+}
+
+// HandleRetryMessage generates again the AI message whose LLM failed, through HTTP POST requests. It
+// expects the "chat_id" and "message_id" form fields, identifying the chat and its failed message, which
+// must be the last message of the chat so the history isn't rewritten.
+//
+// The contents generated before the failure are discarded, while the usage of the failed calls is kept,
+// and the answer is streamed again through SSE, so the handler responds with the AI message in its
+// loading state, replacing the failed one.
+func (m Main) HandleRetryMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ch, messages, ok := m.lastMessage(w, r, func(msg models.Message) bool {
+		return !msg.Error.IsZero()
+	}, "Only the last message of the chat can be retried, if it failed")
+	if !ok {
+		return
+	}
+	chatID := ch.ID
+
+	aiMsg := messages[len(messages)-1]
+	aiMsg.Contents = nil
+	aiMsg.ContextTrim = models.ContextTrim{}
+	aiMsg.FallbackLLM = ""
+	aiMsg.Error = models.MessageError{}
+	aiMsg.Finish = models.Finish{}
+	if err := m.store.UpdateMessage(r.Context(), chatID, aiMsg); err != nil {
+		m.logger.Error("Failed to update message",
+			slog.String("message", fmt.Sprintf("%+v", aiMsg)),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messages[len(messages)-1] = aiMsg
+
+	go m.chat(ch, messages, false)
+
+	if err := m.templates.ExecuteTemplate(w, "ai_message", message{
+		ID:             aiMsg.ID,
+		Role:           string(aiMsg.Role),
+		Timestamp:      aiMsg.Timestamp,
+		Usage:          aiMsg.Usage,
+		StreamingState: "loading",
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleContinueMessage resumes the AI message whose answer was truncated by the maximum number of
+// output tokens, through HTTP POST requests. It expects the "chat_id" and "message_id" form fields,
+// identifying the chat and its truncated message, which must be the last message of the chat.
+//
+// The LLM is asked to continue the truncated answer, and its answer is appended to the message, which is
+// streamed through SSE, so the handler responds with the AI message in its loading state, replacing the
+// truncated one.
+func (m Main) HandleContinueMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ch, messages, ok := m.lastMessage(w, r, func(msg models.Message) bool {
+		return msg.Role == models.RoleAssistant && msg.Error.IsZero() && msg.Finish.Truncated()
+	}, "Only the last message of the chat can be continued, if it was truncated")
+	if !ok {
+		return
+	}
+
+	// The message is no longer truncated while it's continued, the stop reason of its continuation
+	// replaces it.
+	aiMsg := messages[len(messages)-1]
+	aiMsg.Finish.StopReason = ""
+	aiMsg.Finish.NativeStopReason = ""
+	if err := m.store.UpdateMessage(r.Context(), ch.ID, aiMsg); err != nil {
+		m.logger.Error("Failed to update message",
+			slog.String("message", fmt.Sprintf("%+v", aiMsg)),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messages[len(messages)-1] = aiMsg
+
+	content, err := models.RenderContents(aiMsg.Contents)
+	if err != nil {
+		m.logger.Error("Failed to render contents",
+			slog.String("message", fmt.Sprintf("%+v", aiMsg)),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go m.chat(ch, messages, true)
+
+	if err := m.templates.ExecuteTemplate(w, "ai_message", message{
+		ID:             aiMsg.ID,
+		Role:           string(aiMsg.Role),
+		Content:        content,
+		Timestamp:      aiMsg.Timestamp,
+		Usage:          aiMsg.Usage,
+		ContextTrim:    aiMsg.ContextTrim,
+		FallbackLLM:    aiMsg.FallbackLLM,
+		StreamingState: "loading",
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// lastMessage returns the chat of the "chat_id" form field with its messages, if the "message_id" form
+// field identifies its last message and the message passes the check. Otherwise it responds with an
+// error, with the conflict message if the message isn't the last one or doesn't pass the check.
+func (m Main) lastMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	check func(models.Message) bool,
+	conflict string,
+) (models.Chat, []models.Message, bool) {
+	chatID := r.FormValue("chat_id")
+	messageID := r.FormValue("message_id")
+	if chatID == "" || messageID == "" {
+		m.logger.Error("Chat ID and message ID are required")
+		http.Error(w, "Chat ID and message ID are required", http.StatusBadRequest)
+		return models.Chat{}, nil, false
+	}
+
+	ch, err := m.store.Chat(r.Context(), chatID)
+	if err != nil {
+		m.logger.Error("Failed to get chat",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return models.Chat{}, nil, false
+	}
+	if ch.ID == "" {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return models.Chat{}, nil, false
+	}
+
+	messages, err := m.store.Messages(r.Context(), chatID)
+	if err != nil {
+		m.logger.Error("Failed to get messages",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return models.Chat{}, nil, false
+	}
+	if len(messages) == 0 || messages[len(messages)-1].ID != messageID || !check(messages[len(messages)-1]) {
+		m.logger.Error("Message can't be regenerated", slog.String("messageID", messageID))
+		http.Error(w, conflict, http.StatusConflict)
+		return models.Chat{}, nil, false
+	}
+	return ch, messages, true
+}
+
+// HandleUpdateChat updates the metadata of a chat through HTTP POST requests. It expects a "chat_id" form
+// field identifying the chat, and any of the optional "pinned" and "archived" fields, set to "true" or
+// "false", and "folders" field, holding a comma-separated list of folder names. As the folders may be
+// entered through an hx-prompt, they are read from the HX-Prompt header when the form field is absent.
+//
+// The updated chat is published to all clients through SSE, moving it between the chat lists it's
+// listed in, and the handler responds with no content.
+func (m Main) HandleUpdateChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	if chatID == "" {
+		m.logger.Error("Chat ID is required")
+		http.Error(w, "Chat ID is required", http.StatusBadRequest)
+		return
+	}
+
+	prev, err := m.store.Chat(r.Context(), chatID)
+	if err != nil {
+		m.logger.Error("Failed to get chat",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if prev.ID == "" {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+
+	updated := prev
+	if pinned := r.FormValue("pinned"); pinned != "" {
+		updated.Pinned = pinned == "true"
+	}
+	if archived := r.FormValue("archived"); archived != "" {
+		updated.Archived = archived == "true"
+	}
+	if _, ok := r.Form["folders"]; ok {
+		updated.Folders = parseFolders(r.FormValue("folders"))
+	} else if folders := r.Header.Values("HX-Prompt"); len(folders) > 0 {
+		updated.Folders = parseFolders(strings.Join(folders, ","))
+	}
+
+	if err := m.store.UpdateChat(r.Context(), updated); err != nil {
+		m.logger.Error("Failed to update chat",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Pinning moves the chat between the pinned and the other chats, so it's moved in the chat lists.
+	if err := m.publishChat(chatID, prev, updated.Pinned != prev.Pinned); err != nil {
+		m.logger.Error("Failed to publish chat",
+			slog.String(errLoggerKey, err.Error()))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleChatParameters sets the LLM parameters of a chat from the chat settings panel through HTTP POST
+// requests. It expects a "chat_id" form field identifying the chat, and the LLM parameter fields, see
+// parseLLMParametersForm. The parameters replace the previous parameters of the chat, so empty fields
+// reset their parameter to the one of the persona or the LLM configuration.
+func (m Main) HandleChatParameters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.FormValue("chat_id")
+	if chatID == "" {
+		m.logger.Error("Chat ID is required")
+		http.Error(w, "Chat ID is required", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseLLMParametersForm(r)
+	if err != nil {
+		m.logger.Error("Invalid chat parameters", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ch, err := m.store.Chat(r.Context(), chatID)
+	if err != nil {
+		m.logger.Error("Failed to get chat",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ch.ID == "" {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+
+	ch.Parameters = params
+	if err := m.store.UpdateChat(r.Context(), ch); err != nil {
+		m.logger.Error("Failed to update chat",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseFolders parses a comma-separated list of folder names, ignoring blank and duplicated names.
+func parseFolders(s string) []string {
+	var folders []string
+	for _, folder := range strings.Split(s, ",") {
+		folder = strings.TrimSpace(folder)
+		if folder == "" || slices.Contains(folders, folder) {
+			continue
+		}
+		folders = append(folders, folder)
+	}
+	return folders
 }
 
 // processPromptInput handles prompt-based inputs, extracting arguments and retrieving
@@ -405,7 +747,13 @@ func (m Main) processAttachedResources(ctx context.Context, resourceURIs []strin
 }
 
 // renderNewChatResponse renders the complete chatbox for new chats.
-func (m Main) renderNewChatResponse(w http.ResponseWriter, chatID string, messages []models.Message, aiMsgID string) {
+func (m Main) renderNewChatResponse(
+	ctx context.Context,
+	w http.ResponseWriter,
+	ch models.Chat,
+	messages []models.Message,
+	aiMsgID string,
+) {
 	msgs := make([]message, len(messages))
 	for i := range messages {
 		// Mark only the AI message as "loading", others as "ended"
@@ -430,9 +778,22 @@ func (m Main) renderNewChatResponse(w http.ResponseWriter, chatID string, messag
 		}
 	}
 
+	personas, err := m.personasData(ctx, ch.PersonaID)
+	if err != nil {
+		m.logger.Error("Failed to get personas", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	data := homePageData{
-		CurrentChatID: chatID,
-		Messages:      msgs,
+		CurrentChatID: ch.ID,
+		MessageList: messageListData{
+			ChatID:   ch.ID,
+			Messages: msgs,
+		},
+		LLMProfiles: m.llmProfilesData(ctx, ch.LLMProfile, ch.Model),
+		Personas:    personas,
+		Parameters:  ch.Parameters,
 	}
 	if err := m.templates.ExecuteTemplate(w, "chatbox", data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -465,6 +826,11 @@ func (m Main) renderExistingChatResponse(w http.ResponseWriter, messages []model
 					Role:           string(messages[i].Role),
 					Content:        content,
 					Timestamp:      messages[i].Timestamp,
+					Usage:          messages[i].Usage,
+					ContextTrim:    messages[i].ContextTrim,
+					FallbackLLM:    messages[i].FallbackLLM,
+					Error:          messages[i].Error,
+					Finish:         messages[i].Finish,
 					StreamingState: "ended",
 				}); err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -496,31 +862,22 @@ func (m Main) renderExistingChatResponse(w http.ResponseWriter, messages []model
 	}
 }
 
-func (m Main) newChat() (string, error) {
+func (m Main) newChat(settings chatSettings) (models.Chat, error) {
 	newChat := models.Chat{
 		ID: uuid.New().String(),
 	}
+	settings.apply(&newChat)
 	newChatID, err := m.store.AddChat(context.Background(), newChat)
 	if err != nil {
-		return "", fmt.Errorf("failed to add chat: %w", err)
+		return models.Chat{}, fmt.Errorf("failed to add chat: %w", err)
 	}
 	newChat.ID = newChatID
 
-	divs, err := m.chatDivs(newChat.ID)
-	if err != nil {
-		return "", fmt.Errorf("failed to create chat divs: %w", err)
-	}
-
-	msg := sse.Message{
-		Type: chatsSSEType,
-	}
-	msg.AppendData(divs)
-
-	if err := m.sseSrv.Publish(&msg, chatsSSETopic); err != nil {
-		return "", fmt.Errorf("failed to publish chats: %w", err)
+	if err := m.publishChat(newChat.ID, models.Chat{}, true); err != nil {
+		return models.Chat{}, fmt.Errorf("failed to publish chat: %w", err)
 	}
 
-	return newChat.ID, nil
+	return newChat, nil
 }
 
 // continueChat continues chat with given chatID.
@@ -603,7 +960,15 @@ func (m Main) callTool(params mcp.CallToolParams) (json.RawMessage, bool) {
 	return resContent, !toolRes.IsError
 }
 
-func (m Main) chat(chatID string, messages []models.Message) {
+// chat streams the response to the last message, which is the empty AI message added by HandleChats, and
+// calls the tools requested by the LLM until it stops requesting them. The response is generated by the
+// LLM of the chat's profile, with the system prompt, tools and parameters of the chat's persona.
+//
+// If resume is set, the last message is a truncated answer instead, which the LLM is asked to continue,
+// and the continuation is appended to its text.
+func (m Main) chat(ch models.Chat, messages []models.Message, resume bool) {
+	chatID := ch.ID
+
 	// Ensure SSE connection cleanup on function exit
 	defer func() {
 		e := &sse.Message{Type: sse.Type("closeMessage")}
@@ -611,16 +976,43 @@ func (m Main) chat(chatID string, messages []models.Message) {
 		_ = m.sseSrv.Publish(e)
 	}()
 
+	profile := m.profile(ch.LLMProfile)
+	tools, opts := m.chatOptions(context.Background(), ch)
 	aiMsg := messages[len(messages)-1]
-	contentIdx := -1
+	if resume {
+		// The text of the truncated answer is extended in place, so it mustn't share its contents with the
+		// messages sent to the LLM.
+		aiMsg.Contents = slices.Clone(aiMsg.Contents)
+	}
+	contentIdx := len(aiMsg.Contents) - 1
+	summaries := make(contextSummaries)
+	// The latency of a continued message includes the time it took before it was truncated.
+	start := time.Now()
+	prevLatency := aiMsg.Finish.Latency
 
 	for {
-		it := m.llm.Chat(context.Background(), messages, m.tools)
-		aiMsg.Contents = append(aiMsg.Contents, models.Content{
-			Type: models.ContentTypeText,
-			Text: "",
-		})
-		contentIdx++
+		request := messages
+		if resume {
+			// The truncated answer is followed by the request to continue it, which isn't stored in the chat.
+			request = append(slices.Clip(messages), models.Message{
+				Role:     models.RoleUser,
+				Contents: []models.Content{{Type: models.ContentTypeText, Text: continuePrompt}},
+			})
+		}
+		fitted, trim := m.fitContext(context.Background(), profile, request, tools, opts, summaries)
+		aiMsg.ContextTrim = trim
+		// The LLM that answers, which is a fallback LLM of the profile if its LLM fails.
+		answering := profile
+		it := profile.LLM.Chat(context.Background(), fitted, tools, opts)
+		// The continuation of a truncated text extends it, instead of starting a new paragraph.
+		if !resume || contentIdx < 0 || aiMsg.Contents[contentIdx].Type != models.ContentTypeText {
+			aiMsg.Contents = append(aiMsg.Contents, models.Content{
+				Type: models.ContentTypeText,
+				Text: "",
+			})
+			contentIdx++
+		}
+		resume = false
 		callTool := false
 		badToolInputFlag := false
 		badToolInput := json.RawMessage("{}")
@@ -631,16 +1023,45 @@ func (m Main) chat(chatID string, messages []models.Message) {
 			}
 			if err != nil {
 				m.logger.Error("Error from llm provider", slog.String(errLoggerKey, err.Error()))
-				msg.AppendData(err.Error())
-				_ = m.sseSrv.Publish(&msg, messageIDTopic(aiMsg.ID))
+				// The message keeps the contents generated before the failure, and is marked as failed so it
+				// can be retried.
+				aiMsg.Error = messageError(err)
+				if err := m.store.UpdateMessage(context.Background(), chatID, aiMsg); err != nil {
+					m.logger.Error("Failed to update message",
+						slog.String("message", fmt.Sprintf("%+v", aiMsg)),
+						slog.String(errLoggerKey, err.Error()))
+				}
+				if err := m.publishContents(aiMsg, "message_error"); err != nil {
+					m.logger.Error("Failed to publish error", slog.String(errLoggerKey, err.Error()))
+				}
 				return
 			}
 
 			m.logger.Debug("LLM response", slog.String("content", fmt.Sprintf("%+v", content)))
 
+			if content.Type == models.ContentTypeStatus {
+				// The status of the LLM, such as a retry of the request, is only shown while the answer is
+				// generated, it isn't stored with the message.
+				if err := m.publishStatus(aiMsg, content.Text); err != nil {
+					m.logger.Error("Failed to publish status",
+						slog.String("status", content.Text),
+						slog.String(errLoggerKey, err.Error()))
+				}
+				continue
+			}
+
 			switch content.Type {
+			case models.ContentTypeFallback:
+				answering = m.profile(content.Text)
+				aiMsg.FallbackLLM = content.Text
 			case models.ContentTypeText:
+				if aiMsg.Contents[contentIdx].Type != models.ContentTypeText {
+					aiMsg.Contents = append(aiMsg.Contents, models.Content{Type: models.ContentTypeText})
+					contentIdx++
+				}
 				aiMsg.Contents[contentIdx].Text += content.Text
+			case models.ContentTypeThinking:
+				aiMsg.Contents, contentIdx = appendThinking(aiMsg.Contents, contentIdx, content)
 			case models.ContentTypeCallTool:
 				// Non-anthropic models sometimes give a bad tool input which can't be json-marshalled, and it would lead to failure
 				// when the store try to save the message. So we check if the tool input is valid json, and if not, we set a flag
@@ -655,6 +1076,21 @@ func (m Main) chat(chatID string, messages []models.Message) {
 				callTool = true
 				aiMsg.Contents = append(aiMsg.Contents, content)
 				contentIdx++
+			case models.ContentTypeUsage:
+				if content.Usage == nil {
+					continue
+				}
+				usage := *content.Usage
+				if usage.Cost == 0 {
+					usage.Cost = answering.Price.Cost(usage)
+				}
+				aiMsg.Usage = aiMsg.Usage.Add(usage)
+			case models.ContentTypeFinish:
+				if content.Finish == nil {
+					continue
+				}
+				aiMsg.Finish = *content.Finish
+				aiMsg.Finish.Latency = prevLatency + time.Since(start)
 			case models.ContentTypeResource:
 				m.logger.Error("Content type resource is not allowed")
 				return
@@ -694,6 +1130,11 @@ func (m Main) chat(chatID string, messages []models.Message) {
 		}
 
 		if !callTool {
+			if aiMsg.Finish.Truncated() {
+				if err := m.publishContents(aiMsg, "message_truncated"); err != nil {
+					m.logger.Error("Failed to publish truncation", slog.String(errLoggerKey, err.Error()))
+				}
+			}
 			break
 		}
 
@@ -726,6 +1167,81 @@ func (m Main) chat(chatID string, messages []models.Message) {
 	}
 }
 
+// publishStatus publishes the contents of the message being generated, followed by the status of the
+// LLM that generates it.
+func (m Main) publishStatus(aiMsg models.Message, status string) error {
+	rc, err := models.RenderContents(aiMsg.Contents)
+	if err != nil {
+		return fmt.Errorf("failed to render contents: %w", err)
+	}
+	msg := sse.Message{
+		Type: messagesSSEType,
+	}
+	msg.AppendData(rc + fmt.Sprintf(`<div class="llm-status text-warning small">%s</div>`, html.EscapeString(status)))
+	if err := m.sseSrv.Publish(&msg, messageIDTopic(aiMsg.ID)); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+// publishContents publishes the contents of the message, followed by the block of the named template, such
+// as the error block with the retry button.
+func (m Main) publishContents(aiMsg models.Message, block string) error {
+	rc, err := models.RenderContents(aiMsg.Contents)
+	if err != nil {
+		return fmt.Errorf("failed to render contents: %w", err)
+	}
+	var sb strings.Builder
+	sb.WriteString(rc)
+	if err := m.templates.ExecuteTemplate(&sb, block, message{
+		ID:     aiMsg.ID,
+		Error:  aiMsg.Error,
+		Finish: aiMsg.Finish,
+	}); err != nil {
+		return fmt.Errorf("failed to render %s: %w", block, err)
+	}
+	msg := sse.Message{
+		Type: messagesSSEType,
+	}
+	msg.AppendData(sb.String())
+	if err := m.sseSrv.Publish(&msg, messageIDTopic(aiMsg.ID)); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+// messageError returns the error recorded on a message whose LLM failed with err. The errors of the LLM
+// providers are classified by their kind of failure, the other errors are unknown failures.
+func messageError(err error) models.MessageError {
+	var classified interface {
+		MessageError() models.MessageError
+	}
+	if errors.As(err, &classified) {
+		return classified.MessageError()
+	}
+	return models.MessageError{Kind: models.ErrorKindUnknown, Message: err.Error()}
+}
+
+// appendThinking appends a thinking chunk to the contents of the message being generated, and returns
+// the contents with the index of the current content. The chunk continues the current thinking block
+// until the block is ended by its signature or a redacted thinking, and a new thinking block replaces
+// the empty text content that is added before each LLM call.
+func appendThinking(contents []models.Content, idx int, chunk models.Content) ([]models.Content, int) {
+	current := &contents[idx]
+	switch {
+	case current.Type == models.ContentTypeThinking && current.ThinkingSignature == "" &&
+		current.RedactedThinking == "" && chunk.RedactedThinking == "":
+		current.Text += chunk.Text
+		current.ThinkingSignature = chunk.ThinkingSignature
+	case current.Type == models.ContentTypeText && current.Text == "":
+		*current = chunk
+	default:
+		contents = append(contents, chunk)
+		idx++
+	}
+	return contents, idx
+}
+
 func (m Main) generateChatTitle(chatID string, message string) {
 	title, err := m.titleGenerator.GenerateTitle(context.Background(), message)
 	if err != nil {
@@ -735,49 +1251,250 @@ func (m Main) generateChatTitle(chatID string, message string) {
 		return
 	}
 
-	updatedChat := models.Chat{
-		ID:    chatID,
-		Title: title,
-	}
-	if err := m.store.UpdateChat(context.Background(), updatedChat); err != nil {
+	prev, err := m.updateChatTitle(context.Background(), chatID, title)
+	if err != nil {
 		m.logger.Error("Failed to update chat title",
 			slog.String(errLoggerKey, err.Error()))
 		return
 	}
 
-	divs, err := m.chatDivs(chatID)
+	if err := m.publishChat(chatID, prev, false); err != nil {
+		m.logger.Error("Failed to publish chat",
+			slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+// hasLLMProfile reports whether there is an LLM profile with the given name.
+func (m Main) hasLLMProfile(name string) bool {
+	return slices.ContainsFunc(m.llmProfiles, func(p LLMProfile) bool {
+		return p.Name == name
+	})
+}
+
+// profile returns the LLM profile with the given name, or the default profile if there is no such
+// profile, e.g. because the profile was removed from the configuration since the chat was created.
+func (m Main) profile(name string) LLMProfile {
+	for _, p := range m.llmProfiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	if len(m.llmProfiles) > 0 {
+		return m.llmProfiles[0]
+	}
+	return LLMProfile{LLM: m.llm}
+}
+
+// chatSettings are the settings of a chat selected in the chatbox.
+type chatSettings struct {
+	llmProfile string
+	// model is the local model selected for the profile, empty for its configured model.
+	model     string
+	personaID string
+	// setPersona is true if the persona is selected, as an empty personaID removes the persona.
+	setPersona bool
+}
+
+// chatSettingsFromRequest returns the chat settings of the "llm_profile" and "persona_id" form fields.
+// Settings missing from the form are left unchanged. The local models are selected as "profile|model",
+// split at the last separator as model names don't contain it.
+func chatSettingsFromRequest(r *http.Request) chatSettings {
+	llmProfile, model := r.FormValue("llm_profile"), ""
+	if i := strings.LastIndex(llmProfile, "|"); i >= 0 {
+		llmProfile, model = llmProfile[:i], llmProfile[i+1:]
+	}
+	// FormValue parses the form, so the presence of the persona field can be checked afterwards.
+	_, setPersona := r.Form["persona_id"]
+	return chatSettings{
+		llmProfile: llmProfile,
+		model:      model,
+		personaID:  r.FormValue("persona_id"),
+		setPersona: setPersona,
+	}
+}
+
+// apply applies the settings to the chat, and reports whether the chat changed.
+func (s chatSettings) apply(ch *models.Chat) bool {
+	changed := false
+	if s.llmProfile != "" && (s.llmProfile != ch.LLMProfile || s.model != ch.Model) {
+		ch.LLMProfile = s.llmProfile
+		ch.Model = s.model
+		changed = true
+	}
+	if s.setPersona && s.personaID != ch.PersonaID {
+		ch.PersonaID = s.personaID
+		changed = true
+	}
+	return changed
+}
+
+// updateChatSettings saves the settings on the chat, and returns the updated chat.
+func (m Main) updateChatSettings(ctx context.Context, chatID string, settings chatSettings) (models.Chat, error) {
+	ch, err := m.store.Chat(ctx, chatID)
+	if err != nil {
+		return models.Chat{}, fmt.Errorf("failed to get chat: %w", err)
+	}
+	if ch.ID == "" {
+		// The chat isn't stored, so the settings only apply to this response.
+		ch.ID = chatID
+		settings.apply(&ch)
+		return ch, nil
+	}
+	if !settings.apply(&ch) {
+		return ch, nil
+	}
+	if err := m.store.UpdateChat(ctx, ch); err != nil {
+		return models.Chat{}, fmt.Errorf("failed to update chat: %w", err)
+	}
+	return ch, nil
+}
+
+// chatOptions returns the tools and the options of the LLM calls of the chat, from its persona. The chats
+// whose persona has been deleted are sent with the default options. The local model of the chat is only
+// used while its profile's models are managed from the UI.
+func (m Main) chatOptions(ctx context.Context, ch models.Chat) ([]mcp.Tool, models.ChatOptions) {
+	model := ""
+	if _, ok := m.managedProfile(ch.LLMProfile); ok {
+		model = ch.Model
+	}
+	defaultOpts := models.ChatOptions{Parameters: ch.Parameters, Model: model}
+	if ch.PersonaID == "" {
+		return m.tools, defaultOpts
+	}
+	p, ok, err := m.persona(ctx, ch.PersonaID)
 	if err != nil {
-		m.logger.Error("Failed to generate chat divs",
+		m.logger.Error("Failed to get persona",
+			slog.String("personaID", ch.PersonaID),
 			slog.String(errLoggerKey, err.Error()))
-		return
+		return m.tools, defaultOpts
+	}
+	if !ok {
+		m.logger.Warn("Persona not found", slog.String("personaID", ch.PersonaID))
+		return m.tools, defaultOpts
 	}
 
+	tools := m.tools
+	if len(p.Tools) > 0 {
+		tools = slices.DeleteFunc(slices.Clone(m.tools), func(t mcp.Tool) bool {
+			return !slices.Contains(p.Tools, t.Name)
+		})
+	}
+	return tools, models.ChatOptions{
+		SystemPrompt: p.SystemPrompt,
+		Parameters:   p.Parameters.Merge(ch.Parameters),
+		Model:        model,
+	}
+}
+
+// llmProfilesData returns the data of the LLM profile picker with the given profile and local model
+// selected. The first profile is selected if the given one is empty or no longer available.
+func (m Main) llmProfilesData(ctx context.Context, selected, model string) llmProfilesData {
+	names := make([]string, len(m.llmProfiles))
+	for i, p := range m.llmProfiles {
+		names[i] = p.Name
+	}
+	if !slices.Contains(names, selected) && len(names) > 0 {
+		selected, model = names[0], ""
+	}
+	return llmProfilesData{
+		Names:         names,
+		Selected:      selected,
+		Models:        m.localModelNames(ctx, selected, model),
+		SelectedModel: model,
+	}
+}
+
+// publishChat publishes the chat with the given ID to all clients through SSE. Only the changed chat
+// is rendered, as out-of-band swaps published to the topic of every chat list filter the chat belongs to,
+// or belonged to before the change, as given by prev.
+//
+// The chat is removed from the lists it no longer belongs to, and prepended to the lists it's new to.
+// If move is true, the chat is also moved to the top of the lists it's already in, as it's the most
+// recently updated chat, otherwise it replaces its own entry.
+func (m Main) publishChat(chatID string, prev models.Chat, move bool) error {
+	ch, err := m.store.Chat(context.Background(), chatID)
+	if err != nil {
+		return fmt.Errorf("failed to get chat: %w", err)
+	}
+	if ch.ID == "" {
+		return fmt.Errorf("chat %s is not found", chatID)
+	}
+
+	var prevFilters []chatsFilter
+	if prev.ID != "" {
+		prevFilters = chatFilters(prev)
+	}
+	filters := chatFilters(ch)
+
+	for _, f := range prevFilters {
+		if slices.Contains(filters, f) {
+			continue
+		}
+		if err := m.publishChatsMessage(f, fmt.Sprintf(`<div id="chat-%s" hx-swap-oob="delete"></div>`, ch.ID)); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range filters {
+		data := chatView(ch, f)
+		listed := slices.Contains(prevFilters, f)
+
+		var sb strings.Builder
+		if !move && listed {
+			data.SwapOOB = "outerHTML"
+			if err := m.templates.ExecuteTemplate(&sb, "chat_title", data); err != nil {
+				return fmt.Errorf("failed to execute chat_title template: %w", err)
+			}
+		} else {
+			if listed {
+				fmt.Fprintf(&sb, `<div id="chat-%s" hx-swap-oob="delete"></div>`, ch.ID)
+			}
+			list := "#chat-list"
+			if ch.Pinned {
+				list = "#pinned-chat-list"
+			}
+			// For swap strategies other than outerHTML, htmx swaps the children of the out-of-band element,
+			// so the chat is wrapped in the element that carries the swap strategy.
+			fmt.Fprintf(&sb, `<div hx-swap-oob="afterbegin:%s">`, list)
+			if err := m.templates.ExecuteTemplate(&sb, "chat_title", data); err != nil {
+				return fmt.Errorf("failed to execute chat_title template: %w", err)
+			}
+			sb.WriteString("</div>")
+		}
+
+		if err := m.publishChatsMessage(f, sb.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Main) publishChatsMessage(filter chatsFilter, data string) error {
 	msg := sse.Message{
 		Type: chatsSSEType,
 	}
-	msg.AppendData(divs)
-	if err := m.sseSrv.Publish(&msg, chatsSSETopic); err != nil {
-		m.logger.Error("Failed to publish chats",
-			slog.String(errLoggerKey, err.Error()))
+	msg.AppendData(data)
+	if err := m.sseSrv.Publish(&msg, filter.topic()); err != nil {
+		return fmt.Errorf("failed to publish chat: %w", err)
 	}
+	return nil
 }
 
-func (m Main) chatDivs(activeID string) (string, error) {
-	chats, err := m.store.Chats(context.Background())
+// updateChatTitle sets the title of the chat with the given ID, and returns the chat as it was before
+// the update, for publishChat.
+func (m Main) updateChatTitle(ctx context.Context, chatID, title string) (models.Chat, error) {
+	ch, err := m.store.Chat(ctx, chatID)
 	if err != nil {
-		return "", fmt.Errorf("failed to get chats: %w", err)
+		return models.Chat{}, fmt.Errorf("failed to get chat: %w", err)
+	}
+	if ch.ID == "" {
+		return models.Chat{}, fmt.Errorf("chat %s is not found", chatID)
 	}
 
-	var sb strings.Builder
-	for _, ch := range chats {
-		err := m.templates.ExecuteTemplate(&sb, "chat_title", chat{
-			ID:     ch.ID,
-			Title:  ch.Title,
-			Active: ch.ID == activeID,
-		})
-		if err != nil {
-			return "", fmt.Errorf("failed to execute chat_title template: %w", err)
-		}
+	updated := ch
+	updated.Title = title
+	if err := m.store.UpdateChat(ctx, updated); err != nil {
+		return models.Chat{}, fmt.Errorf("failed to update chat: %w", err)
 	}
-	return sb.String(), nil
+	return ch, nil
 }
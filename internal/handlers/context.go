@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// TokenEstimator is implemented by the LLMs that estimate the number of input tokens of their chat
+// calls. The context of the chats sent to an LLM that doesn't implement it is estimated with
+// defaultCharsPerToken.
+type TokenEstimator interface {
+	EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int
+}
+
+const (
+	defaultCharsPerToken = 4
+
+	// summaryContentLimit is the number of characters the tool inputs and results and the text resources
+	// are truncated to in the transcript given to the summarizer.
+	summaryContentLimit = 1000
+
+	summaryPrefix = "Summary of the earlier conversation, which was omitted to fit in the context window:\n\n"
+)
+
+// elidedToolResult replaces the tool results that are elided to fit a chat in the context window.
+var elidedToolResult = json.RawMessage(
+	`"The tool result was omitted to fit the conversation in the context window."`)
+
+// contextSummaries caches the summaries of the earliest messages of a chat, by the number of summarized
+// messages, so the tool calls of a single answer don't summarize the same messages again.
+type contextSummaries map[int]string
+
+// WithSummarizer sets the LLM that summarizes the earliest messages of the chats that don't fit in the
+// context window of their LLM. Without it, those messages are dropped instead.
+func WithSummarizer(llm LLM) MainOption {
+	return func(m *Main) {
+		m.summarizer = llm
+	}
+}
+
+// fitContext returns the messages to send to the LLM of the profile, trimmed to fit in its context
+// window, and how they were trimmed. The messages are returned as is if the profile has no context
+// window.
+//
+// The tool results of the earliest messages are elided first, as they are usually the largest contents
+// and the least relevant to the next answer. If that's not enough, the earliest messages are replaced
+// by a summary, or dropped if there's no summarizer. The last message, which is the answer being
+// generated, and the user message it answers are always kept intact.
+func (m Main) fitContext(
+	ctx context.Context,
+	profile LLMProfile,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+	summaries contextSummaries,
+) ([]models.Message, models.ContextTrim) {
+	var trim models.ContextTrim
+	if profile.ContextWindow <= 0 || len(messages) < 2 {
+		return messages, trim
+	}
+
+	budget := contextBudget(profile.ContextWindow, opts.Parameters)
+	estimate := func(msgs []models.Message) int {
+		if e, ok := profile.LLM.(TokenEstimator); ok {
+			return e.EstimateTokens(msgs, tools, opts)
+		}
+		return models.EstimateTokens(opts.SystemPrompt, msgs, tools, defaultCharsPerToken)
+	}
+	if estimate(messages) <= budget {
+		return messages, trim
+	}
+
+	// The index of the user message the last message answers, from where the messages are kept intact.
+	lastUserIdx := len(messages) - 2
+	for lastUserIdx > 0 && messages[lastUserIdx].Role != models.RoleUser {
+		lastUserIdx--
+	}
+
+	fitted := make([]models.Message, len(messages))
+	copy(fitted, messages)
+	elided := make([]int, len(messages))
+	for i := 0; i < lastUserIdx; i++ {
+		fitted[i], elided[i] = elideToolResults(fitted[i])
+		if elided[i] > 0 && estimate(fitted) <= budget {
+			break
+		}
+	}
+
+	// Drop the earliest messages up to a user message, so the kept messages still start with one.
+	start := 0
+	if estimate(fitted) > budget {
+		start = lastUserIdx
+		for i := 1; i < lastUserIdx; i++ {
+			if fitted[i].Role == models.RoleUser && estimate(fitted[i:]) <= budget {
+				start = i
+				break
+			}
+		}
+	}
+	for _, n := range elided[start:] {
+		trim.ElidedToolResults += n
+	}
+	if start == 0 {
+		return fitted, trim
+	}
+
+	summary, err := m.summarizeContext(ctx, fitted[:start], summaries)
+	if err != nil {
+		m.logger.Error("Failed to summarize the earlier messages",
+			slog.Int("messages", start),
+			slog.String(errLoggerKey, err.Error()))
+		trim.DroppedMessages = start
+		return fitted[start:], trim
+	}
+	if summary == "" {
+		trim.DroppedMessages = start
+		return fitted[start:], trim
+	}
+
+	trim.SummarizedMessages = start
+	first := fitted[start]
+	first.Contents = append([]models.Content{{
+		Type: models.ContentTypeText,
+		Text: summaryPrefix + summary,
+	}}, first.Contents...)
+	fitted[start] = first
+	return fitted[start:], trim
+}
+
+// contextBudget returns the number of tokens the input of an LLM call can take in the context window,
+// leaving room for the answer: the configured max tokens, or a quarter of the window.
+func contextBudget(contextWindow int, params models.LLMParameters) int {
+	reserved := contextWindow / 4
+	if params.MaxTokens != nil && *params.MaxTokens < contextWindow {
+		reserved = *params.MaxTokens
+	}
+	return contextWindow - reserved
+}
+
+// elideToolResults returns the message with its tool results replaced by a placeholder, and the number
+// of replaced tool results. The contents of the given message are left untouched.
+func elideToolResults(msg models.Message) (models.Message, int) {
+	elided := 0
+	contents := make([]models.Content, len(msg.Contents))
+	for i, content := range msg.Contents {
+		if content.Type == models.ContentTypeToolResult && string(content.ToolResult) != string(elidedToolResult) {
+			content.ToolResult = elidedToolResult
+			elided++
+		}
+		contents[i] = content
+	}
+	msg.Contents = contents
+	return msg, elided
+}
+
+// summarizeContext returns the summary of the messages by the summarizer, or an empty string if there's
+// no summarizer.
+func (m Main) summarizeContext(
+	ctx context.Context,
+	messages []models.Message,
+	summaries contextSummaries,
+) (string, error) {
+	if m.summarizer == nil {
+		return "", nil
+	}
+	if summary, ok := summaries[len(messages)]; ok {
+		return summary, nil
+	}
+
+	req := []models.Message{{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: summaryTranscript(messages)}},
+	}}
+
+	var summary strings.Builder
+	for content, err := range m.summarizer.Chat(ctx, req, nil, models.ChatOptions{}) {
+		if err != nil {
+			return "", err
+		}
+		if content.Type == models.ContentTypeText {
+			summary.WriteString(content.Text)
+		}
+	}
+	summaries[len(messages)] = summary.String()
+	return summary.String(), nil
+}
+
+// summaryTranscript returns the transcript of the messages given to the summarizer. The tool inputs and
+// results and the text resources are truncated to summaryContentLimit characters, and the binary resources
+// are only described, so the large contents that are elided from the chat don't fill the context window of
+// the summarizer instead. The thinking is left out, only the conversation is summarized.
+func summaryTranscript(messages []models.Message) string {
+	var sb strings.Builder
+	for _, msg := range messages {
+		sb.WriteString(fmt.Sprintf("%s:\n", msg.Role))
+		for _, content := range msg.Contents {
+			switch content.Type {
+			case models.ContentTypeText:
+				if content.Text != "" {
+					sb.WriteString(content.Text + "\n")
+				}
+			case models.ContentTypeResource:
+				for _, resource := range content.ResourceContents {
+					if resource.Blob != "" {
+						sb.WriteString(fmt.Sprintf("[Resource %s (%s) omitted]\n", resource.URI, resource.MimeType))
+						continue
+					}
+					sb.WriteString(fmt.Sprintf("Resource %s:\n%s\n", resource.URI,
+						truncateContent(resource.Text)))
+				}
+			case models.ContentTypeCallTool:
+				sb.WriteString(fmt.Sprintf("Called the tool %s with %s\n", content.ToolName,
+					truncateContent(string(content.ToolInput))))
+			case models.ContentTypeToolResult:
+				sb.WriteString(fmt.Sprintf("Tool result: %s\n", truncateContent(string(content.ToolResult))))
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// truncateContent returns s cut to summaryContentLimit characters, with a note of the truncation.
+func truncateContent(s string) string {
+	runes := []rune(s)
+	if len(runes) <= summaryContentLimit {
+		return s
+	}
+	return fmt.Sprintf("%s... [%d more characters truncated]", string(runes[:summaryContentLimit]),
+		len(runes)-summaryContentLimit)
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+const (
+	exportFormatMarkdown = "markdown"
+	exportFormatJSON     = "json"
+
+	// maxImportSize limits the size of the uploaded import file, as the whole file is decoded in memory.
+	maxImportSize = 64 << 20
+)
+
+// HandleExport exports chats as a downloadable file. It accepts GET requests with an optional "chat_id"
+// query parameter, and exports all chats if it's omitted.
+//
+// The "format" query parameter selects the file format: "markdown" renders the conversation into a
+// human-readable document, while "json" (the default) produces the lossless models.Export format that
+// can be imported back through HandleImport.
+func (m Main) HandleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportFormatJSON
+	}
+	if format != exportFormatJSON && format != exportFormatMarkdown {
+		m.logger.Error("Unknown export format", slog.String("format", format))
+		http.Error(w, "Unknown export format", http.StatusBadRequest)
+		return
+	}
+
+	chatID := r.URL.Query().Get("chat_id")
+	export, err := m.exportChats(r.Context(), chatID)
+	if err != nil {
+		m.logger.Error("Failed to export chats",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if chatID != "" && len(export.Chats) == 0 {
+		m.logger.Error("Chat not found", slog.String("chatID", chatID))
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+
+	fileName := "chats"
+	if chatID != "" {
+		fileName = "chat-" + chatID
+	}
+
+	if format == exportFormatMarkdown {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName+".md"))
+
+		mds := make([]string, len(export.Chats))
+		for i, ch := range export.Chats {
+			mds[i] = ch.Markdown()
+		}
+		fmt.Fprint(w, strings.Join(mds, "---\n\n"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName+".json"))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		m.logger.Error("Failed to encode export", slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+// HandleImport imports chats from a file in the models.Export JSON format, as produced by HandleExport.
+// It accepts POST requests with the file in the "file" multipart form field.
+//
+// Every imported chat and message is recreated through the store with a new ID, so importing the same
+// file twice results in duplicated chats instead of overwriting existing ones. The imported chats are
+// published to all clients through SSE, and the client is redirected to the imported chat, or to the
+// home page if several chats were imported.
+func (m Main) HandleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		m.logger.Error("Failed to read import file", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, "Import file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	export, err := decodeExport(file)
+	if err != nil {
+		m.logger.Error("Failed to decode import file", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chatIDs := make([]string, 0, len(export.Chats))
+	for _, ch := range export.Chats {
+		chatID, err := m.importChat(r.Context(), ch)
+		if err != nil {
+			m.logger.Error("Failed to import chat",
+				slog.String("chatID", ch.Chat.ID),
+				slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chatIDs = append(chatIDs, chatID)
+
+		if err := m.publishChat(chatID, models.Chat{}, true); err != nil {
+			m.logger.Error("Failed to publish chat",
+				slog.String(errLoggerKey, err.Error()))
+		}
+	}
+
+	redirectURL := "/"
+	if len(chatIDs) == 1 {
+		redirectURL = "/?chat_id=" + chatIDs[0]
+	}
+
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", redirectURL)
+		return
+	}
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+func decodeExport(r io.Reader) (models.Export, error) {
+	var export models.Export
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return models.Export{}, fmt.Errorf("invalid import file: %w", err)
+	}
+	if export.Version < 1 || export.Version > models.ExportVersion {
+		return models.Export{}, fmt.Errorf("unsupported import file version: %d", export.Version)
+	}
+	return export, nil
+}
+
+func (m Main) exportChats(ctx context.Context, chatID string) (models.Export, error) {
+	var chats []models.Chat
+	if chatID != "" {
+		ch, err := m.store.Chat(ctx, chatID)
+		if err != nil {
+			return models.Export{}, fmt.Errorf("failed to get chat: %w", err)
+		}
+		if ch.ID != "" {
+			chats = append(chats, ch)
+		}
+	} else {
+		var err error
+		chats, err = m.store.Chats(ctx)
+		if err != nil {
+			return models.Export{}, fmt.Errorf("failed to get chats: %w", err)
+		}
+	}
+
+	export := models.Export{
+		Version:    models.ExportVersion,
+		ExportedAt: time.Now(),
+		Chats:      make([]models.ChatExport, len(chats)),
+	}
+	for i, ch := range chats {
+		messages, err := m.store.Messages(ctx, ch.ID)
+		if err != nil {
+			return models.Export{}, fmt.Errorf("failed to get messages of chat %s: %w", ch.ID, err)
+		}
+		export.Chats[i] = models.ChatExport{
+			Chat:     ch,
+			Messages: messages,
+		}
+	}
+	return export, nil
+}
+
+func (m Main) importChat(ctx context.Context, ch models.ChatExport) (string, error) {
+	chat := ch.Chat
+	chat.ID = uuid.New().String()
+	chatID, err := m.store.AddChat(ctx, chat)
+	if err != nil {
+		return "", fmt.Errorf("failed to add chat: %w", err)
+	}
+
+	for _, msg := range ch.Messages {
+		msg.ID = uuid.New().String()
+		if _, err := m.store.AddMessage(ctx, chatID, msg); err != nil {
+			return "", fmt.Errorf("failed to add message: %w", err)
+		}
+	}
+	return chatID, nil
+}
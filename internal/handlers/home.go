@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"slices"
 
 	"github.com/MegaGrindStone/go-mcp"
@@ -11,86 +12,220 @@ import (
 )
 
 type homePageData struct {
-	Chats         []chat
-	Messages      []message
+	PinnedChats   []chat
+	ChatList      chatListData
+	MessageList   messageListData
 	CurrentChatID string
 
+	Filter  chatsFilter
+	Folders []string
+
+	LLMProfiles llmProfilesData
+	// ManagedModels is true if the models of any LLM profile are managed from the UI.
+	ManagedModels bool
+	Personas      personasData
+	// Parameters are the LLM parameters of the current chat, edited in the chat settings panel.
+	Parameters models.LLMParameters
+
 	Servers   []mcp.Info
 	Tools     []mcp.Tool
 	Resources []mcp.Resource
 	Prompts   []mcp.Prompt
 }
 
-// HandleHome renders the home page template with chat and message data. It displays a list of available
-// chats and, if a chat_id query parameter is provided, shows the messages for the selected chat.
-// The handler retrieves chat and message data from the store and prepares it for template rendering.
+// llmProfilesData is the data of the LLM profile picker, which is only rendered if there are several
+// profiles or local models to choose from.
+type llmProfilesData struct {
+	Names    []string
+	Selected string
+
+	// Models are the local models of the profiles whose models are managed from the UI, by profile name.
+	Models map[string][]string
+	// SelectedModel is the local model selected for the selected profile, empty for its configured model.
+	SelectedModel string
+}
+
+type chatListData struct {
+	Chats       []chat
+	NextCursor  string
+	FilterQuery string
+}
+
+// chatsFilter is a filter of the chat list. The chats of each filter are published through their own SSE
+// topic, so clients only receive the updates of the chat list they display.
+type chatsFilter struct {
+	Folder   string
+	Archived bool
+}
+
+type messageListData struct {
+	ChatID     string
+	Messages   []message
+	NextCursor string
+}
+
+const (
+	chatsPageSize    = 30
+	messagesPageSize = 20
+)
+
+// chatsFilterFromRequest returns the chat list filter from the "folder" and "archived" query parameters.
+func chatsFilterFromRequest(r *http.Request) chatsFilter {
+	return chatsFilter{
+		Folder:   r.URL.Query().Get("folder"),
+		Archived: r.URL.Query().Get("archived") == "true",
+	}
+}
+
+// chatFilters returns the filters whose chat list contains the chat.
+func chatFilters(ch models.Chat) []chatsFilter {
+	filters := []chatsFilter{{Archived: ch.Archived}}
+	for _, folder := range ch.Folders {
+		filters = append(filters, chatsFilter{Folder: folder, Archived: ch.Archived})
+	}
+	return filters
+}
+
+func (f chatsFilter) topic() string {
+	topic := chatsSSETopic
+	if f.Archived {
+		topic += "-archived"
+	}
+	if f.Folder != "" {
+		topic += "-folder-" + f.Folder
+	}
+	return topic
+}
+
+// query returns the encoded URL query of the filter, so the links of the chat list keep the filter.
+func (f chatsFilter) query() string {
+	q := url.Values{}
+	if f.Folder != "" {
+		q.Set("folder", f.Folder)
+	}
+	if f.Archived {
+		q.Set("archived", "true")
+	}
+	return q.Encode()
+}
+
+func (f chatsFilter) chatsQuery(cursor string) models.ChatsQuery {
+	return models.ChatsQuery{
+		Cursor:   cursor,
+		Limit:    chatsPageSize,
+		Folder:   f.Folder,
+		Archived: f.Archived,
+	}
+}
+
+// chatView transforms the store's chat into the view-specific chat, to avoid exposing internal
+// implementation details to the template.
+func chatView(ch models.Chat, filter chatsFilter) chat {
+	return chat{
+		ID:          ch.ID,
+		Title:       ch.Title,
+		Pinned:      ch.Pinned,
+		Archived:    ch.Archived,
+		Folders:     ch.Folders,
+		FilterQuery: filter.query(),
+	}
+}
+
+// HandleHome renders the home page template with chat and message data. It displays the first page of
+// available chats and, if a chat_id query parameter is provided, shows the latest messages of the
+// selected chat. Older chats and messages are loaded lazily by HandleChatList and HandleMessages as the
+// user scrolls.
+//
+// The chat list can be filtered with the "folder" and "archived" query parameters, and the pinned chats
+// of the first page are rendered in their own section above the other chats.
 func (m Main) HandleHome(w http.ResponseWriter, r *http.Request) {
-	cs, err := m.store.Chats(r.Context())
+	filter := chatsFilterFromRequest(r)
+	cs, nextChatsCursor, err := m.store.ChatsPage(r.Context(), filter.chatsQuery(""))
 	if err != nil {
 		m.logger.Error("Failed to get chats", slog.String(errLoggerKey, err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// We transform the store's chat data into our view-specific chat structs
-	// to avoid exposing internal implementation details to the template
-	chats := make([]chat, len(cs))
+	folders, err := m.store.Folders(r.Context())
+	if err != nil {
+		m.logger.Error("Failed to get folders", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var pinnedChats, chats []chat
 	for i := range cs {
-		chats[i] = chat{
-			ID:     cs[i].ID,
-			Title:  cs[i].Title,
-			Active: false,
+		if cs[i].Pinned {
+			pinnedChats = append(pinnedChats, chatView(cs[i], filter))
+			continue
 		}
+		chats = append(chats, chatView(cs[i], filter))
 	}
 
 	currentChatID := ""
-	var messages []message
+	currentLLMProfile := ""
+	currentModel := ""
+	currentPersonaID := ""
+	var currentParameters models.LLMParameters
+	messageList := messageListData{}
 	if chatID := r.URL.Query().Get("chat_id"); chatID != "" {
-		// We find and mark the currently selected chat as active for UI highlighting
-		idx := slices.IndexFunc(chats, func(c chat) bool {
-			return c.ID == chatID
-		})
+		ch, err := m.store.Chat(r.Context(), chatID)
+		if err != nil {
+			m.logger.Error("Failed to get chat", slog.String(errLoggerKey, err.Error()))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		// Only proceed if the chat was found
-		if idx >= 0 {
-			currentChatID = chatID
-			chats[idx].Active = true
+		if ch.ID != "" {
+			currentChatID = ch.ID
+			currentLLMProfile = ch.LLMProfile
+			currentModel = ch.Model
+			currentPersonaID = ch.PersonaID
+			currentParameters = ch.Parameters
+
+			// We mark the currently selected chat as active for UI highlighting, if it's in the first page
+			for _, list := range [][]chat{pinnedChats, chats} {
+				if idx := slices.IndexFunc(list, func(c chat) bool {
+					return c.ID == ch.ID
+				}); idx >= 0 {
+					list[idx].Active = true
+				}
+			}
 
-			// We fetch and transform messages for the selected chat,
-			// setting initial streaming state to "ended" for all messages
-			ms, err := m.store.Messages(r.Context(), currentChatID)
+			// When jumping to a message, e.g. from the search results, we load pages until the
+			// message is rendered, so the browser can scroll to it.
+			messageList, err = m.messageList(r, currentChatID, "", r.URL.Query().Get("message_id"))
 			if err != nil {
 				m.logger.Error("Failed to get messages", slog.String(errLoggerKey, err.Error()))
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			messages = make([]message, len(ms))
-			for i := range ms {
-				rc, err := models.RenderContents(ms[i].Contents)
-				if err != nil {
-					m.logger.Error("Failed to render contents",
-						slog.String("message", fmt.Sprintf("%+v", ms[i])),
-						slog.String(errLoggerKey, err.Error()))
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				m.logger.Debug("Render contents",
-					slog.String("origMsg", fmt.Sprintf("%+v", ms[i].Contents)),
-					slog.String("renderedMsg", rc))
-				messages[i] = message{
-					ID:             ms[i].ID,
-					Role:           string(ms[i].Role),
-					Content:        rc,
-					Timestamp:      ms[i].Timestamp,
-					StreamingState: "ended",
-				}
-			}
 		}
 	}
+	personas, err := m.personasData(r.Context(), currentPersonaID)
+	if err != nil {
+		m.logger.Error("Failed to get personas", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	data := homePageData{
-		Chats:         chats,
-		Messages:      messages,
+		PinnedChats: pinnedChats,
+		ChatList: chatListData{
+			Chats:       chats,
+			NextCursor:  nextChatsCursor,
+			FilterQuery: filter.query(),
+		},
+		MessageList:   messageList,
 		CurrentChatID: currentChatID,
+		Filter:        filter,
+		Folders:       folders,
+		LLMProfiles:   m.llmProfilesData(r.Context(), currentLLMProfile, currentModel),
+		ManagedModels: slices.ContainsFunc(m.llmProfiles, func(p LLMProfile) bool { return p.Models != nil }),
+		Personas:      personas,
+		Parameters:    currentParameters,
 		Servers:       m.servers,
 		Tools:         m.tools,
 		Resources:     m.resources,
@@ -104,6 +239,127 @@ func (m Main) HandleHome(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// HandleChatList renders the next page of chats for the sidebar. It expects a "cursor" query parameter
+// holding the cursor of the previously rendered page, along with the filter of the chat list. The
+// rendered page ends with a placeholder that requests the following page once it's scrolled into view,
+// until there are no chats left.
+func (m Main) HandleChatList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := chatsFilterFromRequest(r)
+	cs, nextCursor, err := m.store.ChatsPage(r.Context(), filter.chatsQuery(r.URL.Query().Get("cursor")))
+	if err != nil {
+		m.logger.Error("Failed to get chats", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	chats := make([]chat, len(cs))
+	for i := range cs {
+		chats[i] = chatView(cs[i], filter)
+	}
+
+	data := chatListData{
+		Chats:       chats,
+		NextCursor:  nextCursor,
+		FilterQuery: filter.query(),
+	}
+	if err := m.templates.ExecuteTemplate(w, "chat_list", data); err != nil {
+		m.logger.Error("Failed to execute chat_list template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleMessages renders the page of messages that precedes the given cursor in a chat. It expects the
+// "chat_id" and "cursor" query parameters. The rendered page starts with a placeholder that requests
+// the preceding page once it's scrolled into view, until the first message of the chat is rendered.
+func (m Main) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.URL.Query().Get("chat_id")
+	if chatID == "" {
+		m.logger.Error("Chat ID is required")
+		http.Error(w, "Chat ID is required", http.StatusBadRequest)
+		return
+	}
+
+	data, err := m.messageList(r, chatID, r.URL.Query().Get("cursor"), "")
+	if err != nil {
+		m.logger.Error("Failed to get messages",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "message_list", data); err != nil {
+		m.logger.Error("Failed to execute message_list template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// messageList retrieves and renders a page of messages of the chat, setting the streaming state of all
+// the messages to "ended". If untilMessageID is not empty, preceding pages are retrieved as well until
+// the page containing that message.
+func (m Main) messageList(r *http.Request, chatID, cursor, untilMessageID string) (messageListData, error) {
+	var ms []models.Message
+	nextCursor := cursor
+	for {
+		page, next, err := m.store.MessagesPage(r.Context(), chatID, models.MessagesQuery{
+			Cursor: nextCursor,
+			Limit:  messagesPageSize,
+		})
+		if err != nil {
+			return messageListData{}, fmt.Errorf("failed to get messages: %w", err)
+		}
+		ms = append(page, ms...)
+		nextCursor = next
+
+		if untilMessageID == "" || nextCursor == "" || slices.ContainsFunc(page, func(msg models.Message) bool {
+			return msg.ID == untilMessageID
+		}) {
+			break
+		}
+	}
+
+	messages := make([]message, len(ms))
+	for i := range ms {
+		rc, err := models.RenderContents(ms[i].Contents)
+		if err != nil {
+			return messageListData{}, fmt.Errorf("failed to render contents of message %s: %w", ms[i].ID, err)
+		}
+		m.logger.Debug("Render contents",
+			slog.String("origMsg", fmt.Sprintf("%+v", ms[i].Contents)),
+			slog.String("renderedMsg", rc))
+		messages[i] = message{
+			ID:             ms[i].ID,
+			Role:           string(ms[i].Role),
+			Content:        rc,
+			Timestamp:      ms[i].Timestamp,
+			Usage:          ms[i].Usage,
+			ContextTrim:    ms[i].ContextTrim,
+			FallbackLLM:    ms[i].FallbackLLM,
+			Error:          ms[i].Error,
+			Finish:         ms[i].Finish,
+			StreamingState: "ended",
+		}
+	}
+
+	return messageListData{
+		ChatID:     chatID,
+		Messages:   messages,
+		NextCursor: nextCursor,
+	}, nil
+}
+
 // HandleSSE serves Server-Sent Events (SSE) requests by delegating to the underlying SSE server.
 // This endpoint enables real-time updates for the client.
 func (m Main) HandleSSE(w http.ResponseWriter, r *http.Request) {
@@ -16,8 +16,40 @@ import (
 
 // LLM represents a large language model interface that provides chat functionality. It accepts a context
 // and a sequence of messages, returning an iterator that yields response chunks and potential errors.
+//
+// The options hold the system prompt and parameters of the chat, e.g. from its persona, which take
+// precedence over the configuration of the LLM.
 type LLM interface {
-	Chat(ctx context.Context, messages []models.Message, tools []mcp.Tool) iter.Seq2[models.Content, error]
+	Chat(
+		ctx context.Context,
+		messages []models.Message,
+		tools []mcp.Tool,
+		opts models.ChatOptions,
+	) iter.Seq2[models.Content, error]
+}
+
+// LLMProfile is a named LLM that users can select to send a chat to, instead of the default LLM.
+type LLMProfile struct {
+	Name string
+	LLM  LLM
+	// Price estimates the cost of the LLM calls whose cost isn't reported by the LLM itself.
+	Price models.Price
+	// ContextWindow is the maximum number of tokens of the LLM calls, including the answer. The chats
+	// that don't fit in it are trimmed before being sent to the LLM. Zero sends the chats as is.
+	ContextWindow int
+	// Models manages the local models of the LLM server, if they can be managed from the UI, e.g. with
+	// Ollama. The chats sent to the profile can then select one of its models instead of the configured
+	// one. It's nil for the other LLMs.
+	Models ModelManager
+}
+
+// ModelManager manages the models of an LLM server that runs the models locally, such as Ollama. Models
+// lists the models available on the server, ModelDetails reads the metadata of one of them, and PullModel
+// downloads a model to the server, returning an iterator over the progress of the download.
+type ModelManager interface {
+	Models(ctx context.Context) ([]models.LocalModel, error)
+	ModelDetails(ctx context.Context, name string) (models.LocalModelDetails, error)
+	PullModel(ctx context.Context, name string) iter.Seq2[models.PullProgress, error]
 }
 
 // TitleGenerator represents a title generator interface that generates a title for a given message.
@@ -28,14 +60,44 @@ type TitleGenerator interface {
 // Store defines the interface for managing chat and message persistence. It provides methods for
 // creating, reading, and updating chats and their associated messages. The interface supports both
 // atomic operations and bulk retrieval of chats and messages.
+//
+// ChatsPage and MessagesPage provide cursor-based pagination, so the UI can load chats and messages
+// lazily instead of retrieving everything on each page load. Chat returns a zero models.Chat if the
+// chat doesn't exist.
+//
+// The implementation is expected to maintain the UpdatedAt of a chat when a message is added to it, as
+// the chat list is sorted by the last activity. Folders returns the folders that contain at least one
+// chat, to filter the chat list by.
+//
+// ChatUsage returns the sum of the usages of the messages of a chat, and UsageByChat returns the
+// same sum for every chat with a non-zero usage, from the most expensive one.
+//
+// Personas returns the personas created from the UI, sorted by name, and SavePersona adds a persona or
+// replaces the persona with the same ID.
+//
+// SearchChats performs a full-text search over chat titles, message texts and called tool names, and
+// the implementation is expected to keep its search index up to date on every write operation.
 type Store interface {
 	Chats(ctx context.Context) ([]models.Chat, error)
+	Chat(ctx context.Context, chatID string) (models.Chat, error)
+	ChatsPage(ctx context.Context, query models.ChatsQuery) ([]models.Chat, string, error)
 	AddChat(ctx context.Context, chat models.Chat) (string, error)
 	UpdateChat(ctx context.Context, chat models.Chat) error
+	Folders(ctx context.Context) ([]string, error)
 
 	Messages(ctx context.Context, chatID string) ([]models.Message, error)
+	MessagesPage(ctx context.Context, chatID string, query models.MessagesQuery) ([]models.Message, string, error)
 	AddMessage(ctx context.Context, chatID string, message models.Message) (string, error)
 	UpdateMessage(ctx context.Context, chatID string, message models.Message) error
+
+	ChatUsage(ctx context.Context, chatID string) (models.Usage, error)
+	UsageByChat(ctx context.Context) ([]models.ChatUsage, error)
+
+	Personas(ctx context.Context) ([]models.Persona, error)
+	SavePersona(ctx context.Context, persona models.Persona) error
+	DeletePersona(ctx context.Context, personaID string) error
+
+	SearchChats(ctx context.Context, query string, limit int) ([]models.SearchResult, error)
 }
 
 // MCPClient defines the interface for interacting with an MCP server.
@@ -57,10 +119,14 @@ type MCPClient interface {
 // HTML templates, and interactions between the LLM and Store components.
 type Main struct {
 	sseSrv    *sse.Server
+	sseShared bool
 	templates *template.Template
 
 	llm            LLM
+	llmProfiles    []LLMProfile
+	personas       []models.Persona
 	titleGenerator TitleGenerator
+	summarizer     LLM
 	store          Store
 
 	mcpClients []MCPClient
@@ -76,11 +142,45 @@ type Main struct {
 	logger       *slog.Logger
 }
 
+// MainOption configures the optional behaviors of Main.
+type MainOption func(*Main)
+
 const (
 	chatsSSETopic = "chats"
 	errLoggerKey  = "err"
 )
 
+// WithSSEProvider sets the provider the SSE server publishes messages through, instead of the default
+// in-memory one. It's used to share the SSE topics between several replicas of the server, so a
+// message published by one replica reaches the clients connected to the others.
+func WithSSEProvider(provider sse.Provider) MainOption {
+	return func(m *Main) {
+		m.sseSrv.Provider = provider
+		m.sseShared = true
+	}
+}
+
+// WithLLMProfiles sets the LLM profiles users can select for each chat. The first profile is the one
+// selected by default, so it's expected to hold the LLM given to NewMain. Chats without a profile, or
+// with a profile that is no longer available, are sent to the first profile.
+func WithLLMProfiles(profiles ...LLMProfile) MainOption {
+	return func(m *Main) {
+		m.llmProfiles = profiles
+	}
+}
+
+// WithPersonas sets the personas defined in the configuration, which are listed before the personas
+// created from the UI, and can't be deleted from the UI.
+func WithPersonas(personas ...models.Persona) MainOption {
+	return func(m *Main) {
+		m.personas = make([]models.Persona, len(personas))
+		for i, p := range personas {
+			p.ReadOnly = true
+			m.personas[i] = p
+		}
+	}
+}
+
 // NewMain creates a new Main instance with the provided LLM and Store implementations. It initializes
 // the SSE server with default configurations and parses the required HTML templates from the embedded
 // filesystem. The SSE server is configured to handle both default events and chat-specific topics.
@@ -90,6 +190,7 @@ func NewMain(
 	store Store,
 	mcpClients []MCPClient,
 	logger *slog.Logger,
+	opts ...MainOption,
 ) (Main, error) {
 	// We parse templates from three distinct directories to separate layout, pages, and partial views
 	tmpl, err := template.ParseFS(
@@ -154,17 +255,23 @@ func NewMain(
 		prompts = append(prompts, ps...)
 	}
 
-	return Main{
+	m := Main{
 		sseSrv: &sse.Server{
 			OnSession: func(s *sse.Session) (sse.Subscription, bool) {
-				// We start with default topics that all clients should subscribe to
-				topics := []string{sse.DefaultTopic, chatsSSETopic}
+				// We start with default topics that all clients should subscribe to, the chats topic depends
+				// on the filter of the chat list displayed by the client.
+				topics := []string{sse.DefaultTopic, chatsFilterFromRequest(s.Req).topic()}
 
 				// We create a message-specific topic if the client requests updates for a particular message
 				messageID := s.Req.URL.Query().Get("message_id")
 				if messageID != "" {
 					topics = append(topics, messageIDTopic(messageID))
 				}
+				// And for the progress of a model pull.
+				pullID := s.Req.URL.Query().Get("pull_id")
+				if pullID != "" {
+					topics = append(topics, pullIDTopic(pullID))
+				}
 
 				return sse.Subscription{
 					Client:      s,
@@ -186,23 +293,36 @@ func NewMain(
 		tools:          tools,
 		resources:      resources,
 		prompts:        prompts,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return m, nil
 }
 
 func messageIDTopic(messageID string) string {
 	return fmt.Sprintf("message-%s", messageID)
 }
 
+func pullIDTopic(pullID string) string {
+	return fmt.Sprintf("pull-%s", pullID)
+}
+
 // Shutdown gracefully terminates the Main instance's SSE server. It broadcasts a close message to all
 // connected clients and waits up to 5 seconds for connections to terminate. After the timeout, any
 // remaining connections are forcefully closed.
+//
+// With a shared SSE provider, the close message would also reach the clients of the other replicas, so
+// it isn't sent, and the clients reconnect to another replica once their connections are closed.
 func (m Main) Shutdown(ctx context.Context) error {
-	e := &sse.Message{Type: sse.Type("closeChat")}
-	// We create a close event that complies with SSE spec requiring data
-	e.AppendData("bye")
+	if !m.sseShared {
+		e := &sse.Message{Type: sse.Type("closeChat")}
+		// We create a close event that complies with SSE spec requiring data
+		e.AppendData("bye")
 
-	// We ignore the error here since we're shutting down anyway
-	_ = m.sseSrv.Publish(e)
+		// We ignore the error here since we're shutting down anyway
+		_ = m.sseSrv.Publish(e)
+	}
 
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
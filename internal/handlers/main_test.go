@@ -1,32 +1,56 @@
 package handlers_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"iter"
 	"log/slog"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/MegaGrindStone/go-mcp"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/handlers"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/services"
 )
 
 type mockLLM struct {
+	// contents are yielded before the responses.
+	contents  []models.Content
 	responses []string
 	err       error
+	// opts receives the options of each Chat call, if set.
+	opts chan models.ChatOptions
+	// usage is yielded after the responses, if set.
+	usage *models.Usage
+	// messages receives the messages of each Chat call, if set.
+	messages chan []models.Message
+	// finish is yielded last, if set.
+	finish *models.Finish
+}
+
+type mockModelManager struct {
+	models []models.LocalModel
+	err    error
 }
 
 type mockStore struct {
 	sync.Mutex
 	chats    []models.Chat
 	messages map[string][]models.Message
+	personas []models.Persona
 	err      error
 }
 
@@ -130,6 +154,172 @@ func TestHandleHome(t *testing.T) {
 	}
 }
 
+func TestHandleChatList(t *testing.T) {
+	llm := &mockLLM{}
+	chats := make([]models.Chat, 45)
+	for i := range chats {
+		chats[i] = models.Chat{ID: fmt.Sprintf("chat-%d", i), Title: fmt.Sprintf("Chat %d", i)}
+	}
+	store := &mockStore{chats: chats}
+	mcpClient := &mockMCPClient{
+		serverInfo: mcp.Info{
+			Name: "Test Server",
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		wantStatus    int
+		wantContains  []string
+		wantNotExists []string
+	}{
+		{
+			name:       "Invalid method",
+			method:     http.MethodPost,
+			url:        "/chats/list",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:          "First page",
+			method:        http.MethodGet,
+			url:           "/chats/list",
+			wantStatus:    http.StatusOK,
+			wantContains:  []string{"Chat 0", "Chat 29", "/chats/list?cursor=chat-29"},
+			wantNotExists: []string{"Chat 30"},
+		},
+		{
+			name:          "Last page",
+			method:        http.MethodGet,
+			url:           "/chats/list?cursor=chat-29",
+			wantStatus:    http.StatusOK,
+			wantContains:  []string{"Chat 30", "Chat 44"},
+			wantNotExists: []string{"Chat 29<", "/chats/list?cursor="},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			w := httptest.NewRecorder()
+
+			main.HandleChatList(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleChatList() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			for _, want := range tt.wantContains {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("HandleChatList() body = %v, want to contain %v", w.Body.String(), want)
+				}
+			}
+			for _, notWant := range tt.wantNotExists {
+				if strings.Contains(w.Body.String(), notWant) {
+					t.Errorf("HandleChatList() body = %v, want not to contain %v", w.Body.String(), notWant)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleMessages(t *testing.T) {
+	llm := &mockLLM{}
+	messages := make([]models.Message, 25)
+	for i := range messages {
+		messages[i] = models.Message{
+			ID:   fmt.Sprintf("msg-%d", i),
+			Role: models.RoleUser,
+			Contents: []models.Content{
+				{
+					Type: models.ContentTypeText,
+					Text: fmt.Sprintf("Message number %d", i),
+				},
+			},
+		}
+	}
+	store := &mockStore{
+		chats:    []models.Chat{{ID: "1", Title: "Test Chat"}},
+		messages: map[string][]models.Message{"1": messages},
+	}
+	mcpClient := &mockMCPClient{
+		serverInfo: mcp.Info{
+			Name: "Test Server",
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		wantStatus    int
+		wantContains  []string
+		wantNotExists []string
+	}{
+		{
+			name:       "Invalid method",
+			method:     http.MethodPost,
+			url:        "/messages?chat_id=1",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "Missing chat_id",
+			method:     http.MethodGet,
+			url:        "/messages",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:          "Latest page",
+			method:        http.MethodGet,
+			url:           "/messages?chat_id=1",
+			wantStatus:    http.StatusOK,
+			wantContains:  []string{"Message number 5", "Message number 24", "cursor=msg-5"},
+			wantNotExists: []string{"Message number 4<"},
+		},
+		{
+			name:          "Oldest page",
+			method:        http.MethodGet,
+			url:           "/messages?chat_id=1&cursor=msg-5",
+			wantStatus:    http.StatusOK,
+			wantContains:  []string{"Message number 0", "Message number 4"},
+			wantNotExists: []string{"Message number 5<", "cursor="},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			w := httptest.NewRecorder()
+
+			main.HandleMessages(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleMessages() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			for _, want := range tt.wantContains {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("HandleMessages() body = %v, want to contain %v", w.Body.String(), want)
+				}
+			}
+			for _, notWant := range tt.wantNotExists {
+				if strings.Contains(w.Body.String(), notWant) {
+					t.Errorf("HandleMessages() body = %v, want not to contain %v", w.Body.String(), notWant)
+				}
+			}
+		})
+	}
+}
+
 func TestHandleChats(t *testing.T) {
 	llm := &mockLLM{responses: []string{"AI response"}}
 	store := &mockStore{
@@ -236,6 +426,18 @@ func TestHandleChats(t *testing.T) {
 			formData:   "message=Hello&chat_id=1",
 			wantStatus: http.StatusOK,
 		},
+		{
+			name:       "Unknown LLM profile",
+			method:     http.MethodPost,
+			formData:   "message=Hello&llm_profile=unknown",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Unknown persona",
+			method:     http.MethodPost,
+			formData:   "message=Hello&persona_id=unknown",
+			wantStatus: http.StatusBadRequest,
+		},
 		// Testing prompt functionality
 		{
 			name:       "Invalid prompt arguments",
@@ -377,193 +579,1747 @@ func TestHandleChats(t *testing.T) {
 	}
 }
 
-func TestHandleRefreshTitle(t *testing.T) {
-	// Test success case first
-	t.Run("Success", func(t *testing.T) {
-		llm := &mockLLM{}
-		store := &mockStore{
-			chats: []models.Chat{
-				{ID: "1", Title: "Old Title"},
-			},
-			messages: map[string][]models.Message{
-				"1": {
-					{
-						ID:   "msg1",
-						Role: models.RoleUser,
-						Contents: []models.Content{
-							{
-								Type: models.ContentTypeText,
-								Text: "First user message",
-							},
-						},
-					},
-				},
-			},
-		}
-		mcpClient := &mockMCPClient{
-			serverInfo: mcp.Info{
-				Name: "Test Server",
-			},
-		}
+func TestHandleChatsLLMProfile(t *testing.T) {
+	defaultLLM := &mockLLM{responses: []string{"Default response"}}
+	localLLM := &mockLLM{responses: []string{"Local response"}}
+	store := &mockStore{
+		messages: map[string][]models.Message{},
+	}
 
-		main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
-		if err != nil {
-			t.Fatal(err)
-		}
+	main, err := handlers.NewMain(defaultLLM, defaultLLM, store, []handlers.MCPClient{}, slog.Default(),
+		handlers.WithLLMProfiles(
+			handlers.LLMProfile{Name: "Default", LLM: defaultLLM},
+			handlers.LLMProfile{Name: "Local", LLM: localLLM},
+		))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		form := strings.NewReader("chat_id=1")
-		req := httptest.NewRequest(http.MethodPost, "/refresh-title", form)
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&llm_profile=Local"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
 
-		main.HandleRefreshTitle(w, req)
+	main.HandleChats(w, req)
 
-		if w.Code != http.StatusOK {
-			t.Errorf("HandleRefreshTitle() status = %v, want %v", w.Code, http.StatusOK)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), `<option value="Local" selected>`) {
+		t.Errorf("HandleChats() body doesn't select the Local profile: %s", w.Body.String())
+	}
+
+	chats, err := store.Chats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 1 || chats[0].LLMProfile != "Local" {
+		t.Fatalf("HandleChats() chats = %+v, want one chat with the Local profile", chats)
+	}
+
+	// Selecting another profile for the existing chat saves it on the chat.
+	form := url.Values{"message": {"Hello again"}, "chat_id": {chats[0].ID}, "llm_profile": {"Default"}}
+	req = httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	ch, err := store.Chat(context.Background(), chats[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.LLMProfile != "Default" {
+		t.Errorf("HandleChats() chat profile = %s, want Default", ch.LLMProfile)
+	}
+}
+
+func TestHandleModels(t *testing.T) {
+	defaultLLM := &mockLLM{responses: []string{"Default response"}}
+	localLLM := &mockLLM{responses: []string{"Local response"}, opts: make(chan models.ChatOptions, 1)}
+	manager := &mockModelManager{models: []models.LocalModel{
+		{Name: "llama3.2", Size: 2e9, ParameterSize: "3.2B", QuantizationLevel: "Q4_K_M"},
+		{Name: "qwen3", Size: 5e9, ParameterSize: "8.2B", QuantizationLevel: "Q4_K_M"},
+	}}
+	store := &mockStore{
+		messages: map[string][]models.Message{},
+	}
+
+	main, err := handlers.NewMain(defaultLLM, defaultLLM, store, []handlers.MCPClient{}, slog.Default(),
+		handlers.WithLLMProfiles(
+			handlers.LLMProfile{Name: "Default", LLM: defaultLLM},
+			handlers.LLMProfile{Name: "Local", LLM: localLLM, Models: manager},
+		))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/models", nil)
+	w := httptest.NewRecorder()
+
+	main.HandleModels(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleModels() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	for _, want := range []string{"llama3.2", "qwen3", "5.0 GB"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("HandleModels() body doesn't contain %q: %s", want, w.Body.String())
 		}
+	}
 
-		if !strings.Contains(w.Body.String(), "Test Chat") {
-			t.Errorf("HandleRefreshTitle() body = %v, want to contain %v", w.Body.String(), "Test Chat")
+	// The local models are selected as the model of the chat, and sent to the LLM of their profile.
+	form := url.Values{"message": {"Hello"}, "llm_profile": {"Local|qwen3"}}
+	req = httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), `<option value="Local|qwen3" selected>`) {
+		t.Errorf("HandleChats() body doesn't select the qwen3 model: %s", w.Body.String())
+	}
+
+	select {
+	case opts := <-localLLM.opts:
+		if opts.Model != "qwen3" {
+			t.Errorf("Chat() model = %q, want qwen3", opts.Model)
 		}
+	case <-time.After(time.Second):
+		t.Fatal("Chat() wasn't called")
+	}
 
-		// Verify chat title was updated
-		if store.chats[0].Title != "Test Chat" {
-			t.Errorf("Chat title not updated, got %s, want %s", store.chats[0].Title, "Test Chat")
+	chats, err := store.Chats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 1 || chats[0].LLMProfile != "Local" || chats[0].Model != "qwen3" {
+		t.Fatalf("HandleChats() chats = %+v, want one chat with the qwen3 model of the Local profile", chats)
+	}
+
+	// The models can't be pulled to the profiles whose models aren't managed from the UI.
+	form = url.Values{"profile": {"Default"}, "model": {"llama3.2"}}
+	req = httptest.NewRequest(http.MethodPost, "/models/pull", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+
+	main.HandlePullModel(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("HandlePullModel() status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleChatsPersona(t *testing.T) {
+	llm := &mockLLM{responses: []string{"Arr"}, opts: make(chan models.ChatOptions, 1)}
+	store := &mockStore{
+		messages: map[string][]models.Message{},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default(),
+		handlers.WithPersonas(models.Persona{ID: "pirate", Name: "Pirate", SystemPrompt: "Talk like a pirate."}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&persona_id=pirate"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), `<option value="pirate" selected>`) {
+		t.Errorf("HandleChats() body doesn't select the Pirate persona: %s", w.Body.String())
+	}
+
+	select {
+	case opts := <-llm.opts:
+		if opts.SystemPrompt != "Talk like a pirate." {
+			t.Errorf("Chat() system prompt = %q, want the persona system prompt", opts.SystemPrompt)
 		}
-	})
+	case <-time.After(time.Second):
+		t.Fatal("Chat() wasn't called")
+	}
 
-	// Test various error cases
-	tests := []struct {
-		name        string
-		method      string
-		chatID      string
-		messages    map[string][]models.Message
-		err         error
-		titleGenErr bool
-		wantStatus  int
-	}{
-		{
-			name:       "Invalid method",
-			method:     http.MethodGet,
-			chatID:     "1",
-			wantStatus: http.StatusMethodNotAllowed,
+	chats, err := store.Chats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 1 || chats[0].PersonaID != "pirate" {
+		t.Fatalf("HandleChats() chats = %+v, want one chat with the Pirate persona", chats)
+	}
+}
+
+func TestHandleChatParameters(t *testing.T) {
+	llm := &mockLLM{responses: []string{"Hi"}, opts: make(chan models.ChatOptions, 1)}
+	temperature := float32(0.9)
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Test Chat", PersonaID: "pirate"}},
+		messages: map[string][]models.Message{
+			"1": {},
 		},
-		{
-			name:       "Missing chat_id",
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default(),
+		handlers.WithPersonas(models.Persona{
+			ID:         "pirate",
+			Name:       "Pirate",
+			Parameters: models.LLMParameters{Temperature: &temperature, Stop: []string{"Arr"}},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		formData   string
+		wantStatus int
+	}{
+		{
+			name:       "Invalid method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "Missing chat ID",
+			method:     http.MethodPost,
+			formData:   "temperature=0.1",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Invalid parameter",
+			method:     http.MethodPost,
+			formData:   "chat_id=1&max_tokens=many",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Chat not found",
+			method:     http.MethodPost,
+			formData:   "chat_id=unknown&temperature=0.1",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Set parameters",
+			method:     http.MethodPost,
+			formData:   "chat_id=1&temperature=0.1&max_tokens=256",
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/chats/parameters", strings.NewReader(tt.formData))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			main.HandleChatParameters(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleChatParameters() status = %v, want %v: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+
+	// The parameters of the chat are merged over the parameters of its persona.
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	select {
+	case opts := <-llm.opts:
+		params := opts.Parameters
+		if params.Temperature == nil || *params.Temperature != 0.1 {
+			t.Errorf("Chat() temperature = %v, want the chat temperature", params.Temperature)
+		}
+		if params.MaxTokens == nil || *params.MaxTokens != 256 {
+			t.Errorf("Chat() max tokens = %v, want the chat max tokens", params.MaxTokens)
+		}
+		if !slices.Equal(params.Stop, []string{"Arr"}) {
+			t.Errorf("Chat() stop = %v, want the persona stop sequences", params.Stop)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Chat() wasn't called")
+	}
+}
+
+func TestHandlePersonas(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockStore{
+		personas: []models.Persona{{ID: "stored", Name: "Stored"}},
+	}
+	mcpClient := &mockMCPClient{
+		serverInfo:          mcp.Info{Name: "Test Server"},
+		toolServerSupported: true,
+		tools:               []mcp.Tool{{Name: "search"}},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default(),
+		handlers.WithPersonas(models.Persona{ID: "config:Pirate", Name: "Pirate"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		formData   string
+		wantStatus int
+	}{
+		{
+			name:       "Invalid method",
+			method:     http.MethodGet,
+			url:        "/personas",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "Missing name",
+			method:     http.MethodPost,
+			url:        "/personas",
+			formData:   "system_prompt=Hi",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Unknown tool",
+			method:     http.MethodPost,
+			url:        "/personas",
+			formData:   "name=Coder&tools=unknown",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Invalid parameter",
+			method:     http.MethodPost,
+			url:        "/personas",
+			formData:   "name=Coder&temperature=hot",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Create persona",
+			method:     http.MethodPost,
+			url:        "/personas",
+			formData:   "name=Coder&system_prompt=Write+Go.&tools=search&temperature=0.2&stop=END",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "Delete unknown persona",
+			method:     http.MethodPost,
+			url:        "/personas/delete",
+			formData:   "persona_id=unknown",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Delete config persona",
+			method:     http.MethodPost,
+			url:        "/personas/delete",
+			formData:   "persona_id=config:Pirate",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Delete stored persona",
+			method:     http.MethodPost,
+			url:        "/personas/delete",
+			formData:   "persona_id=stored",
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.formData))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			if tt.url == "/personas" {
+				main.HandlePersonas(w, req)
+			} else {
+				main.HandleDeletePersona(w, req)
+			}
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+
+	personas, err := store.Personas(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(personas) != 1 {
+		t.Fatalf("Personas() = %+v, want only the created persona", personas)
+	}
+	p := personas[0]
+	if p.Name != "Coder" || p.SystemPrompt != "Write Go." || !slices.Equal(p.Tools, []string{"search"}) ||
+		p.Parameters.Temperature == nil || *p.Parameters.Temperature != 0.2 ||
+		!slices.Equal(p.Parameters.Stop, []string{"END"}) {
+		t.Errorf("Personas() = %+v, want the created Coder persona", p)
+	}
+}
+
+func TestHandleChatsUsage(t *testing.T) {
+	llm := &mockLLM{
+		responses: []string{"Hi"},
+		usage:     &models.Usage{InputTokens: 1000, OutputTokens: 1000},
+	}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Priced Chat"}},
+		messages: map[string][]models.Message{
+			"1": {},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default(),
+		handlers.WithLLMProfiles(handlers.LLMProfile{
+			Name:  "Default",
+			LLM:   llm,
+			Price: models.Price{Input: 3, Output: 15},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	// The usage is saved on the AI message once the LLM stream ends.
+	wantUsage := models.Usage{InputTokens: 1000, OutputTokens: 1000, Cost: 0.018}
+	deadline := time.Now().Add(time.Second)
+	for {
+		usage, err := store.ChatUsage(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage == wantUsage {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ChatUsage() = %+v, want %+v", usage, wantUsage)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("Chat usage", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/chats/usage?chat_id=1", nil)
+		w := httptest.NewRecorder()
+
+		main.HandleChatUsage(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("HandleChatUsage() status = %v, want %v", w.Code, http.StatusOK)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "1000 in / 1000 out") || !strings.Contains(body, "$0.0180") {
+			t.Errorf("HandleChatUsage() body = %s, want the chat usage and cost", body)
+		}
+	})
+
+	t.Run("Missing chat ID", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/chats/usage", nil)
+		w := httptest.NewRecorder()
+
+		main.HandleChatUsage(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("HandleChatUsage() status = %v, want %v", w.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Dashboard", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/usage", nil)
+		w := httptest.NewRecorder()
+
+		main.HandleUsage(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("HandleUsage() status = %v, want %v", w.Code, http.StatusOK)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "Priced Chat") || !strings.Contains(body, "$0.0180") {
+			t.Errorf("HandleUsage() body = %s, want the usage of the chat", body)
+		}
+	})
+}
+
+func TestHandleChatsPromptCacheUsage(t *testing.T) {
+	llm := &mockLLM{
+		responses: []string{"Hi"},
+		usage:     &models.Usage{InputTokens: 1000, CacheReadTokens: 800},
+	}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Cached Chat"}},
+		messages: map[string][]models.Message{
+			"1": {},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default(),
+		handlers.WithLLMProfiles(handlers.LLMProfile{
+			Name:  "Default",
+			LLM:   llm,
+			Price: models.Price{Input: 3, Output: 15, CacheRead: 0.3},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	// The cached input tokens are priced at the cache read price.
+	wantUsage := models.Usage{InputTokens: 1000, CacheReadTokens: 800, Cost: 0.00084}
+	deadline := time.Now().Add(time.Second)
+	for {
+		usage, err := store.ChatUsage(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.InputTokens == wantUsage.InputTokens && usage.CacheReadTokens == wantUsage.CacheReadTokens &&
+			math.Abs(usage.Cost-wantUsage.Cost) < 1e-9 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ChatUsage() = %+v, want %+v", usage, wantUsage)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/chats/usage?chat_id=1", nil)
+	w = httptest.NewRecorder()
+
+	main.HandleChatUsage(w, req)
+
+	if body := w.Body.String(); !strings.Contains(body, "(800 cached)") {
+		t.Errorf("HandleChatUsage() body = %s, want the cached input tokens", body)
+	}
+}
+
+func TestHandleChatsThinking(t *testing.T) {
+	llm := &mockLLM{
+		contents: []models.Content{
+			{Type: models.ContentTypeThinking, Text: "Let me"},
+			{Type: models.ContentTypeThinking, Text: " think"},
+			{Type: models.ContentTypeThinking, ThinkingSignature: "signature"},
+			{Type: models.ContentTypeThinking, RedactedThinking: "redacted"},
+		},
+		responses: []string{"The ", "answer"},
+	}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Thinking Chat"}},
+		messages: map[string][]models.Message{
+			"1": {},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	want := []models.Content{
+		{Type: models.ContentTypeThinking, Text: "Let me think", ThinkingSignature: "signature"},
+		{Type: models.ContentTypeThinking, RedactedThinking: "redacted"},
+		{Type: models.ContentTypeText, Text: "The answer"},
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		msgs, err := store.Messages(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 2 && reflect.DeepEqual(msgs[1].Contents, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages() AI message = %+v, want contents %+v", msgs[len(msgs)-1], want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleChatsStatus(t *testing.T) {
+	llm := &mockLLM{
+		contents: []models.Content{
+			{Type: models.ContentTypeStatus, Text: "Mock is unavailable, retrying in 1s (attempt 1 of 3)…"},
+		},
+		responses: []string{"The ", "answer"},
+	}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Status Chat"}},
+		messages: map[string][]models.Message{
+			"1": {},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	// The status isn't stored with the message.
+	want := []models.Content{
+		{Type: models.ContentTypeText, Text: "The answer"},
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		msgs, err := store.Messages(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 2 && reflect.DeepEqual(msgs[1].Contents, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages() AI message = %+v, want contents %+v", msgs[len(msgs)-1], want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleChatsFallback(t *testing.T) {
+	llm := &mockLLM{
+		contents: []models.Content{
+			{Type: models.ContentTypeStatus, Text: "Primary failed (HTTP 529 Overloaded), falling back to Backup…"},
+			{Type: models.ContentTypeFallback, Text: "Backup"},
+		},
+		responses: []string{"Hi"},
+		usage:     &models.Usage{InputTokens: 1000, OutputTokens: 100},
+	}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Fallback Chat"}},
+		messages: map[string][]models.Message{
+			"1": {},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default(),
+		handlers.WithLLMProfiles(
+			handlers.LLMProfile{Name: "Primary", LLM: llm, Price: models.Price{Input: 3, Output: 15}},
+			handlers.LLMProfile{Name: "Backup", LLM: llm, Price: models.Price{Input: 1, Output: 5}},
+		))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	// The usage is priced at the price of the fallback LLM that answered.
+	wantCost := 0.0015
+	deadline := time.Now().Add(time.Second)
+	for {
+		msgs, err := store.Messages(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 2 && msgs[1].FallbackLLM == "Backup" && math.Abs(msgs[1].Usage.Cost-wantCost) < 1e-9 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages() AI message = %+v, want answered by Backup with cost %v", msgs[len(msgs)-1], wantCost)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/messages?chat_id=1", nil)
+	w = httptest.NewRecorder()
+
+	main.HandleMessages(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "Answered by Backup (fallback)") {
+		t.Errorf("HandleMessages() body = %s, want the fallback LLM", body)
+	}
+}
+
+func TestHandleChatsError(t *testing.T) {
+	llm := &mockLLM{
+		err: &services.LLMError{Kind: models.ErrorKindRateLimit, StatusCode: 429, Message: "Too many requests"},
+	}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Error Chat"}},
+		messages: map[string][]models.Message{
+			"1": {},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	wantErr := models.MessageError{Kind: models.ErrorKindRateLimit, Message: "Too many requests"}
+	var userMsgID, aiMsgID string
+	deadline := time.Now().Add(time.Second)
+	for {
+		msgs, err := store.Messages(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 2 && msgs[1].Error == wantErr {
+			userMsgID, aiMsgID = msgs[0].ID, msgs[1].ID
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages() AI message = %+v, want error %+v", msgs[len(msgs)-1], wantErr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/messages?chat_id=1", nil)
+	w = httptest.NewRecorder()
+
+	main.HandleMessages(w, req)
+	body := w.Body.String()
+	if !strings.Contains(body, "Rate limited") || !strings.Contains(body, "/chats/retry") {
+		t.Errorf("HandleMessages() body = %s, want the error block with a retry button", body)
+	}
+
+	// Only the last failed message can be retried.
+	req = httptest.NewRequest(http.MethodPost, "/chats/retry", strings.NewReader("chat_id=1&message_id="+userMsgID))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+
+	main.HandleRetryMessage(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("HandleRetryMessage() status = %v, want %v", w.Code, http.StatusConflict)
+	}
+
+	llm.err = nil
+	llm.responses = []string{"Hi"}
+	req = httptest.NewRequest(http.MethodPost, "/chats/retry", strings.NewReader("chat_id=1&message_id="+aiMsgID))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+
+	main.HandleRetryMessage(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleRetryMessage() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	want := []models.Content{{Type: models.ContentTypeText, Text: "Hi"}}
+	deadline = time.Now().Add(time.Second)
+	for {
+		msgs, err := store.Messages(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 2 && msgs[1].Error.IsZero() && reflect.DeepEqual(msgs[1].Contents, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages() AI message = %+v, want contents %+v without error", msgs[len(msgs)-1], want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleChatsContinue(t *testing.T) {
+	llm := &mockLLM{
+		responses: []string{"Once upon"},
+		finish:    &models.Finish{Provider: "mock", Model: "mock-1", StopReason: models.StopReasonMaxTokens},
+		messages:  make(chan []models.Message, 2),
+	}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Truncated Chat"}},
+		messages: map[string][]models.Message{
+			"1": {},
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Tell+a+story&chat_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	main.HandleChats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	<-llm.messages
+
+	var aiMsgID string
+	deadline := time.Now().Add(time.Second)
+	for {
+		msgs, err := store.Messages(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 2 && msgs[1].Finish.Truncated() {
+			if msgs[1].Finish.Model != "mock-1" || msgs[1].Finish.Latency <= 0 {
+				t.Errorf("Messages() AI message finish = %+v, want the model and latency", msgs[1].Finish)
+			}
+			aiMsgID = msgs[1].ID
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages() AI message = %+v, want a truncated answer", msgs[len(msgs)-1])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/messages?chat_id=1", nil)
+	w = httptest.NewRecorder()
+
+	main.HandleMessages(w, req)
+	body := w.Body.String()
+	if !strings.Contains(body, "Max tokens reached") || !strings.Contains(body, "/chats/continue") {
+		t.Errorf("HandleMessages() body = %s, want the truncation block with a continue button", body)
+	}
+
+	llm.responses = []string{" a time."}
+	llm.finish = &models.Finish{Provider: "mock", Model: "mock-1", StopReason: models.StopReasonEnd}
+	req = httptest.NewRequest(http.MethodPost, "/chats/continue", strings.NewReader("chat_id=1&message_id="+aiMsgID))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+
+	main.HandleContinueMessage(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleContinueMessage() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	// The LLM is asked to continue the truncated answer, after it.
+	sent := <-llm.messages
+	if len(sent) != 3 || sent[1].ID != aiMsgID || sent[2].Role != models.RoleUser {
+		t.Errorf("Chat() messages = %+v, want the truncated answer followed by the request to continue it", sent)
+	}
+
+	want := []models.Content{{Type: models.ContentTypeText, Text: "Once upon a time."}}
+	deadline = time.Now().Add(time.Second)
+	for {
+		msgs, err := store.Messages(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 2 && msgs[1].Finish.StopReason == models.StopReasonEnd &&
+			reflect.DeepEqual(msgs[1].Contents, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Messages() AI message = %+v, want contents %+v", msgs[len(msgs)-1], want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The answer is no longer truncated, so it can't be continued.
+	req = httptest.NewRequest(http.MethodPost, "/chats/continue", strings.NewReader("chat_id=1&message_id="+aiMsgID))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+
+	main.HandleContinueMessage(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("HandleContinueMessage() status = %v, want %v", w.Code, http.StatusConflict)
+	}
+}
+
+func TestHandleChatsContextWindow(t *testing.T) {
+	history := []models.Message{
+		{ID: "1", Role: models.RoleUser, Contents: []models.Content{{Type: models.ContentTypeText, Text: "List files"}}},
+		{ID: "2", Role: models.RoleAssistant, Contents: []models.Content{
+			{Type: models.ContentTypeCallTool, ToolName: "list_files", ToolInput: json.RawMessage("{}"), CallToolID: "call"},
+			{
+				Type:       models.ContentTypeToolResult,
+				ToolResult: json.RawMessage(`"` + strings.Repeat("file ", 800) + `"`),
+				CallToolID: "call",
+			},
+		}},
+		{ID: "3", Role: models.RoleUser, Contents: []models.Content{
+			{Type: models.ContentTypeText, Text: strings.Repeat("Long question. ", 100)},
+		}},
+		{ID: "4", Role: models.RoleAssistant, Contents: []models.Content{{Type: models.ContentTypeText, Text: "Answer"}}},
+	}
+
+	tests := []struct {
+		name          string
+		contextWindow int
+		wantMessages  int
+		wantTrim      models.ContextTrim
+	}{
+		{
+			name:         "Fits",
+			wantMessages: 6,
+		},
+		{
+			name:          "Elide tool results",
+			contextWindow: 1200,
+			wantMessages:  6,
+			wantTrim:      models.ContextTrim{ElidedToolResults: 1},
+		},
+		{
+			name:          "Summarize earlier messages",
+			contextWindow: 400,
+			wantMessages:  2,
+			wantTrim:      models.ContextTrim{SummarizedMessages: 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := &mockLLM{responses: []string{"Hi"}, messages: make(chan []models.Message, 1)}
+			summarizer := &mockLLM{responses: []string{"The user listed files."}}
+			store := &mockStore{
+				chats: []models.Chat{{ID: "1", Title: "Long Chat"}},
+				messages: map[string][]models.Message{
+					"1": slices.Clone(history),
+				},
+			}
+
+			main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default(),
+				handlers.WithLLMProfiles(handlers.LLMProfile{Name: "Default", LLM: llm, ContextWindow: tt.contextWindow}),
+				handlers.WithSummarizer(summarizer))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			main.HandleChats(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+			}
+
+			var sent []models.Message
+			select {
+			case sent = <-llm.messages:
+			case <-time.After(time.Second):
+				t.Fatal("Chat() wasn't called")
+			}
+			if len(sent) != tt.wantMessages {
+				t.Fatalf("Chat() got %d messages, want %d", len(sent), tt.wantMessages)
+			}
+			if tt.wantTrim.SummarizedMessages > 0 && !strings.Contains(sent[0].Contents[0].Text, "The user listed files.") {
+				t.Errorf("Chat() first message = %+v, want the summary of the earlier messages", sent[0])
+			}
+			if tt.wantTrim.ElidedToolResults > 0 && !strings.Contains(string(sent[1].Contents[1].ToolResult), "omitted") {
+				t.Errorf("Chat() tool result = %s, want it elided", sent[1].Contents[1].ToolResult)
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for {
+				msgs, err := store.Messages(context.Background(), "1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				aiMsg := msgs[len(msgs)-1]
+				if aiMsg.ContextTrim == tt.wantTrim && len(aiMsg.Contents) > 0 && aiMsg.Contents[0].Text == "Hi" {
+					// Only the messages sent to the LLM are trimmed, not the stored ones.
+					if !reflect.DeepEqual(msgs[:len(history)], history) {
+						t.Errorf("Messages() = %+v, want the stored history intact", msgs[:len(history)])
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Messages() AI message context trim = %+v, want %+v", aiMsg.ContextTrim, tt.wantTrim)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestHandleChatsContextResources(t *testing.T) {
+	blob := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, 1<<20))
+	longInput := `{"text": "` + strings.Repeat("a", 3000) + `"}`
+	history := []models.Message{
+		{ID: "1", Role: models.RoleUser, Contents: []models.Content{
+			{Type: models.ContentTypeText, Text: "Look at this"},
+			{Type: models.ContentTypeResource, ResourceContents: []mcp.ResourceContents{
+				{URI: "file:///cat.png", MimeType: "image/png", Blob: blob},
+			}},
+		}},
+		{ID: "2", Role: models.RoleAssistant, Contents: []models.Content{
+			{Type: models.ContentTypeCallTool, ToolName: "save", ToolInput: json.RawMessage(longInput), CallToolID: "call"},
+			{Type: models.ContentTypeToolResult, ToolResult: json.RawMessage(`"Saved"`), CallToolID: "call"},
+			{Type: models.ContentTypeText, Text: "A cat"},
+		}},
+	}
+
+	tests := []struct {
+		name          string
+		contextWindow int
+		wantMessages  int
+	}{
+		{
+			// The image is estimated at a fixed number of tokens, not by the length of its encoding.
+			name:          "Image fits",
+			contextWindow: 8000,
+			wantMessages:  4,
+		},
+		{
+			name:          "Summarize the image",
+			contextWindow: 400,
+			wantMessages:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := &mockLLM{responses: []string{"Hi"}, messages: make(chan []models.Message, 1)}
+			summarizer := &mockLLM{responses: []string{"The user showed a cat."}, messages: make(chan []models.Message, 1)}
+			store := &mockStore{
+				chats:    []models.Chat{{ID: "1", Title: "Cat Chat"}},
+				messages: map[string][]models.Message{"1": slices.Clone(history)},
+			}
+
+			main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default(),
+				handlers.WithLLMProfiles(handlers.LLMProfile{Name: "Default", LLM: llm, ContextWindow: tt.contextWindow}),
+				handlers.WithSummarizer(summarizer))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/chats", strings.NewReader("message=Hello&chat_id=1"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			main.HandleChats(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("HandleChats() status = %v, want %v", w.Code, http.StatusOK)
+			}
+
+			var sent []models.Message
+			select {
+			case sent = <-llm.messages:
+			case <-time.After(time.Second):
+				t.Fatal("Chat() wasn't called")
+			}
+			if len(sent) != tt.wantMessages {
+				t.Fatalf("Chat() got %d messages, want %d", len(sent), tt.wantMessages)
+			}
+			if tt.wantMessages == len(history)+2 {
+				return
+			}
+
+			// The summarizer gets the description of the image and the truncated tool input, not their data.
+			var transcript string
+			select {
+			case summarized := <-summarizer.messages:
+				transcript = summarized[0].Contents[0].Text
+			case <-time.After(time.Second):
+				t.Fatal("the summarizer wasn't called")
+			}
+			if strings.Contains(transcript, blob[:100]) || !strings.Contains(transcript,
+				"[Resource file:///cat.png (image/png) omitted]") {
+				t.Errorf("transcript = %.500s, want the image described", transcript)
+			}
+			if strings.Contains(transcript, longInput) || !strings.Contains(transcript, "characters truncated]") {
+				t.Errorf("transcript = %.500s, want the tool input truncated", transcript)
+			}
+			if !strings.Contains(transcript, "Look at this") || !strings.Contains(transcript, "A cat") {
+				t.Errorf("transcript = %.500s, want the text of the messages", transcript)
+			}
+		})
+	}
+}
+
+func TestHandleRefreshTitle(t *testing.T) {
+	// Test success case first
+	t.Run("Success", func(t *testing.T) {
+		llm := &mockLLM{}
+		store := &mockStore{
+			chats: []models.Chat{
+				{ID: "1", Title: "Old Title"},
+			},
+			messages: map[string][]models.Message{
+				"1": {
+					{
+						ID:   "msg1",
+						Role: models.RoleUser,
+						Contents: []models.Content{
+							{
+								Type: models.ContentTypeText,
+								Text: "First user message",
+							},
+						},
+					},
+				},
+			},
+		}
+		mcpClient := &mockMCPClient{
+			serverInfo: mcp.Info{
+				Name: "Test Server",
+			},
+		}
+
+		main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		form := strings.NewReader("chat_id=1")
+		req := httptest.NewRequest(http.MethodPost, "/refresh-title", form)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		main.HandleRefreshTitle(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("HandleRefreshTitle() status = %v, want %v", w.Code, http.StatusOK)
+		}
+
+		if !strings.Contains(w.Body.String(), "Test Chat") {
+			t.Errorf("HandleRefreshTitle() body = %v, want to contain %v", w.Body.String(), "Test Chat")
+		}
+
+		// Verify chat title was updated
+		if store.chats[0].Title != "Test Chat" {
+			t.Errorf("Chat title not updated, got %s, want %s", store.chats[0].Title, "Test Chat")
+		}
+	})
+
+	// Test various error cases
+	tests := []struct {
+		name        string
+		method      string
+		chatID      string
+		messages    map[string][]models.Message
+		err         error
+		titleGenErr bool
+		wantStatus  int
+	}{
+		{
+			name:       "Invalid method",
+			method:     http.MethodGet,
+			chatID:     "1",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "Missing chat_id",
+			method:     http.MethodPost,
+			chatID:     "",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "No messages",
+			method:     http.MethodPost,
+			chatID:     "1",
+			messages:   map[string][]models.Message{"1": {}},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "No user messages",
+			method: http.MethodPost,
+			chatID: "1",
+			messages: map[string][]models.Message{
+				"1": {
+					{
+						ID:   "msg3",
+						Role: models.RoleAssistant,
+						Contents: []models.Content{
+							{
+								Type: models.ContentTypeText,
+								Text: "Assistant message",
+							},
+						},
+					},
+				},
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:   "Store error",
+			method: http.MethodPost,
+			chatID: "1",
+			messages: map[string][]models.Message{
+				"1": {
+					{
+						ID:   "msg1",
+						Role: models.RoleUser,
+						Contents: []models.Content{
+							{
+								Type: models.ContentTypeText,
+								Text: "Hello",
+							},
+						},
+					},
+				},
+			},
+			err:        fmt.Errorf("store error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:   "Title generator error",
+			method: http.MethodPost,
+			chatID: "1",
+			messages: map[string][]models.Message{
+				"1": {
+					{
+						ID:   "msg1",
+						Role: models.RoleUser,
+						Contents: []models.Content{
+							{
+								Type: models.ContentTypeText,
+								Text: "Hello",
+							},
+						},
+					},
+				},
+			},
+			titleGenErr: true,
+			wantStatus:  http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := &mockLLM{}
+			if tt.titleGenErr {
+				llm = &mockLLM{
+					err: fmt.Errorf("title generation failed"),
+				}
+			}
+
+			store := &mockStore{
+				chats:    []models.Chat{{ID: "1", Title: "Old Title"}},
+				messages: tt.messages,
+				err:      tt.err,
+			}
+			mcpClient := &mockMCPClient{
+				serverInfo: mcp.Info{
+					Name: "Test Server",
+				},
+			}
+
+			main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			form := strings.NewReader("chat_id=" + tt.chatID)
+			req := httptest.NewRequest(tt.method, "/refresh-title", form)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			main.HandleRefreshTitle(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleRefreshTitle() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandleUpdateChat(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		form       url.Values
+		prompt     string
+		err        error
+		wantStatus int
+		wantChat   models.Chat
+	}{
+		{
+			name:       "Pin",
 			method:     http.MethodPost,
-			chatID:     "",
+			form:       url.Values{"chat_id": {"1"}, "pinned": {"true"}},
+			wantStatus: http.StatusNoContent,
+			wantChat:   models.Chat{ID: "1", Title: "Chat", Pinned: true, Folders: []string{"work"}},
+		},
+		{
+			name:       "Archive",
+			method:     http.MethodPost,
+			form:       url.Values{"chat_id": {"1"}, "archived": {"true"}},
+			wantStatus: http.StatusNoContent,
+			wantChat:   models.Chat{ID: "1", Title: "Chat", Archived: true, Folders: []string{"work"}},
+		},
+		{
+			name:       "Folders from form",
+			method:     http.MethodPost,
+			form:       url.Values{"chat_id": {"1"}, "folders": {" home, ,travel,home "}},
+			wantStatus: http.StatusNoContent,
+			wantChat:   models.Chat{ID: "1", Title: "Chat", Folders: []string{"home", "travel"}},
+		},
+		{
+			name:       "Folders from prompt",
+			method:     http.MethodPost,
+			form:       url.Values{"chat_id": {"1"}},
+			prompt:     "travel",
+			wantStatus: http.StatusNoContent,
+			wantChat:   models.Chat{ID: "1", Title: "Chat", Folders: []string{"travel"}},
+		},
+		{
+			name:       "Invalid method",
+			method:     http.MethodGet,
+			form:       url.Values{"chat_id": {"1"}},
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "Missing chat_id",
+			method:     http.MethodPost,
+			form:       url.Values{"pinned": {"true"}},
 			wantStatus: http.StatusBadRequest,
 		},
 		{
-			name:       "No messages",
+			name:       "Chat not found",
 			method:     http.MethodPost,
-			chatID:     "1",
-			messages:   map[string][]models.Message{"1": {}},
+			form:       url.Values{"chat_id": {"2"}, "pinned": {"true"}},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Store error",
+			method:     http.MethodPost,
+			form:       url.Values{"chat_id": {"1"}, "pinned": {"true"}},
+			err:        fmt.Errorf("store error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := &mockLLM{}
+			store := &mockStore{
+				chats: []models.Chat{{ID: "1", Title: "Chat", Folders: []string{"work"}}},
+				err:   tt.err,
+			}
+
+			main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{}, slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(tt.method, "/chats/update", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.prompt != "" {
+				req.Header.Set("HX-Prompt", tt.prompt)
+			}
+			w := httptest.NewRecorder()
+
+			main.HandleUpdateChat(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleUpdateChat() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantChat.ID == "" {
+				return
+			}
+			if !reflect.DeepEqual(store.chats[0], tt.wantChat) {
+				t.Errorf("HandleUpdateChat() chat = %+v, want %+v", store.chats[0], tt.wantChat)
+			}
+		})
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	llm := &mockLLM{}
+	mcpClient := &mockMCPClient{
+		serverInfo: mcp.Info{
+			Name: "Test Server",
+		},
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		query        string
+		storeErr     error
+		wantStatus   int
+		wantContains []string
+	}{
+		{
+			name:       "Invalid method",
+			method:     http.MethodPost,
+			query:      "hello",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "Empty query",
+			method:     http.MethodGet,
+			query:      "",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Message match",
+			method:     http.MethodGet,
+			query:      "weather",
+			wantStatus: http.StatusOK,
+			wantContains: []string{
+				"/?chat_id=1&message_id=msg1#message-msg1",
+				"<mark>weather</mark>",
+			},
+		},
+		{
+			name:       "Title match",
+			method:     http.MethodGet,
+			query:      "forecast",
+			wantStatus: http.StatusOK,
+			wantContains: []string{
+				`href="/?chat_id=1"`,
+				"Forecast Chat",
+			},
+		},
+		{
+			name:         "No results",
+			method:       http.MethodGet,
+			query:        "<script>",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{`No chats found for "&lt;script&gt;"`},
+		},
+		{
+			name:       "Store error",
+			method:     http.MethodGet,
+			query:      "weather",
+			storeErr:   fmt.Errorf("store error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &mockStore{
+				chats: []models.Chat{{ID: "1", Title: "Forecast Chat"}},
+				messages: map[string][]models.Message{
+					"1": {
+						{
+							ID:   "msg1",
+							Role: models.RoleUser,
+							Contents: []models.Content{
+								{
+									Type: models.ContentTypeText,
+									Text: "How is the weather today?",
+								},
+							},
+						},
+					},
+				},
+				err: tt.storeErr,
+			}
+
+			main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(tt.method, "/search?q="+url.QueryEscape(tt.query), nil)
+			w := httptest.NewRecorder()
+
+			main.HandleSearch(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleSearch() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			for _, want := range tt.wantContains {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("HandleSearch() body = %v, want to contain %v", w.Body.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleExport(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockStore{
+		chats: []models.Chat{{ID: "1", Title: "Export Chat"}},
+		messages: map[string][]models.Message{
+			"1": {
+				{
+					ID:   "msg1",
+					Role: models.RoleUser,
+					Contents: []models.Content{
+						{
+							Type: models.ContentTypeText,
+							Text: "Read the file",
+						},
+					},
+				},
+				{
+					ID:   "msg2",
+					Role: models.RoleAssistant,
+					Contents: []models.Content{
+						{
+							Type:       models.ContentTypeCallTool,
+							ToolName:   "read_file",
+							ToolInput:  json.RawMessage(`{"path":"/tmp/a.txt"}`),
+							CallToolID: "call-1",
+						},
+						{
+							Type:       models.ContentTypeToolResult,
+							ToolResult: json.RawMessage(`[{"type":"text","text":"file content"}]`),
+							CallToolID: "call-1",
+						},
+					},
+				},
+			},
+		},
+	}
+	mcpClient := &mockMCPClient{
+		serverInfo: mcp.Info{
+			Name: "Test Server",
+		},
+	}
+
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		url          string
+		wantStatus   int
+		wantContains []string
+	}{
+		{
+			name:       "Unknown format",
+			url:        "/export?chat_id=1&format=pdf",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Chat not found",
+			url:        "/export?chat_id=2",
 			wantStatus: http.StatusNotFound,
 		},
 		{
-			name:   "No user messages",
-			method: http.MethodPost,
-			chatID: "1",
-			messages: map[string][]models.Message{
-				"1": {
+			name:         "Markdown",
+			url:          "/export?chat_id=1&format=markdown",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{"# Export Chat", "## User", "Read the file", "Calling Tool: read_file"},
+		},
+		{
+			name:         "JSON of all chats",
+			url:          "/export",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{`"Version": 1`, `"ToolName": "read_file"`, `"CallToolID": "call-1"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			w := httptest.NewRecorder()
+
+			main.HandleExport(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("HandleExport() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			for _, want := range tt.wantContains {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("HandleExport() body = %v, want to contain %v", w.Body.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleImport(t *testing.T) {
+	llm := &mockLLM{}
+	mcpClient := &mockMCPClient{
+		serverInfo: mcp.Info{
+			Name: "Test Server",
+		},
+	}
+
+	export := models.Export{
+		Version: models.ExportVersion,
+		Chats: []models.ChatExport{
+			{
+				Chat: models.Chat{ID: "old-id", Title: "Imported Chat"},
+				Messages: []models.Message{
 					{
-						ID:   "msg3",
+						ID:   "old-msg",
 						Role: models.RoleAssistant,
 						Contents: []models.Content{
 							{
-								Type: models.ContentTypeText,
-								Text: "Assistant message",
+								Type:       models.ContentTypeCallTool,
+								ToolName:   "read_file",
+								ToolInput:  json.RawMessage(`{"path":"/tmp/a.txt"}`),
+								CallToolID: "call-1",
 							},
 						},
 					},
 				},
 			},
-			wantStatus: http.StatusInternalServerError,
 		},
+	}
+	validFile, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		file       string
+		wantStatus int
+	}{
 		{
-			name:   "Store error",
-			method: http.MethodPost,
-			chatID: "1",
-			messages: map[string][]models.Message{
-				"1": {
-					{
-						ID:   "msg1",
-						Role: models.RoleUser,
-						Contents: []models.Content{
-							{
-								Type: models.ContentTypeText,
-								Text: "Hello",
-							},
-						},
-					},
-				},
-			},
-			err:        fmt.Errorf("store error"),
-			wantStatus: http.StatusInternalServerError,
+			name:       "Valid file",
+			file:       string(validFile),
+			wantStatus: http.StatusSeeOther,
 		},
 		{
-			name:   "Title generator error",
-			method: http.MethodPost,
-			chatID: "1",
-			messages: map[string][]models.Message{
-				"1": {
-					{
-						ID:   "msg1",
-						Role: models.RoleUser,
-						Contents: []models.Content{
-							{
-								Type: models.ContentTypeText,
-								Text: "Hello",
-							},
-						},
-					},
-				},
-			},
-			titleGenErr: true,
-			wantStatus:  http.StatusInternalServerError,
+			name:       "Invalid JSON",
+			file:       "{invalid",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Unsupported version",
+			file:       `{"Version": 99}`,
+			wantStatus: http.StatusBadRequest,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			llm := &mockLLM{}
-			if tt.titleGenErr {
-				llm = &mockLLM{
-					err: fmt.Errorf("title generation failed"),
-				}
+			store := &mockStore{messages: map[string][]models.Message{}}
+			main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
+			if err != nil {
+				t.Fatal(err)
 			}
 
-			store := &mockStore{
-				chats:    []models.Chat{{ID: "1", Title: "Old Title"}},
-				messages: tt.messages,
-				err:      tt.err,
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, err := mw.CreateFormFile("file", "chats.json")
+			if err != nil {
+				t.Fatal(err)
 			}
-			mcpClient := &mockMCPClient{
-				serverInfo: mcp.Info{
-					Name: "Test Server",
-				},
+			if _, err := fw.Write([]byte(tt.file)); err != nil {
+				t.Fatal(err)
 			}
-
-			main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{mcpClient}, slog.Default())
-			if err != nil {
+			if err := mw.Close(); err != nil {
 				t.Fatal(err)
 			}
 
-			form := strings.NewReader("chat_id=" + tt.chatID)
-			req := httptest.NewRequest(tt.method, "/refresh-title", form)
-			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req := httptest.NewRequest(http.MethodPost, "/import", &body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
 			w := httptest.NewRecorder()
 
-			main.HandleRefreshTitle(w, req)
+			main.HandleImport(w, req)
 
 			if w.Code != tt.wantStatus {
-				t.Errorf("HandleRefreshTitle() status = %v, want %v", w.Code, tt.wantStatus)
+				t.Errorf("HandleImport() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusSeeOther {
+				return
+			}
+
+			if len(store.chats) != 1 || store.chats[0].Title != "Imported Chat" || store.chats[0].ID == "old-id" {
+				t.Fatalf("Imported chats = %+v, want one chat with a new ID", store.chats)
+			}
+			msgs := store.messages[store.chats[0].ID]
+			if len(msgs) != 1 || msgs[0].ID == "old-msg" || msgs[0].Contents[0].ToolName != "read_file" {
+				t.Errorf("Imported messages = %+v, want one message with a new ID", msgs)
 			}
 		})
 	}
 }
 
+func TestHandleImportMarkupTitle(t *testing.T) {
+	llm := &mockLLM{}
+	store := &mockStore{messages: map[string][]models.Message{}}
+	main, err := handlers.NewMain(llm, llm, store, []handlers.MCPClient{&mockMCPClient{}}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	title := `<img src=x onerror="alert(1)">`
+	file, err := json.Marshal(models.Export{
+		Version: models.ExportVersion,
+		Chats:   []models.ChatExport{{Chat: models.Chat{ID: "old-id", Title: title}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "chats.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	main.HandleImport(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("HandleImport() status = %v, want %v", w.Code, http.StatusSeeOther)
+	}
+
+	// The imported title is shown as text in the chat list, not as markup.
+	w = httptest.NewRecorder()
+	main.HandleChatList(w, httptest.NewRequest(http.MethodGet, "/chats/list", nil))
+	if strings.Contains(w.Body.String(), title) {
+		t.Errorf("HandleChatList() body = %v, want the title escaped", w.Body.String())
+	}
+	if want := "&lt;img src=x onerror=&#34;alert(1)&#34;&gt;"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("HandleChatList() body = %v, want to contain %v", w.Body.String(), want)
+	}
+}
+
 func TestMCPToolInteractions(t *testing.T) {
 	// Test tool call functionality
 	llm := &mockLLM{
@@ -611,12 +2367,28 @@ func TestMCPToolInteractions(t *testing.T) {
 	}
 }
 
-func (m mockLLM) Chat(_ context.Context, _ []models.Message, _ []mcp.Tool) iter.Seq2[models.Content, error] {
+func (m mockLLM) Chat(
+	_ context.Context,
+	messages []models.Message,
+	_ []mcp.Tool,
+	opts models.ChatOptions,
+) iter.Seq2[models.Content, error] {
 	return func(yield func(models.Content, error) bool) {
+		if m.opts != nil {
+			m.opts <- opts
+		}
+		if m.messages != nil {
+			m.messages <- messages
+		}
 		if m.err != nil {
 			yield(models.Content{}, m.err)
 			return
 		}
+		for _, content := range m.contents {
+			if !yield(content, nil) {
+				return
+			}
+		}
 		for _, resp := range m.responses {
 			if !yield(models.Content{
 				Type: models.ContentTypeText,
@@ -625,6 +2397,14 @@ func (m mockLLM) Chat(_ context.Context, _ []models.Message, _ []mcp.Tool) iter.
 				return
 			}
 		}
+		if m.usage != nil {
+			if !yield(models.Content{Type: models.ContentTypeUsage, Usage: m.usage}, nil) {
+				return
+			}
+		}
+		if m.finish != nil {
+			yield(models.Content{Type: models.ContentTypeFinish, Finish: m.finish}, nil)
+		}
 	}
 }
 
@@ -635,6 +2415,29 @@ func (m mockLLM) GenerateTitle(_ context.Context, _ string) (string, error) {
 	return "Test Chat", nil
 }
 
+func (m *mockModelManager) Models(_ context.Context) ([]models.LocalModel, error) {
+	return m.models, m.err
+}
+
+func (m *mockModelManager) ModelDetails(_ context.Context, name string) (models.LocalModelDetails, error) {
+	for _, model := range m.models {
+		if model.Name == name {
+			return models.LocalModelDetails{LocalModel: model}, nil
+		}
+	}
+	return models.LocalModelDetails{}, fmt.Errorf("model %s not found", name)
+}
+
+func (m *mockModelManager) PullModel(_ context.Context, name string) iter.Seq2[models.PullProgress, error] {
+	return func(yield func(models.PullProgress, error) bool) {
+		if m.err != nil {
+			yield(models.PullProgress{}, m.err)
+			return
+		}
+		yield(models.PullProgress{Status: "pulling " + name}, nil)
+	}
+}
+
 func (m *mockStore) Chats(_ context.Context) ([]models.Chat, error) {
 	m.Lock()
 	defer m.Unlock()
@@ -647,6 +2450,64 @@ func (m *mockStore) Chats(_ context.Context) ([]models.Chat, error) {
 	return chatsCopy, nil
 }
 
+func (m *mockStore) Chat(_ context.Context, chatID string) (models.Chat, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return models.Chat{}, m.err
+	}
+	for _, chat := range m.chats {
+		if chat.ID == chatID {
+			return chat, nil
+		}
+	}
+	return models.Chat{}, nil
+}
+
+func (m *mockStore) ChatsPage(_ context.Context, query models.ChatsQuery) ([]models.Chat, string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, "", m.err
+	}
+
+	start := 0
+	if query.Cursor != "" {
+		start = slices.IndexFunc(m.chats, func(c models.Chat) bool { return c.ID == query.Cursor }) + 1
+	}
+	end := len(m.chats)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+
+	page := make([]models.Chat, end-start)
+	copy(page, m.chats[start:end])
+
+	nextCursor := ""
+	if end < len(m.chats) {
+		nextCursor = m.chats[end-1].ID
+	}
+	return page, nextCursor, nil
+}
+
+func (m *mockStore) Folders(_ context.Context) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	var folders []string
+	for _, chat := range m.chats {
+		for _, folder := range chat.Folders {
+			if !slices.Contains(folders, folder) {
+				folders = append(folders, folder)
+			}
+		}
+	}
+	slices.Sort(folders)
+	return folders, nil
+}
+
 func (m *mockStore) AddChat(_ context.Context, chat models.Chat) (string, error) {
 	m.Lock()
 	defer m.Unlock()
@@ -668,6 +2529,66 @@ func (m *mockStore) UpdateChat(_ context.Context, chat models.Chat) error {
 	return m.err
 }
 
+func (m *mockStore) ChatUsage(_ context.Context, chatID string) (models.Usage, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return models.Usage{}, m.err
+	}
+	var usage models.Usage
+	for _, msg := range m.messages[chatID] {
+		usage = usage.Add(msg.Usage)
+	}
+	return usage, nil
+}
+
+func (m *mockStore) UsageByChat(ctx context.Context) ([]models.ChatUsage, error) {
+	m.Lock()
+	chats := slices.Clone(m.chats)
+	m.Unlock()
+
+	var usages []models.ChatUsage
+	for _, chat := range chats {
+		usage, err := m.ChatUsage(ctx, chat.ID)
+		if err != nil {
+			return nil, err
+		}
+		if usage.TotalTokens() > 0 {
+			usages = append(usages, models.ChatUsage{ChatID: chat.ID, ChatTitle: chat.Title, Usage: usage})
+		}
+	}
+	return usages, nil
+}
+
+func (m *mockStore) Personas(_ context.Context) ([]models.Persona, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	return slices.Clone(m.personas), nil
+}
+
+func (m *mockStore) SavePersona(_ context.Context, persona models.Persona) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.personas = append(m.personas, persona)
+	return nil
+}
+
+func (m *mockStore) DeletePersona(_ context.Context, personaID string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.personas = slices.DeleteFunc(m.personas, func(p models.Persona) bool { return p.ID == personaID })
+	return nil
+}
+
 func (m *mockStore) Messages(_ context.Context, chatID string) ([]models.Message, error) {
 	m.Lock()
 	defer m.Unlock()
@@ -680,6 +2601,37 @@ func (m *mockStore) Messages(_ context.Context, chatID string) ([]models.Message
 	return messagesCopy, nil
 }
 
+func (m *mockStore) MessagesPage(
+	_ context.Context,
+	chatID string,
+	query models.MessagesQuery,
+) ([]models.Message, string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, "", m.err
+	}
+
+	msgs := m.messages[chatID]
+	end := len(msgs)
+	if query.Cursor != "" {
+		end = slices.IndexFunc(msgs, func(msg models.Message) bool { return msg.ID == query.Cursor })
+	}
+	start := 0
+	if query.Limit > 0 && end-query.Limit > 0 {
+		start = end - query.Limit
+	}
+
+	page := make([]models.Message, end-start)
+	copy(page, msgs[start:end])
+
+	nextCursor := ""
+	if start > 0 {
+		nextCursor = msgs[start].ID
+	}
+	return page, nextCursor, nil
+}
+
 func (m *mockStore) AddMessage(_ context.Context, chatID string, msg models.Message) (string, error) {
 	m.Lock()
 	defer m.Unlock()
@@ -697,6 +2649,9 @@ func (m *mockStore) UpdateMessage(_ context.Context, chatID string, msg models.M
 		return m.err
 	}
 
+	// Store a copy of the contents, as the stores do, since the chat keeps updating the ones of the message.
+	msg.Contents = slices.Clone(msg.Contents)
+
 	// Find and update the message
 	for i, existingMsg := range m.messages[chatID] {
 		if existingMsg.ID == msg.ID {
@@ -710,6 +2665,41 @@ func (m *mockStore) UpdateMessage(_ context.Context, chatID string, msg models.M
 	return nil
 }
 
+func (m *mockStore) SearchChats(_ context.Context, query string, limit int) ([]models.SearchResult, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	query = strings.ToLower(query)
+	var results []models.SearchResult
+	for _, chat := range m.chats {
+		if strings.Contains(strings.ToLower(chat.Title), query) {
+			results = append(results, models.SearchResult{
+				ChatID:    chat.ID,
+				ChatTitle: chat.Title,
+				Snippet:   chat.Title,
+			})
+		}
+		for _, msg := range m.messages[chat.ID] {
+			text := msg.SearchText()
+			if strings.Contains(strings.ToLower(text), query) {
+				results = append(results, models.SearchResult{
+					ChatID:    chat.ID,
+					ChatTitle: chat.Title,
+					MessageID: msg.ID,
+					Snippet:   text,
+				})
+			}
+		}
+	}
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
 func (m *mockMCPClient) ServerInfo() mcp.Info {
 	return m.serverInfo
 }
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+	"github.com/tmaxmax/go-sse"
+)
+
+// localModelsData is the data of the local models dialog, with the models of every LLM profile whose
+// models are managed from the UI.
+type localModelsData struct {
+	Profiles []localModelsProfile
+}
+
+type localModelsProfile struct {
+	Name   string
+	Models []models.LocalModel
+	// Err is the error of listing the models, e.g. because the LLM server is down.
+	Err string
+}
+
+type localModelDetailsData struct {
+	Profile string
+	Details models.LocalModelDetails
+}
+
+// modelPullData is the state of the pull of a model, rendered when the pull starts and on each progress.
+type modelPullData struct {
+	ID       string
+	Profile  string
+	Model    string
+	Progress models.PullProgress
+	Done     bool
+	Err      string
+}
+
+var modelPullSSEType = sse.Type("pull")
+
+// HandleModels renders the local models of every LLM profile whose models are managed from the UI,
+// through HTTP GET requests. The models of a profile whose server can't be reached are replaced by the
+// error, so the other profiles are still listed.
+func (m Main) HandleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data localModelsData
+	for _, p := range m.llmProfiles {
+		if p.Models == nil {
+			continue
+		}
+		profile := localModelsProfile{Name: p.Name}
+		ms, err := p.Models.Models(r.Context())
+		if err != nil {
+			m.logger.Error("Failed to list models",
+				slog.String("profile", p.Name),
+				slog.String(errLoggerKey, err.Error()))
+			profile.Err = err.Error()
+		}
+		profile.Models = ms
+		data.Profiles = append(data.Profiles, profile)
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "local_models", data); err != nil {
+		m.logger.Error("Failed to execute local_models template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleModelDetails renders the details of a local model through HTTP GET requests, such as its context
+// length, quantization and capabilities. It expects the "profile" and "model" query parameters, naming
+// the LLM profile and its model.
+func (m Main) HandleModelDetails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profileName := r.URL.Query().Get("profile")
+	name := r.URL.Query().Get("model")
+	if name == "" {
+		m.logger.Error("Model is required")
+		http.Error(w, "Model is required", http.StatusBadRequest)
+		return
+	}
+	profile, ok := m.managedProfile(profileName)
+	if !ok {
+		http.Error(w, "LLM profile not found, or its models aren't managed from the UI", http.StatusNotFound)
+		return
+	}
+
+	details, err := profile.Models.ModelDetails(r.Context(), name)
+	if err != nil {
+		m.logger.Error("Failed to get model details",
+			slog.String("profile", profileName),
+			slog.String("model", name),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "local_model_details", localModelDetailsData{
+		Profile: profileName,
+		Details: details,
+	}); err != nil {
+		m.logger.Error("Failed to execute local_model_details template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandlePullModel starts downloading a model to the server of an LLM profile, through HTTP POST requests.
+// It expects the "profile" and "model" form fields, naming the LLM profile and the model to pull.
+//
+// The pull runs in the background, and its progress is streamed through SSE, so the handler responds
+// with the progress bar connected to the SSE topic of the pull. The pulled model can then be selected
+// as the model of a chat.
+func (m Main) HandlePullModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profileName := r.FormValue("profile")
+	name := strings.TrimSpace(r.FormValue("model"))
+	if name == "" {
+		m.logger.Error("Model is required")
+		http.Error(w, "Model is required", http.StatusBadRequest)
+		return
+	}
+	profile, ok := m.managedProfile(profileName)
+	if !ok {
+		http.Error(w, "LLM profile not found, or its models aren't managed from the UI", http.StatusNotFound)
+		return
+	}
+
+	pull := modelPullData{
+		ID:       uuid.New().String(),
+		Profile:  profileName,
+		Model:    name,
+		Progress: models.PullProgress{Status: "starting"},
+	}
+	go m.pullModel(profile.Models, pull)
+
+	if err := m.templates.ExecuteTemplate(w, "model_pull", pull); err != nil {
+		m.logger.Error("Failed to execute model_pull template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// pullModel pulls the model of the pull with the manager, and publishes its progress to the SSE topic of
+// the pull. The progress is only published when its status or percentage changes, as the LLM servers
+// report it many times per second.
+func (m Main) pullModel(manager ModelManager, pull modelPullData) {
+	// Close the SSE connection of the pull once it's done.
+	defer func() {
+		e := &sse.Message{Type: sse.Type("closePull")}
+		e.AppendData("bye")
+		_ = m.sseSrv.Publish(e, pullIDTopic(pull.ID))
+	}()
+
+	var last models.PullProgress
+	for progress, err := range manager.PullModel(context.Background(), pull.Model) {
+		if err != nil {
+			m.logger.Error("Failed to pull model",
+				slog.String("profile", pull.Profile),
+				slog.String("model", pull.Model),
+				slog.String(errLoggerKey, err.Error()))
+			pull.Err = err.Error()
+			break
+		}
+		if progress.Status == last.Status && progress.Percent() == last.Percent() {
+			continue
+		}
+		last = progress
+		pull.Progress = progress
+		if err := m.publishPull(pull); err != nil {
+			m.logger.Error("Failed to publish pull progress", slog.String(errLoggerKey, err.Error()))
+			return
+		}
+	}
+
+	pull.Done = true
+	if err := m.publishPull(pull); err != nil {
+		m.logger.Error("Failed to publish pull progress", slog.String(errLoggerKey, err.Error()))
+	}
+}
+
+func (m Main) publishPull(pull modelPullData) error {
+	var sb strings.Builder
+	if err := m.templates.ExecuteTemplate(&sb, "model_pull_progress", pull); err != nil {
+		return err
+	}
+	msg := sse.Message{Type: modelPullSSEType}
+	msg.AppendData(sb.String())
+	return m.sseSrv.Publish(&msg, pullIDTopic(pull.ID))
+}
+
+// managedProfile returns the LLM profile with the given name, if its models are managed from the UI.
+func (m Main) managedProfile(name string) (LLMProfile, bool) {
+	for _, p := range m.llmProfiles {
+		if p.Name == name && p.Models != nil {
+			return p, true
+		}
+	}
+	return LLMProfile{}, false
+}
+
+// localModelNames returns the names of the local models of the LLM profiles whose models are managed from
+// the UI, by profile name, with the selected model of the selected profile even if it's no longer
+// available, so the chat keeps it until another one is selected. The profiles whose models can't be listed
+// are left out.
+func (m Main) localModelNames(ctx context.Context, selected, selectedModel string) map[string][]string {
+	var names map[string][]string
+	for _, p := range m.llmProfiles {
+		if p.Models == nil {
+			continue
+		}
+		ms, err := p.Models.Models(ctx)
+		if err != nil {
+			m.logger.Warn("Failed to list models",
+				slog.String("profile", p.Name),
+				slog.String(errLoggerKey, err.Error()))
+		}
+		var profileNames []string
+		for _, model := range ms {
+			profileNames = append(profileNames, model.Name)
+		}
+		if p.Name == selected && selectedModel != "" && !slices.Contains(profileNames, selectedModel) {
+			profileNames = append(profileNames, selectedModel)
+		}
+		if len(profileNames) == 0 {
+			continue
+		}
+		if names == nil {
+			names = make(map[string][]string)
+		}
+		names[p.Name] = profileNames
+	}
+	return names
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+// personasData is the data of the persona picker and the persona management modal.
+type personasData struct {
+	Personas []models.Persona
+	Selected string
+}
+
+// HandlePersonas creates a persona from the persona management modal through HTTP POST requests. It
+// expects a "name" form field, and the optional "system_prompt" field, "tools" fields holding the names
+// of the tools available to the persona, and LLM parameter fields, see parseLLMParametersForm.
+//
+// The persona is stored, and the page is refreshed so the persona is listed in the persona picker.
+func (m Main) HandlePersonas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		m.logger.Error("Persona name is required")
+		http.Error(w, "Persona name is required", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseLLMParametersForm(r)
+	if err != nil {
+		m.logger.Error("Invalid persona parameters", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var tools []string
+	for _, tool := range r.Form["tools"] {
+		if _, ok := m.toolsMap[tool]; !ok {
+			m.logger.Error("Tool not found", slog.String("toolName", tool))
+			http.Error(w, fmt.Sprintf("Tool %s is not found", tool), http.StatusBadRequest)
+			return
+		}
+		tools = append(tools, tool)
+	}
+
+	persona := models.Persona{
+		ID:           uuid.New().String(),
+		Name:         name,
+		SystemPrompt: strings.TrimSpace(r.FormValue("system_prompt")),
+		Tools:        tools,
+		Parameters:   params,
+	}
+	if err := m.store.SavePersona(r.Context(), persona); err != nil {
+		m.logger.Error("Failed to save persona", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDeletePersona deletes a persona created from the UI through HTTP POST requests. It expects a
+// "persona_id" form field, and rejects the personas defined in the configuration. The chats with the
+// deleted persona are sent without persona afterwards.
+func (m Main) HandleDeletePersona(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	personaID := r.FormValue("persona_id")
+	if personaID == "" {
+		m.logger.Error("Persona ID is required")
+		http.Error(w, "Persona ID is required", http.StatusBadRequest)
+		return
+	}
+
+	p, ok, err := m.persona(r.Context(), personaID)
+	if err != nil {
+		m.logger.Error("Failed to get persona", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Persona not found", http.StatusNotFound)
+		return
+	}
+	if p.ReadOnly {
+		http.Error(w, "Personas defined in the configuration can't be deleted", http.StatusBadRequest)
+		return
+	}
+
+	if err := m.store.DeletePersona(r.Context(), personaID); err != nil {
+		m.logger.Error("Failed to delete persona", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allPersonas returns the personas defined in the configuration, followed by the personas created from
+// the UI.
+func (m Main) allPersonas(ctx context.Context) ([]models.Persona, error) {
+	stored, err := m.store.Personas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get personas: %w", err)
+	}
+	return slices.Concat(m.personas, stored), nil
+}
+
+// persona returns the persona with the given ID, and whether it exists.
+func (m Main) persona(ctx context.Context, personaID string) (models.Persona, bool, error) {
+	personas, err := m.allPersonas(ctx)
+	if err != nil {
+		return models.Persona{}, false, err
+	}
+	idx := slices.IndexFunc(personas, func(p models.Persona) bool {
+		return p.ID == personaID
+	})
+	if idx < 0 {
+		return models.Persona{}, false, nil
+	}
+	return personas[idx], true, nil
+}
+
+// personasData returns the data of the persona picker with the given persona selected.
+func (m Main) personasData(ctx context.Context, selected string) (personasData, error) {
+	personas, err := m.allPersonas(ctx)
+	if err != nil {
+		return personasData{}, err
+	}
+	return personasData{
+		Personas: personas,
+		Selected: selected,
+	}, nil
+}
+
+// parseLLMParametersForm parses the LLM parameters of the "temperature", "top_p", "top_k",
+// "frequency_penalty", "presence_penalty", "max_tokens" and "seed" form fields, and the "stop" field
+// holding one stop sequence per line. Empty fields leave
+// their parameter unset, so the parameter of the LLM configuration is used.
+func parseLLMParametersForm(r *http.Request) (models.LLMParameters, error) {
+	var params models.LLMParameters
+	var err error
+	if params.Temperature, err = parseFloatField(r, "temperature"); err != nil {
+		return models.LLMParameters{}, err
+	}
+	if params.TopP, err = parseFloatField(r, "top_p"); err != nil {
+		return models.LLMParameters{}, err
+	}
+	if params.TopK, err = parseIntField(r, "top_k"); err != nil {
+		return models.LLMParameters{}, err
+	}
+	if params.FrequencyPenalty, err = parseFloatField(r, "frequency_penalty"); err != nil {
+		return models.LLMParameters{}, err
+	}
+	if params.PresencePenalty, err = parseFloatField(r, "presence_penalty"); err != nil {
+		return models.LLMParameters{}, err
+	}
+	if params.MaxTokens, err = parseIntField(r, "max_tokens"); err != nil {
+		return models.LLMParameters{}, err
+	}
+	if params.Seed, err = parseIntField(r, "seed"); err != nil {
+		return models.LLMParameters{}, err
+	}
+	for _, seq := range strings.Split(r.FormValue("stop"), "\n") {
+		if seq = strings.TrimRight(seq, "\r"); seq != "" {
+			params.Stop = append(params.Stop, seq)
+		}
+	}
+	return params, nil
+}
+
+func parseFloatField(r *http.Request, name string) (*float32, error) {
+	v := strings.TrimSpace(r.FormValue(name))
+	if v == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(v, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	f32 := float32(f)
+	return &f32, nil
+}
+
+func parseIntField(r *http.Request, name string) (*int, error) {
+	v := strings.TrimSpace(r.FormValue(name))
+	if v == "" {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return &i, nil
+}
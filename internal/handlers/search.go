@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+type searchResult struct {
+	ChatID    string
+	ChatTitle string
+	MessageID string
+	Snippet   string
+}
+
+type searchResultsData struct {
+	Query   string
+	Results []searchResult
+}
+
+const searchResultsLimit = 50
+
+// HandleSearch performs a full-text search across all chats and renders the matching chats with
+// highlighted snippets. It expects a "q" query parameter, and an empty query renders nothing, so the
+// search results are cleared when the user empties the search box.
+//
+// Each result links to its chat, and to the matched message within the chat, so the browser jumps to
+// the message when the chat is opened.
+func (m Main) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		return
+	}
+
+	rs, err := m.store.SearchChats(r.Context(), query, searchResultsLimit)
+	if err != nil {
+		m.logger.Error("Failed to search chats",
+			slog.String("query", query),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	terms := models.SearchTerms(query)
+	results := make([]searchResult, len(rs))
+	for i := range rs {
+		results[i] = searchResult{
+			ChatID:    rs[i].ChatID,
+			ChatTitle: html.EscapeString(rs[i].ChatTitle),
+			MessageID: rs[i].MessageID,
+			Snippet:   highlightTerms(rs[i].Snippet, terms),
+		}
+	}
+
+	data := searchResultsData{
+		Query:   html.EscapeString(query),
+		Results: results,
+	}
+	if err := m.templates.ExecuteTemplate(w, "search_results", data); err != nil {
+		m.logger.Error("Failed to execute search_results template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// highlightTerms escapes text for HTML and wraps every word that starts with one of the terms in a mark
+// tag. Words are matched by prefix, in the same way as the last term of a search query is matched.
+func highlightTerms(text string, terms []string) string {
+	var sb strings.Builder
+	var word []rune
+
+	flush := func() {
+		if len(word) == 0 {
+			return
+		}
+		w := string(word)
+		lw := strings.ToLower(w)
+		matched := false
+		for _, term := range terms {
+			if strings.HasPrefix(lw, term) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			sb.WriteString("<mark>")
+			sb.WriteString(html.EscapeString(w))
+			sb.WriteString("</mark>")
+		} else {
+			sb.WriteString(html.EscapeString(w))
+		}
+		word = word[:0]
+	}
+
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		sb.WriteString(html.EscapeString(string(r)))
+	}
+	flush()
+
+	return sb.String()
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// usageData is the data of the usage dashboard.
+type usageData struct {
+	Total models.Usage
+	Chats []models.ChatUsage
+}
+
+// HandleChatUsage renders the total token usage and cost of a chat through HTTP GET requests, for the
+// chatbox header. It expects a "chat_id" query parameter identifying the chat.
+func (m Main) HandleChatUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID := r.URL.Query().Get("chat_id")
+	if chatID == "" {
+		m.logger.Error("Chat ID is required")
+		http.Error(w, "Chat ID is required", http.StatusBadRequest)
+		return
+	}
+
+	usage, err := m.store.ChatUsage(r.Context(), chatID)
+	if err != nil {
+		m.logger.Error("Failed to get chat usage",
+			slog.String("chatID", chatID),
+			slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := m.templates.ExecuteTemplate(w, "chat_usage", usage); err != nil {
+		m.logger.Error("Failed to execute chat_usage template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandleUsage renders the usage dashboard through HTTP GET requests, with the total token usage and cost
+// of all chats, and the usage of each chat from the most expensive one.
+func (m Main) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		m.logger.Error("Method not allowed", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chats, err := m.store.UsageByChat(r.Context())
+	if err != nil {
+		m.logger.Error("Failed to get usage", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := usageData{Chats: chats}
+	for _, c := range chats {
+		data.Total = data.Total.Add(c.Usage)
+	}
+	if err := m.templates.ExecuteTemplate(w, "usage", data); err != nil {
+		m.logger.Error("Failed to execute usage template", slog.String(errLoggerKey, err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
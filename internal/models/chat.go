@@ -19,6 +19,53 @@ import (
 type Chat struct {
 	ID    string
 	Title string
+
+	CreatedAt time.Time
+	// UpdatedAt is the time of the last activity in the chat. It's kept up to date by the store when a
+	// message is added, and the chat list is sorted by it.
+	UpdatedAt time.Time
+
+	// Pinned chats are listed before the other chats.
+	Pinned bool
+	// Archived chats are hidden from the chat list, unless the archived chats are explicitly listed.
+	Archived bool
+	// Folders are the user-defined folders the chat belongs to, used to filter the chat list.
+	Folders []string
+
+	// LLMProfile is the name of the LLM profile the chat is sent to. It's empty for the chats that use
+	// the default LLM.
+	LLMProfile string
+	// Model is the local model of the LLM profile the chat is sent to, for the profiles whose models are
+	// managed from the UI, e.g. a model pulled with Ollama. It's empty for the chats sent to the configured
+	// model of the profile.
+	Model string
+	// PersonaID is the ID of the persona of the chat, empty for the chats without persona.
+	PersonaID string
+	// Parameters override the parameters of the LLM and of the persona in this chat.
+	Parameters LLMParameters
+}
+
+// ChatsQuery describes a page of chats to retrieve from the store. Pinned chats come first, then chats
+// are paged from the most recently updated to the least recently updated one.
+type ChatsQuery struct {
+	// Cursor is the cursor returned with the previous page, empty for the first page.
+	Cursor string
+	// Limit is the maximum number of chats in the page.
+	Limit int
+
+	// Folder limits the page to the chats in the folder, if it's not empty.
+	Folder string
+	// Archived selects the archived chats instead of the unarchived ones.
+	Archived bool
+}
+
+// MessagesQuery describes a page of messages to retrieve from the store. Messages are paged backwards,
+// from the latest message to the first one, but each page is still ordered chronologically.
+type MessagesQuery struct {
+	// Cursor is the cursor returned with the previous page, empty for the page of the latest messages.
+	Cursor string
+	// Limit is the maximum number of messages in the page.
+	Limit int
 }
 
 // Message represents an individual communication entry within a chat. It contains the core components
@@ -29,15 +76,80 @@ type Message struct {
 	Role      Role
 	Contents  []Content
 	Timestamp time.Time
+
+	// Usage is the token usage of the LLM calls that generated the message. It's zero for user messages.
+	Usage Usage
+	// ContextTrim records the earlier messages that were left out of the LLM calls that generated the
+	// message, to fit the chat in the context window of the LLM. It's zero for user messages.
+	ContextTrim ContextTrim
+	// FallbackLLM is the name of the fallback LLM that answered, because the LLM of the chat failed. It's
+	// empty if the LLM of the chat answered, and for user messages.
+	FallbackLLM string
+	// Error records why the LLM failed to generate the message. It's zero if it didn't fail, and for user
+	// messages.
+	Error MessageError
+	// Finish records how the LLM finished generating the message, and how long it took. It's zero for user
+	// messages, and until the LLM finishes.
+	Finish Finish
+}
+
+// MessageError records why the LLM failed to generate a message, which is kept with the contents
+// generated before the failure, so the message can be retried.
+type MessageError struct {
+	Kind ErrorKind `json:"kind,omitempty"`
+	// Message describes the failure to the user. It's the message of the LLM provider, which never
+	// includes the request.
+	Message string `json:"message,omitempty"`
+}
+
+// ErrorKind is the kind of failure of an LLM, which tells the user what to do about it.
+type ErrorKind string
+
+// Finish records the end of an answer of an LLM: which model answered, and why it stopped.
+type Finish struct {
+	// Provider is the LLM provider that answered, e.g. "anthropic".
+	Provider string `json:"provider,omitempty"`
+	// Model is the model that answered, as reported by the provider, or as configured if it doesn't report
+	// it.
+	Model string `json:"model,omitempty"`
+	// StopReason is why the LLM stopped answering.
+	StopReason StopReason `json:"stopReason,omitempty"`
+	// NativeStopReason is the stop reason as named by the provider, e.g. "max_tokens" or "length".
+	NativeStopReason string `json:"nativeStopReason,omitempty"`
+	// Latency is the time the message took to generate, including the tool calls. It's measured by the
+	// chat, so it's zero in the finish yielded by the LLM streams.
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// StopReason is why an LLM stopped answering, normalized across the LLM providers.
+type StopReason string
+
+// ContextTrim records how the history of a chat was trimmed to fit in the context window of an LLM.
+// Tool results are elided first, then the earliest messages are replaced by a summary, or dropped if
+// they can't be summarized.
+type ContextTrim struct {
+	// ElidedToolResults is the number of tool results replaced by a placeholder.
+	ElidedToolResults int `json:"elidedToolResults,omitempty"`
+	// SummarizedMessages is the number of earliest messages replaced by a summary.
+	SummarizedMessages int `json:"summarizedMessages,omitempty"`
+	// DroppedMessages is the number of earliest messages left out without a summary.
+	DroppedMessages int `json:"droppedMessages,omitempty"`
 }
 
 // Content is a message content with its type.
 type Content struct {
 	Type ContentType
 
-	// Text would be filled if Type is ContentTypeText.
+	// Text would be filled if Type is ContentTypeText or ContentTypeThinking.
 	Text string
 
+	// ThinkingSignature would be filled if Type is ContentTypeThinking and the LLM signs its thinking, to
+	// verify the thinking when it's sent back to the LLM.
+	ThinkingSignature string `json:",omitempty"`
+	// RedactedThinking would be filled instead of Text if Type is ContentTypeThinking and the thinking
+	// was redacted by the LLM. It's the encrypted thinking that is sent back to the LLM as is.
+	RedactedThinking string `json:",omitempty"`
+
 	// ResourceContents would be filled if Type is ContentTypeResource.
 	ResourceContents []mcp.ResourceContents
 
@@ -54,6 +166,95 @@ type Content struct {
 	// CallToolFailed is a flag indicating if the call tool failed.
 	// This flag would be set to true if the call tool failed and Type is ContentTypeToolResult.
 	CallToolFailed bool
+
+	// Usage would be filled if Type is ContentTypeUsage.
+	Usage *Usage `json:",omitempty"`
+
+	// Finish would be filled if Type is ContentTypeFinish.
+	Finish *Finish `json:",omitempty"`
+}
+
+// IsZero reports whether the message didn't fail.
+func (e MessageError) IsZero() bool {
+	return e == MessageError{}
+}
+
+// Title returns a short title of the kind of failure, e.g. "Rate limited".
+func (k ErrorKind) Title() string {
+	switch k {
+	case ErrorKindAuth:
+		return "Authentication failed"
+	case ErrorKindRateLimit:
+		return "Rate limited"
+	case ErrorKindContextLength:
+		return "Context too long"
+	case ErrorKindOverloaded:
+		return "Provider overloaded"
+	case ErrorKindInvalidRequest:
+		return "Invalid request"
+	case ErrorKindUnsupported:
+		return "Not supported by the model"
+	default:
+		return "LLM error"
+	}
+}
+
+// IsZero reports whether the LLM hasn't finished.
+func (f Finish) IsZero() bool {
+	return f == Finish{}
+}
+
+// RoundedLatency returns the latency rounded to a tenth of a second, or to the millisecond if it's shorter
+// than a second, to be shown to the user.
+func (f Finish) RoundedLatency() time.Duration {
+	if f.Latency < time.Second {
+		return f.Latency.Round(time.Millisecond)
+	}
+	return f.Latency.Round(100 * time.Millisecond)
+}
+
+// Truncated reports whether the answer was cut off by the maximum number of output tokens, so it can be
+// continued.
+func (f Finish) Truncated() bool {
+	return f.StopReason == StopReasonMaxTokens
+}
+
+// Title returns a short description of the stop reason, e.g. "Max tokens reached".
+func (r StopReason) Title() string {
+	switch r {
+	case StopReasonEnd:
+		return "Completed"
+	case StopReasonMaxTokens:
+		return "Max tokens reached"
+	case StopReasonStopSequence:
+		return "Stop sequence"
+	case StopReasonToolUse:
+		return "Tool call"
+	case StopReasonContentFilter:
+		return "Content filtered"
+	default:
+		return "Stopped"
+	}
+}
+
+// IsZero reports whether nothing was trimmed.
+func (t ContextTrim) IsZero() bool {
+	return t == ContextTrim{}
+}
+
+// String describes what was trimmed, e.g. "2 tool results elided, 4 messages summarized".
+func (t ContextTrim) String() string {
+	var parts []string
+	if t.ElidedToolResults > 0 {
+		parts = append(parts, fmt.Sprintf("%d tool results elided", t.ElidedToolResults))
+	}
+	if t.SummarizedMessages > 0 {
+		parts = append(parts, fmt.Sprintf("%d messages summarized", t.SummarizedMessages))
+	}
+	if t.DroppedMessages > 0 {
+		parts = append(parts, fmt.Sprintf("%d messages dropped", t.DroppedMessages))
+	}
+	return strings.Join(parts, ", ")
 }
 
 // Role represents the role of a message participant.
@@ -77,6 +278,55 @@ const (
 	ContentTypeCallTool ContentType = "call_tool"
 	// ContentTypeToolResult represents the result of a tool call.
 	ContentTypeToolResult ContentType = "tool_result"
+	// ContentTypeThinking represents the reasoning of the LLM before its answer. The LLM streams yield
+	// the thinking text in chunks, then the signature, if any, in a content without text which ends the
+	// thinking block.
+	ContentTypeThinking ContentType = "thinking"
+	// ContentTypeStatus represents a transient status of an LLM call, e.g. a retry of a failed request.
+	// It's only yielded by the LLM streams, and is shown while the message is generated without being
+	// stored in its contents.
+	ContentTypeStatus ContentType = "status"
+	// ContentTypeFallback represents the switch of an LLM stream to a fallback LLM, named by the text, which
+	// answers instead of the failed one. It's only yielded by the LLM streams, and is recorded as the
+	// FallbackLLM of the message instead of being stored in its contents.
+	ContentTypeFallback ContentType = "fallback"
+	// ContentTypeUsage represents the token usage of an LLM call. It's only yielded by the LLM streams,
+	// before the call tool content if any, as the stream isn't read further after a tool call. It's
+	// accumulated into the Usage of the message instead of being stored in its contents.
+	ContentTypeUsage ContentType = "usage"
+	// ContentTypeFinish represents the end of an LLM call, with why the LLM stopped. It's only yielded by
+	// the LLM streams, before the call tool content if any, like the usage. It's recorded as the Finish of
+	// the message instead of being stored in its contents.
+	ContentTypeFinish ContentType = "finish"
+
+	// ErrorKindAuth is a failure to authenticate to the LLM provider, e.g. a missing or invalid API key.
+	ErrorKindAuth ErrorKind = "auth"
+	// ErrorKindRateLimit is a rate limit or quota of the LLM provider that was exceeded.
+	ErrorKindRateLimit ErrorKind = "rate_limit"
+	// ErrorKindContextLength is a chat that doesn't fit in the context window of the model.
+	ErrorKindContextLength ErrorKind = "context_length"
+	// ErrorKindOverloaded is an LLM provider that is overloaded or unavailable.
+	ErrorKindOverloaded ErrorKind = "overloaded"
+	// ErrorKindInvalidRequest is a request rejected by the LLM provider, e.g. an unknown model.
+	ErrorKindInvalidRequest ErrorKind = "invalid_request"
+	// ErrorKindUnsupported is a chat with content the model doesn't support, e.g. an image sent to a model
+	// without vision.
+	ErrorKindUnsupported ErrorKind = "unsupported"
+	// ErrorKindUnknown is any other failure, e.g. a network error.
+	ErrorKindUnknown ErrorKind = "unknown"
+
+	// StopReasonEnd is the natural end of the answer.
+	StopReasonEnd StopReason = "end"
+	// StopReasonMaxTokens is the maximum number of output tokens reached, which truncated the answer.
+	StopReasonMaxTokens StopReason = "max_tokens"
+	// StopReasonStopSequence is a stop sequence generated by the LLM.
+	StopReasonStopSequence StopReason = "stop_sequence"
+	// StopReasonToolUse is a tool call requested by the LLM.
+	StopReasonToolUse StopReason = "tool_use"
+	// StopReasonContentFilter is an answer blocked or cut off by the content filter of the provider.
+	StopReasonContentFilter StopReason = "content_filter"
+	// StopReasonOther is any other stop reason of the provider, kept in the native stop reason.
+	StopReasonOther StopReason = "other"
 )
 
 var mimeTypeToLanguage = map[string]string{
@@ -88,8 +338,33 @@ var mimeTypeToLanguage = map[string]string{
 	"text/css":         "css",
 }
 
-// RenderContents renders contents into a markdown string.
+// RenderContents renders contents into an HTML string, by converting the markdown produced by
+// RenderMarkdown.
 func RenderContents(contents []Content) (string, error) {
+	md := goldmark.New(
+		goldmark.WithExtensions(
+			extension.GFM,
+			highlighting.NewHighlighting(
+				highlighting.WithStyle("rose-pine"),
+			),
+		),
+		goldmark.WithRendererOptions(
+			html.WithHardWraps(), // To render newlines.
+			html.WithUnsafe(),    // To render details tag.
+		),
+	)
+
+	var buf bytes.Buffer
+	if err := md.Convert([]byte(RenderMarkdown(contents)), &buf); err != nil {
+		return "", fmt.Errorf("failed to convert markdown: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// RenderMarkdown renders contents into a markdown string. Thinking, resources and tool calls are
+// rendered as collapsible details blocks.
+func RenderMarkdown(contents []Content) string {
 	var sb strings.Builder
 	for _, content := range contents {
 		switch content.Type {
@@ -98,6 +373,18 @@ func RenderContents(contents []Content) (string, error) {
 				continue
 			}
 			sb.WriteString(content.Text)
+		case ContentTypeThinking:
+			if content.Text == "" && content.RedactedThinking == "" {
+				continue
+			}
+			sb.WriteString("  \n\n<details class=\"thinking\">\n")
+			sb.WriteString("<summary>Thinking</summary>\n\n")
+			if content.Text != "" {
+				sb.WriteString(content.Text)
+			} else {
+				sb.WriteString("_The thinking was redacted._")
+			}
+			sb.WriteString("\n\n</details>  \n\n")
 		case ContentTypeResource:
 			if len(content.ResourceContents) == 0 {
 				continue
@@ -158,25 +445,8 @@ func RenderContents(contents []Content) (string, error) {
 			sb.WriteString("\n</details>  \n\n")
 		}
 	}
-	md := goldmark.New(
-		goldmark.WithExtensions(
-			extension.GFM,
-			highlighting.NewHighlighting(
-				highlighting.WithStyle("rose-pine"),
-			),
-		),
-		goldmark.WithRendererOptions(
-			html.WithHardWraps(), // To render newlines.
-			html.WithUnsafe(),    // To render details tag.
-		),
-	)
 
-	var buf bytes.Buffer
-	if err := md.Convert([]byte(sb.String()), &buf); err != nil {
-		return "", fmt.Errorf("failed to convert markdown: %w", err)
-	}
-
-	return buf.String(), nil
+	return sb.String()
 }
 
 // String returns a string representation of the Content.
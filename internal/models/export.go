@@ -0,0 +1,49 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Export is the lossless export format of chats. It contains every chat with all of its messages, as
+// they are stored, including tool calls, tool results and attached resources.
+type Export struct {
+	// Version is the version of the export format, it's increased on incompatible changes.
+	Version    int
+	ExportedAt time.Time
+	Chats      []ChatExport
+}
+
+// ChatExport is a chat and its messages, in their stored order.
+type ChatExport struct {
+	Chat     Chat
+	Messages []Message
+}
+
+// ExportVersion is the current version of the Export format.
+const ExportVersion = 1
+
+// Markdown renders the chat export as a human-readable markdown document. Each message is rendered
+// with RenderMarkdown under a heading containing its role and timestamp.
+func (c ChatExport) Markdown() string {
+	var sb strings.Builder
+
+	title := c.Chat.Title
+	if title == "" {
+		title = "New Chat"
+	}
+	sb.WriteString(fmt.Sprintf("# %s\n\n", title))
+
+	for _, msg := range c.Messages {
+		role := "User"
+		if msg.Role == RoleAssistant {
+			role = "Assistant"
+		}
+		sb.WriteString(fmt.Sprintf("## %s (%s)\n\n", role, msg.Timestamp.Format(time.RFC3339)))
+		sb.WriteString(strings.TrimSpace(RenderMarkdown(msg.Contents)))
+		sb.WriteString("\n\n")
+	}
+
+	return sb.String()
+}
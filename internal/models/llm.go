@@ -0,0 +1,283 @@
+package models
+
+import (
+	"cmp"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+)
+
+// LLMParameters contains the optional configuration parameters for LLM services.
+//
+// Not all parameters are supported by all LLM providers. The parameters are documented in the
+// corresponding LLM provider's documentation.
+//
+// These parameters is taken from OpenRouter documentation:
+// https://openrouter.ai/docs/api-reference/parameters
+// For more information obout what these parameters do, please refer to it.
+type LLMParameters struct {
+	Temperature       *float32       `yaml:"temperature" json:"temperature,omitempty"`
+	TopP              *float32       `yaml:"topP" json:"topP,omitempty"`
+	TopK              *int           `yaml:"topK" json:"topK,omitempty"`
+	FrequencyPenalty  *float32       `yaml:"frequencyPenalty" json:"frequencyPenalty,omitempty"`
+	PresencePenalty   *float32       `yaml:"presencePenalty" json:"presencePenalty,omitempty"`
+	RepetitionPenalty *float32       `yaml:"repetitionPenalty" json:"repetitionPenalty,omitempty"`
+	MinP              *float32       `yaml:"minP" json:"minP,omitempty"`
+	TopA              *float32       `yaml:"topA" json:"topA,omitempty"`
+	Seed              *int           `yaml:"seed" json:"seed,omitempty"`
+	MaxTokens         *int           `yaml:"maxTokens" json:"maxTokens,omitempty"`
+	LogitBias         map[string]int `yaml:"logitBias" json:"logitBias,omitempty"`
+	Logprobs          *bool          `yaml:"logprobs" json:"logprobs,omitempty"`
+	TopLogprobs       *int           `yaml:"topLogprobs" json:"topLogprobs,omitempty"`
+	Stop              []string       `yaml:"stop" json:"stop,omitempty"`
+	IncludeReasoning  *bool          `yaml:"includeReasoning" json:"includeReasoning,omitempty"`
+}
+
+// ChatOptions are the options of a single LLM chat call. They take precedence over the configuration
+// of the LLM, so the same LLM can be used by chats with different personas.
+type ChatOptions struct {
+	// SystemPrompt replaces the configured system prompt of the LLM, if it's not empty.
+	SystemPrompt string
+	// Parameters override the configured parameters of the LLM, for the parameters that are set.
+	Parameters LLMParameters
+	// Model replaces the configured model of the LLM, if it's not empty. It's one of the local models of
+	// the LLMs whose models are managed from the UI, and ignored by the other LLMs.
+	Model string
+}
+
+// ModelCapabilities are the features of a model that the chats are adapted to. A capability is nil if it's
+// unknown.
+type ModelCapabilities struct {
+	// Tools is true if the model can call tools.
+	Tools *bool
+	// Vision is true if the model accepts images.
+	Vision *bool
+}
+
+// LocalModel is a model available on an LLM server that runs the models locally, such as Ollama.
+type LocalModel struct {
+	Name       string
+	ModifiedAt time.Time
+	// Size is the size of the model on disk, in bytes.
+	Size int64
+
+	Family string
+	// ParameterSize is the number of parameters of the model, e.g. "8.0B".
+	ParameterSize string
+	// QuantizationLevel is the quantization of the weights of the model, e.g. "Q4_K_M".
+	QuantizationLevel string
+}
+
+// LocalModelDetails are the details of a local model, read from its metadata.
+type LocalModelDetails struct {
+	LocalModel
+
+	// ContextLength is the maximum number of tokens the model was trained with, zero if it's unknown.
+	ContextLength int
+	// Capabilities are what the model supports, such as "completion", "tools" and "vision".
+	Capabilities []string
+	// License is the license of the model, if any.
+	License string
+}
+
+// PullProgress is the progress of the download of a local model.
+type PullProgress struct {
+	// Status describes the current step of the download, e.g. "pulling manifest" or "success".
+	Status string
+	// Completed and Total are the downloaded and total bytes of the current layer of the model, zero if
+	// the step doesn't download anything.
+	Completed int64
+	Total     int64
+}
+
+// Persona is a reusable assistant configuration that users can select for a chat.
+type Persona struct {
+	ID   string
+	Name string
+
+	// SystemPrompt replaces the default system prompt in the chats with the persona.
+	SystemPrompt string
+	// Tools are the names of the tools available in the chats with the persona. All tools are available
+	// if it's empty.
+	Tools []string
+	// Parameters override the parameters of the LLM in the chats with the persona.
+	Parameters LLMParameters
+
+	// ReadOnly personas are defined in the configuration, so they can't be deleted from the UI.
+	ReadOnly bool `json:"-"`
+}
+
+// SizeGB returns the size of the model on disk in gigabytes, for display.
+func (m LocalModel) SizeGB() float64 {
+	return float64(m.Size) / 1e9
+}
+
+// Percent returns the percentage of the current layer that is downloaded, zero if it's unknown.
+func (p PullProgress) Percent() int {
+	if p.Total <= 0 {
+		return 0
+	}
+	return int(p.Completed * 100 / p.Total)
+}
+
+// Merge returns the parameters with the parameters that are set in override replacing their values.
+func (p LLMParameters) Merge(override LLMParameters) LLMParameters {
+	if override.Temperature != nil {
+		p.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		p.TopP = override.TopP
+	}
+	if override.TopK != nil {
+		p.TopK = override.TopK
+	}
+	if override.FrequencyPenalty != nil {
+		p.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.PresencePenalty != nil {
+		p.PresencePenalty = override.PresencePenalty
+	}
+	if override.RepetitionPenalty != nil {
+		p.RepetitionPenalty = override.RepetitionPenalty
+	}
+	if override.MinP != nil {
+		p.MinP = override.MinP
+	}
+	if override.TopA != nil {
+		p.TopA = override.TopA
+	}
+	if override.Seed != nil {
+		p.Seed = override.Seed
+	}
+	if override.MaxTokens != nil {
+		p.MaxTokens = override.MaxTokens
+	}
+	if override.LogitBias != nil {
+		p.LogitBias = override.LogitBias
+	}
+	if override.Logprobs != nil {
+		p.Logprobs = override.Logprobs
+	}
+	if override.TopLogprobs != nil {
+		p.TopLogprobs = override.TopLogprobs
+	}
+	if override.Stop != nil {
+		p.Stop = override.Stop
+	}
+	if override.IncludeReasoning != nil {
+		p.IncludeReasoning = override.IncludeReasoning
+	}
+	return p
+}
+
+// Names returns the names of the parameters that are set, as they're named in the configuration.
+func (p LLMParameters) Names() []string {
+	var names []string
+	add := func(set bool, name string) {
+		if set {
+			names = append(names, name)
+		}
+	}
+	add(p.Temperature != nil, "temperature")
+	add(p.TopP != nil, "topP")
+	add(p.TopK != nil, "topK")
+	add(p.FrequencyPenalty != nil, "frequencyPenalty")
+	add(p.PresencePenalty != nil, "presencePenalty")
+	add(p.RepetitionPenalty != nil, "repetitionPenalty")
+	add(p.MinP != nil, "minP")
+	add(p.TopA != nil, "topA")
+	add(p.Seed != nil, "seed")
+	add(p.MaxTokens != nil, "maxTokens")
+	add(p.LogitBias != nil, "logitBias")
+	add(p.Logprobs != nil, "logprobs")
+	add(p.TopLogprobs != nil, "topLogprobs")
+	add(p.Stop != nil, "stop")
+	add(p.IncludeReasoning != nil, "includeReasoning")
+	return names
+}
+
+// Usage is the token usage of LLM calls, and their estimated cost.
+type Usage struct {
+	InputTokens  int
+	OutputTokens int
+	// CacheReadTokens and CacheWriteTokens are the input tokens that were read from and written to the
+	// prompt cache of the LLM provider. They are included in the InputTokens.
+	CacheReadTokens  int
+	CacheWriteTokens int
+	// Cost is the cost in USD, either reported by the LLM provider, or estimated from the configured
+	// price of the model. It's zero if neither is available.
+	Cost float64
+}
+
+// Add returns the sum of both usages.
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		InputTokens:      u.InputTokens + other.InputTokens,
+		OutputTokens:     u.OutputTokens + other.OutputTokens,
+		CacheReadTokens:  u.CacheReadTokens + other.CacheReadTokens,
+		CacheWriteTokens: u.CacheWriteTokens + other.CacheWriteTokens,
+		Cost:             u.Cost + other.Cost,
+	}
+}
+
+// TotalTokens returns the sum of the input and output tokens.
+func (u Usage) TotalTokens() int {
+	return u.InputTokens + u.OutputTokens
+}
+
+// ChatUsage is the total usage of the messages of a chat.
+type ChatUsage struct {
+	ChatID    string
+	ChatTitle string
+	Usage     Usage
+}
+
+// Price is the price of an LLM model, in USD per million tokens. The input tokens read from and written
+// to the prompt cache are priced as the other input tokens, unless their own price is set.
+type Price struct {
+	Input      float64 `yaml:"input"`
+	Output     float64 `yaml:"output"`
+	CacheRead  float64 `yaml:"cacheRead"`
+	CacheWrite float64 `yaml:"cacheWrite"`
+}
+
+// Cost returns the estimated cost of the usage in USD.
+func (p Price) Cost(u Usage) float64 {
+	uncached := u.InputTokens - u.CacheReadTokens - u.CacheWriteTokens
+	return (float64(uncached)*p.Input +
+		float64(u.CacheReadTokens)*cmp.Or(p.CacheRead, p.Input) +
+		float64(u.CacheWriteTokens)*cmp.Or(p.CacheWrite, p.Input) +
+		float64(u.OutputTokens)*p.Output) / 1_000_000
+}
+
+// messageTokenOverhead is the estimated number of tokens each message takes besides its contents, for
+// its role and delimiters.
+const messageTokenOverhead = 4
+
+// blobTokenEstimate is the estimated number of tokens of an image or another binary resource. The LLMs
+// don't read their base64 encoding as text, the images are billed by their size in pixels, which is about
+// 1,600 tokens for the largest images that aren't downscaled.
+const blobTokenEstimate = 1600
+
+// EstimateTokens estimates the number of input tokens of an LLM call with the given system prompt,
+// messages and tools, from the number of characters that make up a token on average for the tokenizer
+// of the LLM. The binary resources are estimated at blobTokenEstimate tokens each, whatever their size.
+// It's a rough estimate, meant to keep the chats within the context window of the LLM.
+func EstimateTokens(systemPrompt string, messages []Message, tools []mcp.Tool, charsPerToken float64) int {
+	chars, blobs := len(systemPrompt), 0
+	for _, msg := range messages {
+		for _, content := range msg.Contents {
+			chars += len(content.Text) + len(content.ToolName) + len(content.ToolInput) + len(content.ToolResult)
+			for _, resource := range content.ResourceContents {
+				chars += len(resource.URI) + len(resource.Text)
+				if resource.Blob != "" {
+					blobs++
+				}
+			}
+		}
+	}
+	for _, tool := range tools {
+		chars += len(tool.Name) + len(tool.Description) + len(tool.InputSchema)
+	}
+	return int(float64(chars)/charsPerToken) + blobs*blobTokenEstimate + len(messages)*messageTokenOverhead
+}
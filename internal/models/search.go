@@ -0,0 +1,118 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+)
+
+// SearchResult represents a single match of a full-text search across chats. A result either points
+// to a message inside a chat, or, if MessageID is empty, to the chat title itself.
+type SearchResult struct {
+	ChatID    string
+	ChatTitle string
+	MessageID string
+
+	// Snippet is a plain-text excerpt of the matched document, centered around the first match.
+	Snippet string
+}
+
+const (
+	minSearchTermLength = 2
+	snippetRadius       = 60
+)
+
+// SearchTerms splits text into lowercased search terms. Terms are sequences of letters and digits, and
+// terms shorter than two characters are dropped. Each term is returned only once, in the order of its
+// first occurrence.
+func SearchTerms(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]struct{}, len(fields))
+	terms := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if len([]rune(f)) < minSearchTermLength {
+			continue
+		}
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		seen[f] = struct{}{}
+		terms = append(terms, f)
+	}
+	return terms
+}
+
+// SearchText returns the searchable text of the message, which consists of its text contents and the
+// names of the tools it called. Resources and tool results are left out, as they tend to be large and
+// would drown the actual conversation in the search results.
+func (m Message) SearchText() string {
+	parts := make([]string, 0, len(m.Contents))
+	for _, ct := range m.Contents {
+		switch ct.Type {
+		case ContentTypeText:
+			if ct.Text != "" {
+				parts = append(parts, ct.Text)
+			}
+		case ContentTypeCallTool:
+			parts = append(parts, ct.ToolName)
+		case ContentTypeResource, ContentTypeToolResult:
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Snippet returns an excerpt of text around the first occurrence of any of the given terms. The
+// excerpt is prefixed or suffixed with an ellipsis if it was cut. If none of the terms is found, the
+// beginning of text is returned.
+func Snippet(text string, terms []string) string {
+	runes := []rune(text)
+	// We lowercase rune by rune, so the indexes in lower always match the indexes in runes.
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	matchAt := -1
+	for _, term := range terms {
+		idx := indexRunes(lower, []rune(term))
+		if idx >= 0 && (matchAt < 0 || idx < matchAt) {
+			matchAt = idx
+		}
+	}
+	if matchAt < 0 {
+		matchAt = 0
+	}
+
+	start := max(matchAt-snippetRadius, 0)
+	end := min(matchAt+snippetRadius, len(runes))
+
+	snippet := strings.Join(strings.Fields(string(runes[start:end])), " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+func indexRunes(s, sub []rune) int {
+	if len(sub) == 0 || len(sub) > len(s) {
+		return -1
+	}
+	for i := 0; i+len(sub) <= len(s); i++ {
+		match := true
+		for j := range sub {
+			if s[i+j] != sub[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
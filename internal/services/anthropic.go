@@ -2,13 +2,14 @@ package services
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"iter"
+	"log/slog"
 	"net/http"
 	"strings"
 
@@ -22,21 +23,50 @@ import (
 type Anthropic struct {
 	apiKey       string
 	model        string
+	endpoint     string
 	maxTokens    int
 	systemPrompt string
+	// thinkingBudget is the number of tokens Claude may use to think before answering, zero to disable
+	// the extended thinking.
+	thinkingBudget int
+	caching        AnthropicCaching
+	retry          RetryPolicy
 
-	params LLMParameters
+	params models.LLMParameters
+	// extra are the vendor-specific fields merged into the request body.
+	extra map[string]any
 
 	client *http.Client
+
+	logger *slog.Logger
+}
+
+// AnthropicCaching selects the parts of the requests that are cached by the prompt caching of
+// Anthropic, so the following requests that start with the same parts read them from the cache at a
+// fraction of the price of the input tokens. Each cached part is a cache breakpoint, and Anthropic
+// caches the whole request prefix up to the breakpoint.
+type AnthropicCaching struct {
+	// SystemPrompt caches the system prompt.
+	SystemPrompt bool
+	// Tools caches the tool definitions, along with the system prompt that precedes them.
+	Tools bool
+	// History caches the messages up to the latest one, which is the stable prefix of the following
+	// requests of the chat, e.g. the agentic turns that add the tool results to it.
+	History bool
 }
 
+// AnthropicParameters are the names of the LLM parameters supported by Anthropic, the others are ignored.
+var AnthropicParameters = []string{"temperature", "topP", "topK", "maxTokens", "stop", "includeReasoning"}
+
 type anthropicChatRequest struct {
-	Model     string             `json:"model"`
-	Messages  []anthropicMessage `json:"messages"`
-	System    string             `json:"system"`
-	MaxTokens int                `json:"max_tokens"`
-	Tools     []anthropicTool    `json:"tools"`
-	Stream    bool               `json:"stream"`
+	Model     string                    `json:"model"`
+	Messages  []anthropicMessage        `json:"messages"`
+	System    []anthropicMessageContent `json:"system,omitempty"`
+	MaxTokens int                       `json:"max_tokens"`
+	Tools     []anthropicTool           `json:"tools"`
+	Stream    bool                      `json:"stream"`
+
+	Thinking *anthropicThinking `json:"thinking,omitempty"`
 
 	StopSequences []string `json:"stop_sequences,omitempty"`
 	Temperature   *float32 `json:"temperature,omitempty"`
@@ -44,6 +74,11 @@ type anthropicChatRequest struct {
 	TopP          *float32 `json:"top_p,omitempty"`
 }
 
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
 type anthropicMessage struct {
 	Role    string                    `json:"role"`
 	Content []anthropicMessageContent `json:"content"`
@@ -52,9 +87,18 @@ type anthropicMessage struct {
 type anthropicMessageContent struct {
 	Type string `json:"type"`
 
+	CacheControl *anthropicCacheControl `json:"cache_control,omitempty"`
+
 	// For text type.
 	Text string `json:"text,omitempty"`
 
+	// For thinking type.
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+
+	// For redacted_thinking type.
+	Data string `json:"data,omitempty"`
+
 	// For image and document type.
 	Source *anthropicResourceContent `json:"source,omitempty"`
 
@@ -69,6 +113,10 @@ type anthropicMessageContent struct {
 	IsError   bool            `json:"is_error,omitempty"`
 }
 
+type anthropicCacheControl struct {
+	Type string `json:"type"`
+}
+
 type anthropicResourceContent struct {
 	Type      string `json:"type"`
 	MediaType string `json:"media_type"`
@@ -82,6 +130,7 @@ type anthropicContentBlockStart struct {
 		ID    string          `json:"id"`
 		Name  string          `json:"name"`
 		Input json.RawMessage `json:"input"`
+		Data  string          `json:"data"`
 	} `json:"content_block"`
 }
 
@@ -91,9 +140,32 @@ type anthropicContentBlockDelta struct {
 		Type        string `json:"type"`
 		Text        string `json:"text"`
 		PartialJSON string `json:"partial_json"`
+		Thinking    string `json:"thinking"`
+		Signature   string `json:"signature"`
 	} `json:"delta"`
 }
 
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+type anthropicMessageStart struct {
+	Message struct {
+		Model string         `json:"model"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+}
+
+type anthropicMessageDelta struct {
+	Delta struct {
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+}
+
 type anthropicError struct {
 	Type  string `json:"type"`
 	Error struct {
@@ -106,38 +178,85 @@ type anthropicTool struct {
 	Name        string          `json:"name"`
 	Description string          `json:"description"`
 	InputSchema json.RawMessage `json:"input_schema"`
+
+	CacheControl *anthropicCacheControl `json:"cache_control,omitempty"`
 }
 
 const (
 	anthropicAPIEndpoint = "https://api.anthropic.com/v1"
 )
 
-// NewAnthropic creates a new Anthropic instance with the specified API key, model name, and maximum
-// token limit. It initializes an HTTP client for API communication and returns a configured Anthropic
-// instance ready for chat interactions.
-func NewAnthropic(apiKey, model, systemPrompt string, maxTokens int, params LLMParameters) Anthropic {
+// NewAnthropic creates a new Anthropic instance with the specified API key, model name, endpoint of the
+// Anthropic API, and maximum token limit. The endpoint defaults to the public endpoint if it's empty. It
+// initializes an HTTP client for API communication and returns a configured Anthropic instance ready for
+// chat interactions.
+func NewAnthropic(
+	apiKey, model, systemPrompt, endpoint string,
+	maxTokens int,
+	params models.LLMParameters,
+	logger *slog.Logger,
+) Anthropic {
 	return Anthropic{
 		apiKey:       apiKey,
 		model:        model,
+		endpoint:     strings.TrimSuffix(cmp.Or(endpoint, anthropicAPIEndpoint), "/"),
 		maxTokens:    maxTokens,
 		systemPrompt: systemPrompt,
 		params:       params,
+		retry:        DefaultRetryPolicy,
 		client:       &http.Client{},
+		logger:       logger.With(slog.String("module", "anthropic")),
 	}
 }
 
+// WithThinking returns a copy of a with the extended thinking enabled, letting Claude think with up to
+// budgetTokens tokens before answering. The budget must be lower than the maximum token limit. The
+// thinking is streamed as models.ContentTypeThinking contents, unless the IncludeReasoning parameter is
+// false, which disables the thinking.
+func (a Anthropic) WithThinking(budgetTokens int) Anthropic {
+	a.thinkingBudget = budgetTokens
+	return a
+}
+
+// WithRetry returns a copy of a that retries the failed requests with the given policy.
+func (a Anthropic) WithRetry(policy RetryPolicy) Anthropic {
+	a.retry = policy
+	return a
+}
+
+// WithExtra returns a copy of a that merges the extra fields into the body of its requests.
+func (a Anthropic) WithExtra(extra map[string]any) Anthropic {
+	a.extra = extra
+	return a
+}
+
+// WithPromptCaching returns a copy of a that caches the given parts of its chat requests.
+func (a Anthropic) WithPromptCaching(caching AnthropicCaching) Anthropic {
+	a.caching = caching
+	return a
+}
+
 // Chat streams responses from the Anthropic API for a given sequence of messages. It processes system
 // messages separately and returns an iterator that yields response chunks and potential errors. The
 // context can be used to cancel ongoing requests. Refer to models.Message for message structure details.
+// The system prompt and parameters of opts take precedence over the configured ones.
 func (a Anthropic) Chat(
 	ctx context.Context,
 	messages []models.Message,
 	tools []mcp.Tool,
+	opts models.ChatOptions,
 ) iter.Seq2[models.Content, error] {
 	return func(yield func(models.Content, error) bool) {
-		resp, err := a.doRequest(ctx, messages, tools, true)
+		var resp *http.Response
+		err := a.retry.retry(ctx, "Anthropic", func() error {
+			var err error
+			resp, err = a.doRequest(ctx, messages, tools, opts, true)
+			return err
+		}, func(status models.Content) bool {
+			return yield(status, nil)
+		})
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
+			if errors.Is(err, context.Canceled) || errors.Is(err, errStreamStopped) {
 				return
 			}
 			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
@@ -150,6 +269,10 @@ func (a Anthropic) Chat(
 		toolContent := models.Content{
 			Type: models.ContentTypeCallTool,
 		}
+		// The tool call is yielded at the end of the message, after the usage that is only known then.
+		var pendingToolContent *models.Content
+		var usage models.Usage
+		model, stopReason := a.model, ""
 		for ev, err := range sse.Read(resp.Body, nil) {
 			if err != nil {
 				yield(models.Content{}, fmt.Errorf("error reading response: %w", err))
@@ -162,9 +285,42 @@ func (a Anthropic) Chat(
 					yield(models.Content{}, fmt.Errorf("error unmarshaling error: %w", err))
 					return
 				}
-				yield(models.Content{}, fmt.Errorf("anthropic error %s: %s", e.Error.Type, e.Error.Message))
+				yield(models.Content{}, newTypedLLMError(e.Error.Type, e.Error.Message))
 				return
+			case "message_start":
+				var res anthropicMessageStart
+				if err := json.Unmarshal([]byte(ev.Data), &res); err != nil {
+					yield(models.Content{}, fmt.Errorf("error unmarshaling message start: %w", err))
+					return
+				}
+				model = cmp.Or(res.Message.Model, model)
+				u := res.Message.Usage
+				usage.InputTokens = u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+				usage.CacheReadTokens = u.CacheReadInputTokens
+				usage.CacheWriteTokens = u.CacheCreationInputTokens
+				a.logger.Debug("Prompt cache usage",
+					slog.Int("inputTokens", usage.InputTokens),
+					slog.Int("cacheReadTokens", usage.CacheReadTokens),
+					slog.Int("cacheWriteTokens", usage.CacheWriteTokens))
+			case "message_delta":
+				var res anthropicMessageDelta
+				if err := json.Unmarshal([]byte(ev.Data), &res); err != nil {
+					yield(models.Content{}, fmt.Errorf("error unmarshaling message delta: %w", err))
+					return
+				}
+				// The output tokens of the delta are cumulative.
+				usage.OutputTokens = res.Usage.OutputTokens
+				stopReason = cmp.Or(res.Delta.StopReason, stopReason)
+				if !yield(models.Content{Type: models.ContentTypeUsage, Usage: &usage}, nil) {
+					return
+				}
 			case "message_stop":
+				if !yield(finishContent("anthropic", model, stopReason), nil) {
+					return
+				}
+				if pendingToolContent != nil {
+					yield(*pendingToolContent, nil)
+				}
 				return
 			case "content_block_start":
 				var res anthropicContentBlockStart
@@ -172,7 +328,17 @@ func (a Anthropic) Chat(
 					yield(models.Content{}, fmt.Errorf("error unmarshaling block start: %w", err))
 					return
 				}
-				if res.ContentBlock.Type != "tool_use" {
+				switch res.ContentBlock.Type {
+				case "redacted_thinking":
+					if !yield(models.Content{
+						Type:             models.ContentTypeThinking,
+						RedactedThinking: res.ContentBlock.Data,
+					}, nil) {
+						return
+					}
+					continue
+				case "tool_use":
+				default:
 					continue
 				}
 				isToolUse = true
@@ -184,14 +350,19 @@ func (a Anthropic) Chat(
 					yield(models.Content{}, fmt.Errorf("error unmarshaling block delta: %w", err))
 					return
 				}
-				if isToolUse {
+				var content models.Content
+				switch res.Delta.Type {
+				case "input_json_delta":
 					inputJSON += res.Delta.PartialJSON
 					continue
+				case "thinking_delta":
+					content = models.Content{Type: models.ContentTypeThinking, Text: res.Delta.Thinking}
+				case "signature_delta":
+					content = models.Content{Type: models.ContentTypeThinking, ThinkingSignature: res.Delta.Signature}
+				default:
+					content = models.Content{Type: models.ContentTypeText, Text: res.Delta.Text}
 				}
-				if !yield(models.Content{
-					Type: models.ContentTypeText,
-					Text: res.Delta.Text,
-				}, nil) {
+				if !yield(content, nil) {
 					return
 				}
 			case "content_block_stop":
@@ -203,8 +374,10 @@ func (a Anthropic) Chat(
 					inputJSON = "{}"
 				}
 				toolContent.ToolInput = json.RawMessage(inputJSON)
-				if !yield(toolContent, nil) {
-					return
+				// Only the first tool call is used, as the chat calls one tool at a time.
+				if pendingToolContent == nil {
+					content := toolContent
+					pendingToolContent = &content
 				}
 				isToolUse = false
 				inputJSON = ""
@@ -214,6 +387,13 @@ func (a Anthropic) Chat(
 	}
 }
 
+// EstimateTokens estimates the number of input tokens of a chat call with the given messages, tools and
+// options, to fit the chat in the context window of the model. It's based on the fact that Claude models
+// tokenize English text into about 3.5 characters per token.
+func (a Anthropic) EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int {
+	return models.EstimateTokens(cmp.Or(opts.SystemPrompt, a.systemPrompt), messages, tools, 3.5)
+}
+
 // GenerateTitle generates a title for a given message using the Anthropic API. It sends a single message to the
 // Anthropic API and returns the first response content as the title. The context can be used to cancel ongoing
 // requests.
@@ -229,35 +409,43 @@ func (a Anthropic) GenerateTitle(ctx context.Context, message string) (string, e
 			},
 		},
 	}
-	resp, err := a.doRequest(ctx, messages, nil, false)
+	// The titles are short enough to not need the extended thinking, which would only delay them.
+	a.thinkingBudget = 0
+
+	var resp *http.Response
+	err := a.retry.retry(ctx, "Anthropic", func() error {
+		var err error
+		resp, err = a.doRequest(ctx, messages, nil, models.ChatOptions{}, false)
+		return err
+	}, nil)
 	if err != nil {
 		return "", fmt.Errorf("error sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
-	}
-
 	var msg anthropicMessage
 	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
 		return "", fmt.Errorf("error decoding response: %w", err)
 	}
 
-	if len(msg.Content) == 0 {
-		return "", fmt.Errorf("empty response content")
+	// The thinking blocks, if enabled by the extra parameters, come before the text.
+	for _, content := range msg.Content {
+		if content.Type == "text" {
+			return content.Text, nil
+		}
 	}
-
-	return msg.Content[0].Text, nil
+	return "", fmt.Errorf("empty response content")
 }
 
 func (a Anthropic) doRequest(
 	ctx context.Context,
 	messages []models.Message,
 	tools []mcp.Tool,
+	opts models.ChatOptions,
 	stream bool,
 ) (*http.Response, error) {
+	params := a.params.Merge(opts.Parameters)
+
 	msgs, err := a.convertMessages(messages)
 	if err != nil {
 		return nil, err
@@ -275,8 +463,8 @@ func (a Anthropic) doRequest(
 	// Filter out invalid stop sequences by trimming whitespace
 	// because antrhopic doesn't support whitespace in stop sequences
 	var validStopSequences []string
-	if a.params.Stop != nil {
-		for _, seq := range a.params.Stop {
+	if params.Stop != nil {
+		for _, seq := range params.Stop {
 			// Trim all whitespace and check if anything remains
 			trimmed := strings.TrimSpace(seq)
 			if trimmed != "" {
@@ -285,27 +473,50 @@ func (a Anthropic) doRequest(
 		}
 	}
 
+	var system []anthropicMessageContent
+	if systemPrompt := cmp.Or(opts.SystemPrompt, a.systemPrompt); systemPrompt != "" {
+		system = []anthropicMessageContent{{Type: "text", Text: systemPrompt}}
+	}
+
+	// The requests of the chats are cached, but not the single requests that generate the titles.
+	if stream {
+		a.addCacheBreakpoints(system, aTools, msgs)
+	}
+
 	reqBody := anthropicChatRequest{
 		Model:     a.model,
 		Messages:  msgs,
-		System:    a.systemPrompt,
+		System:    system,
 		MaxTokens: a.maxTokens,
 		Tools:     aTools,
 		Stream:    stream,
 
 		StopSequences: validStopSequences,
-		Temperature:   a.params.Temperature,
-		TopK:          a.params.TopK,
-		TopP:          a.params.TopP,
+		Temperature:   params.Temperature,
+		TopK:          params.TopK,
+		TopP:          params.TopP,
+	}
+	if params.MaxTokens != nil {
+		reqBody.MaxTokens = *params.MaxTokens
+	}
+	if a.thinkingBudget > 0 && (params.IncludeReasoning == nil || *params.IncludeReasoning) {
+		reqBody.Thinking = &anthropicThinking{Type: "enabled", BudgetTokens: a.thinkingBudget}
+		// The extended thinking isn't compatible with the sampling parameters.
+		reqBody.Temperature = nil
+		reqBody.TopK = nil
+		reqBody.TopP = nil
 	}
 
 	jsonBody, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling request: %w", err)
 	}
+	if jsonBody, err = mergeExtra(jsonBody, a.extra); err != nil {
+		return nil, err
+	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		anthropicAPIEndpoint+"/messages", bytes.NewBuffer(jsonBody))
+		a.endpoint+"/messages", bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
@@ -319,13 +530,39 @@ func (a Anthropic) doRequest(
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code: %d, body: %s, request: %s", resp.StatusCode, string(body), jsonBody)
+		return nil, newStatusError(resp)
 	}
 
 	return resp, nil
 }
 
+// addCacheBreakpoints marks the last system block, tool and message content for caching, as selected by
+// the caching configuration.
+func (a Anthropic) addCacheBreakpoints(
+	system []anthropicMessageContent,
+	tools []anthropicTool,
+	msgs []anthropicMessage,
+) {
+	cacheControl := &anthropicCacheControl{Type: "ephemeral"}
+	if a.caching.SystemPrompt && len(system) > 0 {
+		system[len(system)-1].CacheControl = cacheControl
+	}
+	if a.caching.Tools && len(tools) > 0 {
+		tools[len(tools)-1].CacheControl = cacheControl
+	}
+	if !a.caching.History || len(msgs) == 0 {
+		return
+	}
+	// The thinking blocks can't be cached directly, they're cached as part of the prefix.
+	contents := msgs[len(msgs)-1].Content
+	for i := len(contents) - 1; i >= 0; i-- {
+		if contents[i].Type != "thinking" && contents[i].Type != "redacted_thinking" {
+			contents[i].CacheControl = cacheControl
+			return
+		}
+	}
+}
+
 func (a Anthropic) convertMessages(messages []models.Message) ([]anthropicMessage, error) {
 	var msgs []anthropicMessage
 
@@ -363,7 +600,7 @@ func (a Anthropic) processUserMessage(msg models.Message) (anthropicMessage, err
 			}
 		case models.ContentTypeResource:
 			contents = append(contents, a.processResourceContents(ct.ResourceContents)...)
-		case models.ContentTypeCallTool, models.ContentTypeToolResult:
+		case models.ContentTypeCallTool, models.ContentTypeToolResult, models.ContentTypeThinking:
 			return anthropicMessage{}, fmt.Errorf("content type %s is not supported for user messages", ct.Type)
 		}
 	}
@@ -387,6 +624,22 @@ func (a Anthropic) processOtherRoleMessage(msg models.Message) ([]anthropicMessa
 					Text: ct.Text,
 				})
 			}
+		case models.ContentTypeThinking:
+			// Only the thinking signed by Anthropic can be sent back, the thinking of other providers is
+			// dropped.
+			switch {
+			case ct.RedactedThinking != "":
+				contents = append(contents, anthropicMessageContent{
+					Type: "redacted_thinking",
+					Data: ct.RedactedThinking,
+				})
+			case ct.ThinkingSignature != "":
+				contents = append(contents, anthropicMessageContent{
+					Type:      "thinking",
+					Thinking:  ct.Text,
+					Signature: ct.ThinkingSignature,
+				})
+			}
 		case models.ContentTypeCallTool:
 			contents = append(contents, anthropicMessageContent{
 				Type:  "tool_use",
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// anthropicStreamHandler returns a handler of a test server of the Anthropic API that streams the events as
+// server-sent events, named by their type.
+func anthropicStreamHandler(events ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			var e struct {
+				Type string `json:"type"`
+			}
+			_ = json.Unmarshal([]byte(event), &e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, event)
+		}
+	}
+}
+
+func TestAnthropicChatUsage(t *testing.T) {
+	srv := newRecordingServer(t, anthropicStreamHandler(
+		`{"type": "message_start", "message": {"model": "claude-test", "usage": {"input_tokens": 12, `+
+			`"output_tokens": 1}}}`,
+		`{"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`,
+		`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "Hello"}}`,
+		`{"type": "content_block_stop", "index": 0}`,
+		`{"type": "message_delta", "delta": {"stop_reason": "end_turn"}, "usage": {"output_tokens": 4}}`,
+		`{"type": "message_stop"}`,
+	))
+	anthropic := NewAnthropic("test-key", "claude-test", "", srv.URL, 1024, models.LLMParameters{}, slog.Default())
+
+	// The input tokens are sent at the start of the message, and the cumulative output tokens at its end.
+	contents := collectChat(t, anthropic)
+	usage := chatUsage(t, contents)
+	if usage.InputTokens != 12 || usage.OutputTokens != 4 {
+		t.Errorf("usage = %+v, want 12 input and 4 output tokens", usage)
+	}
+	if finish := contents[len(contents)-1].Finish; finish == nil || finish.StopReason != models.StopReasonEnd {
+		t.Errorf("finish = %+v, want the end of the turn after the usage", finish)
+	}
+}
+
+func TestAnthropicChatThinking(t *testing.T) {
+	srv := newRecordingServer(t, anthropicStreamHandler(
+		`{"type": "message_start", "message": {"model": "claude-test", "usage": {"input_tokens": 12}}}`,
+		`{"type": "content_block_start", "index": 0, "content_block": {"type": "thinking", "thinking": ""}}`,
+		`{"type": "content_block_delta", "index": 0, "delta": {"type": "thinking_delta", "thinking": "Let me "}}`,
+		`{"type": "content_block_delta", "index": 0, "delta": {"type": "thinking_delta", "thinking": "think."}}`,
+		`{"type": "content_block_delta", "index": 0, "delta": {"type": "signature_delta", "signature": "sig-1"}}`,
+		`{"type": "content_block_stop", "index": 0}`,
+		`{"type": "content_block_start", "index": 1, "content_block": {"type": "redacted_thinking", `+
+			`"data": "encrypted"}}`,
+		`{"type": "content_block_stop", "index": 1}`,
+		`{"type": "content_block_start", "index": 2, "content_block": {"type": "text", "text": ""}}`,
+		`{"type": "content_block_delta", "index": 2, "delta": {"type": "text_delta", "text": "Answer"}}`,
+		`{"type": "content_block_stop", "index": 2}`,
+		`{"type": "message_delta", "delta": {"stop_reason": "end_turn"}, "usage": {"output_tokens": 20}}`,
+		`{"type": "message_stop"}`,
+	))
+	anthropic := NewAnthropic("test-key", "claude-test", "", srv.URL, 1024, models.LLMParameters{}, slog.Default()).
+		WithThinking(512)
+
+	var thinking []models.Content
+	answer := models.Message{Role: models.RoleAssistant}
+	for _, content := range collectChat(t, anthropic) {
+		switch content.Type {
+		case models.ContentTypeThinking:
+			thinking = append(thinking, content)
+			// The thinking chunks continue the thinking block until its signature, as the chat stores them.
+			last := len(answer.Contents) - 1
+			if last >= 0 && answer.Contents[last].Type == models.ContentTypeThinking &&
+				answer.Contents[last].ThinkingSignature == "" && answer.Contents[last].RedactedThinking == "" &&
+				content.RedactedThinking == "" {
+				answer.Contents[last].Text += content.Text
+				answer.Contents[last].ThinkingSignature = content.ThinkingSignature
+				continue
+			}
+			answer.Contents = append(answer.Contents, content)
+		case models.ContentTypeText:
+			answer.Contents = append(answer.Contents, content)
+		}
+	}
+
+	wantThinking := []models.Content{
+		{Type: models.ContentTypeThinking, Text: "Let me "},
+		{Type: models.ContentTypeThinking, Text: "think."},
+		{Type: models.ContentTypeThinking, ThinkingSignature: "sig-1"},
+		{Type: models.ContentTypeThinking, RedactedThinking: "encrypted"},
+	}
+	if !reflect.DeepEqual(thinking, wantThinking) {
+		t.Errorf("thinking = %+v, want %+v", thinking, wantThinking)
+	}
+	if got := srv.lastBody(t)["thinking"]; !reflect.DeepEqual(got, map[string]any{
+		"type":          "enabled",
+		"budget_tokens": 512.0,
+	}) {
+		t.Errorf("thinking = %v, want it enabled with the budget", got)
+	}
+
+	// The thinking blocks are sent back unchanged with the answer, as Anthropic checks their signature.
+	messages := []models.Message{
+		{Role: models.RoleUser, Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hi"}}},
+		answer,
+		{Role: models.RoleUser, Contents: []models.Content{{Type: models.ContentTypeText, Text: "Why?"}}},
+	}
+	for _, err := range anthropic.Chat(context.Background(), messages, nil, models.ChatOptions{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent, _ := srv.lastBody(t)["messages"].([]any)
+	if len(sent) != 3 {
+		t.Fatalf("messages = %v, want the question, the answer and the next question", sent)
+	}
+	want := map[string]any{
+		"role": "assistant",
+		"content": []any{
+			map[string]any{"type": "thinking", "thinking": "Let me think.", "signature": "sig-1"},
+			map[string]any{"type": "redacted_thinking", "data": "encrypted"},
+			map[string]any{"type": "text", "text": "Answer"},
+		},
+	}
+	if !reflect.DeepEqual(sent[1], want) {
+		t.Errorf("answer = %v, want %v", sent[1], want)
+	}
+}
+
+func TestAnthropicPromptCaching(t *testing.T) {
+	tools := []mcp.Tool{
+		{Name: "weather", InputSchema: json.RawMessage(`{"type": "object"}`)},
+		{Name: "now", InputSchema: json.RawMessage(`{"type": "object"}`)},
+	}
+	messages := []models.Message{
+		{Role: models.RoleUser, Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hi"}}},
+		{Role: models.RoleAssistant, Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hello"}}},
+		{Role: models.RoleUser, Contents: []models.Content{{Type: models.ContentTypeText, Text: "Weather in Paris?"}}},
+	}
+	ephemeral := map[string]any{"type": "ephemeral"}
+
+	tests := []struct {
+		name    string
+		caching AnthropicCaching
+		// want are the fields of the request body that have a cache breakpoint, by their dotted path with
+		// the list indexes.
+		want []string
+	}{
+		{name: "disabled"},
+		{
+			name:    "all",
+			caching: AnthropicCaching{SystemPrompt: true, Tools: true, History: true},
+			want:    []string{"system.0", "tools.1", "messages.2.content.0"},
+		},
+		{name: "history", caching: AnthropicCaching{History: true}, want: []string{"messages.2.content.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRecordingServer(t, anthropicStreamHandler(
+				`{"type": "message_start", "message": {"model": "claude-test", "usage": {"input_tokens": 5, `+
+					`"cache_creation_input_tokens": 100, "cache_read_input_tokens": 1000}}}`,
+				`{"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`,
+				`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "Sunny"}}`,
+				`{"type": "content_block_stop", "index": 0}`,
+				`{"type": "message_delta", "delta": {"stop_reason": "end_turn"}, "usage": {"output_tokens": 4}}`,
+				`{"type": "message_stop"}`,
+			))
+			anthropic := NewAnthropic("test-key", "claude-test", "Be brief.", srv.URL, 1024,
+				models.LLMParameters{}, slog.Default()).WithPromptCaching(tt.caching)
+
+			var contents []models.Content
+			for content, err := range anthropic.Chat(context.Background(), messages, tools, models.ChatOptions{}) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents = append(contents, content)
+			}
+
+			// The input tokens are the sum of the uncached, written and read tokens.
+			want := models.Usage{InputTokens: 1105, OutputTokens: 4, CacheReadTokens: 1000, CacheWriteTokens: 100}
+			if usage := chatUsage(t, contents); usage != want {
+				t.Errorf("usage = %+v, want %+v", usage, want)
+			}
+
+			body := srv.lastBody(t)
+			var got []string
+			for _, path := range []string{
+				"system.0", "tools.0", "tools.1",
+				"messages.0.content.0", "messages.1.content.0", "messages.2.content.0",
+			} {
+				block, ok := jsonPath(body, path)
+				if !ok {
+					t.Fatalf("request body has no %s: %v", path, body)
+				}
+				if cacheControl, ok := block.(map[string]any)["cache_control"]; ok {
+					if !reflect.DeepEqual(cacheControl, ephemeral) {
+						t.Errorf("%s.cache_control = %v, want %v", path, cacheControl, ephemeral)
+					}
+					got = append(got, path)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("cache breakpoints = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnthropicGenerateTitle(t *testing.T) {
+	srv := newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"role": "assistant", "content": [{"type": "text", "text": "Sourdough basics"}]}`))
+	})
+	temperature := float32(0.3)
+	anthropic := NewAnthropic("test-key", "claude-test", "", srv.URL+"/v1/", 1024,
+		models.LLMParameters{Temperature: &temperature}, slog.Default()).
+		WithThinking(512)
+
+	title, err := anthropic.GenerateTitle(context.Background(), "How do I bake sourdough?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Sourdough basics" {
+		t.Errorf("GenerateTitle() = %q, want %q", title, "Sourdough basics")
+	}
+
+	// The thinking of the chats isn't used for the titles, so the sampling parameters are kept.
+	body := srv.lastBody(t)
+	if _, ok := body["thinking"]; ok {
+		t.Errorf("title request has thinking: %v", body["thinking"])
+	}
+	if body["temperature"] != 0.3 {
+		t.Errorf("title request temperature = %v, want 0.3", body["temperature"])
+	}
+	if req := srv.lastRequest(t); req.url.Path != "/v1/messages" || req.header.Get("x-api-key") != "test-key" {
+		t.Errorf("title request sent to %s with the key %q", req.url.Path, req.header.Get("x-api-key"))
+	}
+}
+
+func TestAnthropicGenerateTitleError(t *testing.T) {
+	srv := newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"type": "error", "error": {"type": "invalid_request_error", "message": "Bad model"}}`))
+	})
+	anthropic := NewAnthropic("test-key", "claude-test", "", srv.URL, 1024, models.LLMParameters{}, slog.Default())
+
+	if _, err := anthropic.GenerateTitle(context.Background(), "Hello"); err == nil {
+		t.Error("GenerateTitle() succeeded, want the error of the API")
+	}
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AWSCredentials are the credentials of the requests to the AWS APIs, either an access key, which signs
+// the requests with Signature Version 4, or an API key sent as a bearer token.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is the token of the temporary credentials, empty for long-term credentials.
+	SessionToken string
+	// APIKey is the API key of the service, used instead of the access key if it's set.
+	APIKey string
+}
+
+// eventStreamMessage is a message of the AWS event stream encoding, used by the streaming APIs of AWS.
+type eventStreamMessage struct {
+	headers map[string]string
+	payload []byte
+}
+
+const (
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	awsTimeFormat       = "20060102T150405Z"
+	awsDateFormat       = "20060102"
+
+	// eventStreamPreludeLength is the length of the total and headers lengths of an event stream message,
+	// followed by their CRC.
+	eventStreamPreludeLength = 12
+	// eventStreamMaxMessageLength is the maximum length of an event stream message, 16 MB as set by AWS.
+	eventStreamMaxMessageLength = 16 << 20
+
+	eventStreamHeaderTypeString = 7
+)
+
+// authorize authorizes the request to the service in the region: with the API key as a bearer token, or
+// with a Signature Version 4 of the request and its body.
+func (c AWSCredentials) authorize(req *http.Request, body []byte, service, region string, now time.Time) {
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+		return
+	}
+
+	now = now.UTC()
+	amzDate := now.Format(awsTimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	payloadHash := sha256.Sum256(body)
+	signedHeaders, canonicalHeaders := awsCanonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.EscapedPath(), false),
+		awsCanonicalQuery(req),
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(awsDateFormat), region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + c.SecretAccessKey)
+	for _, part := range []string{now.Format(awsDateFormat), region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsCanonicalHeaders returns the signed headers of the request and their canonical form: the host and
+// the headers set on the request, with lowercase names, sorted by name.
+func awsCanonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+
+	names := slices.Sorted(func(yield func(string) bool) {
+		for name := range headers {
+			if !yield(name) {
+				return
+			}
+		}
+	})
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), canonical.String()
+}
+
+// awsCanonicalQuery returns the query of the request with its encoded parameters sorted by name and value.
+func awsCanonicalQuery(req *http.Request) string {
+	var params []string
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	slices.Sort(params)
+	return strings.Join(params, "&")
+}
+
+// awsURIEncode encodes every byte of s but the unreserved characters of RFC 3986, and the slashes unless
+// encodeSlash is set, as required by the Signature Version 4.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// readEventStream returns an iterator over the messages of the AWS event stream encoding read from r.
+// Each message is a prelude with its total and headers lengths, the headers, the payload, and a CRC of
+// the message.
+func readEventStream(r io.Reader) iter.Seq2[eventStreamMessage, error] {
+	return func(yield func(eventStreamMessage, error) bool) {
+		prelude := make([]byte, eventStreamPreludeLength)
+		for {
+			if _, err := io.ReadFull(r, prelude); err != nil {
+				if !errors.Is(err, io.EOF) {
+					yield(eventStreamMessage{}, fmt.Errorf("error reading message prelude: %w", err))
+				}
+				return
+			}
+			totalLength := binary.BigEndian.Uint32(prelude[0:4])
+			headersLength := binary.BigEndian.Uint32(prelude[4:8])
+			if crc32.ChecksumIEEE(prelude[0:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+				yield(eventStreamMessage{}, fmt.Errorf("invalid message prelude checksum"))
+				return
+			}
+			if totalLength > eventStreamMaxMessageLength ||
+				totalLength < eventStreamPreludeLength+headersLength+4 {
+				yield(eventStreamMessage{}, fmt.Errorf("invalid message length %d", totalLength))
+				return
+			}
+
+			message := make([]byte, totalLength)
+			copy(message, prelude)
+			if _, err := io.ReadFull(r, message[eventStreamPreludeLength:]); err != nil {
+				yield(eventStreamMessage{}, fmt.Errorf("error reading message: %w", err))
+				return
+			}
+			crcOffset := totalLength - 4
+			if crc32.ChecksumIEEE(message[:crcOffset]) != binary.BigEndian.Uint32(message[crcOffset:]) {
+				yield(eventStreamMessage{}, fmt.Errorf("invalid message checksum"))
+				return
+			}
+
+			headersEnd := eventStreamPreludeLength + headersLength
+			headers, err := parseEventStreamHeaders(message[eventStreamPreludeLength:headersEnd])
+			if err != nil {
+				yield(eventStreamMessage{}, err)
+				return
+			}
+			if !yield(eventStreamMessage{headers: headers, payload: message[headersEnd:crcOffset]}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// parseEventStreamHeaders parses the headers of an event stream message. Only the string headers, which
+// hold the message and event types, are kept.
+func parseEventStreamHeaders(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	buf := bytes.NewReader(data)
+	for buf.Len() > 0 {
+		nameLength, err := buf.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("error reading header name length: %w", err)
+		}
+		name := make([]byte, nameLength)
+		if _, err := io.ReadFull(buf, name); err != nil {
+			return nil, fmt.Errorf("error reading header name: %w", err)
+		}
+		valueType, err := buf.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("error reading header type: %w", err)
+		}
+
+		var valueLength int
+		switch valueType {
+		case 0, 1: // Boolean true and false, without value.
+		case 2: // Byte.
+			valueLength = 1
+		case 3: // Short.
+			valueLength = 2
+		case 4: // Integer.
+			valueLength = 4
+		case 5, 8: // Long and timestamp.
+			valueLength = 8
+		case 9: // UUID.
+			valueLength = 16
+		case 6, eventStreamHeaderTypeString: // Byte array and string, prefixed by their length.
+			var length uint16
+			if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+				return nil, fmt.Errorf("error reading header value length: %w", err)
+			}
+			valueLength = int(length)
+		default:
+			return nil, fmt.Errorf("unknown header value type %d", valueType)
+		}
+		value := make([]byte, valueLength)
+		if _, err := io.ReadFull(buf, value); err != nil {
+			return nil, fmt.Errorf("error reading header value: %w", err)
+		}
+		if valueType == eventStreamHeaderTypeString {
+			headers[string(name)] = string(value)
+		}
+	}
+	return headers, nil
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestAWSCredentialsAuthorize(t *testing.T) {
+	// The vectors of the Signature Version 4 test suite of AWS.
+	credentials := AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	const credential = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "
+
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		signature string
+	}{
+		{
+			name:      "get vanilla",
+			method:    http.MethodGet,
+			url:       "https://example.amazonaws.com/",
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:      "post vanilla",
+			method:    http.MethodPost,
+			url:       "https://example.amazonaws.com/",
+			signature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:      "query order",
+			method:    http.MethodGet,
+			url:       "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			credentials.authorize(req, nil, "service", "us-east-1", now)
+
+			want := credential + "SignedHeaders=host;x-amz-date, Signature=" + tt.signature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization = %q, want %q", got, want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q, want %q", got, "20150830T123600Z")
+			}
+		})
+	}
+}
+
+func TestAWSCredentialsAuthorizeSessionAndAPIKey(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "https://example.amazonaws.com/", nil)
+	AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}.
+		authorize(req, []byte("{}"), "bedrock", "us-east-1", time.Now())
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "token" {
+		t.Errorf("X-Amz-Security-Token = %q, want %q", got, "token")
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "x-amz-security-token") {
+		t.Errorf("Authorization = %q, want the session token signed", got)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "https://example.amazonaws.com/", nil)
+	AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", APIKey: "api-key"}.
+		authorize(req, nil, "bedrock", "us-east-1", time.Now())
+	if got := req.Header.Get("Authorization"); got != "Bearer api-key" {
+		t.Errorf("Authorization = %q, want the API key as a bearer token", got)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "" {
+		t.Errorf("X-Amz-Date = %q, want no signature with an API key", got)
+	}
+}
+
+func TestReadEventStream(t *testing.T) {
+	first := encodeEventStreamMessage(map[string]string{":event-type": "contentBlockDelta"}, `{"delta":{}}`)
+	second := encodeEventStreamMessage(map[string]string{":event-type": "messageStop"}, `{"stopReason":"end_turn"}`)
+
+	badPrelude := bytes.Clone(first)
+	badPrelude[8]++
+	badMessage := bytes.Clone(first)
+	badMessage[len(badMessage)-1]++
+	tooShort := bytes.Clone(first)
+	binary.BigEndian.PutUint32(tooShort[0:4], 8)
+	binary.BigEndian.PutUint32(tooShort[8:12], crc32.ChecksumIEEE(tooShort[0:8]))
+
+	tests := []struct {
+		name     string
+		reader   io.Reader
+		want     []eventStreamMessage
+		wantErr  string
+		errAfter int
+	}{
+		{
+			name:   "messages",
+			reader: bytes.NewReader(append(bytes.Clone(first), second...)),
+			want: []eventStreamMessage{
+				{headers: map[string]string{":event-type": "contentBlockDelta"}, payload: []byte(`{"delta":{}}`)},
+				{headers: map[string]string{":event-type": "messageStop"}, payload: []byte(`{"stopReason":"end_turn"}`)},
+			},
+		},
+		{
+			name:   "split reads",
+			reader: iotest.OneByteReader(bytes.NewReader(first)),
+			want: []eventStreamMessage{
+				{headers: map[string]string{":event-type": "contentBlockDelta"}, payload: []byte(`{"delta":{}}`)},
+			},
+		},
+		{name: "empty", reader: bytes.NewReader(nil)},
+		{name: "invalid prelude checksum", reader: bytes.NewReader(badPrelude), wantErr: "invalid message prelude checksum"},
+		{name: "invalid message checksum", reader: bytes.NewReader(badMessage), wantErr: "invalid message checksum"},
+		{name: "invalid length", reader: bytes.NewReader(tooShort), wantErr: "invalid message length 8"},
+		{name: "truncated prelude", reader: bytes.NewReader(first[:6]), wantErr: "error reading message prelude"},
+		{name: "truncated message", reader: bytes.NewReader(first[:20]), wantErr: "error reading message"},
+		{
+			name:   "error after a message",
+			reader: bytes.NewReader(append(bytes.Clone(first), badMessage...)),
+			want: []eventStreamMessage{
+				{headers: map[string]string{":event-type": "contentBlockDelta"}, payload: []byte(`{"delta":{}}`)},
+			},
+			wantErr: "invalid message checksum",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []eventStreamMessage
+			var gotErr error
+			for msg, err := range readEventStream(tt.reader) {
+				if err != nil {
+					gotErr = err
+					break
+				}
+				got = append(got, msg)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readEventStream() = %+v, want %+v", got, tt.want)
+			}
+			switch {
+			case tt.wantErr == "" && gotErr != nil:
+				t.Errorf("readEventStream() error = %v, want none", gotErr)
+			case tt.wantErr != "" && (gotErr == nil || !strings.Contains(gotErr.Error(), tt.wantErr)):
+				t.Errorf("readEventStream() error = %v, want %q", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseEventStreamHeaders(t *testing.T) {
+	var data bytes.Buffer
+	// A boolean, an integer and a UUID header, which are skipped, around a string header.
+	data.Write([]byte{4, 'f', 'l', 'a', 'g', 0})
+	data.Write([]byte{5, 'c', 'o', 'u', 'n', 't', 4, 0, 0, 0, 42})
+	writeEventStreamStringHeader(&data, ":message-type", "event")
+	data.Write(append([]byte{2, 'i', 'd', 9}, make([]byte, 16)...))
+
+	headers, err := parseEventStreamHeaders(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{":message-type": "event"}; !reflect.DeepEqual(headers, want) {
+		t.Errorf("parseEventStreamHeaders() = %v, want %v", headers, want)
+	}
+
+	if _, err := parseEventStreamHeaders([]byte{1, 'x', 42}); err == nil {
+		t.Error("parseEventStreamHeaders() succeeded with an unknown value type")
+	}
+	if _, err := parseEventStreamHeaders([]byte{1, 'x', eventStreamHeaderTypeString, 0, 10, 'a'}); err == nil {
+		t.Error("parseEventStreamHeaders() succeeded with a truncated value")
+	}
+}
+
+// encodeEventStreamMessage encodes a message of the AWS event stream encoding with the string headers and
+// the payload.
+func encodeEventStreamMessage(headers map[string]string, payload string) []byte {
+	var encodedHeaders bytes.Buffer
+	for name, value := range headers {
+		writeEventStreamStringHeader(&encodedHeaders, name, value)
+	}
+
+	totalLength := eventStreamPreludeLength + encodedHeaders.Len() + len(payload) + 4
+	message := make([]byte, 0, totalLength)
+	message = binary.BigEndian.AppendUint32(message, uint32(totalLength))
+	message = binary.BigEndian.AppendUint32(message, uint32(encodedHeaders.Len()))
+	message = binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(message))
+	message = append(message, encodedHeaders.Bytes()...)
+	message = append(message, payload...)
+	return binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(message))
+}
+
+func writeEventStreamStringHeader(w *bytes.Buffer, name, value string) {
+	w.WriteByte(byte(len(name)))
+	w.WriteString(name)
+	w.WriteByte(eventStreamHeaderTypeString)
+	_ = binary.Write(w, binary.BigEndian, uint16(len(value)))
+	w.WriteString(value)
+}
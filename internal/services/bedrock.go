@@ -0,0 +1,601 @@
+package services
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// Bedrock provides an implementation of the LLM interface for interacting with the models of AWS Bedrock,
+// through the Converse API which works the same for every model that supports it.
+type Bedrock struct {
+	region       string
+	model        string
+	systemPrompt string
+	endpoint     string
+	credentials  AWSCredentials
+
+	params models.LLMParameters
+	retry  RetryPolicy
+	// extra are the vendor-specific fields merged into the request body.
+	extra map[string]any
+
+	client *http.Client
+
+	logger *slog.Logger
+}
+
+// BedrockParameters are the names of the LLM parameters supported by the Converse API of Bedrock for every
+// model, the others are ignored. The parameters specific to a model can be sent as extra fields.
+var BedrockParameters = []string{"temperature", "topP", "maxTokens", "stop"}
+
+type bedrockConverseRequest struct {
+	Messages        []bedrockMessage        `json:"messages"`
+	System          []bedrockContentBlock   `json:"system,omitempty"`
+	InferenceConfig *bedrockInferenceConfig `json:"inferenceConfig,omitempty"`
+	ToolConfig      *bedrockToolConfig      `json:"toolConfig,omitempty"`
+}
+
+type bedrockMessage struct {
+	Role    string                `json:"role"`
+	Content []bedrockContentBlock `json:"content"`
+}
+
+type bedrockContentBlock struct {
+	Text             string                   `json:"text,omitempty"`
+	Image            *bedrockImageBlock       `json:"image,omitempty"`
+	Document         *bedrockDocumentBlock    `json:"document,omitempty"`
+	ToolUse          *bedrockToolUseBlock     `json:"toolUse,omitempty"`
+	ToolResult       *bedrockToolResultBlock  `json:"toolResult,omitempty"`
+	ReasoningContent *bedrockReasoningContent `json:"reasoningContent,omitempty"`
+}
+
+type bedrockImageBlock struct {
+	Format string             `json:"format"`
+	Source bedrockBytesSource `json:"source"`
+}
+
+type bedrockDocumentBlock struct {
+	Format string             `json:"format"`
+	Name   string             `json:"name"`
+	Source bedrockBytesSource `json:"source"`
+}
+
+type bedrockBytesSource struct {
+	// Bytes are the base64 encoded bytes of the image or document.
+	Bytes string `json:"bytes"`
+}
+
+type bedrockToolUseBlock struct {
+	ToolUseID string          `json:"toolUseId"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+}
+
+type bedrockToolResultBlock struct {
+	ToolUseID string                     `json:"toolUseId"`
+	Content   []bedrockToolResultContent `json:"content"`
+	Status    string                     `json:"status,omitempty"`
+}
+
+type bedrockToolResultContent struct {
+	Text string `json:"text,omitempty"`
+	JSON any    `json:"json,omitempty"`
+}
+
+type bedrockReasoningContent struct {
+	ReasoningText   *bedrockReasoningText `json:"reasoningText,omitempty"`
+	RedactedContent string                `json:"redactedContent,omitempty"`
+}
+
+type bedrockReasoningText struct {
+	Text      string `json:"text"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type bedrockInferenceConfig struct {
+	MaxTokens     *int     `json:"maxTokens,omitempty"`
+	Temperature   *float32 `json:"temperature,omitempty"`
+	TopP          *float32 `json:"topP,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+}
+
+type bedrockToolConfig struct {
+	Tools []bedrockTool `json:"tools"`
+}
+
+type bedrockTool struct {
+	ToolSpec bedrockToolSpec `json:"toolSpec"`
+}
+
+type bedrockToolSpec struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	InputSchema bedrockInputSchema `json:"inputSchema"`
+}
+
+type bedrockInputSchema struct {
+	JSON json.RawMessage `json:"json"`
+}
+
+type bedrockContentBlockStart struct {
+	Start struct {
+		ToolUse *struct {
+			ToolUseID string `json:"toolUseId"`
+			Name      string `json:"name"`
+		} `json:"toolUse"`
+	} `json:"start"`
+}
+
+type bedrockContentBlockDelta struct {
+	Delta struct {
+		Text    string `json:"text"`
+		ToolUse *struct {
+			Input string `json:"input"`
+		} `json:"toolUse"`
+		ReasoningContent *struct {
+			Text            string `json:"text"`
+			Signature       string `json:"signature"`
+			RedactedContent string `json:"redactedContent"`
+		} `json:"reasoningContent"`
+	} `json:"delta"`
+}
+
+type bedrockUsage struct {
+	InputTokens           int `json:"inputTokens"`
+	OutputTokens          int `json:"outputTokens"`
+	CacheReadInputTokens  int `json:"cacheReadInputTokens"`
+	CacheWriteInputTokens int `json:"cacheWriteInputTokens"`
+}
+
+type bedrockMessageStop struct {
+	StopReason string `json:"stopReason"`
+}
+
+type bedrockMetadata struct {
+	Usage bedrockUsage `json:"usage"`
+}
+
+type bedrockConverseResponse struct {
+	Output struct {
+		Message bedrockMessage `json:"message"`
+	} `json:"output"`
+}
+
+type bedrockException struct {
+	Message string `json:"message"`
+}
+
+const (
+	bedrockService = "bedrock"
+
+	bedrockRoleUser      = "user"
+	bedrockRoleAssistant = "assistant"
+)
+
+// NewBedrock creates a new Bedrock instance with the specified region, model ID or inference profile,
+// system prompt, endpoint and credentials. The endpoint defaults to the Bedrock runtime endpoint of the
+// region if it's empty.
+func NewBedrock(
+	region, model, systemPrompt, endpoint string,
+	credentials AWSCredentials,
+	params models.LLMParameters,
+	logger *slog.Logger,
+) Bedrock {
+	endpoint = cmp.Or(endpoint, fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", region))
+	return Bedrock{
+		region:       region,
+		model:        model,
+		systemPrompt: systemPrompt,
+		endpoint:     strings.TrimSuffix(endpoint, "/"),
+		credentials:  credentials,
+		params:       params,
+		retry:        DefaultRetryPolicy,
+		client:       &http.Client{},
+		logger:       logger.With(slog.String("module", "bedrock")),
+	}
+}
+
+// WithRetry returns a copy of b that retries the failed requests with the given policy.
+func (b Bedrock) WithRetry(policy RetryPolicy) Bedrock {
+	b.retry = policy
+	return b
+}
+
+// WithExtra returns a copy of b that merges the extra fields into the body of its requests.
+func (b Bedrock) WithExtra(extra map[string]any) Bedrock {
+	b.extra = extra
+	return b
+}
+
+// Chat streams responses from the Bedrock Converse API for a given sequence of messages. It returns an
+// iterator that yields response chunks and potential errors. The context can be used to cancel ongoing
+// requests. Refer to models.Message for message structure details. The system prompt and parameters of
+// opts take precedence over the configured ones.
+func (b Bedrock) Chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		var resp *http.Response
+		err := b.retry.retry(ctx, "Bedrock", func() error {
+			var err error
+			resp, err = b.doRequest(ctx, messages, tools, opts, true)
+			return err
+		}, func(status models.Content) bool {
+			return yield(status, nil)
+		})
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, errStreamStopped) {
+				return
+			}
+			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
+			return
+		}
+		defer resp.Body.Close()
+
+		var toolContent *models.Content
+		toolInput := ""
+		isToolUse := false
+		var usage *models.Usage
+		stopReason := ""
+		for msg, err := range readEventStream(resp.Body) {
+			if err != nil {
+				yield(models.Content{}, fmt.Errorf("error reading response: %w", err))
+				return
+			}
+
+			b.logger.Debug("Received event",
+				slog.String("type", msg.headers[":event-type"]),
+				slog.String("payload", string(msg.payload)))
+
+			if msg.headers[":message-type"] == "exception" {
+				var e bedrockException
+				_ = json.Unmarshal(msg.payload, &e)
+				yield(models.Content{}, newTypedLLMError(msg.headers[":exception-type"], e.Message))
+				return
+			}
+
+			switch msg.headers[":event-type"] {
+			case "contentBlockStart":
+				var res bedrockContentBlockStart
+				if err := json.Unmarshal(msg.payload, &res); err != nil {
+					yield(models.Content{}, fmt.Errorf("error unmarshaling block start: %w", err))
+					return
+				}
+				if res.Start.ToolUse == nil {
+					continue
+				}
+				isToolUse = true
+				toolInput = ""
+				// Only the first tool call is used, as the chat calls one tool at a time.
+				if toolContent == nil {
+					toolContent = &models.Content{
+						Type:       models.ContentTypeCallTool,
+						ToolName:   res.Start.ToolUse.Name,
+						CallToolID: res.Start.ToolUse.ToolUseID,
+					}
+				}
+			case "contentBlockDelta":
+				var res bedrockContentBlockDelta
+				if err := json.Unmarshal(msg.payload, &res); err != nil {
+					yield(models.Content{}, fmt.Errorf("error unmarshaling block delta: %w", err))
+					return
+				}
+				var content models.Content
+				switch delta := res.Delta; {
+				case delta.ToolUse != nil:
+					toolInput += delta.ToolUse.Input
+					continue
+				case delta.ReasoningContent != nil:
+					content = models.Content{
+						Type:              models.ContentTypeThinking,
+						Text:              delta.ReasoningContent.Text,
+						ThinkingSignature: delta.ReasoningContent.Signature,
+						RedactedThinking:  delta.ReasoningContent.RedactedContent,
+					}
+				default:
+					content = models.Content{Type: models.ContentTypeText, Text: delta.Text}
+				}
+				if !yield(content, nil) {
+					return
+				}
+			case "contentBlockStop":
+				if !isToolUse {
+					continue
+				}
+				isToolUse = false
+				if toolContent.ToolInput == nil {
+					toolContent.ToolInput = json.RawMessage(cmp.Or(toolInput, "{}"))
+				}
+			case "messageStop":
+				var res bedrockMessageStop
+				if err := json.Unmarshal(msg.payload, &res); err != nil {
+					yield(models.Content{}, fmt.Errorf("error unmarshaling message stop: %w", err))
+					return
+				}
+				stopReason = res.StopReason
+			case "metadata":
+				var res bedrockMetadata
+				if err := json.Unmarshal(msg.payload, &res); err != nil {
+					yield(models.Content{}, fmt.Errorf("error unmarshaling metadata: %w", err))
+					return
+				}
+				u := res.Usage
+				usage = &models.Usage{
+					InputTokens:      u.InputTokens + u.CacheReadInputTokens + u.CacheWriteInputTokens,
+					OutputTokens:     u.OutputTokens,
+					CacheReadTokens:  u.CacheReadInputTokens,
+					CacheWriteTokens: u.CacheWriteInputTokens,
+				}
+			}
+		}
+		if usage != nil {
+			if !yield(models.Content{Type: models.ContentTypeUsage, Usage: usage}, nil) {
+				return
+			}
+		}
+		if !yield(finishContent("bedrock", b.model, stopReason), nil) {
+			return
+		}
+		if toolContent != nil {
+			yield(*toolContent, nil)
+		}
+	}
+}
+
+// EstimateTokens estimates the number of input tokens of a chat call with the given messages, tools and
+// options, to fit the chat in the context window of the model. It's based on the fact that Bedrock serves
+// models with various tokenizers, so it's estimated conservatively with 3.5 characters per token.
+func (b Bedrock) EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int {
+	return models.EstimateTokens(cmp.Or(opts.SystemPrompt, b.systemPrompt), messages, tools, 3.5)
+}
+
+// GenerateTitle generates a title for a given message using the Bedrock Converse API. It sends a single
+// message and returns the first response text as the title. The context can be used to cancel ongoing
+// requests.
+func (b Bedrock) GenerateTitle(ctx context.Context, message string) (string, error) {
+	messages := []models.Message{
+		{
+			Role: models.RoleUser,
+			Contents: []models.Content{
+				{
+					Type: models.ContentTypeText,
+					Text: message,
+				},
+			},
+		},
+	}
+	var resp *http.Response
+	err := b.retry.retry(ctx, "Bedrock", func() error {
+		var err error
+		resp, err = b.doRequest(ctx, messages, nil, models.ChatOptions{}, false)
+		return err
+	}, nil)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var res bedrockConverseResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("error decoding response: %w", err)
+	}
+	for _, content := range res.Output.Message.Content {
+		if content.Text != "" {
+			return content.Text, nil
+		}
+	}
+	return "", fmt.Errorf("empty response content")
+}
+
+func (b Bedrock) doRequest(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+	stream bool,
+) (*http.Response, error) {
+	params := b.params.Merge(opts.Parameters)
+
+	msgs, err := b.convertMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody := bedrockConverseRequest{
+		Messages: msgs,
+		InferenceConfig: &bedrockInferenceConfig{
+			MaxTokens:     params.MaxTokens,
+			Temperature:   params.Temperature,
+			TopP:          params.TopP,
+			StopSequences: params.Stop,
+		},
+	}
+	if systemPrompt := cmp.Or(opts.SystemPrompt, b.systemPrompt); systemPrompt != "" {
+		reqBody.System = []bedrockContentBlock{{Text: systemPrompt}}
+	}
+	if len(tools) > 0 {
+		bTools := make([]bedrockTool, len(tools))
+		for i, tool := range tools {
+			bTools[i] = bedrockTool{ToolSpec: bedrockToolSpec{
+				Name:        tool.Name,
+				Description: tool.Description,
+				InputSchema: bedrockInputSchema{JSON: tool.InputSchema},
+			}}
+		}
+		reqBody.ToolConfig = &bedrockToolConfig{Tools: bTools}
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+	if jsonBody, err = mergeExtra(jsonBody, b.extra); err != nil {
+		return nil, err
+	}
+
+	operation := "converse"
+	if stream {
+		operation = "converse-stream"
+	}
+	// The model IDs contain colons, which are escaped in the path.
+	path := "/model/" + awsURIEncode(b.model, true) + "/" + operation
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint+path, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	b.credentials.authorize(req, jsonBody, bedrockService, b.region, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+
+	return resp, nil
+}
+
+func (b Bedrock) convertMessages(messages []models.Message) ([]bedrockMessage, error) {
+	var msgs []bedrockMessage
+	// The Converse API requires the roles to alternate, so consecutive blocks of the same role, e.g. a tool
+	// result followed by the next user message, are merged.
+	appendBlocks := func(role string, blocks ...bedrockContentBlock) {
+		if len(blocks) == 0 {
+			return
+		}
+		if len(msgs) > 0 && msgs[len(msgs)-1].Role == role {
+			msgs[len(msgs)-1].Content = append(msgs[len(msgs)-1].Content, blocks...)
+			return
+		}
+		msgs = append(msgs, bedrockMessage{Role: role, Content: blocks})
+	}
+
+	for _, msg := range messages {
+		if msg.Role == models.RoleUser {
+			var blocks []bedrockContentBlock
+			for _, ct := range msg.Contents {
+				switch ct.Type {
+				case models.ContentTypeText:
+					if ct.Text != "" {
+						blocks = append(blocks, bedrockContentBlock{Text: ct.Text})
+					}
+				case models.ContentTypeResource:
+					blocks = append(blocks, b.processResourceContents(ct.ResourceContents)...)
+				case models.ContentTypeCallTool, models.ContentTypeToolResult, models.ContentTypeThinking:
+					return nil, fmt.Errorf("content type %s is not supported for user messages", ct.Type)
+				}
+			}
+			appendBlocks(bedrockRoleUser, blocks...)
+			continue
+		}
+
+		for _, ct := range msg.Contents {
+			switch ct.Type {
+			case models.ContentTypeText:
+				if ct.Text != "" {
+					appendBlocks(bedrockRoleAssistant, bedrockContentBlock{Text: ct.Text})
+				}
+			case models.ContentTypeThinking:
+				// Only the signed reasoning can be sent back, the thinking of other providers is dropped.
+				switch {
+				case ct.RedactedThinking != "":
+					appendBlocks(bedrockRoleAssistant, bedrockContentBlock{ReasoningContent: &bedrockReasoningContent{
+						RedactedContent: ct.RedactedThinking,
+					}})
+				case ct.ThinkingSignature != "":
+					appendBlocks(bedrockRoleAssistant, bedrockContentBlock{ReasoningContent: &bedrockReasoningContent{
+						ReasoningText: &bedrockReasoningText{Text: ct.Text, Signature: ct.ThinkingSignature},
+					}})
+				}
+			case models.ContentTypeCallTool:
+				appendBlocks(bedrockRoleAssistant, bedrockContentBlock{ToolUse: &bedrockToolUseBlock{
+					ToolUseID: ct.CallToolID,
+					Name:      ct.ToolName,
+					Input:     ct.ToolInput,
+				}})
+			case models.ContentTypeToolResult:
+				result := bedrockToolResultBlock{
+					ToolUseID: ct.CallToolID,
+					Content:   []bedrockToolResultContent{bedrockToolResult(ct.ToolResult)},
+				}
+				if ct.CallToolFailed {
+					result.Status = "error"
+				}
+				appendBlocks(bedrockRoleUser, bedrockContentBlock{ToolResult: &result})
+			case models.ContentTypeResource:
+				return nil, fmt.Errorf("content type %s is not supported for assistant messages", ct.Type)
+			}
+		}
+	}
+
+	return msgs, nil
+}
+
+func (b Bedrock) processResourceContents(resources []mcp.ResourceContents) []bedrockContentBlock {
+	var blocks []bedrockContentBlock
+
+	for i, resource := range resources {
+		blobData := resource.Blob
+		if blobData != "" && !isBase64(blobData) {
+			blobData = base64.StdEncoding.EncodeToString([]byte(blobData))
+		}
+		switch format, _ := strings.CutPrefix(resource.MimeType, "image/"); {
+		case strings.HasPrefix(resource.MimeType, "image/") && blobData != "":
+			blocks = append(blocks, bedrockContentBlock{Image: &bedrockImageBlock{
+				Format: format,
+				Source: bedrockBytesSource{Bytes: blobData},
+			}})
+		case resource.MimeType == "application/pdf" && blobData != "":
+			// The document names only allow some characters, so they're numbered instead of named after
+			// their URI.
+			blocks = append(blocks, bedrockContentBlock{Document: &bedrockDocumentBlock{
+				Format: "pdf",
+				Name:   fmt.Sprintf("Document %d", i+1),
+				Source: bedrockBytesSource{Bytes: blobData},
+			}})
+		default:
+			// Only images and PDFs are sent as is, so treat others as text
+			data := resource.Text
+			if data == "" {
+				data = resource.Blob
+			}
+			blocks = append(blocks, bedrockContentBlock{
+				Text: fmt.Sprintf("[Document of type %s]\n%s", resource.MimeType, data),
+			})
+		}
+	}
+
+	return blocks
+}
+
+// bedrockToolResult returns the content of a tool result: the text of the results that are strings, and
+// the JSON of the others.
+func bedrockToolResult(result json.RawMessage) bedrockToolResultContent {
+	var value any
+	if err := json.Unmarshal(result, &value); err != nil {
+		return bedrockToolResultContent{Text: string(result)}
+	}
+	if text, ok := value.(string); ok {
+		return bedrockToolResultContent{Text: text}
+	}
+	return bedrockToolResultContent{JSON: value}
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// bedrockEvent is an event of the Converse stream sent by the test server.
+type bedrockEvent struct {
+	eventType string
+	payload   string
+}
+
+// newBedrockServer returns a test server of the Bedrock runtime that answers with the events in the event
+// stream encoding.
+func newBedrockServer(t *testing.T, events ...bedrockEvent) *recordingServer {
+	return newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		for _, event := range events {
+			headers := map[string]string{":message-type": "event", ":event-type": event.eventType}
+			if strings.HasSuffix(event.eventType, "Exception") {
+				headers = map[string]string{":message-type": "exception", ":exception-type": event.eventType}
+			}
+			_, _ = w.Write(encodeEventStreamMessage(headers, event.payload))
+		}
+	})
+}
+
+func TestBedrockChat(t *testing.T) {
+	srv := newBedrockServer(t,
+		bedrockEvent{"messageStart", `{"role": "assistant"}`},
+		bedrockEvent{"contentBlockDelta", `{"contentBlockIndex": 0, "delta": {"text": "Let me "}}`},
+		bedrockEvent{"contentBlockDelta", `{"contentBlockIndex": 0, "delta": {"text": "check."}}`},
+		bedrockEvent{"contentBlockStop", `{"contentBlockIndex": 0}`},
+		bedrockEvent{"contentBlockStart", `{"contentBlockIndex": 1, ` +
+			`"start": {"toolUse": {"toolUseId": "tooluse_1", "name": "weather"}}}`},
+		bedrockEvent{"contentBlockDelta", `{"contentBlockIndex": 1, "delta": {"toolUse": {"input": "{\"city\": "}}}`},
+		bedrockEvent{"contentBlockDelta", `{"contentBlockIndex": 1, "delta": {"toolUse": {"input": "\"Paris\"}"}}}`},
+		bedrockEvent{"contentBlockStop", `{"contentBlockIndex": 1}`},
+		bedrockEvent{"messageStop", `{"stopReason": "tool_use"}`},
+		bedrockEvent{"metadata", `{"usage": {"inputTokens": 10, "outputTokens": 5, ` +
+			`"cacheReadInputTokens": 20, "cacheWriteInputTokens": 3}, "metrics": {"latencyMs": 100}}`},
+	)
+	temperature := float32(0.5)
+	bedrock := NewBedrock("us-east-1", "anthropic.claude-test:0", "Be brief.", srv.URL,
+		AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		models.LLMParameters{Temperature: &temperature}, slog.Default())
+
+	var contents []models.Content
+	for content, err := range bedrock.Chat(context.Background(), []models.Message{{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: "Weather in Paris?"}},
+	}}, []mcp.Tool{{Name: "weather", InputSchema: json.RawMessage(`{"type": "object"}`)}}, models.ChatOptions{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, content)
+	}
+
+	want := []models.Content{
+		{Type: models.ContentTypeText, Text: "Let me "},
+		{Type: models.ContentTypeText, Text: "check."},
+		{Type: models.ContentTypeUsage, Usage: &models.Usage{
+			InputTokens:      33,
+			OutputTokens:     5,
+			CacheReadTokens:  20,
+			CacheWriteTokens: 3,
+		}},
+		finishContent("bedrock", "anthropic.claude-test:0", "tool_use"),
+		{
+			Type:       models.ContentTypeCallTool,
+			ToolName:   "weather",
+			CallToolID: "tooluse_1",
+			ToolInput:  json.RawMessage(`{"city": "Paris"}`),
+		},
+	}
+	if !reflect.DeepEqual(contents, want) {
+		t.Errorf("Chat() = %+v, want %+v", contents, want)
+	}
+
+	req := srv.lastRequest(t)
+	// The colon of the model ID is escaped in the path.
+	if got := req.url.EscapedPath(); got != "/model/anthropic.claude-test%3A0/converse-stream" {
+		t.Errorf("request path = %q, want the converse-stream of the model", got)
+	}
+	if got := req.header.Get("Authorization"); !strings.HasPrefix(got, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		!strings.Contains(got, "/us-east-1/bedrock/aws4_request") {
+		t.Errorf("Authorization = %q, want a signature of the bedrock service in us-east-1", got)
+	}
+	body := srv.lastBody(t)
+	if got := body["inferenceConfig"]; !reflect.DeepEqual(got, map[string]any{"temperature": 0.5}) {
+		t.Errorf("inferenceConfig = %v, want the temperature", got)
+	}
+	if got := body["system"]; !reflect.DeepEqual(got, []any{map[string]any{"text": "Be brief."}}) {
+		t.Errorf("system = %v, want the system prompt", got)
+	}
+}
+
+func TestBedrockChatToolWithoutInput(t *testing.T) {
+	srv := newBedrockServer(t,
+		bedrockEvent{"contentBlockStart", `{"start": {"toolUse": {"toolUseId": "tooluse_1", "name": "now"}}}`},
+		bedrockEvent{"contentBlockStop", `{}`},
+		bedrockEvent{"messageStop", `{"stopReason": "tool_use"}`},
+	)
+	bedrock := NewBedrock("us-east-1", "test-model", "", srv.URL, AWSCredentials{APIKey: "api-key"},
+		models.LLMParameters{}, slog.Default())
+
+	var call models.Content
+	for content, err := range bedrock.Chat(context.Background(), nil, nil, models.ChatOptions{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content.Type == models.ContentTypeCallTool {
+			call = content
+		}
+	}
+	if call.ToolName != "now" || string(call.ToolInput) != "{}" {
+		t.Errorf("tool call = %+v, want now with empty arguments", call)
+	}
+	if got := srv.lastRequest(t).header.Get("Authorization"); got != "Bearer api-key" {
+		t.Errorf("Authorization = %q, want the API key", got)
+	}
+}
+
+func TestBedrockChatException(t *testing.T) {
+	srv := newBedrockServer(t,
+		bedrockEvent{"contentBlockDelta", `{"delta": {"text": "Hello"}}`},
+		bedrockEvent{"throttlingException", `{"message": "Too many tokens"}`},
+	)
+	bedrock := NewBedrock("us-east-1", "test-model", "", srv.URL, AWSCredentials{APIKey: "api-key"},
+		models.LLMParameters{}, slog.Default())
+
+	var text string
+	var streamErr error
+	for content, err := range bedrock.Chat(context.Background(), nil, nil, models.ChatOptions{}) {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		text += content.Text
+	}
+
+	if text != "Hello" {
+		t.Errorf("text = %q, want %q", text, "Hello")
+	}
+	var llmErr *LLMError
+	if !errors.As(streamErr, &llmErr) || llmErr.Kind != models.ErrorKindRateLimit ||
+		llmErr.Message != "Too many tokens" {
+		t.Errorf("error = %v, want a rate limit LLMError", streamErr)
+	}
+}
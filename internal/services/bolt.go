@@ -5,9 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
 	bolt "go.etcd.io/bbolt"
@@ -23,6 +25,9 @@ type BoltDB struct {
 // NewBoltDB creates a new BoltDB instance with the specified file path. It initializes the database
 // with required buckets and returns an error if the database cannot be opened or initialized. The
 // database file is created with 0600 permissions if it doesn't exist.
+//
+// The stored records are upgraded to the current schema version on startup, after the database file is
+// backed up next to itself, see migrateBolt.
 func NewBoltDB(path string) (BoltDB, error) {
 	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
@@ -30,17 +35,94 @@ func NewBoltDB(path string) (BoltDB, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("chats"))
+		if _, err := tx.CreateBucketIfNotExists([]byte("chats")); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(personasBucket)
 		return err
 	})
+	if err != nil {
+		_ = db.Close()
+		return BoltDB{}, fmt.Errorf("failed to initialize bolt db: %w", err)
+	}
+
+	if err := migrateBolt(db, path); err != nil {
+		_ = db.Close()
+		return BoltDB{}, fmt.Errorf("failed to migrate bolt db: %w", err)
+	}
+
+	return BoltDB{db: db}, nil
+}
+
+// OpenBoltDBReadOnly opens the existing BoltDB file at the specified path for reading only, to copy its
+// chats into another store. Unlike NewBoltDB, the file is never written: the buckets aren't created and
+// the migrations aren't applied, so the records may be of an older schema version. In particular, the
+// chats stored before their creation and update times were recorded have zero times.
+func OpenBoltDBReadOnly(path string) (BoltDB, error) {
+	// Bolt creates the missing files even in read-only mode.
+	if _, err := os.Stat(path); err != nil {
+		return BoltDB{}, fmt.Errorf("failed to open bolt db: %w", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return BoltDB{}, fmt.Errorf("failed to open bolt db: %w", err)
+	}
+	return BoltDB{db: db}, nil
+}
 
-	return BoltDB{db: db}, err
+// Close releases the database file lock.
+func (b BoltDB) Close() error {
+	return b.db.Close()
 }
 
+var personasBucket = []byte("personas")
+
 func messageBucketName(chatID string) []byte {
 	return []byte(fmt.Sprintf("chat-%s", chatID))
 }
 
+// sortedKeys returns the keys of the bucket sorted by their sequence number prefix.
+func sortedKeys(b *bolt.Bucket) []string {
+	var keys []string
+	_ = b.ForEach(func(k, _ []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	slices.SortFunc(keys, compareIDPrefix)
+	return keys
+}
+
+// pageAfter returns at most limit keys that come after cursor, and whether there are more keys left
+// after the returned page. An empty cursor, or a cursor that isn't found, starts from the first key.
+func pageAfter(keys []string, cursor string, limit int) ([]string, bool) {
+	if cursor != "" {
+		if idx := slices.Index(keys, cursor); idx >= 0 {
+			keys = keys[idx+1:]
+		}
+	}
+	if limit <= 0 || len(keys) <= limit {
+		return keys, false
+	}
+	return keys[:limit], true
+}
+
+// compareIDPrefix compares two IDs generated by AddChat or AddMessage by their sequence number prefix.
+func compareIDPrefix(a, b string) int {
+	aID := 0
+	bID := 0
+
+	aIDArr := strings.Split(a, "-")
+	if len(aIDArr) > 1 {
+		aID, _ = strconv.Atoi(aIDArr[0])
+	}
+	bIDArr := strings.Split(b, "-")
+	if len(bIDArr) > 1 {
+		bID, _ = strconv.Atoi(bIDArr[0])
+	}
+
+	return cmp.Compare(aID, bID)
+}
+
 // Chats retrieves all stored chat records from the database in reverse chronological order. It
 // returns a slice of Chat models or an error if the database operation fails.
 func (b BoltDB) Chats(context.Context) ([]models.Chat, error) {
@@ -64,27 +146,126 @@ func (b BoltDB) Chats(context.Context) ([]models.Chat, error) {
 		return nil, err
 	}
 	slices.SortFunc(chats, func(a, b models.Chat) int {
-		aID := 0
-		bID := 0
+		return compareIDPrefix(b.ID, a.ID)
+	})
+	return chats, nil
+}
 
-		aIDArr := strings.Split(a.ID, "-")
-		if len(aIDArr) > 1 {
-			aID, _ = strconv.Atoi(aIDArr[0])
+// Chat retrieves the chat with the given ID. If the chat doesn't exist, a zero Chat is returned
+// without an error, so callers should check the returned ID.
+func (b BoltDB) Chat(_ context.Context, chatID string) (models.Chat, error) {
+	var chat models.Chat
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("chats"))
+		if b == nil {
+			return nil
 		}
-		bIDArr := strings.Split(b.ID, "-")
-		if len(bIDArr) > 1 {
-			bID, _ = strconv.Atoi(bIDArr[0])
+
+		v := b.Get([]byte(chatID))
+		if v == nil {
+			return nil
 		}
 
-		return cmp.Compare(bID, aID)
+		if err := json.Unmarshal(v, &chat); err != nil {
+			return fmt.Errorf("failed to unmarshal chat: %w", err)
+		}
+		return nil
 	})
-	return chats, nil
+
+	return chat, err
+}
+
+// ChatsPage retrieves a page of the chats that match the query filters, with the pinned chats first,
+// then from the most recently updated one. The cursor of a page holds the sort key of its last chat, and
+// the returned next cursor is empty when there are no chats left. As the chats are sorted by their
+// content, every chat is unmarshaled, but only the chats of the requested page are returned.
+func (b BoltDB) ChatsPage(_ context.Context, query models.ChatsQuery) ([]models.Chat, string, error) {
+	var after models.Chat
+	if query.Cursor != "" {
+		var err error
+		after, err = parseChatsCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var chats []models.Chat
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("chats"))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			var chat models.Chat
+			if err := json.Unmarshal(v, &chat); err != nil {
+				return fmt.Errorf("failed to unmarshal chat: %w", err)
+			}
+			if !matchChatsQuery(chat, query) {
+				return nil
+			}
+			if query.Cursor != "" && compareChats(chat, after, compareIDPrefix) <= 0 {
+				return nil
+			}
+			chats = append(chats, chat)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	slices.SortFunc(chats, func(a, b models.Chat) int {
+		return compareChats(a, b, compareIDPrefix)
+	})
+	if query.Limit <= 0 || len(chats) <= query.Limit {
+		return chats, "", nil
+	}
+	chats = chats[:query.Limit]
+	return chats, chatsCursor(chats[len(chats)-1]), nil
+}
+
+// Folders retrieves the sorted names of the folders that contain at least one chat.
+func (b BoltDB) Folders(context.Context) ([]string, error) {
+	var folders []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("chats"))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			var chat models.Chat
+			if err := json.Unmarshal(v, &chat); err != nil {
+				return fmt.Errorf("failed to unmarshal chat: %w", err)
+			}
+			for _, folder := range chat.Folders {
+				if !slices.Contains(folders, folder) {
+					folders = append(folders, folder)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(folders)
+	return folders, nil
 }
 
 // AddChat stores a new chat record in the database and creates an associated message bucket. It
 // generates a unique ID for the chat by combining a sequence number with the chat's original ID,
-// and returns the new ID or an error if the operation fails.
+// and returns the new ID or an error if the operation fails. The creation and update times default to
+// the current time.
 func (b BoltDB) AddChat(_ context.Context, chat models.Chat) (string, error) {
+	if chat.CreatedAt.IsZero() {
+		chat.CreatedAt = time.Now()
+	}
+	if chat.UpdatedAt.IsZero() {
+		chat.UpdatedAt = chat.CreatedAt
+	}
+
 	var newID string
 	err := b.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("chats"))
@@ -109,7 +290,11 @@ func (b BoltDB) AddChat(_ context.Context, chat models.Chat) (string, error) {
 			return fmt.Errorf("failed to marshal chat: %w", err)
 		}
 
-		return b.Put([]byte(newID), v)
+		if err := b.Put([]byte(newID), v); err != nil {
+			return err
+		}
+
+		return indexSearchDoc(tx, chat.ID, "", chat.Title)
 	})
 
 	return newID, err
@@ -117,6 +302,9 @@ func (b BoltDB) AddChat(_ context.Context, chat models.Chat) (string, error) {
 
 // UpdateChat modifies an existing chat record in the database. If the chat doesn't exist, the
 // operation is silently ignored. Returns an error if the marshaling or database operation fails.
+//
+// The creation time can't be changed, and the update time is never moved backwards, so updating a chat
+// read before a message was added doesn't revert the activity recorded by AddMessage.
 func (b BoltDB) UpdateChat(_ context.Context, chat models.Chat) error {
 	return b.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("chats"))
@@ -129,12 +317,25 @@ func (b BoltDB) UpdateChat(_ context.Context, chat models.Chat) error {
 			return nil
 		}
 
+		var stored models.Chat
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return fmt.Errorf("failed to unmarshal chat: %w", err)
+		}
+		chat.CreatedAt = stored.CreatedAt
+		if stored.UpdatedAt.After(chat.UpdatedAt) {
+			chat.UpdatedAt = stored.UpdatedAt
+		}
+
 		v, err := json.Marshal(chat)
 		if err != nil {
 			return fmt.Errorf("failed to marshal chat: %w", err)
 		}
 
-		return b.Put([]byte(chat.ID), v)
+		if err := b.Put([]byte(chat.ID), v); err != nil {
+			return err
+		}
+
+		return indexSearchDoc(tx, chat.ID, "", chat.Title)
 	})
 }
 
@@ -161,26 +362,54 @@ func (b BoltDB) Messages(_ context.Context, chatID string) ([]models.Message, er
 		return nil, err
 	}
 	slices.SortFunc(messages, func(a, b models.Message) int {
-		aID := 0
-		bID := 0
+		return compareIDPrefix(a.ID, b.ID)
+	})
+	return messages, nil
+}
 
-		aIDArr := strings.Split(a.ID, "-")
-		if len(aIDArr) > 1 {
-			aID, _ = strconv.Atoi(aIDArr[0])
-		}
-		bIDArr := strings.Split(b.ID, "-")
-		if len(bIDArr) > 1 {
-			bID, _ = strconv.Atoi(bIDArr[0])
+// MessagesPage retrieves a page of messages of the specified chat, starting from the latest message
+// and going backwards. The messages within the page are in their stored order. The cursor of a page is
+// the ID of its oldest message, and the returned next cursor is empty when there are no older messages
+// left.
+func (b BoltDB) MessagesPage(
+	_ context.Context,
+	chatID string,
+	query models.MessagesQuery,
+) ([]models.Message, string, error) {
+	var messages []models.Message
+	var nextCursor string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messageBucketName(chatID))
+		if b == nil {
+			return nil
 		}
 
-		return cmp.Compare(aID, bID)
+		keys := sortedKeys(b)
+		slices.Reverse(keys)
+
+		page, more := pageAfter(keys, query.Cursor, query.Limit)
+		for i := len(page) - 1; i >= 0; i-- {
+			var message models.Message
+			if err := json.Unmarshal(b.Get([]byte(page[i])), &message); err != nil {
+				return fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			messages = append(messages, message)
+		}
+		if more {
+			nextCursor = page[len(page)-1]
+		}
+		return nil
 	})
-	return messages, nil
+	if err != nil {
+		return nil, "", err
+	}
+	return messages, nextCursor, nil
 }
 
 // AddMessage stores a new message in the specified chat's message bucket. It generates a unique
 // ID for the message by combining a sequence number with the message's original ID, and returns
-// the new ID or an error if the operation fails.
+// the new ID or an error if the operation fails. The update time of the chat is moved to the message
+// timestamp, if it's later.
 func (b BoltDB) AddMessage(_ context.Context, chatID string, message models.Message) (string, error) {
 	var newID string
 	err := b.db.Update(func(tx *bolt.Tx) error {
@@ -201,12 +430,44 @@ func (b BoltDB) AddMessage(_ context.Context, chatID string, message models.Mess
 			return fmt.Errorf("failed to marshal message: %w", err)
 		}
 
-		return b.Put([]byte(newID), v)
+		if err := b.Put([]byte(newID), v); err != nil {
+			return err
+		}
+
+		if err := touchChat(tx, chatID, message.Timestamp); err != nil {
+			return err
+		}
+
+		return indexSearchDoc(tx, chatID, message.ID, message.SearchText())
 	})
 
 	return newID, err
 }
 
+// touchChat moves the update time of the chat to t, if it's later.
+func touchChat(tx *bolt.Tx, chatID string, t time.Time) error {
+	b := tx.Bucket([]byte("chats"))
+	v := b.Get([]byte(chatID))
+	if v == nil {
+		return nil
+	}
+
+	var chat models.Chat
+	if err := json.Unmarshal(v, &chat); err != nil {
+		return fmt.Errorf("failed to unmarshal chat: %w", err)
+	}
+	if !t.After(chat.UpdatedAt) {
+		return nil
+	}
+	chat.UpdatedAt = t
+
+	v, err := json.Marshal(chat)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat: %w", err)
+	}
+	return b.Put([]byte(chatID), v)
+}
+
 // UpdateMessage modifies an existing message in the specified chat's message bucket. If the
 // message doesn't exist, the operation is silently ignored. Returns an error if the marshaling
 // or database operation fails.
@@ -224,6 +485,111 @@ func (b BoltDB) UpdateMessage(_ context.Context, chatID string, message models.M
 			return fmt.Errorf("failed to marshal message: %w", err)
 		}
 
-		return b.Put([]byte(msgID), v)
+		if err := b.Put([]byte(msgID), v); err != nil {
+			return err
+		}
+
+		return indexSearchDoc(tx, chatID, msgID, message.SearchText())
+	})
+}
+
+// Personas retrieves the stored personas sorted by name.
+func (b BoltDB) Personas(context.Context) ([]models.Persona, error) {
+	var personas []models.Persona
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(personasBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var persona models.Persona
+			if err := json.Unmarshal(v, &persona); err != nil {
+				return fmt.Errorf("failed to unmarshal persona: %w", err)
+			}
+			personas = append(personas, persona)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(personas, func(a, b models.Persona) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.ID, b.ID))
+	})
+	return personas, nil
+}
+
+// SavePersona stores the persona, replacing the stored persona with the same ID.
+func (b BoltDB) SavePersona(_ context.Context, persona models.Persona) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(persona)
+		if err != nil {
+			return fmt.Errorf("failed to marshal persona: %w", err)
+		}
+		return tx.Bucket(personasBucket).Put([]byte(persona.ID), v)
+	})
+}
+
+// DeletePersona deletes the persona with the given ID. If the persona doesn't exist, the operation is
+// silently ignored.
+func (b BoltDB) DeletePersona(_ context.Context, personaID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(personasBucket).Delete([]byte(personaID))
+	})
+}
+
+// ChatUsage returns the total usage of the messages of the specified chat.
+func (b BoltDB) ChatUsage(_ context.Context, chatID string) (models.Usage, error) {
+	var usage models.Usage
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		usage, err = boltChatUsage(tx, chatID)
+		return err
+	})
+	return usage, err
+}
+
+// UsageByChat returns the total usage of each chat with a non-zero usage, from the most expensive chat.
+func (b BoltDB) UsageByChat(_ context.Context) ([]models.ChatUsage, error) {
+	var usages []models.ChatUsage
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("chats")).ForEach(func(_, v []byte) error {
+			var chat models.Chat
+			if err := json.Unmarshal(v, &chat); err != nil {
+				return fmt.Errorf("failed to unmarshal chat: %w", err)
+			}
+			usage, err := boltChatUsage(tx, chat.ID)
+			if err != nil {
+				return err
+			}
+			if usage.TotalTokens() > 0 {
+				usages = append(usages, models.ChatUsage{ChatID: chat.ID, ChatTitle: chat.Title, Usage: usage})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortChatUsages(usages)
+	return usages, nil
+}
+
+func boltChatUsage(tx *bolt.Tx, chatID string) (models.Usage, error) {
+	var usage models.Usage
+	msgs := tx.Bucket(messageBucketName(chatID))
+	if msgs == nil {
+		return usage, nil
+	}
+	err := msgs.ForEach(func(_, v []byte) error {
+		var message struct {
+			Usage models.Usage
+		}
+		if err := json.Unmarshal(v, &message); err != nil {
+			return fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		usage = usage.Add(message.Usage)
+		return nil
 	})
+	return usage, err
 }
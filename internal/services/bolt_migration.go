@@ -0,0 +1,170 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltMigration upgrades the stored records from the previous schema version. The version of a
+// migration is its index in boltMigrations plus one.
+type boltMigration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// The schema version of the database is stored under schemaVersionKey in the metaBucket. Databases
+// created before the schema was versioned have no meta bucket, and are considered at version 0.
+var (
+	metaBucket       = []byte("meta")
+	schemaVersionKey = []byte("schemaVersion")
+)
+
+// boltMigrations are the migrations of the Bolt store, applied in order on startup. Migrations must
+// never be changed once released, new changes to the stored records are appended as new migrations.
+var boltMigrations = []boltMigration{
+	{
+		description: "index chats for full-text search",
+		migrate:     rebuildSearchIndex,
+	},
+	{
+		description: "add creation and update times to chats",
+		migrate:     migrateChatTimes,
+	},
+}
+
+// migrateBolt applies the pending migrations to the database at path. If the database already contains
+// chats, it's copied to a backup file next to it before any migration is applied, so the chats can be
+// restored if a migration fails or turns out to be wrong.
+//
+// Each migration is applied in its own transaction together with the schema version update, so an
+// interrupted migration is retried from the same version on the next startup.
+func migrateBolt(db *bolt.DB, path string) error {
+	current, hasChats, err := boltSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > len(boltMigrations) {
+		return fmt.Errorf("store schema version %d is newer than the supported version %d",
+			current, len(boltMigrations))
+	}
+	if current == len(boltMigrations) {
+		return nil
+	}
+
+	if hasChats {
+		backupPath := fmt.Sprintf("%s.v%d-%s.bak", path, current, time.Now().Format("20060102150405"))
+		if err := db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backupPath, 0600)
+		}); err != nil {
+			return fmt.Errorf("failed to backup store before migrating: %w", err)
+		}
+	}
+
+	for i := current; i < len(boltMigrations); i++ {
+		version := i + 1
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := boltMigrations[i].migrate(tx); err != nil {
+				return err
+			}
+			meta, err := tx.CreateBucketIfNotExists(metaBucket)
+			if err != nil {
+				return err
+			}
+			return meta.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %w", version, boltMigrations[i].description, err)
+		}
+	}
+	return nil
+}
+
+func boltSchemaVersion(db *bolt.DB) (int, bool, error) {
+	var version int
+	var hasChats bool
+	err := db.View(func(tx *bolt.Tx) error {
+		if chats := tx.Bucket([]byte("chats")); chats != nil {
+			k, _ := chats.Cursor().First()
+			hasChats = k != nil
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return nil
+		}
+		v := meta.Get(schemaVersionKey)
+		if v == nil {
+			return nil
+		}
+		var err error
+		version, err = strconv.Atoi(string(v))
+		if err != nil {
+			return fmt.Errorf("invalid store schema version %q: %w", v, err)
+		}
+		return nil
+	})
+	return version, hasChats, err
+}
+
+// migrateChatTimes sets the creation and update times of the chats to the timestamps of their first and
+// last messages. Chats without messages are considered created and updated at the time of migration.
+func migrateChatTimes(tx *bolt.Tx) error {
+	chats := tx.Bucket([]byte("chats"))
+	if chats == nil {
+		return nil
+	}
+	now := time.Now()
+
+	updated := make(map[string][]byte)
+	err := chats.ForEach(func(k, v []byte) error {
+		var chat models.Chat
+		if err := json.Unmarshal(v, &chat); err != nil {
+			return fmt.Errorf("failed to unmarshal chat: %w", err)
+		}
+
+		chat.CreatedAt, chat.UpdatedAt = now, now
+		if msgs := tx.Bucket(messageBucketName(chat.ID)); msgs != nil {
+			first := true
+			err := msgs.ForEach(func(_, v []byte) error {
+				var message models.Message
+				if err := json.Unmarshal(v, &message); err != nil {
+					return fmt.Errorf("failed to unmarshal message: %w", err)
+				}
+				if first || message.Timestamp.Before(chat.CreatedAt) {
+					chat.CreatedAt = message.Timestamp
+				}
+				if first || message.Timestamp.After(chat.UpdatedAt) {
+					chat.UpdatedAt = message.Timestamp
+				}
+				first = false
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		v, err := json.Marshal(chat)
+		if err != nil {
+			return fmt.Errorf("failed to marshal chat: %w", err)
+		}
+		updated[string(k)] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Buckets can't be modified while iterating over them, so the chats are written afterwards.
+	for k, v := range updated {
+		if err := chats.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The search index is an inverted index stored in two buckets:
+//   - searchIndexBucket maps "term\x00chatID\x00messageID" keys to empty values, so the documents
+//     containing a term (or a term prefix) can be found with a single cursor scan.
+//   - searchDocsBucket maps "chatID\x00messageID" keys to the JSON-encoded terms of that document,
+//     so the stale postings can be removed when the document changes.
+//
+// A document is either a message, or the chat title, in which case the messageID part is empty.
+var (
+	searchIndexBucket = []byte("search-index")
+	searchDocsBucket  = []byte("search-docs")
+)
+
+const searchKeySeparator = "\x00"
+
+func searchDocKey(chatID, messageID string) string {
+	return chatID + searchKeySeparator + messageID
+}
+
+func searchPostingKey(term, docKey string) []byte {
+	return []byte(term + searchKeySeparator + docKey)
+}
+
+// indexSearchDoc replaces the indexed terms of the document identified by chatID and messageID with
+// the terms of text. The postings of the old terms of the document are removed before the new terms are
+// indexed, so the replaced content of a chat title or message isn't found anymore. Only the postings of
+// the terms that changed are written, as messages are re-indexed on every streamed chunk.
+func indexSearchDoc(tx *bolt.Tx, chatID, messageID, text string) error {
+	idx := tx.Bucket(searchIndexBucket)
+	docs := tx.Bucket(searchDocsBucket)
+	if idx == nil || docs == nil {
+		return nil
+	}
+
+	docKey := searchDocKey(chatID, messageID)
+	newTerms := models.SearchTerms(text)
+	oldTerms, err := unindexSearchDoc(idx, docs, docKey, newTerms)
+	if err != nil {
+		return err
+	}
+
+	for _, term := range newTerms {
+		if slices.Contains(oldTerms, term) {
+			continue
+		}
+		if err := idx.Put(searchPostingKey(term, docKey), []byte{}); err != nil {
+			return fmt.Errorf("failed to put search posting: %w", err)
+		}
+	}
+
+	if len(newTerms) == 0 {
+		return docs.Delete([]byte(docKey))
+	}
+	v, err := json.Marshal(newTerms)
+	if err != nil {
+		return fmt.Errorf("failed to marshal search doc: %w", err)
+	}
+	return docs.Put([]byte(docKey), v)
+}
+
+// unindexSearchDoc removes the postings of the indexed terms of the document, except the ones to keep, and
+// returns the terms the document was indexed with.
+func unindexSearchDoc(idx, docs *bolt.Bucket, docKey string, keep []string) ([]string, error) {
+	v := docs.Get([]byte(docKey))
+	if v == nil {
+		return nil, nil
+	}
+	var terms []string
+	if err := json.Unmarshal(v, &terms); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal search doc: %w", err)
+	}
+	for _, term := range terms {
+		if slices.Contains(keep, term) {
+			continue
+		}
+		if err := idx.Delete(searchPostingKey(term, docKey)); err != nil {
+			return nil, fmt.Errorf("failed to delete search posting: %w", err)
+		}
+	}
+	return terms, nil
+}
+
+// rebuildSearchIndex drops the search index and indexes every stored chat title and message again.
+func rebuildSearchIndex(tx *bolt.Tx) error {
+	for _, name := range [][]byte{searchIndexBucket, searchDocsBucket} {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return fmt.Errorf("failed to delete bucket %s: %w", name, err)
+			}
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return fmt.Errorf("failed to create bucket %s: %w", name, err)
+		}
+	}
+
+	chats := tx.Bucket([]byte("chats"))
+	if chats == nil {
+		return nil
+	}
+
+	return chats.ForEach(func(_, v []byte) error {
+		var chat models.Chat
+		if err := json.Unmarshal(v, &chat); err != nil {
+			return fmt.Errorf("failed to unmarshal chat: %w", err)
+		}
+		if err := indexSearchDoc(tx, chat.ID, "", chat.Title); err != nil {
+			return err
+		}
+
+		msgs := tx.Bucket(messageBucketName(chat.ID))
+		if msgs == nil {
+			return nil
+		}
+		return msgs.ForEach(func(_, v []byte) error {
+			var message models.Message
+			if err := json.Unmarshal(v, &message); err != nil {
+				return fmt.Errorf("failed to unmarshal message: %w", err)
+			}
+			return indexSearchDoc(tx, chat.ID, message.ID, message.SearchText())
+		})
+	})
+}
+
+// SearchChats returns the chat titles and messages that contain all the terms of query. The last term
+// of query is matched as a prefix, so results can be shown while the user is still typing. Results are
+// ordered from the most recent chat to the oldest one, and from the first message to the last one
+// within a chat, and at most limit results are returned.
+func (b BoltDB) SearchChats(_ context.Context, query string, limit int) ([]models.SearchResult, error) {
+	terms := models.SearchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var results []models.SearchResult
+	err := b.db.View(func(tx *bolt.Tx) error {
+		idx := tx.Bucket(searchIndexBucket)
+		if idx == nil {
+			return nil
+		}
+
+		var docKeys map[string]struct{}
+		for i, term := range terms {
+			matches := searchPostings(idx, term, i == len(terms)-1)
+			if docKeys == nil {
+				docKeys = matches
+				continue
+			}
+			for k := range docKeys {
+				if _, ok := matches[k]; !ok {
+					delete(docKeys, k)
+				}
+			}
+		}
+
+		var err error
+		results, err = searchResults(tx, docKeys, terms)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(results, func(a, b models.SearchResult) int {
+		if c := compareIDPrefix(b.ChatID, a.ChatID); c != 0 {
+			return c
+		}
+		// Title matches come first, then messages in their stored order.
+		if a.MessageID == "" || b.MessageID == "" {
+			return strings.Compare(a.MessageID, b.MessageID)
+		}
+		return compareIDPrefix(a.MessageID, b.MessageID)
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// searchPostings returns the keys of the documents containing term. If prefix is true, documents
+// containing any term that starts with term are returned as well.
+func searchPostings(idx *bolt.Bucket, term string, prefix bool) map[string]struct{} {
+	seek := []byte(term + searchKeySeparator)
+	if prefix {
+		seek = []byte(term)
+	}
+
+	docKeys := make(map[string]struct{})
+	c := idx.Cursor()
+	for k, _ := c.Seek(seek); k != nil && bytes.HasPrefix(k, seek); k, _ = c.Next() {
+		_, docKey, ok := strings.Cut(string(k), searchKeySeparator)
+		if !ok {
+			continue
+		}
+		docKeys[docKey] = struct{}{}
+	}
+	return docKeys
+}
+
+func searchResults(tx *bolt.Tx, docKeys map[string]struct{}, terms []string) ([]models.SearchResult, error) {
+	chats := tx.Bucket([]byte("chats"))
+	if chats == nil {
+		return nil, nil
+	}
+
+	results := make([]models.SearchResult, 0, len(docKeys))
+	for docKey := range docKeys {
+		chatID, messageID, _ := strings.Cut(docKey, searchKeySeparator)
+
+		v := chats.Get([]byte(chatID))
+		if v == nil {
+			continue
+		}
+		var chat models.Chat
+		if err := json.Unmarshal(v, &chat); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal chat: %w", err)
+		}
+
+		res := models.SearchResult{
+			ChatID:    chat.ID,
+			ChatTitle: chat.Title,
+			MessageID: messageID,
+		}
+		if messageID == "" {
+			res.Snippet = chat.Title
+			results = append(results, res)
+			continue
+		}
+
+		msgs := tx.Bucket(messageBucketName(chatID))
+		if msgs == nil {
+			continue
+		}
+		v = msgs.Get([]byte(messageID))
+		if v == nil {
+			continue
+		}
+		var message models.Message
+		if err := json.Unmarshal(v, &message); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		res.Snippet = models.Snippet(message.SearchText(), terms)
+		results = append(results, res)
+	}
+	return results, nil
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltSearchIndexUpdates(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewBoltDB(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	chatID, err := db.AddChat(ctx, models.Chat{ID: "chat", Title: "Alpha planning"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := models.Message{
+		ID:       "msg",
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: "Kangaroo migration"}},
+	}
+	msgID, err := db.AddMessage(ctx, chatID, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the title and the message content removes the postings of their old terms.
+	if err := db.UpdateChat(ctx, models.Chat{ID: chatID, Title: "Beta planning"}); err != nil {
+		t.Fatal(err)
+	}
+	msg.ID = msgID
+	msg.Contents[0].Text = "Wombat migration"
+	if err := db.UpdateMessage(ctx, chatID, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{"alpha", "kangaroo"} {
+		results, err := db.SearchChats(ctx, query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 0 {
+			t.Errorf("SearchChats(%q) = %+v, want no stale results", query, results)
+		}
+	}
+	for _, query := range []string{"beta", "wombat"} {
+		results, err := db.SearchChats(ctx, query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 {
+			t.Errorf("SearchChats(%q) = %+v, want one result", query, results)
+		}
+	}
+
+	wantPostings := []string{"beta", "migration", "planning", "wombat"}
+	if got := searchPostingTerms(t, db); !slices.Equal(got, wantPostings) {
+		t.Errorf("search postings = %v, want %v", got, wantPostings)
+	}
+
+	// Emptying the message removes all its postings and its document.
+	msg.Contents[0].Text = ""
+	if err := db.UpdateMessage(ctx, chatID, msg); err != nil {
+		t.Fatal(err)
+	}
+	wantPostings = []string{"beta", "planning"}
+	if got := searchPostingTerms(t, db); !slices.Equal(got, wantPostings) {
+		t.Errorf("search postings = %v, want %v", got, wantPostings)
+	}
+	err = db.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(searchDocsBucket).Stats().KeyN; n != 1 {
+			t.Errorf("search docs = %d, want only the chat title", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// searchPostingTerms returns the terms of every posting of the search index, in key order.
+func searchPostingTerms(t *testing.T, db BoltDB) []string {
+	t.Helper()
+
+	var terms []string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(searchIndexBucket).ForEach(func(k, _ []byte) error {
+			term, _, _ := strings.Cut(string(k), searchKeySeparator)
+			terms = append(terms, term)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return terms
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltDB(t *testing.T) {
+	db, err := NewBoltDB(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	testStore(t, db)
+}
+
+func TestBoltMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.db")
+	first := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	last := first.Add(time.Hour)
+
+	// The store is created before the schema was versioned, with a chat with messages and one without.
+	writeBoltTestDB(t, path, map[string]map[string]string{
+		"chats": {
+			"1-old":   `{"ID": "1-old", "Title": "Old chat"}`,
+			"2-empty": `{"ID": "2-empty", "Title": "Empty chat"}`,
+		},
+		"chat-1-old": {
+			"1-question": `{"ID": "1-question", "Role": "user", "Timestamp": "` + first.Format(time.RFC3339) + `"}`,
+			"2-answer":   `{"ID": "2-answer", "Role": "assistant", "Timestamp": "` + last.Format(time.RFC3339) + `"}`,
+		},
+	})
+
+	beforeMigration := time.Now()
+	db, err := NewBoltDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if version := boltTestSchemaVersion(t, db.db); version != strconv.Itoa(len(boltMigrations)) {
+		t.Errorf("schema version = %s, want %d", version, len(boltMigrations))
+	}
+
+	// The chat times are set from the messages, and the chats without messages are set to the migration time.
+	chat, err := db.Chat(ctx, "1-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chat.CreatedAt.Equal(first) || !chat.UpdatedAt.Equal(last) {
+		t.Errorf("chat times = %s, %s, want %s, %s", chat.CreatedAt, chat.UpdatedAt, first, last)
+	}
+	empty, err := db.Chat(ctx, "2-empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.CreatedAt.Before(beforeMigration) || !empty.UpdatedAt.Equal(empty.CreatedAt) {
+		t.Errorf("empty chat times = %s, %s, want the migration time", empty.CreatedAt, empty.UpdatedAt)
+	}
+
+	// The backup is the store as it was before the migrations.
+	backups, err := filepath.Glob(path + ".v0-*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v, want one backup of the version 0", backups)
+	}
+	backup, err := OpenBoltDBReadOnly(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = backup.Close() })
+	if version := boltTestSchemaVersion(t, backup.db); version != "" {
+		t.Errorf("backup schema version = %s, want none", version)
+	}
+	backupChat, err := backup.Chat(ctx, "1-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupChat.Title != "Old chat" || !backupChat.CreatedAt.IsZero() {
+		t.Errorf("backup chat = %+v, want the chat before the migrations", backupChat)
+	}
+
+	// Reopening the store doesn't back it up again.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewBoltDB(path)
+	if err != nil {
+		t.Fatalf("failed to reopen the migrated store: %v", err)
+	}
+	if backups, _ = filepath.Glob(path + ".v*.bak"); len(backups) != 1 {
+		t.Errorf("backups = %v, want only the backup of the first migration", backups)
+	}
+}
+
+func TestBoltMigrationsEmptyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	db, err := NewBoltDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if version := boltTestSchemaVersion(t, db.db); version != strconv.Itoa(len(boltMigrations)) {
+		t.Errorf("schema version = %s, want %d", version, len(boltMigrations))
+	}
+	// There are no chats to restore, so no backup is written.
+	if backups, _ := filepath.Glob(path + ".v*.bak"); len(backups) != 0 {
+		t.Errorf("backups = %v, want none", backups)
+	}
+}
+
+func TestBoltMigrationsNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	newer := strconv.Itoa(len(boltMigrations) + 1)
+	writeBoltTestDB(t, path, map[string]map[string]string{
+		"chats": {"1-new": `{"ID": "1-new", "Title": "New chat"}`},
+		"meta":  {"schemaVersion": newer},
+	})
+
+	db, err := NewBoltDB(path)
+	if err == nil {
+		_ = db.Close()
+		t.Fatal("NewBoltDB() succeeded with a newer schema version")
+	}
+	if !strings.Contains(err.Error(), "store schema version "+newer+" is newer") {
+		t.Errorf("NewBoltDB() error = %v, want the newer schema version", err)
+	}
+	if backups, _ := filepath.Glob(path + ".v*.bak"); len(backups) != 0 {
+		t.Errorf("backups = %v, want none", backups)
+	}
+}
+
+// writeBoltTestDB writes a Bolt file at path with the buckets and their values, by their keys.
+func writeBoltTestDB(t *testing.T, path string, buckets map[string]map[string]string) {
+	t.Helper()
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for name, values := range buckets {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range values {
+				if err := b.Put([]byte(k), []byte(v)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// boltTestSchemaVersion returns the stored schema version of the database, or "" if there is none.
+func boltTestSchemaVersion(t *testing.T, db *bolt.DB) string {
+	t.Helper()
+
+	var version string
+	err := db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			version = string(meta.Get(schemaVersionKey))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
@@ -0,0 +1,322 @@
+package services
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// Capabilities is an LLM that adapts the chats to the capabilities of the model of another LLM. The tools
+// aren't sent to the models that can't call them, and the images aren't sent to the models without vision:
+// the images of the earlier messages are replaced by a text description of them, and the images attached
+// to the last user message are rejected with an error, as the user expects the model to see them.
+//
+// With text tools, the models that can't call tools natively are given the tools in their system prompt
+// instead, and call them in text, see WithTextTools.
+//
+// The capabilities are set in the configuration, or detected from the provider of the LLM if it implements
+// CapabilityDetector, such as Ollama and OpenRouter. The detected capabilities are cached per model for
+// detectedCapabilitiesTTL, and the failed detections for failedDetectionTTL, so a model that changed, e.g.
+// updated on the Ollama server, is detected again. The models whose capabilities are unknown are assumed to
+// support everything, so their chats are sent as is, but a model that rejects the tools of a chat is
+// detected as not supporting them, and the chat is sent again without them.
+type Capabilities struct {
+	llm        ChatLLM
+	model      string
+	configured ConfiguredCapabilities
+	detected   *sync.Map
+
+	// textTools enables the tool calls in text for the models without native tool calls. The tools are
+	// described after the system prompt of the chat, or systemPrompt if the chat has none.
+	textTools    bool
+	systemPrompt string
+
+	logger *slog.Logger
+}
+
+// ConfiguredCapabilities are the capabilities of the models of an LLM set in the configuration, which take
+// precedence over the detected ones. The capabilities that aren't set are detected.
+type ConfiguredCapabilities struct {
+	Tools  *bool
+	Vision *bool
+}
+
+// CapabilityDetector detects the capabilities of the models of an LLM provider.
+type CapabilityDetector interface {
+	ModelCapabilities(ctx context.Context, model string) (models.ModelCapabilities, error)
+}
+
+// detectedCapabilities are the cached capabilities of a model, detected again once they expire.
+type detectedCapabilities struct {
+	caps    models.ModelCapabilities
+	expires time.Time
+}
+
+const (
+	// detectedCapabilitiesTTL is how long the detected capabilities of a model are cached.
+	detectedCapabilitiesTTL = 10 * time.Minute
+	// failedDetectionTTL is how long the model whose capabilities failed to be detected is assumed to
+	// support everything, before it's detected again.
+	failedDetectionTTL = time.Minute
+)
+
+// toolsUnsupportedHints are the error messages of the providers that reject the tools of a chat because
+// the model can't call them.
+var toolsUnsupportedHints = []string{
+	"does not support tools",               // Ollama.
+	"no endpoints found that support tool", // OpenRouter.
+}
+
+// NewCapabilities creates a new Capabilities adapting the chats of llm to the capabilities of its model,
+// the configured model of the LLM unless the chat selects another one.
+func NewCapabilities(
+	llm ChatLLM,
+	model string,
+	configured ConfiguredCapabilities,
+	logger *slog.Logger,
+) Capabilities {
+	return Capabilities{
+		llm:        llm,
+		model:      model,
+		configured: configured,
+		detected:   &sync.Map{},
+		logger:     logger.With(slog.String("module", "capabilities")),
+	}
+}
+
+// WithTextTools returns a copy of c that lets the models without native tool calls call the tools in text,
+// instead of chatting without the tools. The tools are described in the system prompt of the chat, or the
+// given system prompt of the LLM, and the tool call blocks of the answers are parsed as tool calls.
+//
+// It only applies to the models whose tools are detected as unsupported or configured false, the models
+// with native or unknown tool calls are sent the tools as is.
+func (c Capabilities) WithTextTools(systemPrompt string) Capabilities {
+	c.textTools = true
+	c.systemPrompt = systemPrompt
+	return c
+}
+
+// Chat streams the answer of the LLM to the chat, adapted to the capabilities of the model.
+func (c Capabilities) Chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		model := cmp.Or(opts.Model, c.model)
+		caps := c.capabilities(ctx, model)
+		if !supported(caps.Vision) {
+			var err error
+			messages, err = withoutImages(messages, model)
+			if err != nil {
+				yield(models.Content{}, err)
+				return
+			}
+		}
+
+		started := false
+		for content, err := range c.chat(ctx, messages, tools, opts, supported(caps.Tools)) {
+			if err != nil && !started && caps.Tools == nil && len(tools) > 0 && toolsUnsupported(err) {
+				c.logger.Info("Model rejected the tools, sending the chat again without them",
+					slog.String("model", model),
+					slog.String("err", err.Error()))
+				c.storeToolsUnsupported(model)
+				for content, err := range c.chat(ctx, messages, tools, opts, false) {
+					if !yield(content, err) {
+						return
+					}
+				}
+				return
+			}
+			started = true
+			if !yield(content, err) {
+				return
+			}
+		}
+	}
+}
+
+// chat streams the answer of the LLM to the chat, with the tools if the model supports them, otherwise
+// with the tools called in text if they're enabled, or without the tools.
+func (c Capabilities) chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+	supportsTools bool,
+) iter.Seq2[models.Content, error] {
+	if supportsTools {
+		return c.llm.Chat(ctx, messages, tools, opts)
+	}
+	if c.textTools {
+		return c.textToolsChat(ctx, messages, tools, opts)
+	}
+	if len(tools) > 0 {
+		c.logger.Debug("Model doesn't support tools, sending the chat without them",
+			slog.String("model", cmp.Or(opts.Model, c.model)))
+	}
+	return c.llm.Chat(ctx, messages, nil, opts)
+}
+
+// EstimateTokens estimates the input tokens of the chat with the LLM.
+func (c Capabilities) EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int {
+	if e, ok := c.llm.(tokenEstimator); ok {
+		return e.EstimateTokens(messages, tools, opts)
+	}
+	return models.EstimateTokens(opts.SystemPrompt, messages, tools, 4)
+}
+
+// capabilities returns the capabilities of the model, the configured ones taking precedence over the
+// detected ones. The capabilities that are neither configured nor detected are unknown.
+func (c Capabilities) capabilities(ctx context.Context, model string) models.ModelCapabilities {
+	var caps models.ModelCapabilities
+	if c.configured.Tools == nil || c.configured.Vision == nil {
+		caps = c.detect(ctx, model)
+	}
+	if c.configured.Tools != nil {
+		caps.Tools = c.configured.Tools
+	}
+	if c.configured.Vision != nil {
+		caps.Vision = c.configured.Vision
+	}
+	return caps
+}
+
+func (c Capabilities) detect(ctx context.Context, model string) models.ModelCapabilities {
+	if cached, ok := c.detected.Load(model); ok {
+		if detected, _ := cached.(detectedCapabilities); time.Now().Before(detected.expires) {
+			return detected.caps
+		}
+	}
+	detector, ok := c.llm.(CapabilityDetector)
+	if !ok {
+		return models.ModelCapabilities{}
+	}
+
+	caps, err := detector.ModelCapabilities(ctx, model)
+	ttl := detectedCapabilitiesTTL
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return models.ModelCapabilities{}
+		}
+		c.logger.Warn("Failed to detect the capabilities of the model, assuming it supports everything",
+			slog.String("model", model),
+			slog.String("err", err.Error()))
+		caps, ttl = models.ModelCapabilities{}, failedDetectionTTL
+	}
+	c.detected.Store(model, detectedCapabilities{caps: caps, expires: time.Now().Add(ttl)})
+	return caps
+}
+
+// storeToolsUnsupported caches that the model doesn't support tools, keeping its other capabilities.
+func (c Capabilities) storeToolsUnsupported(model string) {
+	var caps models.ModelCapabilities
+	if cached, ok := c.detected.Load(model); ok {
+		caps = cached.(detectedCapabilities).caps
+	}
+	tools := false
+	caps.Tools = &tools
+	c.detected.Store(model, detectedCapabilities{caps: caps, expires: time.Now().Add(detectedCapabilitiesTTL)})
+}
+
+// supported reports whether the capability is supported, the unknown capabilities being assumed to be.
+func supported(capability *bool) bool {
+	return capability == nil || *capability
+}
+
+// toolsUnsupported reports whether err is the rejection of the tools of a chat by a model that can't call
+// them.
+func toolsUnsupported(err error) bool {
+	message := strings.ToLower(err.Error())
+	return slices.ContainsFunc(toolsUnsupportedHints, func(hint string) bool {
+		return strings.Contains(message, hint)
+	})
+}
+
+// withoutImages returns the messages with their images replaced by a text description of them, for the
+// models without vision. It fails if the last user message has images, as they were just attached by the
+// user, who expects the model to see them.
+func withoutImages(messages []models.Message, model string) ([]models.Message, error) {
+	lastUser := -1
+	for i, msg := range messages {
+		if msg.Role == models.RoleUser {
+			lastUser = i
+		}
+	}
+
+	result := slices.Clone(messages)
+	for i, msg := range messages {
+		if !slices.ContainsFunc(msg.Contents, hasImages) {
+			continue
+		}
+		if i == lastUser {
+			return nil, &LLMError{
+				Kind:    models.ErrorKindUnsupported,
+				Message: fmt.Sprintf("The model %s doesn't support images, select a model with vision to send them", model),
+			}
+		}
+		contents := slices.Clone(msg.Contents)
+		for j, ct := range contents {
+			if ct.Type != models.ContentTypeResource {
+				continue
+			}
+			resources := slices.Clone(ct.ResourceContents)
+			for k, resource := range resources {
+				if isImage(resource) {
+					resources[k] = mcp.ResourceContents{
+						URI:      resource.URI,
+						MimeType: "text/plain",
+						Text:     describeImage(resource),
+					}
+				}
+			}
+			contents[j].ResourceContents = resources
+		}
+		result[i].Contents = contents
+	}
+	return result, nil
+}
+
+// describeImage returns the text that replaces the image for the models without vision: its name, type and
+// size, so the model can still refer to it.
+func describeImage(image mcp.ResourceContents) string {
+	size := base64.StdEncoding.DecodedLen(len(image.Blob))
+	if data, err := base64.StdEncoding.DecodeString(image.Blob); err == nil {
+		size = len(data)
+	}
+	return fmt.Sprintf("[Image %q (%s, %s) left out, as the model doesn't support images]",
+		path.Base(image.URI), image.MimeType, formatByteSize(size))
+}
+
+// formatByteSize formats the size in bytes with the largest unit that keeps it at least 1.
+func formatByteSize(size int) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
+func hasImages(ct models.Content) bool {
+	return ct.Type == models.ContentTypeResource && slices.ContainsFunc(ct.ResourceContents, isImage)
+}
+
+func isImage(resource mcp.ResourceContents) bool {
+	return strings.HasPrefix(resource.MimeType, "image/")
+}
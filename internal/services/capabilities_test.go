@@ -0,0 +1,273 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"iter"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// detectingLLM is an LLM that detects the capabilities of its model, and records the chats it receives.
+type detectingLLM struct {
+	caps      models.ModelCapabilities
+	detectErr error
+	// rejectTools makes the chats with tools fail like a model that can't call them.
+	rejectTools bool
+
+	detections int
+	chats      []detectingLLMChat
+}
+
+type detectingLLMChat struct {
+	messages []models.Message
+	tools    []mcp.Tool
+}
+
+func (d *detectingLLM) ModelCapabilities(context.Context, string) (models.ModelCapabilities, error) {
+	d.detections++
+	return d.caps, d.detectErr
+}
+
+func (d *detectingLLM) Chat(
+	_ context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	_ models.ChatOptions,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		d.chats = append(d.chats, detectingLLMChat{messages: messages, tools: tools})
+		if d.rejectTools && len(tools) > 0 {
+			yield(models.Content{}, &LLMError{
+				Kind:       models.ErrorKindInvalidRequest,
+				StatusCode: http.StatusBadRequest,
+				Message:    "registry.ollama.ai/library/gemma:2b does not support tools",
+			})
+			return
+		}
+		yield(models.Content{Type: models.ContentTypeText, Text: "Answer"}, nil)
+	}
+}
+
+// chatText returns the text of the answer to the chat, and its error.
+func chatText(llm ChatLLM, messages []models.Message, tools []mcp.Tool) (string, error) {
+	var text string
+	for content, err := range llm.Chat(context.Background(), messages, tools, models.ChatOptions{}) {
+		if err != nil {
+			return text, err
+		}
+		text += content.Text
+	}
+	return text, nil
+}
+
+func TestCapabilitiesTools(t *testing.T) {
+	tools := []mcp.Tool{{Name: "search"}}
+	messages := []models.Message{{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hi"}},
+	}}
+
+	tests := []struct {
+		name       string
+		detected   models.ModelCapabilities
+		detectErr  error
+		configured ConfiguredCapabilities
+		wantTools  bool
+	}{
+		{name: "detected", detected: models.ModelCapabilities{Tools: ptrTo(true)}, wantTools: true},
+		{name: "detected without tools", detected: models.ModelCapabilities{Tools: ptrTo(false)}},
+		{name: "unknown", wantTools: true},
+		{name: "detection failed", detectErr: errors.New("unreachable"), wantTools: true},
+		{
+			name:       "configured",
+			detected:   models.ModelCapabilities{Tools: ptrTo(true)},
+			configured: ConfiguredCapabilities{Tools: ptrTo(false)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llm := &detectingLLM{caps: tt.detected, detectErr: tt.detectErr}
+			capabilities := NewCapabilities(llm, "test-model", tt.configured, slog.Default())
+
+			if _, err := chatText(capabilities, messages, tools); err != nil {
+				t.Fatal(err)
+			}
+			if gotTools := len(llm.chats[0].tools) > 0; gotTools != tt.wantTools {
+				t.Errorf("tools sent = %t, want %t", gotTools, tt.wantTools)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesToolsRejected(t *testing.T) {
+	llm := &detectingLLM{rejectTools: true}
+	capabilities := NewCapabilities(llm, "test-model", ConfiguredCapabilities{}, slog.Default())
+	tools := []mcp.Tool{{Name: "search"}}
+
+	// The model with unknown tools rejects them, so the chat is sent again without them.
+	text, err := chatText(capabilities, nil, tools)
+	if err != nil || text != "Answer" {
+		t.Fatalf("Chat() = %q, %v, want the answer without the tools", text, err)
+	}
+	if len(llm.chats) != 2 || len(llm.chats[0].tools) == 0 || len(llm.chats[1].tools) > 0 {
+		t.Fatalf("chats = %+v, want a chat with the tools, then one without them", llm.chats)
+	}
+
+	// The rejection is cached, so the next chats are sent without the tools.
+	if _, err := chatText(capabilities, nil, tools); err != nil {
+		t.Fatal(err)
+	}
+	if len(llm.chats) != 3 || len(llm.chats[2].tools) > 0 || llm.detections != 1 {
+		t.Errorf("chats = %+v after %d detections, want a chat without the tools", llm.chats, llm.detections)
+	}
+
+	// A model known to support tools keeps the error.
+	llm = &detectingLLM{caps: models.ModelCapabilities{Tools: ptrTo(true)}, rejectTools: true}
+	capabilities = NewCapabilities(llm, "test-model", ConfiguredCapabilities{}, slog.Default())
+	if _, err := chatText(capabilities, nil, tools); err == nil || len(llm.chats) != 1 {
+		t.Errorf("Chat() error = %v after %d chats, want the error of the first chat", err, len(llm.chats))
+	}
+}
+
+func TestCapabilitiesDetectionCache(t *testing.T) {
+	llm := &detectingLLM{detectErr: errors.New("unreachable")}
+	capabilities := NewCapabilities(llm, "test-model", ConfiguredCapabilities{}, slog.Default())
+	ctx := context.Background()
+
+	// The failed detection is cached for a while, then detected again.
+	capabilities.capabilities(ctx, "test-model")
+	capabilities.capabilities(ctx, "test-model")
+	if llm.detections != 1 {
+		t.Fatalf("detected %d times, want the failure cached", llm.detections)
+	}
+	expireDetection(t, capabilities, "test-model", failedDetectionTTL)
+
+	llm.detectErr = nil
+	llm.caps = models.ModelCapabilities{Tools: ptrTo(false), Vision: ptrTo(true)}
+	if caps := capabilities.capabilities(ctx, "test-model"); caps.Tools == nil || *caps.Tools || llm.detections != 2 {
+		t.Fatalf("capabilities = %+v after %d detections, want the new detection", caps, llm.detections)
+	}
+
+	// The negative detection expires too, as the model may be updated.
+	expireDetection(t, capabilities, "test-model", detectedCapabilitiesTTL)
+	llm.caps = models.ModelCapabilities{Tools: ptrTo(true), Vision: ptrTo(true)}
+	if caps := capabilities.capabilities(ctx, "test-model"); caps.Tools == nil || !*caps.Tools || llm.detections != 3 {
+		t.Errorf("capabilities = %+v after %d detections, want the new detection", caps, llm.detections)
+	}
+
+	// A canceled detection isn't cached.
+	expireDetection(t, capabilities, "test-model", detectedCapabilitiesTTL)
+	llm.detectErr = context.Canceled
+	capabilities.capabilities(ctx, "test-model")
+	llm.detectErr = nil
+	capabilities.capabilities(ctx, "test-model")
+	if llm.detections != 5 {
+		t.Errorf("detected %d times, want the canceled detection retried", llm.detections)
+	}
+}
+
+// expireDetection moves the expiration of the cached capabilities of the model to now, checking that they
+// were cached for ttl.
+func expireDetection(t *testing.T, c Capabilities, model string, ttl time.Duration) {
+	t.Helper()
+
+	cached, ok := c.detected.Load(model)
+	if !ok {
+		t.Fatalf("capabilities of %s aren't cached", model)
+	}
+	detected := cached.(detectedCapabilities)
+	if remaining := time.Until(detected.expires); remaining <= ttl-time.Minute/2 || remaining > ttl {
+		t.Fatalf("capabilities of %s expire in %s, want %s", model, remaining, ttl)
+	}
+	detected.expires = time.Now()
+	c.detected.Store(model, detected)
+}
+
+func TestCapabilitiesImages(t *testing.T) {
+	image := mcp.ResourceContents{
+		URI:      "file:///photos/cat.png",
+		MimeType: "image/png",
+		Blob:     base64.StdEncoding.EncodeToString(make([]byte, 2048)),
+	}
+	text := mcp.ResourceContents{URI: "file:///notes.txt", MimeType: "text/plain", Text: "Notes"}
+	withImage := models.Message{Role: models.RoleUser, Contents: []models.Content{
+		{Type: models.ContentTypeText, Text: "Look"},
+		{Type: models.ContentTypeResource, ResourceContents: []mcp.ResourceContents{image, text}},
+	}}
+	answer := models.Message{Role: models.RoleAssistant, Contents: []models.Content{{Type: models.ContentTypeText}}}
+	question := models.Message{Role: models.RoleUser, Contents: []models.Content{{Type: models.ContentTypeText}}}
+
+	t.Run("earlier images described", func(t *testing.T) {
+		llm := &detectingLLM{caps: models.ModelCapabilities{Vision: ptrTo(false)}}
+		capabilities := NewCapabilities(llm, "test-model", ConfiguredCapabilities{}, slog.Default())
+		messages := []models.Message{withImage, answer, question}
+
+		if _, err := chatText(capabilities, messages, nil); err != nil {
+			t.Fatal(err)
+		}
+		resources := llm.chats[0].messages[0].Contents[1].ResourceContents
+		want := `[Image "cat.png" (image/png, 2.0 KB) left out, as the model doesn't support images]`
+		if resources[0].MimeType != "text/plain" || resources[0].Text != want || resources[0].Blob != "" {
+			t.Errorf("image = %+v, want its description %s", resources[0], want)
+		}
+		if resources[1] != text {
+			t.Errorf("text resource = %+v, want it kept", resources[1])
+		}
+		// The messages of the chat aren't modified.
+		if messages[0].Contents[1].ResourceContents[0] != image {
+			t.Error("the image of the chat message was modified")
+		}
+	})
+
+	t.Run("new images rejected", func(t *testing.T) {
+		llm := &detectingLLM{caps: models.ModelCapabilities{Vision: ptrTo(false)}}
+		capabilities := NewCapabilities(llm, "test-model", ConfiguredCapabilities{}, slog.Default())
+
+		_, err := chatText(capabilities, []models.Message{question, answer, withImage}, nil)
+		var llmErr *LLMError
+		if !errors.As(err, &llmErr) || llmErr.Kind != models.ErrorKindUnsupported ||
+			!strings.Contains(llmErr.Message, "test-model doesn't support images") {
+			t.Errorf("Chat() error = %v, want an unsupported LLMError", err)
+		}
+		if len(llm.chats) != 0 {
+			t.Errorf("LLM received %d chats, want none", len(llm.chats))
+		}
+	})
+
+	t.Run("vision", func(t *testing.T) {
+		llm := &detectingLLM{}
+		capabilities := NewCapabilities(llm, "test-model", ConfiguredCapabilities{}, slog.Default())
+
+		if _, err := chatText(capabilities, []models.Message{withImage}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := llm.chats[0].messages[0].Contents[1].ResourceContents[0]; got != image {
+			t.Errorf("image = %+v, want it sent as is", got)
+		}
+	})
+}
+
+func TestFormatByteSize(t *testing.T) {
+	tests := []struct {
+		size int
+		want string
+	}{
+		{size: 0, want: "0 bytes"},
+		{size: 1023, want: "1023 bytes"},
+		{size: 1536, want: "1.5 KB"},
+		{size: 5 << 20, want: "5.0 MB"},
+	}
+	for _, tt := range tests {
+		if got := formatByteSize(tt.size); got != tt.want {
+			t.Errorf("formatByteSize(%d) = %q, want %q", tt.size, got, tt.want)
+		}
+	}
+}
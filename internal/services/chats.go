@@ -0,0 +1,75 @@
+package services
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+const chatsCursorSeparator = "|"
+
+// chatsCursor returns the cursor of a page of chats that ends with the given chat. The cursor holds the
+// sort key of the chat instead of just its ID, so the next page starts at the right place even if the
+// chat has been updated, and thus moved, in the meantime.
+func chatsCursor(chat models.Chat) string {
+	return strings.Join([]string{
+		fmt.Sprint(chat.Pinned),
+		chat.UpdatedAt.Format(time.RFC3339Nano),
+		chat.ID,
+	}, chatsCursorSeparator)
+}
+
+// parseChatsCursor parses a cursor returned by chatsCursor into a chat holding only the sort key.
+func parseChatsCursor(cursor string) (models.Chat, error) {
+	parts := strings.SplitN(cursor, chatsCursorSeparator, 3)
+	if len(parts) != 3 {
+		return models.Chat{}, fmt.Errorf("invalid chats cursor: %s", cursor)
+	}
+	updatedAt, err := time.Parse(time.RFC3339Nano, parts[1])
+	if err != nil {
+		return models.Chat{}, fmt.Errorf("invalid chats cursor time: %w", err)
+	}
+	return models.Chat{
+		ID:        parts[2],
+		Pinned:    parts[0] == "true",
+		UpdatedAt: updatedAt,
+	}, nil
+}
+
+// compareChats compares the position of two chats in the chat list: pinned chats come first, then the
+// most recently updated ones. Chats updated at the same time are ordered by compareIDs, in reverse.
+func compareChats(a, b models.Chat, compareIDs func(a, b string) int) int {
+	if a.Pinned != b.Pinned {
+		if a.Pinned {
+			return -1
+		}
+		return 1
+	}
+	if c := b.UpdatedAt.Compare(a.UpdatedAt); c != 0 {
+		return c
+	}
+	return compareIDs(b.ID, a.ID)
+}
+
+// matchChatsQuery reports whether the chat is listed by the query filters.
+func matchChatsQuery(chat models.Chat, query models.ChatsQuery) bool {
+	if chat.Archived != query.Archived {
+		return false
+	}
+	return query.Folder == "" || slices.Contains(chat.Folders, query.Folder)
+}
+
+// sortChatUsages sorts the usages of the chats from the most expensive one. Chats without cost are sorted by
+// their number of tokens.
+func sortChatUsages(usages []models.ChatUsage) {
+	slices.SortStableFunc(usages, func(a, b models.ChatUsage) int {
+		if c := cmp.Compare(b.Usage.Cost, a.Usage.Cost); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Usage.TotalTokens(), a.Usage.TotalTokens())
+	})
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/ollama/ollama/api"
+	goopenai "github.com/sashabaranov/go-openai"
+)
+
+// LLMError is the error of a failed LLM call, classified by the kind of failure, so the user is told
+// what to do about it. Its message is the one of the LLM provider, which never includes the request, so
+// it's safe to show to the user.
+type LLMError struct {
+	Kind models.ErrorKind
+	// StatusCode is the HTTP status of the failed response, zero if the call failed otherwise, e.g. with
+	// an error event of the stream.
+	StatusCode int
+	// Message is the error message of the LLM provider.
+	Message string
+
+	err error
+}
+
+// contextLengthHints are the phrases of the error messages of the LLM providers that reject a request
+// because it doesn't fit in the context window of the model.
+var contextLengthHints = []string{
+	"context length", "context_length", "context window", "maximum context", "prompt is too long",
+	"input is too long", "too many tokens", "token limit", "input length", "reduce the length",
+}
+
+// newLLMError classifies err, the error of an LLM call, into an LLMError wrapping it. The cancellations
+// and the errors that are already classified are returned as is.
+func newLLMError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errStreamStopped) {
+		return err
+	}
+	var llmErr *LLMError
+	if errors.As(err, &llmErr) {
+		return err
+	}
+
+	if code, _, ok := httpStatus(err); ok {
+		message := providerMessage(err)
+		if message == "" {
+			message = statusReason(code)
+		}
+		return &LLMError{Kind: statusErrorKind(code, message), StatusCode: code, Message: message, err: err}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return &LLMError{Kind: models.ErrorKindOverloaded, Message: err.Error(), err: err}
+	}
+	return &LLMError{Kind: models.ErrorKindUnknown, Message: err.Error(), err: err}
+}
+
+// newTypedLLMError returns the LLMError of an error event of an LLM stream, of the given provider-specific
+// type, e.g. "overloaded_error" or "throttlingException".
+func newTypedLLMError(errType, message string) *LLMError {
+	return &LLMError{Kind: typedErrorKind(errType, message), Message: message}
+}
+
+func (e *LLMError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: %s", statusReason(e.StatusCode), e.Message)
+	}
+	return e.Message
+}
+
+func (e *LLMError) Unwrap() error {
+	return e.err
+}
+
+// MessageError returns the error recorded on the message that failed with e.
+func (e *LLMError) MessageError() models.MessageError {
+	return models.MessageError{Kind: e.Kind, Message: e.Message}
+}
+
+// statusErrorKind returns the kind of failure of a response with the HTTP status and error message.
+func statusErrorKind(code int, message string) models.ErrorKind {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return models.ErrorKindAuth
+	case code == http.StatusTooManyRequests || code == http.StatusPaymentRequired:
+		return models.ErrorKindRateLimit
+	case code == http.StatusRequestEntityTooLarge || isContextLengthMessage(message):
+		return models.ErrorKindContextLength
+	case transientStatus(code):
+		return models.ErrorKindOverloaded
+	case code >= 400 && code < 500:
+		return models.ErrorKindInvalidRequest
+	default:
+		return models.ErrorKindUnknown
+	}
+}
+
+// typedErrorKind returns the kind of failure of an error type named by an LLM provider.
+func typedErrorKind(errType, message string) models.ErrorKind {
+	errType = strings.ToLower(errType)
+	switch {
+	case strings.Contains(errType, "auth") || strings.Contains(errType, "permission") ||
+		strings.Contains(errType, "accessdenied"):
+		return models.ErrorKindAuth
+	case strings.Contains(errType, "rate") || strings.Contains(errType, "throttl") ||
+		strings.Contains(errType, "quota"):
+		return models.ErrorKindRateLimit
+	case isContextLengthMessage(message):
+		return models.ErrorKindContextLength
+	case strings.Contains(errType, "overloaded") || strings.Contains(errType, "unavailable") ||
+		strings.Contains(errType, "internal") || strings.Contains(errType, "api_error"):
+		return models.ErrorKindOverloaded
+	case strings.Contains(errType, "invalid") || strings.Contains(errType, "validation") ||
+		strings.Contains(errType, "not_found") || strings.Contains(errType, "notfound"):
+		return models.ErrorKindInvalidRequest
+	default:
+		return models.ErrorKindUnknown
+	}
+}
+
+func isContextLengthMessage(message string) bool {
+	message = strings.ToLower(message)
+	for _, hint := range contextLengthHints {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// providerMessage returns the error message of the LLM provider that answered with an error status, if
+// any.
+func providerMessage(err error) string {
+	var sErr *statusError
+	if errors.As(err, &sErr) {
+		return sErr.message
+	}
+	var apiErr *goopenai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Message
+	}
+	var reqErr *goopenai.RequestError
+	if errors.As(err, &reqErr) {
+		return errorBodyMessage(reqErr.Body)
+	}
+	var ollamaErr api.StatusError
+	if errors.As(err, &ollamaErr) {
+		return ollamaErr.ErrorMessage
+	}
+	return ""
+}
+
+// errorBodyMessage returns the message of the error body of an LLM provider, which is an object with the
+// message, e.g. {"error": {"message": "..."}}, {"error": "..."} or {"message": "..."}, or the raw body.
+func errorBodyMessage(body []byte) string {
+	// The errors of the streaming endpoints of Gemini are wrapped in an array.
+	var list []json.RawMessage
+	if err := json.Unmarshal(body, &list); err == nil && len(list) > 0 {
+		body = list[0]
+	}
+
+	var res struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return strings.TrimSpace(string(body))
+	}
+	var nested struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(res.Error, &nested); err == nil && nested.Message != "" {
+		return nested.Message
+	}
+	var message string
+	if err := json.Unmarshal(res.Error, &message); err == nil && message != "" {
+		return message
+	}
+	if res.Message != "" {
+		return res.Message
+	}
+	return strings.TrimSpace(string(body))
+}
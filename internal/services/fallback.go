@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net/http"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// Fallback is an LLM that chats with the first LLM of a chain, and falls back to the next one when it fails
+// with a transient error, such as an overloaded provider, or runs out of credit, before it started answering.
+// Once an LLM started answering, with a text, a thinking or a tool call, its errors are returned as is.
+//
+// When an LLM falls back to the next one, a status explaining why is yielded, followed by a content of
+// type models.ContentTypeFallback with the name of the LLM that answers instead.
+type Fallback struct {
+	llms []FallbackLLM
+
+	logger *slog.Logger
+}
+
+// FallbackLLM is an LLM of a fallback chain.
+type FallbackLLM struct {
+	// Name is the name of the LLM, shown to the user when it answers instead of the first LLM of the chain.
+	Name string
+	LLM  ChatLLM
+}
+
+// ChatLLM is an LLM that chats, implemented by all the LLM providers.
+type ChatLLM interface {
+	Chat(
+		ctx context.Context,
+		messages []models.Message,
+		tools []mcp.Tool,
+		opts models.ChatOptions,
+	) iter.Seq2[models.Content, error]
+}
+
+type tokenEstimator interface {
+	EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int
+}
+
+// NewFallback creates a new Fallback with the given chain of LLMs, the first one being the one that
+// answers unless it fails.
+func NewFallback(llms []FallbackLLM, logger *slog.Logger) Fallback {
+	return Fallback{
+		llms:   llms,
+		logger: logger.With(slog.String("module", "fallback")),
+	}
+}
+
+// Chat streams the answer of the first LLM of the chain that doesn't fail before it started answering.
+func (f Fallback) Chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		for i, llm := range f.llms {
+			if i > 0 {
+				// The model selected by the chat is a model of the first LLM, the fallback LLMs answer with
+				// their configured model.
+				opts.Model = ""
+			}
+			started := false
+			var lastErr error
+			for content, err := range llm.LLM.Chat(ctx, messages, tools, opts) {
+				if err != nil {
+					lastErr = err
+					break
+				}
+				switch content.Type {
+				case models.ContentTypeText, models.ContentTypeThinking, models.ContentTypeCallTool:
+					started = true
+				default:
+				}
+				if !yield(content, nil) {
+					return
+				}
+			}
+			if lastErr == nil {
+				return
+			}
+
+			reason, ok := fallbackReason(lastErr)
+			if started || !ok || i == len(f.llms)-1 {
+				yield(models.Content{}, lastErr)
+				return
+			}
+
+			next := f.llms[i+1].Name
+			f.logger.Warn("LLM failed, falling back to the next one",
+				slog.String("llm", llm.Name),
+				slog.String("fallback", next),
+				slog.String("err", lastErr.Error()))
+			if !yield(models.Content{
+				Type: models.ContentTypeStatus,
+				Text: fmt.Sprintf("%s failed (%s), falling back to %s…", llm.Name, reason, next),
+			}, nil) {
+				return
+			}
+			if !yield(models.Content{Type: models.ContentTypeFallback, Text: next}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// EstimateTokens estimates the input tokens of the chat with the first LLM of the chain.
+func (f Fallback) EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int {
+	if len(f.llms) > 0 {
+		if e, ok := f.llms[0].LLM.(tokenEstimator); ok {
+			return e.EstimateTokens(messages, tools, opts)
+		}
+	}
+	return models.EstimateTokens(opts.SystemPrompt, messages, tools, 4)
+}
+
+// fallbackReason reports whether the chat should fall back to the next LLM after err, because it's a
+// transient error or the credit of the provider ran out, with a short description of it.
+func fallbackReason(err error) (string, bool) {
+	if errors.Is(err, context.Canceled) {
+		return "", false
+	}
+	if reason, _, ok := transientError(err); ok {
+		return reason, true
+	}
+	if code, _, ok := httpStatus(err); ok && code == http.StatusPaymentRequired {
+		return statusReason(code), true
+	}
+	return "", false
+}
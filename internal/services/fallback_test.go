@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// scriptedLLM is an LLM that yields its contents, then fails with its error if it's not nil.
+type scriptedLLM struct {
+	contents []models.Content
+	err      error
+}
+
+func (s scriptedLLM) Chat(
+	context.Context,
+	[]models.Message,
+	[]mcp.Tool,
+	models.ChatOptions,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		for _, content := range s.contents {
+			if !yield(content, nil) {
+				return
+			}
+		}
+		if s.err != nil {
+			yield(models.Content{}, s.err)
+		}
+	}
+}
+
+func TestFallbackChat(t *testing.T) {
+	overloaded := &statusError{statusCode: http.StatusServiceUnavailable, message: "Overloaded"}
+	answer := models.Content{Type: models.ContentTypeText, Text: "Answer"}
+
+	tests := []struct {
+		name         string
+		contents     []models.Content
+		err          error
+		wantFallback bool
+	}{
+		{name: "failed before any content", err: overloaded, wantFallback: true},
+		{
+			name:         "failed after a status",
+			contents:     []models.Content{{Type: models.ContentTypeStatus, Text: "Retrying"}},
+			err:          overloaded,
+			wantFallback: true,
+		},
+		{
+			name: "failed after the usage and finish",
+			contents: []models.Content{
+				{Type: models.ContentTypeUsage, Usage: &models.Usage{InputTokens: 10}},
+				{Type: models.ContentTypeFinish},
+			},
+			err:          overloaded,
+			wantFallback: true,
+		},
+		{name: "failed with a request error", err: &statusError{statusCode: http.StatusBadRequest}},
+		{
+			name:     "failed after a text",
+			contents: []models.Content{{Type: models.ContentTypeText, Text: "Partial"}},
+			err:      overloaded,
+		},
+		{
+			name:     "failed after a thinking",
+			contents: []models.Content{{Type: models.ContentTypeThinking, Text: "Hmm"}},
+			err:      overloaded,
+		},
+		{
+			name:     "failed after a tool call",
+			contents: []models.Content{{Type: models.ContentTypeCallTool, ToolName: "search"}},
+			err:      overloaded,
+		},
+		{name: "succeeded", contents: []models.Content{answer}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallback := NewFallback([]FallbackLLM{
+				{Name: "primary", LLM: scriptedLLM{contents: tt.contents, err: tt.err}},
+				{Name: "backup", LLM: scriptedLLM{contents: []models.Content{answer}}},
+			}, slog.Default())
+
+			var fellBack bool
+			var lastErr error
+			for content, err := range fallback.Chat(context.Background(), nil, nil, models.ChatOptions{}) {
+				if err != nil {
+					lastErr = err
+					break
+				}
+				if content.Type == models.ContentTypeFallback {
+					fellBack = true
+					if content.Text != "backup" {
+						t.Errorf("fell back to %q, want backup", content.Text)
+					}
+				}
+			}
+
+			if fellBack != tt.wantFallback {
+				t.Errorf("fell back = %t, want %t", fellBack, tt.wantFallback)
+			}
+			wantErr := tt.err != nil && !tt.wantFallback
+			if (lastErr != nil) != wantErr {
+				t.Errorf("error = %v, want an error: %t", lastErr, wantErr)
+			}
+			if wantErr && !errors.Is(lastErr, tt.err) {
+				t.Errorf("error = %v, want the error of the primary LLM %v", lastErr, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,726 @@
+package services
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/tmaxmax/go-sse"
+)
+
+// Gemini provides an implementation of the LLM interface for interacting with the Google Gemini models
+// through the Gemini API.
+type Gemini struct {
+	apiKey       string
+	model        string
+	systemPrompt string
+	endpoint     string
+
+	params models.LLMParameters
+	retry  RetryPolicy
+	// extra are the vendor-specific fields merged into the request body.
+	extra map[string]any
+
+	client *http.Client
+
+	logger *slog.Logger
+}
+
+// GeminiParameters are the names of the LLM parameters supported by Gemini, the others are ignored.
+var GeminiParameters = []string{
+	"temperature", "topP", "topK", "frequencyPenalty", "presencePenalty", "seed", "maxTokens", "logprobs",
+	"topLogprobs", "stop", "includeReasoning",
+}
+
+type geminiChatRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []geminiTool            `json:"tools,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text string `json:"text,omitempty"`
+	// Thought marks the text as the thinking of the model.
+	Thought bool `json:"thought,omitempty"`
+
+	InlineData       *geminiInlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	ID       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature      *float32              `json:"temperature,omitempty"`
+	TopP             *float32              `json:"topP,omitempty"`
+	TopK             *int                  `json:"topK,omitempty"`
+	FrequencyPenalty *float32              `json:"frequencyPenalty,omitempty"`
+	PresencePenalty  *float32              `json:"presencePenalty,omitempty"`
+	Seed             *int                  `json:"seed,omitempty"`
+	MaxOutputTokens  *int                  `json:"maxOutputTokens,omitempty"`
+	ResponseLogprobs *bool                 `json:"responseLogprobs,omitempty"`
+	Logprobs         *int                  `json:"logprobs,omitempty"`
+	StopSequences    []string              `json:"stopSequences,omitempty"`
+	ThinkingConfig   *geminiThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type geminiThinkingConfig struct {
+	IncludeThoughts bool `json:"includeThoughts"`
+}
+
+type geminiResponse struct {
+	Candidates     []geminiCandidate     `json:"candidates"`
+	UsageMetadata  *geminiUsageMetadata  `json:"usageMetadata"`
+	PromptFeedback *geminiPromptFeedback `json:"promptFeedback"`
+	ModelVersion   string                `json:"modelVersion"`
+}
+
+type geminiCandidate struct {
+	Content      geminiContent `json:"content"`
+	FinishReason string        `json:"finishReason"`
+}
+
+type geminiUsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+}
+
+type geminiPromptFeedback struct {
+	BlockReason string `json:"blockReason"`
+}
+
+const (
+	geminiAPIEndpoint = "https://generativelanguage.googleapis.com/v1beta"
+
+	geminiRoleUser  = "user"
+	geminiRoleModel = "model"
+
+	// geminiMaxSchemaDepth limits the resolution of the recursive $ref of the tool schemas, as Gemini
+	// doesn't support references.
+	geminiMaxSchemaDepth = 8
+)
+
+// geminiSchemaFields are the fields of the OpenAPI schema subset supported by Gemini. The other fields of
+// the JSON schemas of the tools are dropped.
+var geminiSchemaFields = []string{
+	"type", "format", "title", "description", "nullable", "enum", "maxItems", "minItems", "properties",
+	"required", "minProperties", "maxProperties", "minLength", "maxLength", "pattern", "anyOf", "items",
+	"minimum", "maximum", "propertyOrdering",
+}
+
+// NewGemini creates a new Gemini instance with the specified API key, model name, system prompt and
+// endpoint of the Gemini API, which defaults to the public endpoint if it's empty.
+func NewGemini(
+	apiKey, model, systemPrompt, endpoint string,
+	params models.LLMParameters,
+	logger *slog.Logger,
+) Gemini {
+	return Gemini{
+		apiKey:       apiKey,
+		model:        model,
+		systemPrompt: systemPrompt,
+		endpoint:     strings.TrimSuffix(cmp.Or(endpoint, geminiAPIEndpoint), "/"),
+		params:       params,
+		retry:        DefaultRetryPolicy,
+		client:       &http.Client{},
+		logger:       logger.With(slog.String("module", "gemini")),
+	}
+}
+
+// WithRetry returns a copy of g that retries the failed requests with the given policy.
+func (g Gemini) WithRetry(policy RetryPolicy) Gemini {
+	g.retry = policy
+	return g
+}
+
+// WithExtra returns a copy of g that merges the extra fields into the body of its requests.
+func (g Gemini) WithExtra(extra map[string]any) Gemini {
+	g.extra = extra
+	return g
+}
+
+// Chat streams responses from the Gemini API for a given sequence of messages. It returns an iterator
+// that yields response chunks and potential errors. The context can be used to cancel ongoing requests.
+// Refer to models.Message for message structure details. The system prompt and parameters of opts take
+// precedence over the configured ones.
+func (g Gemini) Chat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		var resp *http.Response
+		err := g.retry.retry(ctx, "Gemini", func() error {
+			var err error
+			resp, err = g.doRequest(ctx, messages, tools, opts, true)
+			return err
+		}, func(status models.Content) bool {
+			return yield(status, nil)
+		})
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, errStreamStopped) {
+				return
+			}
+			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
+			return
+		}
+		defer resp.Body.Close()
+
+		// The tool call is yielded after the usage, which is sent with the last chunk.
+		var toolContent *models.Content
+		var usage *models.Usage
+		model, finishReason := g.model, ""
+		for ev, err := range sse.Read(resp.Body, nil) {
+			if err != nil {
+				yield(models.Content{}, fmt.Errorf("error reading response: %w", err))
+				return
+			}
+
+			g.logger.Debug("Received event", slog.String("event", ev.Data))
+
+			var res geminiResponse
+			if err := json.Unmarshal([]byte(ev.Data), &res); err != nil {
+				yield(models.Content{}, fmt.Errorf("error unmarshaling response: %w", err))
+				return
+			}
+			if res.PromptFeedback != nil && res.PromptFeedback.BlockReason != "" {
+				yield(models.Content{}, &LLMError{
+					Kind:    models.ErrorKindInvalidRequest,
+					Message: fmt.Sprintf("Gemini blocked the prompt: %s", res.PromptFeedback.BlockReason),
+				})
+				return
+			}
+			if res.UsageMetadata != nil {
+				usage = geminiUsage(*res.UsageMetadata)
+			}
+			model = cmp.Or(res.ModelVersion, model)
+			if len(res.Candidates) == 0 {
+				continue
+			}
+			finishReason = cmp.Or(res.Candidates[0].FinishReason, finishReason)
+
+			for _, part := range res.Candidates[0].Content.Parts {
+				switch {
+				case part.FunctionCall != nil:
+					// Only the first tool call is used, as the chat calls one tool at a time.
+					if toolContent != nil {
+						g.logger.Warn("Received multiples tool call, but only the first one is supported",
+							slog.String("toolCall", fmt.Sprintf("%+v", *part.FunctionCall)))
+						continue
+					}
+					args := part.FunctionCall.Args
+					if len(args) == 0 || string(args) == "null" {
+						args = json.RawMessage("{}")
+					}
+					toolContent = &models.Content{
+						Type:       models.ContentTypeCallTool,
+						ToolName:   part.FunctionCall.Name,
+						ToolInput:  args,
+						CallToolID: part.FunctionCall.ID,
+					}
+				case part.Text == "":
+				case part.Thought:
+					if !yield(models.Content{Type: models.ContentTypeThinking, Text: part.Text}, nil) {
+						return
+					}
+				default:
+					if !yield(models.Content{Type: models.ContentTypeText, Text: part.Text}, nil) {
+						return
+					}
+				}
+			}
+		}
+		if usage != nil {
+			if !yield(models.Content{Type: models.ContentTypeUsage, Usage: usage}, nil) {
+				return
+			}
+		}
+		if !yield(finishContent("gemini", model, finishReason), nil) {
+			return
+		}
+		if toolContent != nil {
+			yield(*toolContent, nil)
+		}
+	}
+}
+
+// EstimateTokens estimates the number of input tokens of a chat call with the given messages, tools and
+// options, to fit the chat in the context window of the model. It's based on the fact that Gemini models
+// tokenize English text into about 4 characters per token.
+func (g Gemini) EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int {
+	return models.EstimateTokens(cmp.Or(opts.SystemPrompt, g.systemPrompt), messages, tools, 4)
+}
+
+// GenerateTitle generates a title for a given message using the Gemini API. It sends a single message to the
+// Gemini API and returns the first response text as the title. The context can be used to cancel ongoing
+// requests.
+func (g Gemini) GenerateTitle(ctx context.Context, message string) (string, error) {
+	messages := []models.Message{
+		{
+			Role: models.RoleUser,
+			Contents: []models.Content{
+				{
+					Type: models.ContentTypeText,
+					Text: message,
+				},
+			},
+		},
+	}
+	var resp *http.Response
+	err := g.retry.retry(ctx, "Gemini", func() error {
+		var err error
+		resp, err = g.doRequest(ctx, messages, nil, models.ChatOptions{}, false)
+		return err
+	}, nil)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var res geminiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("error decoding response: %w", err)
+	}
+	if len(res.Candidates) == 0 {
+		return "", fmt.Errorf("no candidates in response")
+	}
+	for _, part := range res.Candidates[0].Content.Parts {
+		if part.Text != "" && !part.Thought {
+			return part.Text, nil
+		}
+	}
+	return "", fmt.Errorf("empty response content")
+}
+
+func (g Gemini) doRequest(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+	stream bool,
+) (*http.Response, error) {
+	params := g.params.Merge(opts.Parameters)
+
+	contents, err := g.convertMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody := geminiChatRequest{
+		Contents: contents,
+		GenerationConfig: &geminiGenerationConfig{
+			Temperature:      params.Temperature,
+			TopP:             params.TopP,
+			TopK:             params.TopK,
+			FrequencyPenalty: params.FrequencyPenalty,
+			PresencePenalty:  params.PresencePenalty,
+			Seed:             params.Seed,
+			MaxOutputTokens:  params.MaxTokens,
+			ResponseLogprobs: params.Logprobs,
+			Logprobs:         params.TopLogprobs,
+			StopSequences:    params.Stop,
+		},
+	}
+	if params.IncludeReasoning != nil && *params.IncludeReasoning {
+		reqBody.GenerationConfig.ThinkingConfig = &geminiThinkingConfig{IncludeThoughts: true}
+	}
+	if systemPrompt := cmp.Or(opts.SystemPrompt, g.systemPrompt); systemPrompt != "" {
+		reqBody.SystemInstruction = &geminiContent{Parts: []geminiPart{{Text: systemPrompt}}}
+	}
+	if len(tools) > 0 {
+		declarations := make([]geminiFunctionDeclaration, len(tools))
+		for i, tool := range tools {
+			schema, err := geminiSchema(tool.InputSchema)
+			if err != nil {
+				return nil, fmt.Errorf("error converting input schema of tool %s: %w", tool.Name, err)
+			}
+			declarations[i] = geminiFunctionDeclaration{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  schema,
+			}
+		}
+		reqBody.Tools = []geminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+	if jsonBody, err = mergeExtra(jsonBody, g.extra); err != nil {
+		return nil, err
+	}
+
+	reqURL := fmt.Sprintf("%s/models/%s:generateContent", g.endpoint, url.PathEscape(g.model))
+	if stream {
+		reqURL = fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse", g.endpoint, url.PathEscape(g.model))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", g.apiKey)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+
+	return resp, nil
+}
+
+func (g Gemini) convertMessages(messages []models.Message) ([]geminiContent, error) {
+	var contents []geminiContent
+	// The function responses are matched with their calls by name, so the name of the latest call is
+	// kept for the tool result that follows it.
+	var lastCall *geminiFunctionCall
+
+	for _, msg := range messages {
+		if msg.Role == models.RoleUser {
+			parts := make([]geminiPart, 0, len(msg.Contents))
+			for _, ct := range msg.Contents {
+				switch ct.Type {
+				case models.ContentTypeText:
+					if ct.Text != "" {
+						parts = append(parts, geminiPart{Text: ct.Text})
+					}
+				case models.ContentTypeResource:
+					parts = append(parts, g.processResourceContents(ct.ResourceContents)...)
+				case models.ContentTypeCallTool, models.ContentTypeToolResult, models.ContentTypeThinking:
+					return nil, fmt.Errorf("content type %s is not supported for user messages", ct.Type)
+				}
+			}
+			contents = append(contents, geminiContent{Role: geminiRoleUser, Parts: parts})
+			continue
+		}
+
+		parts := make([]geminiPart, 0, len(msg.Contents))
+		for _, ct := range msg.Contents {
+			switch ct.Type {
+			case models.ContentTypeText:
+				if ct.Text != "" {
+					parts = append(parts, geminiPart{Text: ct.Text})
+				}
+			case models.ContentTypeThinking:
+				// The thinking isn't sent back, as Gemini doesn't need it to continue the chat.
+			case models.ContentTypeCallTool:
+				lastCall = &geminiFunctionCall{ID: ct.CallToolID, Name: ct.ToolName, Args: ct.ToolInput}
+				parts = append(parts, geminiPart{FunctionCall: lastCall})
+				contents = append(contents, geminiContent{Role: geminiRoleModel, Parts: parts})
+				parts = make([]geminiPart, 0, len(msg.Contents))
+			case models.ContentTypeToolResult:
+				if lastCall == nil {
+					return nil, fmt.Errorf("tool result without tool call")
+				}
+				contents = append(contents, geminiContent{
+					Role: geminiRoleUser,
+					Parts: []geminiPart{{FunctionResponse: &geminiFunctionResponse{
+						ID:       lastCall.ID,
+						Name:     lastCall.Name,
+						Response: geminiToolResponse(ct.ToolResult, ct.CallToolFailed),
+					}}},
+				})
+			case models.ContentTypeResource:
+				return nil, fmt.Errorf("content type %s is not supported for assistant messages", ct.Type)
+			}
+		}
+		if len(parts) > 0 {
+			contents = append(contents, geminiContent{Role: geminiRoleModel, Parts: parts})
+		}
+	}
+
+	return contents, nil
+}
+
+func (g Gemini) processResourceContents(resources []mcp.ResourceContents) []geminiPart {
+	var parts []geminiPart
+
+	for _, resource := range resources {
+		switch {
+		case strings.HasPrefix(resource.MimeType, "image/"), resource.MimeType == "application/pdf":
+			blobData := resource.Blob
+			if !isBase64(blobData) {
+				blobData = base64.StdEncoding.EncodeToString([]byte(blobData))
+			}
+			parts = append(parts, geminiPart{InlineData: &geminiInlineData{
+				MimeType: resource.MimeType,
+				Data:     blobData,
+			}})
+		default:
+			// Only images and PDFs are sent inline, so treat others as text
+			data := resource.Text
+			if data == "" {
+				data = resource.Blob
+			}
+			parts = append(parts, geminiPart{
+				Text: fmt.Sprintf("[Document of type %s]\n%s", resource.MimeType, data),
+			})
+		}
+	}
+
+	return parts
+}
+
+// geminiToolResponse returns the response of a function call, which Gemini requires to be an object, from
+// the result of the tool.
+func geminiToolResponse(result json.RawMessage, failed bool) map[string]any {
+	key := "result"
+	if failed {
+		key = "error"
+	}
+	var value any
+	if err := json.Unmarshal(result, &value); err != nil {
+		value = string(result)
+	}
+	return map[string]any{key: value}
+}
+
+func geminiUsage(u geminiUsageMetadata) *models.Usage {
+	return &models.Usage{
+		InputTokens:     u.PromptTokenCount,
+		OutputTokens:    u.CandidatesTokenCount + u.ThoughtsTokenCount,
+		CacheReadTokens: u.CachedContentTokenCount,
+	}
+}
+
+// geminiSchema converts the JSON schema of the input of a tool to the subset of the OpenAPI schema that
+// Gemini supports: the references are resolved, the type unions are converted to nullable types, the const
+// and oneOf keywords are converted to their supported equivalent, and the unsupported fields are dropped.
+// It returns nil if the tool has no parameters, as Gemini rejects objects without properties.
+func geminiSchema(inputSchema json.RawMessage) (map[string]any, error) {
+	if len(inputSchema) == 0 {
+		return nil, nil
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(inputSchema, &schema); err != nil {
+		return nil, err
+	}
+
+	defs := make(map[string]any)
+	for _, key := range []string{"definitions", "$defs"} {
+		if d, ok := schema[key].(map[string]any); ok {
+			maps.Copy(defs, d)
+		}
+	}
+
+	converted := convertGeminiSchema(schema, defs, 0)
+	if props, _ := converted["properties"].(map[string]any); len(props) == 0 {
+		return nil, nil
+	}
+	return converted, nil
+}
+
+func convertGeminiSchema(schema map[string]any, defs map[string]any, depth int) map[string]any {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := ref[strings.LastIndex(ref, "/")+1:]
+		def, ok := defs[name].(map[string]any)
+		resolvable := ok && depth < geminiMaxSchemaDepth
+		if !resolvable {
+			// The unresolved references are left as objects of any shape.
+			def = map[string]any{"type": "object"}
+		}
+		resolved := maps.Clone(def)
+		if description, ok := schema["description"]; ok {
+			resolved["description"] = description
+		}
+		if !resolvable {
+			return resolved
+		}
+		return convertGeminiSchema(resolved, defs, depth+1)
+	}
+
+	out := make(map[string]any)
+	for _, field := range geminiSchemaFields {
+		if value, ok := schema[field]; ok {
+			out[field] = value
+		}
+	}
+
+	// A union type with null is a nullable type, other unions keep their first type.
+	if types, ok := schema["type"].([]any); ok {
+		delete(out, "type")
+		for _, t := range types {
+			if t == "null" {
+				out["nullable"] = true
+			} else if _, ok := out["type"]; !ok {
+				out["type"] = t
+			}
+		}
+	}
+	if value, ok := schema["const"]; ok {
+		out["enum"] = []any{value}
+	}
+	if _, ok := out["anyOf"]; !ok {
+		if oneOf, ok := schema["oneOf"]; ok {
+			out["anyOf"] = oneOf
+		}
+	}
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			if subSchema, ok := sub.(map[string]any); ok {
+				mergeGeminiSchema(out, convertGeminiSchema(subSchema, defs, depth+1))
+			}
+		}
+	}
+
+	if anyOf, ok := out["anyOf"].([]any); ok {
+		var converted []any
+		for _, sub := range anyOf {
+			subSchema, ok := sub.(map[string]any)
+			if !ok {
+				continue
+			}
+			if subSchema["type"] == "null" {
+				out["nullable"] = true
+				continue
+			}
+			converted = append(converted, convertGeminiSchema(subSchema, defs, depth+1))
+		}
+		switch len(converted) {
+		case 0:
+			delete(out, "anyOf")
+		case 1:
+			delete(out, "anyOf")
+			mergeGeminiSchema(out, converted[0].(map[string]any))
+		default:
+			out["anyOf"] = converted
+		}
+	}
+
+	if props, ok := out["properties"].(map[string]any); ok {
+		converted := make(map[string]any, len(props))
+		for name, prop := range props {
+			if propSchema, ok := prop.(map[string]any); ok {
+				converted[name] = convertGeminiSchema(propSchema, defs, depth+1)
+			}
+		}
+		out["properties"] = converted
+		if _, ok := out["type"]; !ok {
+			out["type"] = "object"
+		}
+		if required, ok := out["required"].([]any); ok {
+			out["required"] = slices.DeleteFunc(slices.Clone(required), func(name any) bool {
+				n, _ := name.(string)
+				_, ok := converted[n]
+				return !ok
+			})
+		}
+	}
+
+	if out["type"] == "array" {
+		items, ok := out["items"].(map[string]any)
+		if ok {
+			out["items"] = convertGeminiSchema(items, defs, depth+1)
+		} else {
+			// Gemini requires the type of the items of an array.
+			out["items"] = map[string]any{"type": "string"}
+		}
+	}
+
+	// Gemini only supports the enums of strings.
+	if enum, ok := out["enum"].([]any); ok {
+		values := make([]any, 0, len(enum))
+		for _, value := range enum {
+			if value != nil {
+				values = append(values, fmt.Sprint(value))
+			}
+		}
+		out["type"] = "string"
+		out["enum"] = values
+	}
+
+	// Gemini only supports some formats, depending on the type.
+	if format, ok := out["format"].(string); ok {
+		var supported []string
+		switch out["type"] {
+		case "string":
+			supported = []string{"enum", "date-time"}
+		case "number":
+			supported = []string{"float", "double"}
+		case "integer":
+			supported = []string{"int32", "int64"}
+		}
+		if !slices.Contains(supported, format) {
+			delete(out, "format")
+		}
+	}
+
+	return out
+}
+
+// mergeGeminiSchema merges the converted schema src into dst, with the properties and required fields
+// of both.
+func mergeGeminiSchema(dst, src map[string]any) {
+	for key, value := range src {
+		switch key {
+		case "properties":
+			props, _ := dst["properties"].(map[string]any)
+			if props == nil {
+				props = make(map[string]any)
+			}
+			srcProps, _ := value.(map[string]any)
+			maps.Copy(props, srcProps)
+			dst["properties"] = props
+		case "required":
+			required, _ := dst["required"].([]any)
+			srcRequired, _ := value.([]any)
+			dst["required"] = append(slices.Clone(required), srcRequired...)
+		default:
+			if _, ok := dst[key]; !ok {
+				dst[key] = value
+			}
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/services"
+)
+
+// geminiServer is a local stand-in of the Gemini API, which records the requests it receives and answers
+// each of them with the next response.
+type geminiServer struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	requests  []map[string]any
+	paths     []string
+	responses []geminiServerResponse
+}
+
+type geminiServerResponse struct {
+	status int
+	// events are sent as server-sent events if the request is streamed, otherwise the first event is
+	// sent as the body.
+	events []string
+}
+
+func newGeminiServer(t *testing.T, responses ...geminiServerResponse) (*geminiServer, *httptest.Server) {
+	s := &geminiServer{t: t, responses: responses}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func (s *geminiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key := r.Header.Get("x-goog-api-key"); key != "test-key" {
+		s.t.Errorf("x-goog-api-key = %q, want %q", key, "test-key")
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	var req map[string]any
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.t.Fatalf("invalid request body %s: %v", body, err)
+	}
+	s.requests = append(s.requests, req)
+	s.paths = append(s.paths, r.URL.RequestURI())
+
+	if len(s.responses) == 0 {
+		s.t.Fatal("unexpected request")
+	}
+	res := s.responses[0]
+	s.responses = s.responses[1:]
+
+	if res.status != 0 && res.status != http.StatusOK {
+		http.Error(w, `{"error": {"code": 503, "message": "overloaded", "status": "UNAVAILABLE"}}`, res.status)
+		return
+	}
+	if r.URL.Query().Get("alt") != "sse" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, res.events[0])
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range res.events {
+		// The events are sent on a single line, as the Gemini API does.
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(event)); err != nil {
+			s.t.Fatalf("invalid event %s: %v", event, err)
+		}
+		fmt.Fprintf(w, "data: %s\n\n", compact.String())
+	}
+}
+
+func (s *geminiServer) request(i int) map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[i]
+}
+
+func collectGeminiChat(t *testing.T, gemini services.Gemini, messages []models.Message,
+	tools []mcp.Tool, opts models.ChatOptions,
+) []models.Content {
+	t.Helper()
+
+	var contents []models.Content
+	for content, err := range gemini.Chat(context.Background(), messages, tools, opts) {
+		if err != nil {
+			t.Fatalf("Chat() error = %v", err)
+		}
+		contents = append(contents, content)
+	}
+	return contents
+}
+
+func userMessage(text string) models.Message {
+	return models.Message{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: text}},
+	}
+}
+
+func TestGeminiChat(t *testing.T) {
+	server, srv := newGeminiServer(t, geminiServerResponse{events: []string{
+		`{"candidates": [{"content": {"role": "model", "parts": [{"text": "Let me think", "thought": true}]}}]}`,
+		`{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello"}]}}]}`,
+		`{"candidates": [{"content": {"role": "model", "parts": [{"text": " there"}]}}]}`,
+		`{"candidates": [{"content": {"role": "model", "parts": [
+			{"functionCall": {"name": "get_weather", "args": {"city": "Paris"}}}
+		]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 100, "candidatesTokenCount": 20, "thoughtsTokenCount": 5,
+			"cachedContentTokenCount": 40}, "modelVersion": "gemini-test-001"}`,
+	}})
+
+	temperature := float32(0.5)
+	maxTokens := 256
+	includeReasoning := true
+	gemini := services.NewGemini("test-key", "gemini-test", "You are helpful.", srv.URL,
+		models.LLMParameters{Temperature: &temperature, Stop: []string{"END"}}, slog.Default())
+
+	contents := collectGeminiChat(t, gemini, []models.Message{userMessage("Weather in Paris?")}, nil,
+		models.ChatOptions{Parameters: models.LLMParameters{
+			MaxTokens:        &maxTokens,
+			IncludeReasoning: &includeReasoning,
+		}})
+
+	want := []models.Content{
+		{Type: models.ContentTypeThinking, Text: "Let me think"},
+		{Type: models.ContentTypeText, Text: "Hello"},
+		{Type: models.ContentTypeText, Text: " there"},
+		{Type: models.ContentTypeUsage, Usage: &models.Usage{InputTokens: 100, OutputTokens: 25, CacheReadTokens: 40}},
+		{Type: models.ContentTypeFinish, Finish: &models.Finish{
+			Provider:         "gemini",
+			Model:            "gemini-test-001",
+			StopReason:       models.StopReasonEnd,
+			NativeStopReason: "STOP",
+		}},
+		{Type: models.ContentTypeCallTool, ToolName: "get_weather", ToolInput: json.RawMessage(`{"city":"Paris"}`)},
+	}
+	if !reflect.DeepEqual(contents, want) {
+		t.Errorf("Chat() contents = %+v, want %+v", contents, want)
+	}
+
+	if path := server.paths[0]; path != "/models/gemini-test:streamGenerateContent?alt=sse" {
+		t.Errorf("request path = %s, want the streamGenerateContent method", path)
+	}
+	req := server.request(0)
+	wantSystem := map[string]any{"parts": []any{map[string]any{"text": "You are helpful."}}}
+	if !reflect.DeepEqual(req["systemInstruction"], wantSystem) {
+		t.Errorf("systemInstruction = %v, want %v", req["systemInstruction"], wantSystem)
+	}
+	wantConfig := map[string]any{
+		"temperature":     0.5,
+		"maxOutputTokens": float64(256),
+		"stopSequences":   []any{"END"},
+		"thinkingConfig":  map[string]any{"includeThoughts": true},
+	}
+	if !reflect.DeepEqual(req["generationConfig"], wantConfig) {
+		t.Errorf("generationConfig = %v, want %v", req["generationConfig"], wantConfig)
+	}
+}
+
+func TestGeminiChatMessages(t *testing.T) {
+	server, srv := newGeminiServer(t, geminiServerResponse{events: []string{
+		`{"candidates": [{"content": {"role": "model", "parts": [{"text": "It's sunny."}]}}]}`,
+	}})
+	gemini := services.NewGemini("test-key", "gemini-test", "", srv.URL, models.LLMParameters{}, slog.Default())
+
+	messages := []models.Message{
+		{
+			Role: models.RoleUser,
+			Contents: []models.Content{
+				{Type: models.ContentTypeText, Text: "What's in these?"},
+				{Type: models.ContentTypeResource, ResourceContents: []mcp.ResourceContents{
+					{URI: "file:///photo.png", MimeType: "image/png", Blob: "aW1hZ2U="},
+					{URI: "file:///doc.pdf", MimeType: "application/pdf", Blob: "cGRm"},
+					{URI: "file:///notes.txt", MimeType: "text/plain", Text: "Some notes"},
+				}},
+			},
+		},
+		{
+			Role: models.RoleAssistant,
+			Contents: []models.Content{
+				{Type: models.ContentTypeThinking, Text: "Should check the weather"},
+				{Type: models.ContentTypeText, Text: "Checking."},
+				{Type: models.ContentTypeCallTool, ToolName: "get_weather", ToolInput: json.RawMessage(`{"city":"Paris"}`)},
+				{Type: models.ContentTypeToolResult, ToolResult: json.RawMessage(`{"sky":"clear"}`)},
+			},
+		},
+	}
+	collectGeminiChat(t, gemini, messages, nil, models.ChatOptions{})
+
+	var got []any
+	if err := remarshal(server.request(0)["contents"], &got); err != nil {
+		t.Fatal(err)
+	}
+	var want []any
+	if err := json.Unmarshal([]byte(`[
+		{"role": "user", "parts": [
+			{"text": "What's in these?"},
+			{"inlineData": {"mimeType": "image/png", "data": "aW1hZ2U="}},
+			{"inlineData": {"mimeType": "application/pdf", "data": "cGRm"}},
+			{"text": "[Document of type text/plain]\nSome notes"}
+		]},
+		{"role": "model", "parts": [
+			{"text": "Checking."},
+			{"functionCall": {"name": "get_weather", "args": {"city": "Paris"}}}
+		]},
+		{"role": "user", "parts": [
+			{"functionResponse": {"name": "get_weather", "response": {"result": {"sky": "clear"}}}}
+		]}
+	]`), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("contents = %v, want %v", got, want)
+	}
+}
+
+func TestGeminiChatToolSchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		inputSchema string
+		want        string
+	}{
+		{
+			name:        "No parameters",
+			inputSchema: `{"type": "object", "properties": {}, "additionalProperties": false}`,
+			want:        `null`,
+		},
+		{
+			name: "Unsupported fields",
+			inputSchema: `{
+				"$schema": "http://json-schema.org/draft-07/schema#",
+				"type": "object",
+				"properties": {
+					"path": {"type": "string", "format": "uri", "default": "/"},
+					"at": {"type": "string", "format": "date-time"},
+					"tags": {"type": "array"}
+				},
+				"required": ["path", "missing"],
+				"additionalProperties": false
+			}`,
+			want: `{
+				"type": "object",
+				"properties": {
+					"path": {"type": "string"},
+					"at": {"type": "string", "format": "date-time"},
+					"tags": {"type": "array", "items": {"type": "string"}}
+				},
+				"required": ["path"]
+			}`,
+		},
+		{
+			name: "Unions, const and enums",
+			inputSchema: `{
+				"type": "object",
+				"properties": {
+					"limit": {"type": ["integer", "null"]},
+					"mode": {"const": "fast"},
+					"level": {"type": "integer", "enum": [1, 2]},
+					"query": {"oneOf": [{"type": "string"}, {"type": "null"}]}
+				}
+			}`,
+			want: `{
+				"type": "object",
+				"properties": {
+					"limit": {"type": "integer", "nullable": true},
+					"mode": {"type": "string", "enum": ["fast"]},
+					"level": {"type": "string", "enum": ["1", "2"]},
+					"query": {"type": "string", "nullable": true}
+				}
+			}`,
+		},
+		{
+			name: "References",
+			inputSchema: `{
+				"type": "object",
+				"properties": {
+					"owner": {"$ref": "#/$defs/person", "description": "The owner"}
+				},
+				"$defs": {
+					"person": {
+						"type": "object",
+						"properties": {"name": {"type": "string"}},
+						"additionalProperties": false
+					}
+				}
+			}`,
+			want: `{
+				"type": "object",
+				"properties": {
+					"owner": {"type": "object", "description": "The owner", "properties": {"name": {"type": "string"}}}
+				}
+			}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, srv := newGeminiServer(t, geminiServerResponse{events: []string{
+				`{"candidates": [{"content": {"role": "model", "parts": [{"text": "OK"}]}}]}`,
+			}})
+			gemini := services.NewGemini("test-key", "gemini-test", "", srv.URL, models.LLMParameters{},
+				slog.Default())
+
+			tools := []mcp.Tool{{
+				Name:        "tool",
+				Description: "A tool",
+				InputSchema: json.RawMessage(tt.inputSchema),
+			}}
+			collectGeminiChat(t, gemini, []models.Message{userMessage("Hi")}, tools, models.ChatOptions{})
+
+			var decls []struct {
+				Name       string         `json:"name"`
+				Parameters map[string]any `json:"parameters"`
+			}
+			tools0, _ := server.request(0)["tools"].([]any)
+			if len(tools0) != 1 {
+				t.Fatalf("tools = %v, want one tool", server.request(0)["tools"])
+			}
+			if err := remarshal(tools0[0].(map[string]any)["functionDeclarations"], &decls); err != nil {
+				t.Fatal(err)
+			}
+			var want map[string]any
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if len(decls) != 1 || decls[0].Name != "tool" || !reflect.DeepEqual(decls[0].Parameters, want) {
+				t.Errorf("functionDeclarations = %+v, want parameters %v", decls, want)
+			}
+		})
+	}
+}
+
+func TestGeminiChatRetry(t *testing.T) {
+	_, srv := newGeminiServer(t,
+		geminiServerResponse{status: http.StatusServiceUnavailable},
+		geminiServerResponse{events: []string{
+			`{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello"}]}, "finishReason": "MAX_TOKENS"}]}`,
+		}},
+	)
+	gemini := services.NewGemini("test-key", "gemini-test", "", srv.URL, models.LLMParameters{}, slog.Default()).
+		WithRetry(services.RetryPolicy{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	contents := collectGeminiChat(t, gemini, []models.Message{userMessage("Hi")}, nil, models.ChatOptions{})
+
+	if len(contents) != 3 || contents[0].Type != models.ContentTypeStatus ||
+		!strings.Contains(contents[0].Text, "HTTP 503") {
+		t.Fatalf("Chat() contents = %+v, want a retry status then the answer", contents)
+	}
+	if !reflect.DeepEqual(contents[1], models.Content{Type: models.ContentTypeText, Text: "Hello"}) {
+		t.Errorf("Chat() answer = %+v, want Hello", contents[1])
+	}
+	if finish := contents[2].Finish; finish == nil || !finish.Truncated() || finish.Model != "gemini-test" {
+		t.Errorf("Chat() finish = %+v, want the answer truncated by the max tokens", finish)
+	}
+}
+
+func TestGeminiChatError(t *testing.T) {
+	_, srv := newGeminiServer(t, geminiServerResponse{status: http.StatusServiceUnavailable})
+	gemini := services.NewGemini("test-key", "gemini-test", "", srv.URL, models.LLMParameters{}, slog.Default()).
+		WithRetry(services.RetryPolicy{})
+
+	var gotErr error
+	for _, err := range gemini.Chat(context.Background(), []models.Message{userMessage("Hi")}, nil,
+		models.ChatOptions{}) {
+		if err != nil {
+			gotErr = err
+		}
+	}
+	if gotErr == nil || !strings.Contains(gotErr.Error(), "503") {
+		t.Errorf("Chat() error = %v, want the unexpected status", gotErr)
+	}
+}
+
+func TestGeminiGenerateTitle(t *testing.T) {
+	server, srv := newGeminiServer(t, geminiServerResponse{events: []string{
+		`{"candidates": [{"content": {"role": "model", "parts": [
+			{"text": "Thinking about it", "thought": true},
+			{"text": "Weather in Paris"}
+		]}}]}`,
+	}})
+	gemini := services.NewGemini("test-key", "gemini-test", "Generate a title.", srv.URL, models.LLMParameters{},
+		slog.Default())
+
+	title, err := gemini.GenerateTitle(context.Background(), "Weather in Paris?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Weather in Paris" {
+		t.Errorf("GenerateTitle() = %q, want %q", title, "Weather in Paris")
+	}
+	if path := server.paths[0]; path != "/models/gemini-test:generateContent" {
+		t.Errorf("request path = %s, want the generateContent method", path)
+	}
+}
+
+func remarshal(v any, out any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -1,8 +1,154 @@
 package services
 
-import "encoding/base64"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
 
 func isBase64(s string) bool {
 	_, err := base64.StdEncoding.DecodeString(s)
 	return err == nil
 }
+
+// mergeExtra merges the extra fields into the JSON object of the request body, replacing its fields of
+// the same name, except for the objects that are merged recursively, so the extra fields can add to the
+// nested objects of the request.
+func mergeExtra(body []byte, extra map[string]any) ([]byte, error) {
+	if len(extra) == 0 {
+		return body, nil
+	}
+
+	var req map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// The numbers are kept as is, instead of being converted to floats.
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("error decoding request: %w", err)
+	}
+	mergeJSONObject(req, extra)
+
+	merged, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling extra fields: %w", err)
+	}
+	return merged, nil
+}
+
+func mergeJSONObject(dst, src map[string]any) {
+	for name, value := range src {
+		srcObject, ok := value.(map[string]any)
+		if dstObject, isObject := dst[name].(map[string]any); ok && isObject {
+			mergeJSONObject(dstObject, srcObject)
+			continue
+		}
+		dst[name] = value
+	}
+}
+
+// thinkTagSplitter splits the streamed text of the reasoning models that wrap their reasoning in
+// <think></think> tags, e.g. DeepSeek R1 and QwQ, into thinking and text contents. A chunk ending with
+// the beginning of a tag is held back until the next chunk tells whether it's a tag.
+type thinkTagSplitter struct {
+	thinking bool
+	pending  string
+}
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+// split returns the contents of the streamed chunk.
+func (s *thinkTagSplitter) split(chunk string) []models.Content {
+	var contents []models.Content
+	text := s.pending + chunk
+	s.pending = ""
+	for text != "" {
+		tag := thinkOpenTag
+		if s.thinking {
+			tag = thinkCloseTag
+		}
+		if i := strings.Index(text, tag); i >= 0 {
+			contents = s.appendContent(contents, text[:i])
+			text = text[i+len(tag):]
+			s.thinking = !s.thinking
+			continue
+		}
+		// Hold back the longest suffix that may be the beginning of the tag.
+		n := tagPrefixSuffix(text, tag)
+		s.pending = text[len(text)-n:]
+		contents = s.appendContent(contents, text[:len(text)-n])
+		break
+	}
+	return contents
+}
+
+// flush returns the content of the text held back at the end of the stream, if any.
+func (s *thinkTagSplitter) flush() []models.Content {
+	text := s.pending
+	s.pending = ""
+	return s.appendContent(nil, text)
+}
+
+func (s *thinkTagSplitter) appendContent(contents []models.Content, text string) []models.Content {
+	if text == "" {
+		return contents
+	}
+	contentType := models.ContentTypeText
+	if s.thinking {
+		contentType = models.ContentTypeThinking
+	}
+	return append(contents, models.Content{Type: contentType, Text: text})
+}
+
+// tagPrefixSuffix returns the length of the longest suffix of the text that is the beginning of the tag,
+// which the streamed text holds back until the next chunk tells whether it's the tag.
+func tagPrefixSuffix(text, tag string) int {
+	for n := min(len(tag)-1, len(text)); n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// finishContent returns the content ending an answer of the model of the provider, which stopped for the
+// native stop reason of the provider.
+func finishContent(provider, model, nativeReason string) models.Content {
+	return models.Content{
+		Type: models.ContentTypeFinish,
+		Finish: &models.Finish{
+			Provider:         provider,
+			Model:            model,
+			StopReason:       stopReason(nativeReason),
+			NativeStopReason: nativeReason,
+		},
+	}
+}
+
+// stopReason normalizes the stop reason named by an LLM provider, e.g. "end_turn" of Anthropic, "length"
+// of OpenAI or "MAX_TOKENS" of Gemini.
+func stopReason(nativeReason string) models.StopReason {
+	switch strings.ToLower(nativeReason) {
+	case "":
+		return ""
+	case "end_turn", "stop", "end":
+		return models.StopReasonEnd
+	case "max_tokens", "length":
+		return models.StopReasonMaxTokens
+	case "stop_sequence":
+		return models.StopReasonStopSequence
+	case "tool_use", "tool_calls", "function_call":
+		return models.StopReasonToolUse
+	case "content_filter", "content_filtered", "guardrail_intervened", "refusal", "safety", "recitation",
+		"blocklist", "prohibited_content", "spii", "image_safety":
+		return models.StopReasonContentFilter
+	default:
+		return models.StopReasonOther
+	}
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// recordingServer is a test server of an LLM provider that records the requests it receives, and answers
+// them with the handler, or an empty JSON object if it's nil.
+type recordingServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+type recordedRequest struct {
+	method string
+	url    *url.URL
+	header http.Header
+	body   []byte
+}
+
+func newRecordingServer(t *testing.T, handler http.HandlerFunc) *recordingServer {
+	t.Helper()
+
+	s := &recordingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, recordedRequest{method: r.Method, url: r.URL, header: r.Header, body: body})
+		s.mu.Unlock()
+
+		if handler == nil {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// requestCount returns the number of requests received by the server.
+func (s *recordingServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// lastRequest returns the last request received by the server.
+func (s *recordingServer) lastRequest(t *testing.T) recordedRequest {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("the server received no request")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+// lastBody returns the JSON body of the last request received by the server, decoded into a map.
+func (s *recordingServer) lastBody(t *testing.T) map[string]any {
+	t.Helper()
+
+	var body map[string]any
+	if err := json.Unmarshal(s.lastRequest(t).body, &body); err != nil {
+		t.Fatalf("failed to decode the request body: %v", err)
+	}
+	return body
+}
+
+// redirectClient returns an HTTP client that sends the requests to the server, for the providers whose
+// API endpoint can't be configured.
+func (s *recordingServer) redirectClient() *http.Client {
+	target, _ := url.Parse(s.URL)
+	return &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.URL.Scheme = target.Scheme
+		r.URL.Host = target.Host
+		r.Host = target.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"cmp"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -8,10 +9,12 @@ import (
 	"fmt"
 	"iter"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/MegaGrindStone/go-mcp"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
@@ -25,17 +28,26 @@ type Ollama struct {
 	model        string
 	systemPrompt string
 
-	params LLMParameters
+	params models.LLMParameters
+	retry  RetryPolicy
+	// extra are the vendor-specific options of the model, such as num_ctx.
+	extra map[string]any
 
 	client *api.Client
 
 	logger *slog.Logger
 }
 
+// OllamaParameters are the names of the LLM parameters supported by Ollama, the others are ignored.
+var OllamaParameters = []string{
+	"temperature", "topP", "topK", "frequencyPenalty", "presencePenalty", "repetitionPenalty", "minP", "seed",
+	"maxTokens", "stop", "includeReasoning",
+}
+
 // NewOllama creates a new Ollama instance with the specified host URL and model name. The host
 // parameter should be a valid URL pointing to an Ollama server. If the provided host URL is invalid,
 // the function will panic.
-func NewOllama(host, model, systemPrompt string, params LLMParameters, logger *slog.Logger) Ollama {
+func NewOllama(host, model, systemPrompt string, params models.LLMParameters, logger *slog.Logger) Ollama {
 	u, err := url.Parse(host)
 	if err != nil {
 		panic(err)
@@ -46,11 +58,25 @@ func NewOllama(host, model, systemPrompt string, params LLMParameters, logger *s
 		model:        model,
 		systemPrompt: systemPrompt,
 		params:       params,
+		retry:        DefaultRetryPolicy,
 		client:       api.NewClient(u, &http.Client{}),
 		logger:       logger.With(slog.String("module", "ollama")),
 	}
 }
 
+// WithRetry returns a copy of o that retries the failed requests with the given policy.
+func (o Ollama) WithRetry(policy RetryPolicy) Ollama {
+	o.retry = policy
+	return o
+}
+
+// WithExtra returns a copy of o that adds the extra options to the options of its requests, replacing the
+// options set by the parameters.
+func (o Ollama) WithExtra(extra map[string]any) Ollama {
+	o.extra = extra
+	return o
+}
+
 func ollamaMessages(messages []models.Message) ([]api.Message, error) {
 	msgs := make([]api.Message, 0, len(messages))
 	for _, msg := range messages {
@@ -184,11 +210,13 @@ func convertResourceToText(resource mcp.ResourceContents) string {
 // Chat implements the LLM interface by streaming responses from the Ollama model. It accepts a context
 // for cancellation and a slice of messages representing the conversation history. The function returns
 // an iterator that yields response chunks as strings and potential errors. The response is streamed
-// incrementally, allowing for real-time processing of model outputs.
+// incrementally, allowing for real-time processing of model outputs. The system prompt and parameters of
+// opts take precedence over the configured ones.
 func (o Ollama) Chat(
 	ctx context.Context,
 	messages []models.Message,
 	tools []mcp.Tool,
+	opts models.ChatOptions,
 ) iter.Seq2[models.Content, error] {
 	return func(yield func(models.Content, error) bool) {
 		msgs, err := ollamaMessages(messages)
@@ -199,7 +227,7 @@ func (o Ollama) Chat(
 
 		msgs = slices.Insert(msgs, 0, api.Message{
 			Role:    "system",
-			Content: o.systemPrompt,
+			Content: cmp.Or(opts.SystemPrompt, o.systemPrompt),
 		})
 
 		oTools := make([]api.Tool, len(tools))
@@ -233,7 +261,10 @@ func (o Ollama) Chat(
 			oTools[i] = oTool
 		}
 
-		req := o.chatRequest(msgs, oTools, true)
+		params := o.params.Merge(opts.Parameters)
+		req := o.chatRequest(msgs, oTools, params, true)
+		// The chat may select another model pulled on the server than the configured one.
+		req.Model = cmp.Or(opts.Model, o.model)
 
 		reqJSON, err := json.Marshal(req)
 		if err == nil {
@@ -243,17 +274,29 @@ func (o Ollama) Chat(
 		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
 
-		if err := o.client.Chat(ctx, &req, func(res api.ChatResponse) error {
-			if res.Message.Content != "" {
-				if !yield(models.Content{
-					Type: models.ContentTypeText,
-					Text: res.Message.Content,
-				}, nil) {
-					cancel()
-					return nil
+		// The reasoning of the reasoning models is streamed as thinking, unless it's excluded.
+		includeReasoning := params.IncludeReasoning == nil || *params.IncludeReasoning
+		var splitter thinkTagSplitter
+		yieldText := func(contents []models.Content) bool {
+			for _, content := range contents {
+				if content.Type == models.ContentTypeThinking && !includeReasoning {
+					continue
+				}
+				if !yield(content, nil) {
+					return false
 				}
 			}
-			if len(res.Message.ToolCalls) > 0 {
+			return true
+		}
+
+		// The tool call is yielded after the last response, which holds the usage.
+		var toolContent *models.Content
+		handle := func(res api.ChatResponse) error {
+			if !yieldText(splitter.split(res.Message.Content)) {
+				cancel()
+				return nil
+			}
+			if len(res.Message.ToolCalls) > 0 && toolContent == nil {
 				args, err := json.Marshal(res.Message.ToolCalls[0].Function.Arguments)
 				if err != nil {
 					return fmt.Errorf("error marshaling tool arguments: %w", err)
@@ -264,25 +307,74 @@ func (o Ollama) Chat(
 						slog.String("toolCalls", fmt.Sprintf("%+v", res.Message.ToolCalls)),
 					)
 				}
-				if !yield(models.Content{
+				toolContent = &models.Content{
 					Type:      models.ContentTypeCallTool,
 					ToolName:  res.Message.ToolCalls[0].Function.Name,
 					ToolInput: args,
+				}
+			}
+			if res.Done {
+				if !yieldText(splitter.flush()) {
+					cancel()
+					return nil
+				}
+				if !yield(models.Content{
+					Type: models.ContentTypeUsage,
+					Usage: &models.Usage{
+						InputTokens:  res.PromptEvalCount,
+						OutputTokens: res.EvalCount,
+					},
 				}, nil) {
 					cancel()
+					return nil
+				}
+				if !yield(finishContent("ollama", cmp.Or(res.Model, o.model), res.DoneReason), nil) {
+					cancel()
 				}
 			}
 			return nil
-		}); err != nil {
-			if errors.Is(err, context.Canceled) {
+		}
+
+		// The request is only retried until the model starts answering, the errors of the stream aren't
+		// retried.
+		started := false
+		var streamErr error
+		err = o.retry.retry(ctx, "Ollama", func() error {
+			err := o.client.Chat(ctx, &req, func(res api.ChatResponse) error {
+				started = true
+				return handle(res)
+			})
+			if started {
+				streamErr = err
+				return nil
+			}
+			return err
+		}, func(status models.Content) bool {
+			return yield(status, nil)
+		})
+		if err == nil {
+			err = streamErr
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, errStreamStopped) {
 				return
 			}
 			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
 			return
 		}
+		if toolContent != nil && ctx.Err() == nil {
+			yield(*toolContent, nil)
+		}
 	}
 }
 
+// EstimateTokens estimates the number of input tokens of a chat call with the given messages, tools and
+// options, to fit the chat in the context window of the model. It's based on the fact that the tokenizers of
+// the local models vary, so it's estimated conservatively with 3.5 characters per token.
+func (o Ollama) EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int {
+	return models.EstimateTokens(cmp.Or(opts.SystemPrompt, o.systemPrompt), messages, tools, 3.5)
+}
+
 // GenerateTitle generates a title for a given message using the Ollama API. It sends a single message to the
 // Ollama API and returns the first response content as the title. The context can be used to cancel ongoing
 // requests.
@@ -298,21 +390,128 @@ func (o Ollama) GenerateTitle(ctx context.Context, message string) (string, erro
 		},
 	}
 
-	req := o.chatRequest(msgs, nil, false)
+	req := o.chatRequest(msgs, nil, o.params, false)
 
-	var title string
+	var title strings.Builder
 
 	if err := o.client.Chat(ctx, &req, func(res api.ChatResponse) error {
-		title = res.Message.Content
+		// The reasoning of the reasoning models isn't part of the title.
+		var splitter thinkTagSplitter
+		for _, content := range append(splitter.split(res.Message.Content), splitter.flush()...) {
+			if content.Type == models.ContentTypeText {
+				title.WriteString(content.Text)
+			}
+		}
 		return nil
 	}); err != nil {
 		return "", fmt.Errorf("error sending request: %w", err)
 	}
 
-	return title, nil
+	return strings.TrimSpace(title.String()), nil
+}
+
+// Models returns the models pulled on the Ollama server, sorted by name.
+func (o Ollama) Models(ctx context.Context) ([]models.LocalModel, error) {
+	res, err := o.client.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing models: %w", err)
+	}
+
+	ms := make([]models.LocalModel, len(res.Models))
+	for i, m := range res.Models {
+		ms[i] = ollamaLocalModel(m.Name, m.ModifiedAt, m.Size, m.Details)
+	}
+	slices.SortFunc(ms, func(a, b models.LocalModel) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return ms, nil
+}
+
+// ModelDetails returns the details of the model pulled on the Ollama server. The context length is read
+// from the metadata of the model architecture, and the capabilities are inferred from the model: it
+// supports tools if its chat template renders them, and vision if it has a vision projector.
+func (o Ollama) ModelDetails(ctx context.Context, name string) (models.LocalModelDetails, error) {
+	res, err := o.client.Show(ctx, &api.ShowRequest{Model: name})
+	if err != nil {
+		return models.LocalModelDetails{}, fmt.Errorf("error showing model %s: %w", name, err)
+	}
+
+	details := models.LocalModelDetails{
+		LocalModel:   ollamaLocalModel(name, res.ModifiedAt, 0, res.Details),
+		Capabilities: []string{"completion"},
+		License:      res.License,
+	}
+	if arch, ok := res.ModelInfo["general.architecture"].(string); ok {
+		if length, ok := res.ModelInfo[arch+".context_length"].(float64); ok {
+			details.ContextLength = int(length)
+		}
+	}
+	if strings.Contains(res.Template, ".Tools") {
+		details.Capabilities = append(details.Capabilities, "tools")
+	}
+	vision := len(res.ProjectorInfo) > 0
+	for key := range res.ModelInfo {
+		if strings.Contains(key, ".vision.") {
+			vision = true
+			break
+		}
+	}
+	if vision {
+		details.Capabilities = append(details.Capabilities, "vision")
+	}
+	return details, nil
+}
+
+// PullModel downloads the model to the Ollama server, and returns an iterator over the progress of the
+// download. The download is cancelled if the consumer stops reading the iterator, or the context is done.
+func (o Ollama) PullModel(ctx context.Context, name string) iter.Seq2[models.PullProgress, error] {
+	return func(yield func(models.PullProgress, error) bool) {
+		err := o.client.Pull(ctx, &api.PullRequest{Model: name}, func(res api.ProgressResponse) error {
+			if !yield(models.PullProgress{Status: res.Status, Completed: res.Completed, Total: res.Total}, nil) {
+				return errStreamStopped
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStreamStopped) {
+			yield(models.PullProgress{}, fmt.Errorf("error pulling model %s: %w", name, err))
+		}
+	}
 }
 
-func (o Ollama) chatRequest(messages []api.Message, tools []api.Tool, stream bool) api.ChatRequest {
+// ModelCapabilities returns the capabilities of the model pulled on the Ollama server, from its details. The
+// tools are only inferred from the chat template, which may render them without mentioning .Tools, so a
+// model whose template doesn't mention them has unknown tools instead of no tools.
+func (o Ollama) ModelCapabilities(ctx context.Context, model string) (models.ModelCapabilities, error) {
+	details, err := o.ModelDetails(ctx, model)
+	if err != nil {
+		return models.ModelCapabilities{}, err
+	}
+	vision := slices.Contains(details.Capabilities, "vision")
+	caps := models.ModelCapabilities{Vision: &vision}
+	if slices.Contains(details.Capabilities, "tools") {
+		tools := true
+		caps.Tools = &tools
+	}
+	return caps, nil
+}
+
+func ollamaLocalModel(name string, modifiedAt time.Time, size int64, details api.ModelDetails) models.LocalModel {
+	return models.LocalModel{
+		Name:              name,
+		ModifiedAt:        modifiedAt,
+		Size:              size,
+		Family:            details.Family,
+		ParameterSize:     details.ParameterSize,
+		QuantizationLevel: details.QuantizationLevel,
+	}
+}
+
+func (o Ollama) chatRequest(
+	messages []api.Message,
+	tools []api.Tool,
+	params models.LLMParameters,
+	stream bool,
+) api.ChatRequest {
 	req := api.ChatRequest{
 		Model:    o.model,
 		Messages: messages,
@@ -322,24 +521,37 @@ func (o Ollama) chatRequest(messages []api.Message, tools []api.Tool, stream boo
 
 	opts := make(map[string]any)
 
-	if o.params.Temperature != nil {
-		opts["temperature"] = *o.params.Temperature
+	if params.Temperature != nil {
+		opts["temperature"] = *params.Temperature
+	}
+	if params.Seed != nil {
+		opts["seed"] = *params.Seed
+	}
+	if params.Stop != nil {
+		opts["stop"] = params.Stop
+	}
+	if params.TopK != nil {
+		opts["top_k"] = *params.TopK
+	}
+	if params.TopP != nil {
+		opts["top_p"] = *params.TopP
 	}
-	if o.params.Seed != nil {
-		opts["seed"] = *o.params.Seed
+	if params.MinP != nil {
+		opts["min_p"] = *params.MinP
 	}
-	if o.params.Stop != nil {
-		opts["stop"] = o.params.Stop
+	if params.FrequencyPenalty != nil {
+		opts["frequency_penalty"] = *params.FrequencyPenalty
 	}
-	if o.params.TopK != nil {
-		opts["top_k"] = *o.params.TopK
+	if params.PresencePenalty != nil {
+		opts["presence_penalty"] = *params.PresencePenalty
 	}
-	if o.params.TopP != nil {
-		opts["top_p"] = *o.params.TopP
+	if params.RepetitionPenalty != nil {
+		opts["repeat_penalty"] = *params.RepetitionPenalty
 	}
-	if o.params.MinP != nil {
-		opts["min_p"] = *o.params.MinP
+	if params.MaxTokens != nil {
+		opts["num_predict"] = *params.MaxTokens
 	}
+	maps.Copy(opts, o.extra)
 
 	req.Options = opts
 
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+func TestOllamaModelCapabilities(t *testing.T) {
+	tests := []struct {
+		name       string
+		show       string
+		wantTools  *bool
+		wantVision bool
+	}{
+		{
+			name:      "tools template",
+			show:      `{"template": "{{- if .Tools }}{{ .Tools }}{{ end }}{{ .Prompt }}"}`,
+			wantTools: ptrTo(true),
+		},
+		{
+			// The template may render the tools without mentioning them, so they're unknown.
+			name: "template without tools",
+			show: `{"template": "{{ .Prompt }}"}`,
+		},
+		{
+			name:       "vision projector",
+			show:       `{"template": "{{ .Prompt }}", "projector_info": {"clip.has_vision_encoder": true}}`,
+			wantVision: true,
+		},
+		{
+			name: "vision model info",
+			show: `{"template": "{{ .Tools }}", "model_info": {"general.architecture": "mllama", ` +
+				`"mllama.vision.block_count": 32}}`,
+			wantTools:  ptrTo(true),
+			wantVision: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(tt.show))
+			})
+			ollama := NewOllama(srv.URL, "llama3", "", models.LLMParameters{}, slog.Default())
+
+			caps, err := ollama.ModelCapabilities(context.Background(), "test-model")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deref(caps.Tools) != deref(tt.wantTools) {
+				t.Errorf("Tools = %v, want %v", deref(caps.Tools), deref(tt.wantTools))
+			}
+			if caps.Vision == nil || *caps.Vision != tt.wantVision {
+				t.Errorf("Vision = %v, want %t", deref(caps.Vision), tt.wantVision)
+			}
+			if req := srv.lastRequest(t); req.url.Path != "/api/show" {
+				t.Errorf("request path = %q, want /api/show", req.url.Path)
+			}
+		})
+	}
+}
+
+// deref returns the value of the capability, or nil if it's unknown.
+func deref(capability *bool) any {
+	if capability == nil {
+		return nil
+	}
+	return *capability
+}
+
+func TestOllamaChatUsage(t *testing.T) {
+	srv := newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"model": "llama3", "message": {"role": "assistant", "content": "Hello"}, "done": false}`)
+		fmt.Fprintln(w, `{"model": "llama3", "message": {"role": "assistant", "content": ""}, "done": true, `+
+			`"done_reason": "stop", "prompt_eval_count": 12, "eval_count": 4}`)
+	})
+	ollama := NewOllama(srv.URL, "llama3", "", models.LLMParameters{}, slog.Default())
+
+	// The usage is the evaluation counts of the last response.
+	usage := chatUsage(t, collectChat(t, ollama))
+	if usage.InputTokens != 12 || usage.OutputTokens != 4 {
+		t.Errorf("usage = %+v, want 12 input and 4 output tokens", usage)
+	}
+	if req := srv.lastRequest(t); req.url.Path != "/api/chat" {
+		t.Errorf("request path = %q, want the chat API", req.url.Path)
+	}
+}
@@ -1,6 +1,8 @@
 package services
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -9,6 +11,7 @@ import (
 	"io"
 	"iter"
 	"log/slog"
+	"net/http"
 	"slices"
 	"strings"
 
@@ -19,38 +22,159 @@ import (
 
 // OpenAI provides an implementation of the LLM interface for interacting with OpenAI's language models.
 type OpenAI struct {
+	// provider is the name of the provider in the configuration, e.g. "azureOpenAI".
+	provider     string
 	model        string
 	systemPrompt string
 
-	params LLMParameters
+	params models.LLMParameters
+	retry  RetryPolicy
+	compat OpenAICompatibility
+	// extra are the vendor-specific fields merged into the request body.
+	extra map[string]any
+	// legacyMaxTokens sends the maxTokens parameter as max_tokens, for the APIs that don't support its
+	// max_completion_tokens replacement.
+	legacyMaxTokens bool
 
-	client *goopenai.Client
+	clientConfig goopenai.ClientConfig
+	client       *goopenai.Client
 
 	logger *slog.Logger
 }
 
+// OpenAIParameters are the names of the LLM parameters supported by OpenAI, the others are ignored.
+var OpenAIParameters = []string{
+	"temperature", "topP", "frequencyPenalty", "presencePenalty", "seed", "maxTokens", "logitBias", "logprobs",
+	"topLogprobs", "stop",
+}
+
+// OpenAICompatibility describes how a server that speaks the OpenAI protocol deviates from the OpenAI API.
+// Its zero value is a server that behaves like the OpenAI API.
+type OpenAICompatibility struct {
+	// Headers are the extra headers sent with every request, such as the authentication of a proxy.
+	Headers map[string]string
+	// DisableTools doesn't send the tools to the server, for the servers or models that don't support them.
+	DisableTools bool
+	// CumulativeToolArgs is set for the servers that send the arguments of a tool call received so far in
+	// every chunk, or all at once, instead of streaming them as deltas.
+	CumulativeToolArgs bool
+	// SystemAsUser sends the system prompt at the start of the first user message, for the models whose
+	// chat template doesn't support the system role.
+	SystemAsUser bool
+}
+
+// requestDoer is an HTTP client that sets headers on every request, and merges extra fields into their
+// body.
+type requestDoer struct {
+	headers map[string]string
+	extra   map[string]any
+	client  goopenai.HTTPDoer
+}
+
+// defaultAzureAPIVersion is the Azure OpenAI API version used when none is configured, a GA version that
+// supports the tool calls.
+const defaultAzureAPIVersion = "2024-10-21"
+
 // NewOpenAI creates a new OpenAI instance with the specified API key, base URL, model name, and system prompt.
 func NewOpenAI(
 	apiKey, model, systemPrompt, endpoint string,
-	params LLMParameters,
+	params models.LLMParameters,
 	logger *slog.Logger,
 ) OpenAI {
-	var client *goopenai.Client
-	if endpoint == "" {
-		client = goopenai.NewClient(apiKey)
-	} else {
-		cfg := goopenai.DefaultConfig(apiKey)
+	cfg := goopenai.DefaultConfig(apiKey)
+	if endpoint != "" {
 		cfg.BaseURL = endpoint
-		client = goopenai.NewClientWithConfig(cfg)
 	}
 
-	return OpenAI{
+	o := OpenAI{
+		provider:     "openai",
 		model:        model,
 		systemPrompt: systemPrompt,
 		params:       params,
-		client:       client,
+		retry:        DefaultRetryPolicy,
+		clientConfig: cfg,
 		logger:       logger.With(slog.String("module", "openai")),
 	}
+	o.client = o.newClient()
+	return o
+}
+
+// NewAzureOpenAI creates a new OpenAI instance that chats with a deployment of an Azure OpenAI resource,
+// with the specified API key, endpoint of the resource, deployment name, API version and system prompt.
+// The API version defaults to defaultAzureAPIVersion if it's empty.
+func NewAzureOpenAI(
+	apiKey, endpoint, deployment, apiVersion, systemPrompt string,
+	params models.LLMParameters,
+	logger *slog.Logger,
+) OpenAI {
+	cfg := goopenai.DefaultAzureConfig(apiKey, endpoint)
+	cfg.APIVersion = cmp.Or(apiVersion, defaultAzureAPIVersion)
+	// The requests are sent to the deployment, whatever model it deploys.
+	cfg.AzureModelMapperFunc = func(string) string {
+		return deployment
+	}
+
+	o := OpenAI{
+		provider:        "azureOpenAI",
+		model:           deployment,
+		systemPrompt:    systemPrompt,
+		params:          params,
+		retry:           DefaultRetryPolicy,
+		legacyMaxTokens: true,
+		clientConfig:    cfg,
+		logger:          logger.With(slog.String("module", "azureopenai")),
+	}
+	o.client = o.newClient()
+	return o
+}
+
+// NewOpenAICompatible creates a new OpenAI instance that chats with a server that speaks the OpenAI protocol,
+// such as vLLM, LM Studio or llama.cpp, at the specified base URL, with the specified API key, which may be
+// empty, model name, system prompt, and the deviations of the server from the OpenAI API.
+func NewOpenAICompatible(
+	apiKey, baseURL, model, systemPrompt string,
+	compat OpenAICompatibility,
+	params models.LLMParameters,
+	logger *slog.Logger,
+) OpenAI {
+	cfg := goopenai.DefaultConfig(apiKey)
+	cfg.BaseURL = baseURL
+
+	o := OpenAI{
+		provider:        "openaiCompatible",
+		model:           model,
+		systemPrompt:    systemPrompt,
+		params:          params,
+		retry:           DefaultRetryPolicy,
+		compat:          compat,
+		legacyMaxTokens: true,
+		clientConfig:    cfg,
+		logger:          logger.With(slog.String("module", "openaicompatible")),
+	}
+	o.client = o.newClient()
+	return o
+}
+
+// WithRetry returns a copy of o that retries the failed requests with the given policy.
+func (o OpenAI) WithRetry(policy RetryPolicy) OpenAI {
+	o.retry = policy
+	return o
+}
+
+// WithExtra returns a copy of o that merges the extra fields into the body of its requests.
+func (o OpenAI) WithExtra(extra map[string]any) OpenAI {
+	o.extra = extra
+	o.client = o.newClient()
+	return o
+}
+
+// newClient creates the client of the API, which sends the headers and extra fields of o with every request.
+func (o OpenAI) newClient() *goopenai.Client {
+	cfg := o.clientConfig
+	if len(o.compat.Headers) > 0 || len(o.extra) > 0 {
+		cfg.HTTPClient = requestDoer{headers: o.compat.Headers, extra: o.extra, client: cfg.HTTPClient}
+	}
+	return goopenai.NewClientWithConfig(cfg)
 }
 
 func openAIMessages(messages []models.Message) ([]goopenai.ChatCompletionMessage, error) {
@@ -218,11 +342,13 @@ func convertResourceToTextForOpenAI(resource mcp.ResourceContents) string {
 	return ""
 }
 
-// Chat is a wrapper around the OpenAI chat completion API.
+// Chat is a wrapper around the OpenAI chat completion API. The system prompt and parameters of opts take
+// precedence over the configured ones.
 func (o OpenAI) Chat(
 	ctx context.Context,
 	messages []models.Message,
 	tools []mcp.Tool,
+	opts models.ChatOptions,
 ) iter.Seq2[models.Content, error] {
 	return func(yield func(models.Content, error) bool) {
 		msgs, err := openAIMessages(messages)
@@ -231,24 +357,24 @@ func (o OpenAI) Chat(
 			return
 		}
 
-		msgs = slices.Insert(msgs, 0, goopenai.ChatCompletionMessage{
-			Role:    "system",
-			Content: o.systemPrompt,
-		})
-
-		oTools := make([]goopenai.Tool, len(tools))
-		for i, tool := range tools {
-			oTools[i] = goopenai.Tool{
-				Type: "function",
-				Function: &goopenai.FunctionDefinition{
-					Name:        tool.Name,
-					Description: tool.Description,
-					Parameters:  tool.InputSchema,
-				},
+		msgs = o.withSystemPrompt(msgs, cmp.Or(opts.SystemPrompt, o.systemPrompt))
+
+		var oTools []goopenai.Tool
+		if !o.compat.DisableTools {
+			oTools = make([]goopenai.Tool, len(tools))
+			for i, tool := range tools {
+				oTools[i] = goopenai.Tool{
+					Type: "function",
+					Function: &goopenai.FunctionDefinition{
+						Name:        tool.Name,
+						Description: tool.Description,
+						Parameters:  tool.InputSchema,
+					},
+				}
 			}
 		}
 
-		req := o.chatRequest(msgs, oTools, true)
+		req := o.chatRequest(msgs, oTools, o.params.Merge(opts.Parameters), true)
 
 		reqJSON, err := json.Marshal(req)
 		if err == nil {
@@ -258,8 +384,18 @@ func (o OpenAI) Chat(
 		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
 
-		stream, err := o.client.CreateChatCompletionStream(ctx, req)
+		var stream *goopenai.ChatCompletionStream
+		err = o.retry.retry(ctx, "OpenAI", func() error {
+			var err error
+			stream, err = o.client.CreateChatCompletionStream(ctx, req)
+			return err
+		}, func(status models.Content) bool {
+			return yield(status, nil)
+		})
 		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, errStreamStopped) {
+				return
+			}
 			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
 			return
 		}
@@ -269,6 +405,8 @@ func (o OpenAI) Chat(
 		callToolContent := models.Content{
 			Type: models.ContentTypeCallTool,
 		}
+		var usage *models.Usage
+		model, finishReason := o.model, ""
 		for {
 			response, err := stream.Recv()
 			if err != nil {
@@ -278,14 +416,24 @@ func (o OpenAI) Chat(
 				if errors.Is(err, context.Canceled) {
 					return
 				}
-				yield(models.Content{}, fmt.Errorf("error receiving response: %w", err))
+				yield(models.Content{}, fmt.Errorf("error receiving response: %w", newLLMError(err)))
 				return
 			}
+			model = cmp.Or(response.Model, model)
+
+			// The usage is sent in the last chunk, without choices.
+			if response.Usage != nil {
+				usage = &models.Usage{
+					InputTokens:  response.Usage.PromptTokens,
+					OutputTokens: response.Usage.CompletionTokens,
+				}
+			}
 
 			if len(response.Choices) == 0 {
 				continue
 			}
 
+			finishReason = cmp.Or(string(response.Choices[0].FinishReason), finishReason)
 			res := response.Choices[0].Delta
 			if res.Content != "" {
 				if !yield(models.Content{
@@ -302,7 +450,11 @@ func (o OpenAI) Chat(
 						slog.String("toolCalls", fmt.Sprintf("%+v", res.ToolCalls)),
 					)
 				}
-				toolArgs += res.ToolCalls[0].Function.Arguments
+				if !o.compat.CumulativeToolArgs {
+					toolArgs += res.ToolCalls[0].Function.Arguments
+				} else if res.ToolCalls[0].Function.Arguments != "" {
+					toolArgs = res.ToolCalls[0].Function.Arguments
+				}
 				if !toolUse {
 					toolUse = true
 					callToolContent.ToolName = res.ToolCalls[0].Function.Name
@@ -310,6 +462,14 @@ func (o OpenAI) Chat(
 				}
 			}
 		}
+		if usage != nil {
+			if !yield(models.Content{Type: models.ContentTypeUsage, Usage: usage}, nil) {
+				return
+			}
+		}
+		if !yield(finishContent(o.provider, model, finishReason), nil) {
+			return
+		}
 		if toolUse {
 			if toolArgs == "" {
 				toolArgs = "{}"
@@ -324,22 +484,30 @@ func (o OpenAI) Chat(
 	}
 }
 
+// EstimateTokens estimates the number of input tokens of a chat call with the given messages, tools and
+// options, to fit the chat in the context window of the model. It's based on the fact that the tokenizers of
+// the OpenAI models average about 4 characters per token of English text.
+func (o OpenAI) EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int {
+	return models.EstimateTokens(cmp.Or(opts.SystemPrompt, o.systemPrompt), messages, tools, 4)
+}
+
 // GenerateTitle is a wrapper around the OpenAI chat completion API.
 func (o OpenAI) GenerateTitle(ctx context.Context, message string) (string, error) {
-	msgs := []goopenai.ChatCompletionMessage{
-		{
-			Role:    goopenai.ChatMessageRoleSystem,
-			Content: o.systemPrompt,
-		},
+	msgs := o.withSystemPrompt([]goopenai.ChatCompletionMessage{
 		{
 			Role:    goopenai.ChatMessageRoleUser,
 			Content: message,
 		},
-	}
+	}, o.systemPrompt)
 
-	req := o.chatRequest(msgs, nil, false)
+	req := o.chatRequest(msgs, nil, o.params, false)
 
-	resp, err := o.client.CreateChatCompletion(ctx, req)
+	var resp goopenai.ChatCompletionResponse
+	err := o.retry.retry(ctx, "OpenAI", func() error {
+		var err error
+		resp, err = o.client.CreateChatCompletion(ctx, req)
+		return err
+	}, nil)
 	if err != nil {
 		return "", fmt.Errorf("error sending request: %w", err)
 	}
@@ -351,9 +519,47 @@ func (o OpenAI) GenerateTitle(ctx context.Context, message string) (string, erro
 	return resp.Choices[0].Message.Content, nil
 }
 
+// withSystemPrompt returns the messages with the system prompt, sent as a system message, or at the start of
+// the first user message if the server doesn't support the system role.
+func (o OpenAI) withSystemPrompt(
+	msgs []goopenai.ChatCompletionMessage,
+	systemPrompt string,
+) []goopenai.ChatCompletionMessage {
+	if !o.compat.SystemAsUser {
+		return slices.Insert(msgs, 0, goopenai.ChatCompletionMessage{
+			Role:    goopenai.ChatMessageRoleSystem,
+			Content: systemPrompt,
+		})
+	}
+	if systemPrompt == "" {
+		return msgs
+	}
+
+	i := slices.IndexFunc(msgs, func(msg goopenai.ChatCompletionMessage) bool {
+		return msg.Role == goopenai.ChatMessageRoleUser
+	})
+	if i < 0 {
+		return slices.Insert(msgs, 0, goopenai.ChatCompletionMessage{
+			Role:    goopenai.ChatMessageRoleUser,
+			Content: systemPrompt,
+		})
+	}
+
+	if msgs[i].MultiContent != nil {
+		msgs[i].MultiContent = slices.Insert(msgs[i].MultiContent, 0, goopenai.ChatMessagePart{
+			Type: goopenai.ChatMessagePartTypeText,
+			Text: systemPrompt,
+		})
+	} else {
+		msgs[i].Content = systemPrompt + "\n\n" + msgs[i].Content
+	}
+	return msgs
+}
+
 func (o OpenAI) chatRequest(
 	messages []goopenai.ChatCompletionMessage,
 	tools []goopenai.Tool,
+	params models.LLMParameters,
 	stream bool,
 ) goopenai.ChatCompletionRequest {
 	req := goopenai.ChatCompletionRequest{
@@ -362,34 +568,67 @@ func (o OpenAI) chatRequest(
 		Stream:   stream,
 		Tools:    tools,
 	}
+	if stream {
+		req.StreamOptions = &goopenai.StreamOptions{IncludeUsage: true}
+	}
 
-	if o.params.Temperature != nil {
-		req.Temperature = *o.params.Temperature
+	if params.Temperature != nil {
+		req.Temperature = *params.Temperature
+	}
+	if params.TopP != nil {
+		req.TopP = *params.TopP
 	}
-	if o.params.TopP != nil {
-		req.TopP = *o.params.TopP
+	if params.Stop != nil {
+		req.Stop = params.Stop
 	}
-	if o.params.Stop != nil {
-		req.Stop = o.params.Stop
+	if params.PresencePenalty != nil {
+		req.PresencePenalty = *params.PresencePenalty
 	}
-	if o.params.PresencePenalty != nil {
-		req.PresencePenalty = *o.params.PresencePenalty
+	if params.Seed != nil {
+		req.Seed = params.Seed
 	}
-	if o.params.Seed != nil {
-		req.Seed = o.params.Seed
+	if params.FrequencyPenalty != nil {
+		req.FrequencyPenalty = *params.FrequencyPenalty
 	}
-	if o.params.FrequencyPenalty != nil {
-		req.FrequencyPenalty = *o.params.FrequencyPenalty
+	if params.LogitBias != nil {
+		req.LogitBias = params.LogitBias
 	}
-	if o.params.LogitBias != nil {
-		req.LogitBias = o.params.LogitBias
+	if params.Logprobs != nil {
+		req.LogProbs = *params.Logprobs
 	}
-	if o.params.Logprobs != nil {
-		req.LogProbs = *o.params.Logprobs
+	if params.TopLogprobs != nil {
+		req.TopLogProbs = *params.TopLogprobs
 	}
-	if o.params.TopLogprobs != nil {
-		req.TopLogProbs = *o.params.TopLogprobs
+	if params.MaxTokens != nil {
+		if o.legacyMaxTokens {
+			req.MaxTokens = *params.MaxTokens
+		} else {
+			req.MaxCompletionTokens = *params.MaxTokens
+		}
 	}
 
 	return req
 }
+
+// Do sends the request with the headers and extra fields of d.
+func (d requestDoer) Do(req *http.Request) (*http.Response, error) {
+	for name, value := range d.headers {
+		req.Header.Set(name, value)
+	}
+	if len(d.extra) > 0 && req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading request: %w", err)
+		}
+		if body, err = mergeExtra(body, d.extra); err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.ContentLength = int64(len(body))
+	}
+	return d.client.Do(req)
+}
@@ -0,0 +1,276 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// openAIStreamHandler returns a handler of a test server of the OpenAI API that streams the chunks as
+// server-sent events.
+func openAIStreamHandler(chunks ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+}
+
+// collectChat returns the contents streamed by the chat of llm with a single user message.
+func collectChat(t *testing.T, llm ChatLLM) []models.Content {
+	t.Helper()
+
+	var contents []models.Content
+	for content, err := range llm.Chat(context.Background(), []models.Message{{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hi"}},
+	}}, nil, models.ChatOptions{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, content)
+	}
+	return contents
+}
+
+// chatUsage returns the usage among the contents, failing the test if there is none.
+func chatUsage(t *testing.T, contents []models.Content) models.Usage {
+	t.Helper()
+
+	for _, content := range contents {
+		if content.Type == models.ContentTypeUsage && content.Usage != nil {
+			return *content.Usage
+		}
+	}
+	t.Fatalf("contents = %+v, want a usage", contents)
+	return models.Usage{}
+}
+
+func TestOpenAIChatUsage(t *testing.T) {
+	srv := newRecordingServer(t, openAIStreamHandler(
+		`{"model": "gpt-4o", "choices": [{"index": 0, "delta": {"content": "Hello"}}]}`,
+		`{"model": "gpt-4o", "choices": [{"index": 0, "delta": {}, "finish_reason": "stop"}]}`,
+		`{"model": "gpt-4o", "choices": [], "usage": {"prompt_tokens": 12, "completion_tokens": 4}}`,
+	))
+	openAI := NewOpenAI("test-key", "gpt-4o", "", srv.URL, models.LLMParameters{}, slog.Default())
+
+	// The usage is sent in the last chunk, as it's asked for in the stream options.
+	usage := chatUsage(t, collectChat(t, openAI))
+	if usage.InputTokens != 12 || usage.OutputTokens != 4 {
+		t.Errorf("usage = %+v, want 12 input and 4 output tokens", usage)
+	}
+	if got := srv.lastBody(t)["stream_options"]; !reflect.DeepEqual(got, map[string]any{"include_usage": true}) {
+		t.Errorf("stream_options = %v, want the usage included", got)
+	}
+}
+
+func TestAzureOpenAIChat(t *testing.T) {
+	srv := newRecordingServer(t, openAIStreamHandler(
+		`{"model": "gpt-4o", "choices": [{"index": 0, "delta": {"content": "Hello"}}]}`,
+		`{"model": "gpt-4o", "choices": [{"index": 0, "delta": {}, "finish_reason": "stop"}]}`,
+		`{"model": "gpt-4o", "choices": [], "usage": {"prompt_tokens": 3, "completion_tokens": 1}}`,
+	))
+	maxTokens := 100
+	azure := NewAzureOpenAI("azure-key", srv.URL, "my-deployment", "", "",
+		models.LLMParameters{MaxTokens: &maxTokens}, slog.Default())
+
+	contents := collectChat(t, azure)
+	if len(contents) != 3 || contents[0].Text != "Hello" || contents[1].Usage == nil ||
+		contents[2].Finish == nil || contents[2].Finish.Provider != "azureOpenAI" {
+		t.Errorf("Chat() = %+v, want the text, the usage and the finish of azureOpenAI", contents)
+	}
+
+	req := srv.lastRequest(t)
+	if req.url.Path != "/openai/deployments/my-deployment/chat/completions" {
+		t.Errorf("request path = %q, want the chat completions of the deployment", req.url.Path)
+	}
+	if got := req.url.Query().Get("api-version"); got != defaultAzureAPIVersion {
+		t.Errorf("api-version = %q, want %q", got, defaultAzureAPIVersion)
+	}
+	if got := req.header.Get("api-key"); got != "azure-key" {
+		t.Errorf("api-key = %q, want %q", got, "azure-key")
+	}
+	if got := req.header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization = %q, want none", got)
+	}
+	// Azure doesn't support max_completion_tokens on every API version.
+	body := srv.lastBody(t)
+	if body["max_tokens"] != 100.0 || body["max_completion_tokens"] != nil {
+		t.Errorf("max_tokens = %v, max_completion_tokens = %v, want max_tokens",
+			body["max_tokens"], body["max_completion_tokens"])
+	}
+}
+
+func TestAzureOpenAIAPIVersion(t *testing.T) {
+	srv := newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices": [{"index": 0, "message": {"role": "assistant", "content": "Greeting"}}]}`))
+	})
+	azure := NewAzureOpenAI("azure-key", srv.URL+"/", "titles", "2025-01-01-preview", "",
+		models.LLMParameters{}, slog.Default())
+
+	title, err := azure.GenerateTitle(context.Background(), "Hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Greeting" {
+		t.Errorf("GenerateTitle() = %q, want %q", title, "Greeting")
+	}
+	req := srv.lastRequest(t)
+	if req.url.Path != "/openai/deployments/titles/chat/completions" ||
+		req.url.Query().Get("api-version") != "2025-01-01-preview" {
+		t.Errorf("request URL = %s, want the deployment with the configured API version", req.url)
+	}
+}
+
+func TestOpenAICompatibleChat(t *testing.T) {
+	srv := newRecordingServer(t, openAIStreamHandler(
+		`{"choices": [{"index": 0, "delta": {"content": "Hello"}}]}`,
+		`{"choices": [{"index": 0, "delta": {}, "finish_reason": "stop"}]}`,
+	))
+	maxTokens := 100
+	compatible := NewOpenAICompatible("", srv.URL+"/v1", "local-model", "Be brief.", OpenAICompatibility{
+		Headers: map[string]string{"X-Proxy-Auth": "proxy-token"},
+	}, models.LLMParameters{MaxTokens: &maxTokens}, slog.Default()).
+		WithExtra(map[string]any{"top_k": 20})
+
+	// The server doesn't send the usage, so none is yielded.
+	contents := collectChat(t, compatible)
+	if len(contents) != 2 || contents[0].Text != "Hello" || contents[1].Type != models.ContentTypeFinish {
+		t.Fatalf("Chat() = %+v, want the text and the finish", contents)
+	}
+	if finish := contents[1].Finish; finish.Provider != "openaiCompatible" || finish.Model != "local-model" ||
+		finish.StopReason != models.StopReasonEnd {
+		t.Errorf("finish = %+v, want the end of local-model", finish)
+	}
+
+	req := srv.lastRequest(t)
+	if req.url.Path != "/v1/chat/completions" {
+		t.Errorf("request path = %q, want the chat completions under the base URL", req.url.Path)
+	}
+	if got := req.header.Get("X-Proxy-Auth"); got != "proxy-token" {
+		t.Errorf("X-Proxy-Auth = %q, want %q", got, "proxy-token")
+	}
+	if got := req.header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization = %q, want none without an API key", got)
+	}
+	body := srv.lastBody(t)
+	if body["max_tokens"] != 100.0 || body["max_completion_tokens"] != nil {
+		t.Errorf("max_tokens = %v, max_completion_tokens = %v, want max_tokens",
+			body["max_tokens"], body["max_completion_tokens"])
+	}
+	// The usage is asked for, even though the servers that don't support it ignore it.
+	if got := body["stream_options"]; !reflect.DeepEqual(got, map[string]any{"include_usage": true}) {
+		t.Errorf("stream_options = %v, want the usage included", got)
+	}
+	if body["top_k"] != 20.0 {
+		t.Errorf("top_k = %v, want the extra field", body["top_k"])
+	}
+	if messages, _ := body["messages"].([]any); len(messages) != 2 {
+		t.Errorf("messages = %v, want the system prompt and the user message", body["messages"])
+	}
+}
+
+func TestOpenAICompatibleQuirks(t *testing.T) {
+	tools := []mcp.Tool{{Name: "weather", InputSchema: json.RawMessage(`{"type": "object"}`)}}
+	toolChunks := []string{
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", ` +
+			`"function": {"name": "weather", "arguments": "{\"city\": "}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, ` +
+			`"function": {"arguments": "\"Paris\"}"}}]}}]}`,
+	}
+	cumulativeChunks := []string{
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", ` +
+			`"function": {"name": "weather", "arguments": "{\"city\": "}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, ` +
+			`"function": {"arguments": "{\"city\": \"Paris\"}"}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": ""}}]}}]}`,
+	}
+
+	tests := []struct {
+		name      string
+		compat    OpenAICompatibility
+		chunks    []string
+		wantTools bool
+		wantInput string
+		// wantMessages are the roles and contents of the messages sent.
+		wantMessages []any
+	}{
+		{
+			name:      "tool call deltas",
+			chunks:    toolChunks,
+			wantTools: true,
+			wantInput: `{"city": "Paris"}`,
+			wantMessages: []any{
+				map[string]any{"role": "system", "content": "Be brief."},
+				map[string]any{"role": "user", "content": "Hi"},
+			},
+		},
+		{
+			name:      "cumulative tool arguments",
+			compat:    OpenAICompatibility{CumulativeToolArgs: true},
+			chunks:    cumulativeChunks,
+			wantTools: true,
+			wantInput: `{"city": "Paris"}`,
+			wantMessages: []any{
+				map[string]any{"role": "system", "content": "Be brief."},
+				map[string]any{"role": "user", "content": "Hi"},
+			},
+		},
+		{
+			name:   "tools disabled and system as user",
+			compat: OpenAICompatibility{DisableTools: true, SystemAsUser: true},
+			chunks: []string{`{"choices": [{"index": 0, "delta": {"content": "Sunny"}}]}`},
+			wantMessages: []any{
+				map[string]any{"role": "user", "content": "Be brief.\n\nHi"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRecordingServer(t, openAIStreamHandler(tt.chunks...))
+			compatible := NewOpenAICompatible("local-key", srv.URL, "local-model", "Be brief.", tt.compat,
+				models.LLMParameters{}, slog.Default())
+
+			var call *models.Content
+			for content, err := range compatible.Chat(context.Background(), []models.Message{{
+				Role:     models.RoleUser,
+				Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hi"}},
+			}}, tools, models.ChatOptions{}) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if content.Type == models.ContentTypeCallTool {
+					call = &content
+				}
+			}
+
+			switch {
+			case tt.wantInput == "" && call != nil:
+				t.Errorf("tool call = %+v, want none", call)
+			case tt.wantInput != "" && (call == nil || string(call.ToolInput) != tt.wantInput):
+				t.Errorf("tool call = %+v, want the arguments %s", call, tt.wantInput)
+			}
+
+			body := srv.lastBody(t)
+			if _, ok := body["tools"]; ok != tt.wantTools {
+				t.Errorf("tools sent = %t, want %t", ok, tt.wantTools)
+			}
+			if !reflect.DeepEqual(body["messages"], tt.wantMessages) {
+				t.Errorf("messages = %v, want %v", body["messages"], tt.wantMessages)
+			}
+			if got := srv.lastRequest(t).header.Get("Authorization"); got != "Bearer local-key" {
+				t.Errorf("Authorization = %q, want the API key", got)
+			}
+		})
+	}
+}
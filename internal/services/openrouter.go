@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -13,6 +14,8 @@ import (
 	"net/http"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/MegaGrindStone/go-mcp"
 	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
@@ -25,13 +28,24 @@ type OpenRouter struct {
 	model        string
 	systemPrompt string
 
-	params LLMParameters
+	params models.LLMParameters
+	retry  RetryPolicy
+	// extra are the vendor-specific fields merged into the request body.
+	extra map[string]any
 
 	client *http.Client
+	// catalogue caches the models listed by OpenRouter, shared by the copies of o.
+	catalogue *openRouterCatalogue
 
 	logger *slog.Logger
 }
 
+// OpenRouterParameters are the names of the LLM parameters supported by OpenRouter, which are all of them.
+var OpenRouterParameters = []string{
+	"temperature", "topP", "topK", "frequencyPenalty", "presencePenalty", "repetitionPenalty", "minP", "topA",
+	"seed", "maxTokens", "logitBias", "logprobs", "topLogprobs", "stop", "includeReasoning",
+}
+
 type openRouterChatRequest struct {
 	Model    string                     `json:"model"`
 	Messages []openRouterMessageRequest `json:"messages"`
@@ -53,6 +67,12 @@ type openRouterChatRequest struct {
 	TopLogprobs       *int           `json:"top_logprobs,omitempty"`
 	Stop              []string       `json:"stop,omitempty"`
 	IncludeReasoning  *bool          `json:"include_reasoning,omitempty"`
+
+	Usage *openRouterUsageRequest `json:"usage,omitempty"`
+}
+
+type openRouterUsageRequest struct {
+	Include bool `json:"include"`
 }
 
 type openRouterMessageRequest struct {
@@ -79,6 +99,7 @@ type openRouterImageContent struct {
 type openRouterMessage struct {
 	Role       string                `json:"role"`
 	Content    string                `json:"content,omitempty"`
+	Reasoning  string                `json:"reasoning,omitempty"`
 	ToolCalls  []openRouterToolCalls `json:"tool_calls,omitempty"`
 	ToolCallID string                `json:"tool_call_id,omitempty"`
 }
@@ -106,7 +127,16 @@ type openRouterToolFunction struct {
 }
 
 type openRouterStreamingResponse struct {
+	Model   string                      `json:"model"`
 	Choices []openRouterStreamingChoice `json:"choices"`
+	Usage   *openRouterUsage            `json:"usage"`
+}
+
+type openRouterUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	// Cost is the cost of the request in credits, which are priced in USD.
+	Cost float64 `json:"cost"`
 }
 
 type openRouterStreamingErrorResponse struct {
@@ -133,37 +163,87 @@ type openRouterChoice struct {
 	Message openRouterMessage `json:"message"`
 }
 
+type openRouterModelsResponse struct {
+	Data []openRouterModel `json:"data"`
+}
+
+// openRouterCatalogue is the cache of the models listed by OpenRouter, or of the error listing them.
+type openRouterCatalogue struct {
+	mu      sync.Mutex
+	models  map[string]openRouterModel
+	err     error
+	expires time.Time
+}
+
+type openRouterModel struct {
+	ID           string `json:"id"`
+	Architecture struct {
+		InputModalities []string `json:"input_modalities"`
+	} `json:"architecture"`
+	SupportedParameters []string `json:"supported_parameters"`
+}
+
 const (
 	openRouterAPIEndpoint = "https://openrouter.ai/api/v1"
 
+	// openRouterCatalogueTTL is how long the models listed by OpenRouter are cached, as the list is large
+	// and rarely changes.
+	openRouterCatalogueTTL = time.Hour
+	// openRouterCatalogueErrorTTL is how long an error listing the models is cached, so the chats don't all
+	// list them again while OpenRouter fails.
+	openRouterCatalogueErrorTTL = time.Minute
+
 	openRouterRequestContentTypeText     = "text"
 	openRouterRequestContentTypeImageURL = "image_url"
 )
 
 // NewOpenRouter creates a new OpenRouter instance with the specified API key, model name, and system prompt.
-func NewOpenRouter(apiKey, model, systemPrompt string, params LLMParameters, logger *slog.Logger) OpenRouter {
+func NewOpenRouter(apiKey, model, systemPrompt string, params models.LLMParameters, logger *slog.Logger) OpenRouter {
 	return OpenRouter{
 		apiKey:       apiKey,
 		model:        model,
 		systemPrompt: systemPrompt,
 		params:       params,
+		retry:        DefaultRetryPolicy,
 		client:       &http.Client{},
+		catalogue:    &openRouterCatalogue{},
 		logger:       logger.With(slog.String("module", "openrouter")),
 	}
 }
 
+// WithRetry returns a copy of o that retries the failed requests with the given policy.
+func (o OpenRouter) WithRetry(policy RetryPolicy) OpenRouter {
+	o.retry = policy
+	return o
+}
+
+// WithExtra returns a copy of o that merges the extra fields into the body of its requests.
+func (o OpenRouter) WithExtra(extra map[string]any) OpenRouter {
+	o.extra = extra
+	return o
+}
+
 // Chat streams responses from the OpenRouter API for a given sequence of messages. It processes system
 // messages separately and returns an iterator that yields response chunks and potential errors. The
 // context can be used to cancel ongoing requests. Refer to models.Message for message structure details.
+// The system prompt and parameters of opts take precedence over the configured ones.
 func (o OpenRouter) Chat(
 	ctx context.Context,
 	messages []models.Message,
 	tools []mcp.Tool,
+	opts models.ChatOptions,
 ) iter.Seq2[models.Content, error] {
 	return func(yield func(models.Content, error) bool) {
-		resp, err := o.doRequest(ctx, messages, tools, true)
+		var resp *http.Response
+		err := o.retry.retry(ctx, "OpenRouter", func() error {
+			var err error
+			resp, err = o.doRequest(ctx, messages, tools, opts, true)
+			return err
+		}, func(status models.Content) bool {
+			return yield(status, nil)
+		})
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
+			if errors.Is(err, context.Canceled) || errors.Is(err, errStreamStopped) {
 				return
 			}
 			yield(models.Content{}, fmt.Errorf("error sending request: %w", err))
@@ -176,6 +256,8 @@ func (o OpenRouter) Chat(
 		callToolContent := models.Content{
 			Type: models.ContentTypeCallTool,
 		}
+		var usage *models.Usage
+		model, finishReason, nativeFinishReason := o.model, "", ""
 		for ev, err := range sse.Read(resp.Body, nil) {
 			if err != nil {
 				yield(models.Content{}, fmt.Errorf("error reading response: %w", err))
@@ -198,7 +280,11 @@ func (o OpenRouter) Chat(
 					o.logger.Error("Received streaming error response",
 						slog.String("error", fmt.Sprintf("%+v", resErr)),
 					)
-					yield(models.Content{}, fmt.Errorf("openrouter error: %+v", resErr.Error))
+					yield(models.Content{}, &LLMError{
+						Kind:       statusErrorKind(resErr.Error.Code, resErr.Error.Message),
+						StatusCode: resErr.Error.Code,
+						Message:    resErr.Error.Message,
+					})
 					return
 				}
 			}
@@ -209,11 +295,26 @@ func (o OpenRouter) Chat(
 				return
 			}
 
+			// The model that answered may be another model than the requested one, as OpenRouter routes the
+			// requests to the auto router and the fallback models.
+			model = cmp.Or(res.Model, model)
+
+			// The usage is sent in the last chunk, without choices.
+			if res.Usage != nil {
+				usage = &models.Usage{
+					InputTokens:  res.Usage.PromptTokens,
+					OutputTokens: res.Usage.CompletionTokens,
+					Cost:         res.Usage.Cost,
+				}
+			}
+
 			if len(res.Choices) == 0 {
 				continue
 			}
 
 			choice := res.Choices[0]
+			finishReason = cmp.Or(choice.FinishReason, finishReason)
+			nativeFinishReason = cmp.Or(choice.NativeFinishReason, nativeFinishReason)
 
 			if len(choice.Delta.ToolCalls) > 0 {
 				if len(choice.Delta.ToolCalls) > 1 {
@@ -230,15 +331,35 @@ func (o OpenRouter) Chat(
 				}
 			}
 
+			if choice.Delta.Reasoning != "" {
+				if !yield(models.Content{
+					Type: models.ContentTypeThinking,
+					Text: choice.Delta.Reasoning,
+				}, nil) {
+					return
+				}
+			}
+
 			if choice.Delta.Content != "" {
 				if !yield(models.Content{
 					Type: models.ContentTypeText,
 					Text: choice.Delta.Content,
 				}, nil) {
-					break
+					return
 				}
 			}
 		}
+		if usage != nil {
+			if !yield(models.Content{Type: models.ContentTypeUsage, Usage: usage}, nil) {
+				return
+			}
+		}
+		// The finish reason is normalized by OpenRouter, while the native one is the one of the provider.
+		finish := finishContent("openrouter", model, finishReason)
+		finish.Finish.NativeStopReason = cmp.Or(nativeFinishReason, finishReason)
+		if !yield(finish, nil) {
+			return
+		}
 		if toolUse {
 			if toolArgs == "" {
 				toolArgs = "{}"
@@ -253,6 +374,13 @@ func (o OpenRouter) Chat(
 	}
 }
 
+// EstimateTokens estimates the number of input tokens of a chat call with the given messages, tools and
+// options, to fit the chat in the context window of the model. It's based on the fact that OpenRouter routes
+// to models with various tokenizers, so it's estimated conservatively with 3.5 characters per token.
+func (o OpenRouter) EstimateTokens(messages []models.Message, tools []mcp.Tool, opts models.ChatOptions) int {
+	return models.EstimateTokens(cmp.Or(opts.SystemPrompt, o.systemPrompt), messages, tools, 3.5)
+}
+
 // GenerateTitle generates a title for a given message using the OpenRouter API. It sends a single message to the
 // OpenRouter API and returns the first response content as the title. The context can be used to cancel ongoing
 // requests.
@@ -269,7 +397,12 @@ func (o OpenRouter) GenerateTitle(ctx context.Context, message string) (string,
 		},
 	}
 
-	resp, err := o.doRequest(ctx, msgs, nil, false)
+	var resp *http.Response
+	err := o.retry.retry(ctx, "OpenRouter", func() error {
+		var err error
+		resp, err = o.doRequest(ctx, msgs, nil, models.ChatOptions{}, false)
+		return err
+	}, nil)
 	if err != nil {
 		return "", fmt.Errorf("error sending request: %w", err)
 	}
@@ -292,12 +425,80 @@ func (o OpenRouter) GenerateTitle(ctx context.Context, message string) (string,
 	return res.Choices[0].Message.Content, nil
 }
 
+// ModelCapabilities returns the capabilities of the model from the models listed by OpenRouter: it supports
+// tools if it accepts the tools parameter, and vision if it accepts images as input.
+func (o OpenRouter) ModelCapabilities(ctx context.Context, model string) (models.ModelCapabilities, error) {
+	ms, err := o.models(ctx)
+	if err != nil {
+		return models.ModelCapabilities{}, err
+	}
+	m, ok := ms[model]
+	if !ok {
+		return models.ModelCapabilities{}, fmt.Errorf("model %s not listed by OpenRouter", model)
+	}
+	tools := slices.Contains(m.SupportedParameters, "tools")
+	vision := slices.Contains(m.Architecture.InputModalities, "image")
+	return models.ModelCapabilities{Tools: &tools, Vision: &vision}, nil
+}
+
+// models returns the models listed by OpenRouter by ID, from the catalogue unless it expired. The
+// concurrent calls wait for the models listed by the first one.
+func (o OpenRouter) models(ctx context.Context) (map[string]openRouterModel, error) {
+	o.catalogue.mu.Lock()
+	defer o.catalogue.mu.Unlock()
+	if time.Now().Before(o.catalogue.expires) {
+		return o.catalogue.models, o.catalogue.err
+	}
+
+	ms, err := o.listModels(ctx)
+	if errors.Is(err, context.Canceled) {
+		// The chat was canceled, OpenRouter didn't fail.
+		return nil, err
+	}
+	ttl := openRouterCatalogueTTL
+	if err != nil {
+		ttl = openRouterCatalogueErrorTTL
+	}
+	o.catalogue.models, o.catalogue.err, o.catalogue.expires = ms, err, time.Now().Add(ttl)
+	return ms, err
+}
+
+func (o OpenRouter) listModels(ctx context.Context) (map[string]openRouterModel, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openRouterAPIEndpoint+"/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+o.apiKey)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error listing models: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+
+	var res openRouterModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("error decoding models: %w", err)
+	}
+	ms := make(map[string]openRouterModel, len(res.Data))
+	for _, m := range res.Data {
+		ms[m.ID] = m
+	}
+	return ms, nil
+}
+
 func (o OpenRouter) doRequest(
 	ctx context.Context,
 	messages []models.Message,
 	tools []mcp.Tool,
+	opts models.ChatOptions,
 	stream bool,
 ) (*http.Response, error) {
+	params := o.params.Merge(opts.Parameters)
+
 	msgs := make([]openRouterMessageRequest, 0, len(messages))
 	// Process messages
 	for _, msg := range messages {
@@ -349,7 +550,7 @@ func (o OpenRouter) doRequest(
 
 	msgs = slices.Insert(msgs, 0, openRouterMessageRequest{
 		Role:    "system",
-		Content: o.systemPrompt,
+		Content: cmp.Or(opts.SystemPrompt, o.systemPrompt),
 	})
 
 	oTools := make([]openRouterTool, len(tools))
@@ -384,27 +585,33 @@ func (o OpenRouter) doRequest(
 		Stream:   stream,
 		Tools:    oTools,
 
-		Temperature:       o.params.Temperature,
-		TopP:              o.params.TopP,
-		TopK:              o.params.TopK,
-		FrequencyPenalty:  o.params.FrequencyPenalty,
-		PresencePenalty:   o.params.PresencePenalty,
-		RepetitionPenalty: o.params.RepetitionPenalty,
-		MinP:              o.params.MinP,
-		TopA:              o.params.TopA,
-		Seed:              o.params.Seed,
-		MaxTokens:         o.params.MaxTokens,
-		LogitBias:         o.params.LogitBias,
-		Logprobs:          o.params.Logprobs,
-		TopLogprobs:       o.params.TopLogprobs,
-		Stop:              o.params.Stop,
-		IncludeReasoning:  o.params.IncludeReasoning,
+		Temperature:       params.Temperature,
+		TopP:              params.TopP,
+		TopK:              params.TopK,
+		FrequencyPenalty:  params.FrequencyPenalty,
+		PresencePenalty:   params.PresencePenalty,
+		RepetitionPenalty: params.RepetitionPenalty,
+		MinP:              params.MinP,
+		TopA:              params.TopA,
+		Seed:              params.Seed,
+		MaxTokens:         params.MaxTokens,
+		LogitBias:         params.LogitBias,
+		Logprobs:          params.Logprobs,
+		TopLogprobs:       params.TopLogprobs,
+		Stop:              params.Stop,
+		IncludeReasoning:  params.IncludeReasoning,
+	}
+	if stream {
+		reqBody.Usage = &openRouterUsageRequest{Include: true}
 	}
 
 	jsonBody, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling request: %w", err)
 	}
+	if jsonBody, err = mergeExtra(jsonBody, o.extra); err != nil {
+		return nil, err
+	}
 
 	o.logger.Debug("Request Body", slog.String("body", string(jsonBody)))
 
@@ -424,8 +631,7 @@ func (o OpenRouter) doRequest(
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code: %d, body: %s, request: %s", resp.StatusCode, string(body), jsonBody)
+		return nil, newStatusError(resp)
 	}
 
 	return resp, nil
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+const openRouterTestModels = `{"data": [
+	{"id": "openai/gpt-4o", "architecture": {"input_modalities": ["text", "image"]},
+		"supported_parameters": ["tools", "temperature"]},
+	{"id": "meta/llama-base", "architecture": {"input_modalities": ["text"]},
+		"supported_parameters": ["temperature"]}
+]}`
+
+func TestOpenRouterModelCapabilities(t *testing.T) {
+	srv := newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(openRouterTestModels))
+	})
+	openRouter := NewOpenRouter("test-key", "openai/gpt-4o", "", models.LLMParameters{}, slog.Default())
+	openRouter.client = srv.redirectClient()
+	ctx := context.Background()
+
+	caps, err := openRouter.ModelCapabilities(ctx, "openai/gpt-4o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*caps.Tools || !*caps.Vision {
+		t.Errorf("capabilities of openai/gpt-4o = %v, %v, want tools and vision", *caps.Tools, *caps.Vision)
+	}
+	if caps, err = openRouter.ModelCapabilities(ctx, "meta/llama-base"); err != nil {
+		t.Fatal(err)
+	}
+	if *caps.Tools || *caps.Vision {
+		t.Errorf("capabilities of meta/llama-base = %v, %v, want none", *caps.Tools, *caps.Vision)
+	}
+	if _, err = openRouter.ModelCapabilities(ctx, "unknown/model"); err == nil {
+		t.Error("ModelCapabilities() succeeded with a model that isn't listed")
+	}
+
+	// The models are listed once for all the models, and by the copies of the LLM.
+	if _, err = openRouter.WithRetry(RetryPolicy{}).ModelCapabilities(ctx, "openai/gpt-4o"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.requestCount(); n != 1 {
+		t.Errorf("server received %d requests, want the models listed once", n)
+	}
+	req := srv.lastRequest(t)
+	if req.url.Path != "/api/v1/models" || req.header.Get("Authorization") != "Bearer test-key" {
+		t.Errorf("request = %s with %q, want the authorized models", req.url.Path, req.header.Get("Authorization"))
+	}
+
+	// The catalogue is listed again once it expired.
+	openRouter.catalogue.expires = time.Now()
+	if _, err = openRouter.ModelCapabilities(ctx, "openai/gpt-4o"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.requestCount(); n != 2 {
+		t.Errorf("server received %d requests, want the models listed again", n)
+	}
+}
+
+func TestOpenRouterModelCapabilitiesError(t *testing.T) {
+	srv := newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	openRouter := NewOpenRouter("test-key", "openai/gpt-4o", "", models.LLMParameters{}, slog.Default())
+	openRouter.client = srv.redirectClient()
+	ctx := context.Background()
+
+	// The error is cached for a while, so the chats don't all list the models again.
+	for range 3 {
+		if _, err := openRouter.ModelCapabilities(ctx, "openai/gpt-4o"); err == nil {
+			t.Fatal("ModelCapabilities() succeeded, want the error listing the models")
+		}
+	}
+	if n := srv.requestCount(); n != 1 {
+		t.Errorf("server received %d requests, want the error cached", n)
+	}
+	if remaining := time.Until(openRouter.catalogue.expires); remaining > openRouterCatalogueErrorTTL {
+		t.Errorf("error cached for %s, want at most %s", remaining, openRouterCatalogueErrorTTL)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	openRouter.catalogue.expires = time.Now()
+	if _, err := openRouter.ModelCapabilities(ctx, "openai/gpt-4o"); err == nil {
+		t.Fatal("ModelCapabilities() succeeded with a canceled context")
+	}
+	if !time.Now().After(openRouter.catalogue.expires) {
+		t.Error("the cancellation was cached")
+	}
+}
+
+func TestOpenRouterChatUsage(t *testing.T) {
+	srv := newRecordingServer(t, openAIStreamHandler(
+		`{"model": "openai/gpt-4o", "choices": [{"index": 0, "delta": {"content": "Hello"}}]}`,
+		`{"model": "openai/gpt-4o", "choices": [{"index": 0, "delta": {}, "finish_reason": "stop"}]}`,
+		`{"model": "openai/gpt-4o", "choices": [], `+
+			`"usage": {"prompt_tokens": 12, "completion_tokens": 4, "cost": 0.0015}}`,
+	))
+	openRouter := NewOpenRouter("test-key", "openai/gpt-4o", "", models.LLMParameters{}, slog.Default())
+	openRouter.client = srv.redirectClient()
+
+	// The usage accounting is asked for, so the last chunk holds the usage and its cost.
+	usage := chatUsage(t, collectChat(t, openRouter))
+	if usage.InputTokens != 12 || usage.OutputTokens != 4 || usage.Cost != 0.0015 {
+		t.Errorf("usage = %+v, want 12 input and 4 output tokens costing 0.0015", usage)
+	}
+	if got := srv.lastBody(t)["usage"]; !reflect.DeepEqual(got, map[string]any{"include": true}) {
+		t.Errorf("usage = %v, want the usage included", got)
+	}
+}
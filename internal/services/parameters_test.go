@@ -0,0 +1,308 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// titleGenerator is an LLM that generates titles, whose requests are sent with the configured parameters.
+type titleGenerator interface {
+	GenerateTitle(ctx context.Context, message string) (string, error)
+}
+
+func TestProviderParameters(t *testing.T) {
+	params := models.LLMParameters{
+		Temperature:       ptrTo[float32](0.5),
+		TopP:              ptrTo[float32](0.9),
+		TopK:              ptrTo(40),
+		FrequencyPenalty:  ptrTo[float32](0.1),
+		PresencePenalty:   ptrTo[float32](0.2),
+		RepetitionPenalty: ptrTo[float32](1.1),
+		MinP:              ptrTo[float32](0.05),
+		TopA:              ptrTo[float32](0.3),
+		Seed:              ptrTo(42),
+		MaxTokens:         ptrTo(256),
+		LogitBias:         map[string]int{"50256": -100},
+		Logprobs:          ptrTo(true),
+		TopLogprobs:       ptrTo(3),
+		Stop:              []string{"END"},
+		IncludeReasoning:  ptrTo(true),
+	}
+
+	tests := []struct {
+		name      string
+		supported []string
+		llm       func(srv *recordingServer) titleGenerator
+		// want are the fields of the request body set by the parameters, by their dotted path.
+		want map[string]any
+		// absent are the fields of the request body of the unsupported parameters.
+		absent []string
+	}{
+		{
+			name:      "ollama",
+			supported: OllamaParameters,
+			llm: func(srv *recordingServer) titleGenerator {
+				return NewOllama(srv.URL, "llama3", "", params, slog.Default())
+			},
+			want: map[string]any{
+				"options.temperature":       0.5,
+				"options.top_p":             0.9,
+				"options.top_k":             40.0,
+				"options.frequency_penalty": 0.1,
+				"options.presence_penalty":  0.2,
+				"options.repeat_penalty":    1.1,
+				"options.min_p":             0.05,
+				"options.seed":              42.0,
+				"options.num_predict":       256.0,
+				"options.stop":              []any{"END"},
+			},
+			absent: []string{"options.top_a", "options.logit_bias", "options.logprobs"},
+		},
+		{
+			name:      "anthropic",
+			supported: AnthropicParameters,
+			llm: func(srv *recordingServer) titleGenerator {
+				return NewAnthropic("test-key", "claude-test", "", srv.URL, 1024, params, slog.Default())
+			},
+			want: map[string]any{
+				"temperature":    0.5,
+				"top_p":          0.9,
+				"top_k":          40.0,
+				"max_tokens":     256.0,
+				"stop_sequences": []any{"END"},
+			},
+			absent: []string{"frequency_penalty", "seed", "logit_bias"},
+		},
+		{
+			name:      "openai",
+			supported: OpenAIParameters,
+			llm: func(srv *recordingServer) titleGenerator {
+				return NewOpenAI("test-key", "gpt-4o", "", srv.URL, params, slog.Default())
+			},
+			want: map[string]any{
+				"temperature":           0.5,
+				"top_p":                 0.9,
+				"frequency_penalty":     0.1,
+				"presence_penalty":      0.2,
+				"seed":                  42.0,
+				"max_completion_tokens": 256.0,
+				"logit_bias":            map[string]any{"50256": -100.0},
+				"logprobs":              true,
+				"top_logprobs":          3.0,
+				"stop":                  []any{"END"},
+			},
+			absent: []string{"top_k", "min_p", "max_tokens"},
+		},
+		{
+			name:      "openrouter",
+			supported: OpenRouterParameters,
+			llm: func(srv *recordingServer) titleGenerator {
+				openRouter := NewOpenRouter("test-key", "openai/gpt-4o", "", params, slog.Default())
+				openRouter.client = srv.redirectClient()
+				return openRouter
+			},
+			want: map[string]any{
+				"temperature":        0.5,
+				"top_p":              0.9,
+				"top_k":              40.0,
+				"frequency_penalty":  0.1,
+				"presence_penalty":   0.2,
+				"repetition_penalty": 1.1,
+				"min_p":              0.05,
+				"top_a":              0.3,
+				"seed":               42.0,
+				"max_tokens":         256.0,
+				"logit_bias":         map[string]any{"50256": -100.0},
+				"logprobs":           true,
+				"top_logprobs":       3.0,
+				"stop":               []any{"END"},
+				"include_reasoning":  true,
+			},
+		},
+		{
+			name:      "gemini",
+			supported: GeminiParameters,
+			llm: func(srv *recordingServer) titleGenerator {
+				return NewGemini("test-key", "gemini-test", "", srv.URL, params, slog.Default())
+			},
+			want: map[string]any{
+				"generationConfig.temperature":                    0.5,
+				"generationConfig.topP":                           0.9,
+				"generationConfig.topK":                           40.0,
+				"generationConfig.frequencyPenalty":               0.1,
+				"generationConfig.presencePenalty":                0.2,
+				"generationConfig.seed":                           42.0,
+				"generationConfig.maxOutputTokens":                256.0,
+				"generationConfig.responseLogprobs":               true,
+				"generationConfig.logprobs":                       3.0,
+				"generationConfig.stopSequences":                  []any{"END"},
+				"generationConfig.thinkingConfig.includeThoughts": true,
+			},
+			absent: []string{"generationConfig.minP", "generationConfig.logitBias"},
+		},
+		{
+			name:      "bedrock",
+			supported: BedrockParameters,
+			llm: func(srv *recordingServer) titleGenerator {
+				return NewBedrock("us-east-1", "test-model", "", srv.URL, AWSCredentials{APIKey: "api-key"},
+					params, slog.Default())
+			},
+			want: map[string]any{
+				"inferenceConfig.temperature":   0.5,
+				"inferenceConfig.topP":          0.9,
+				"inferenceConfig.maxTokens":     256.0,
+				"inferenceConfig.stopSequences": []any{"END"},
+			},
+			absent: []string{"inferenceConfig.topK", "additionalModelRequestFields"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range tt.supported {
+				if !slices.Contains(params.Names(), name) {
+					t.Errorf("supported parameter %q isn't a parameter name", name)
+				}
+			}
+
+			srv := newRecordingServer(t, nil)
+			// The response isn't a title, only the request matters.
+			_, _ = tt.llm(srv).GenerateTitle(context.Background(), "Hello")
+
+			body := srv.lastBody(t)
+			for path, want := range tt.want {
+				if got, _ := jsonPath(body, path); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", path, got, want)
+				}
+			}
+			for _, path := range tt.absent {
+				if got, ok := jsonPath(body, path); ok {
+					t.Errorf("%s = %#v, want it absent", path, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProviderExtra(t *testing.T) {
+	extra := map[string]any{
+		"provider": map[string]any{"order": []any{"openai"}},
+		"top_k":    40,
+	}
+	srv := newRecordingServer(t, nil)
+	openRouter := NewOpenRouter("test-key", "openai/gpt-4o", "", models.LLMParameters{TopK: ptrTo(20)},
+		slog.Default()).WithExtra(extra)
+	openRouter.client = srv.redirectClient()
+	_, _ = openRouter.GenerateTitle(context.Background(), "Hello")
+
+	body := srv.lastBody(t)
+	if got := body["provider"]; !reflect.DeepEqual(got, map[string]any{"order": []any{"openai"}}) {
+		t.Errorf("provider = %v, want the extra field", got)
+	}
+	// The extra fields replace the fields of the parameters.
+	if got := body["top_k"]; got != 40.0 {
+		t.Errorf("top_k = %v, want the extra field", got)
+	}
+	if got := body["model"]; got != "openai/gpt-4o" {
+		t.Errorf("model = %v, want the fields of the request kept", got)
+	}
+}
+
+func TestOllamaWithExtra(t *testing.T) {
+	srv := newRecordingServer(t, nil)
+	ollama := NewOllama(srv.URL, "llama3", "", models.LLMParameters{
+		Temperature: ptrTo[float32](0.5),
+		MaxTokens:   ptrTo(256),
+	}, slog.Default()).WithExtra(map[string]any{"num_ctx": 8192, "num_predict": 512})
+	_, _ = ollama.GenerateTitle(context.Background(), "Hello")
+
+	// The extra fields are options of the model, which replace the options of the parameters.
+	body := srv.lastBody(t)
+	want := map[string]any{"temperature": 0.5, "num_ctx": 8192.0, "num_predict": 512.0}
+	if got := body["options"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("options = %v, want %v", got, want)
+	}
+	if _, ok := body["num_ctx"]; ok {
+		t.Error("num_ctx is a field of the request, want it in the options")
+	}
+}
+
+func TestMergeExtra(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		extra map[string]any
+		want  string
+	}{
+		{name: "no extra", body: `{"model": "m"}`, want: `{"model": "m"}`},
+		{
+			name:  "new fields",
+			body:  `{"model": "m"}`,
+			extra: map[string]any{"provider": map[string]any{"sort": "price"}},
+			want:  `{"model":"m","provider":{"sort":"price"}}`,
+		},
+		{
+			name:  "replaced fields",
+			body:  `{"model": "m", "stop": ["a"]}`,
+			extra: map[string]any{"stop": []any{"b"}},
+			want:  `{"model":"m","stop":["b"]}`,
+		},
+		{
+			name:  "merged objects",
+			body:  `{"generationConfig": {"temperature": 0.5, "topK": 40}}`,
+			extra: map[string]any{"generationConfig": map[string]any{"topK": 10, "candidateCount": 1}},
+			want:  `{"generationConfig":{"candidateCount":1,"temperature":0.5,"topK":10}}`,
+		},
+		{
+			name:  "large numbers kept",
+			body:  `{"seed": 9007199254740993}`,
+			extra: map[string]any{"top_k": 1},
+			want:  `{"seed":9007199254740993,"top_k":1}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeExtra([]byte(tt.body), tt.extra)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("mergeExtra() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := mergeExtra([]byte(`[]`), map[string]any{"a": 1}); err == nil {
+		t.Error("mergeExtra() succeeded with a body that isn't an object")
+	}
+}
+
+// jsonPath returns the value of the decoded JSON object at the dotted path, and whether it's set. The
+// elements of the lists are selected by their index.
+func jsonPath(object map[string]any, path string) (any, bool) {
+	var value any = object
+	for _, name := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			var ok bool
+			if value, ok = v[name]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
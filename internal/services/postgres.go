@@ -0,0 +1,456 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	_ "github.com/jackc/pgx/v5/stdlib" // Register the pgx database/sql driver.
+)
+
+// Postgres implements the Store interface using a PostgreSQL database. As opposed to the file-based
+// stores, the database can be shared by several replicas of the server, and PostgresSSE should be used
+// alongside it so the SSE events published by a replica reach the clients connected to the others.
+type Postgres struct {
+	db      *sql.DB
+	connStr string
+}
+
+// postgresMigrationLockID is the key of the advisory lock held while migrating, so replicas that start
+// at the same time don't apply the same migrations concurrently.
+const postgresMigrationLockID = 7_361_927_410
+
+// postgresMigrations are the schema migrations of the Postgres store, applied in order. The version of
+// a migration is its index plus one, and applied versions are recorded in the schema_migrations table.
+// Migrations must never be changed once released, new schema changes are appended as new migrations.
+var postgresMigrations = []sqlMigration{
+	execMigration(`CREATE TABLE chats (
+		seq BIGSERIAL PRIMARY KEY,
+		id TEXT NOT NULL UNIQUE,
+		title TEXT NOT NULL DEFAULT '',
+		search_terms TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE messages (
+		seq BIGSERIAL PRIMARY KEY,
+		id TEXT NOT NULL,
+		chat_id TEXT NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+		role TEXT NOT NULL,
+		contents JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		search_terms TEXT NOT NULL DEFAULT '',
+		UNIQUE (chat_id, id)
+	);
+	CREATE INDEX messages_chat_id_seq ON messages (chat_id, seq);
+	CREATE TABLE sse_events (
+		id BIGSERIAL PRIMARY KEY,
+		topics TEXT[] NOT NULL,
+		message TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX sse_events_created_at ON sse_events (created_at);`),
+	execMigration(`ALTER TABLE chats
+		ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN folders JSONB NOT NULL DEFAULT '[]';
+	UPDATE chats c SET created_at = m.first, updated_at = m.last
+		FROM (SELECT chat_id, MIN(created_at) AS first, MAX(created_at) AS last FROM messages GROUP BY chat_id) m
+		WHERE m.chat_id = c.id;
+	CREATE INDEX chats_list ON chats (archived, pinned, updated_at, id);`),
+	execMigration(`ALTER TABLE chats ADD COLUMN llm_profile TEXT NOT NULL DEFAULT '';`),
+	execMigration(`ALTER TABLE chats ADD COLUMN persona_id TEXT NOT NULL DEFAULT '';
+	CREATE TABLE personas (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		data JSONB NOT NULL
+	);`),
+	execMigration(`ALTER TABLE chats ADD COLUMN parameters JSONB NOT NULL DEFAULT '{}';`),
+	execMigration(`ALTER TABLE messages ADD COLUMN input_tokens INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN output_tokens INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN cost DOUBLE PRECISION NOT NULL DEFAULT 0;`),
+	execMigration(`ALTER TABLE messages ADD COLUMN context_trim JSONB NOT NULL DEFAULT '{}';`),
+	execMigration(`ALTER TABLE messages ADD COLUMN cache_read_tokens INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN cache_write_tokens INTEGER NOT NULL DEFAULT 0;`),
+	execMigration(`ALTER TABLE messages ADD COLUMN fallback_llm TEXT NOT NULL DEFAULT '';`),
+	execMigration(`ALTER TABLE messages ADD COLUMN error_kind TEXT NOT NULL DEFAULT '',
+		ADD COLUMN error_message TEXT NOT NULL DEFAULT '';`),
+	execMigration(`ALTER TABLE messages ADD COLUMN finish JSONB NOT NULL DEFAULT '{}';`),
+	execMigration(`ALTER TABLE chats ADD COLUMN model TEXT NOT NULL DEFAULT '';`),
+}
+
+const postgresChatColumns = "id, title, created_at, updated_at, pinned, archived, folders::text, llm_profile, " +
+	"persona_id, parameters::text, model"
+
+const postgresMessageColumns = "id, role, contents::text, created_at, input_tokens, output_tokens, cost, " +
+	"context_trim::text, cache_read_tokens, cache_write_tokens, fallback_llm, error_kind, error_message, " +
+	"finish::text"
+
+// NewPostgres connects to the PostgreSQL database with the specified connection string, either a URL or
+// a DSN, and applies the pending schema migrations.
+func NewPostgres(ctx context.Context, connStr string) (Postgres, error) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return Postgres{}, fmt.Errorf("failed to open postgres db: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return Postgres{}, fmt.Errorf("failed to connect to postgres db: %w", err)
+	}
+
+	p := Postgres{db: db, connStr: connStr}
+	if err := p.migrate(ctx); err != nil {
+		_ = db.Close()
+		return Postgres{}, err
+	}
+	return p, nil
+}
+
+// Close closes the connections to the database.
+func (p Postgres) Close() error {
+	return p.db.Close()
+}
+
+func (p Postgres) migrate(ctx context.Context) error {
+	// Postgres supports transactional DDL, so all the pending migrations are applied atomically.
+	return withSQLTx(ctx, p.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, postgresMigrationLockID); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`); err != nil {
+			return fmt.Errorf("failed to create schema_migrations table: %w", err)
+		}
+
+		var current int
+		if err := tx.QueryRowContext(ctx,
+			`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+			return fmt.Errorf("failed to get schema version: %w", err)
+		}
+
+		for i := current; i < len(postgresMigrations); i++ {
+			version := i + 1
+			if err := postgresMigrations[i](ctx, tx); err != nil {
+				return fmt.Errorf("failed to apply migration %d: %w", version, err)
+			}
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+				return fmt.Errorf("failed to record migration %d: %w", version, err)
+			}
+		}
+		return nil
+	})
+}
+
+// pageLimit returns the LIMIT argument for a page of the given size, which includes one more row to
+// know whether there is a next page. A nil limit, which is returned for an unlimited page, is the same
+// as LIMIT ALL.
+func pageLimit(size int) any {
+	if size <= 0 {
+		return nil
+	}
+	return size + 1
+}
+
+// Chats retrieves all stored chats, from the most recently created to the oldest one.
+func (p Postgres) Chats(ctx context.Context) ([]models.Chat, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+postgresChatColumns+` FROM chats ORDER BY seq DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chats: %w", err)
+	}
+	return scanSQLChats(rows)
+}
+
+// Chat retrieves the chat with the given ID. If the chat doesn't exist, a zero Chat is returned
+// without an error.
+func (p Postgres) Chat(ctx context.Context, chatID string) (models.Chat, error) {
+	chat, err := scanSQLChat(p.db.QueryRowContext(ctx,
+		`SELECT `+postgresChatColumns+` FROM chats WHERE id = $1`, chatID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Chat{}, nil
+	}
+	if err != nil {
+		return models.Chat{}, fmt.Errorf("failed to query chat: %w", err)
+	}
+	return chat, nil
+}
+
+// ChatsPage retrieves a page of the chats that match the query filters, with the pinned chats first,
+// then from the most recently updated one. The cursor of a page holds the sort key of its last chat, and
+// the returned next cursor is empty when there are no chats left.
+func (p Postgres) ChatsPage(ctx context.Context, query models.ChatsQuery) ([]models.Chat, string, error) {
+	var after models.Chat
+	if query.Cursor != "" {
+		var err error
+		after, err = parseChatsCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	rows, err := p.db.QueryContext(ctx, `SELECT `+postgresChatColumns+` FROM chats
+		WHERE archived = $1
+		AND ($2 = '' OR folders @> jsonb_build_array($2::text))
+		AND ($3 = '' OR (pinned, updated_at, id) < ($4::boolean, $5::timestamptz, $6::text))
+		ORDER BY pinned DESC, updated_at DESC, id DESC LIMIT $7`,
+		query.Archived, query.Folder, query.Cursor, after.Pinned, after.UpdatedAt, after.ID,
+		pageLimit(query.Limit))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query chats: %w", err)
+	}
+	chats, err := scanSQLChats(rows)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if query.Limit > 0 && len(chats) > query.Limit {
+		chats = chats[:query.Limit]
+		return chats, chatsCursor(chats[len(chats)-1]), nil
+	}
+	return chats, "", nil
+}
+
+// Folders retrieves the sorted names of the folders that contain at least one chat.
+func (p Postgres) Folders(ctx context.Context) ([]string, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT DISTINCT f FROM chats, jsonb_array_elements_text(folders) AS f
+		ORDER BY f`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query folders: %w", err)
+	}
+	return scanSQLFolders(rows)
+}
+
+// AddChat stores a new chat and returns its ID. The ID of the given chat is kept as is, and the creation
+// and update times default to the current time.
+func (p Postgres) AddChat(ctx context.Context, chat models.Chat) (string, error) {
+	if chat.CreatedAt.IsZero() {
+		chat.CreatedAt = time.Now()
+	}
+	if chat.UpdatedAt.IsZero() {
+		chat.UpdatedAt = chat.CreatedAt
+	}
+
+	_, err := p.db.ExecContext(ctx, `INSERT INTO chats
+		(id, title, search_terms, created_at, updated_at, pinned, archived, folders, llm_profile, persona_id,
+		parameters, model)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		chat.ID, chat.Title, searchTermsColumn(chat.Title), chat.CreatedAt, chat.UpdatedAt,
+		chat.Pinned, chat.Archived, foldersColumn(chat.Folders), chat.LLMProfile, chat.PersonaID,
+		parametersColumn(chat.Parameters), chat.Model)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert chat: %w", err)
+	}
+	return chat.ID, nil
+}
+
+// UpdateChat modifies an existing chat. If the chat doesn't exist, the operation is silently ignored.
+// The creation time can't be changed, and the update time is never moved backwards, so updating a chat
+// read before a message was added doesn't revert the activity recorded by AddMessage.
+func (p Postgres) UpdateChat(ctx context.Context, chat models.Chat) error {
+	_, err := p.db.ExecContext(ctx, `UPDATE chats SET title = $1, search_terms = $2,
+		updated_at = GREATEST(updated_at, $3), pinned = $4, archived = $5, folders = $6, llm_profile = $7,
+		persona_id = $8, parameters = $9, model = $10
+		WHERE id = $11`,
+		chat.Title, searchTermsColumn(chat.Title), chat.UpdatedAt, chat.Pinned, chat.Archived,
+		foldersColumn(chat.Folders), chat.LLMProfile, chat.PersonaID, parametersColumn(chat.Parameters), chat.Model,
+		chat.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update chat: %w", err)
+	}
+	return nil
+}
+
+// Messages retrieves all messages of the specified chat in their stored order.
+func (p Postgres) Messages(ctx context.Context, chatID string) ([]models.Message, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+postgresMessageColumns+` FROM messages
+		WHERE chat_id = $1 ORDER BY seq`, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	return scanSQLMessages(rows)
+}
+
+// MessagesPage retrieves a page of messages of the specified chat, starting from the latest message and
+// going backwards. The messages within the page are in their stored order. The cursor of a page is the
+// ID of its oldest message, and the returned next cursor is empty when there are no older messages left.
+func (p Postgres) MessagesPage(
+	ctx context.Context,
+	chatID string,
+	query models.MessagesQuery,
+) ([]models.Message, string, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+postgresMessageColumns+` FROM messages
+		WHERE chat_id = $1 AND ($2 = '' OR seq < (SELECT seq FROM messages WHERE chat_id = $1 AND id = $2))
+		ORDER BY seq DESC LIMIT $3`, chatID, query.Cursor, pageLimit(query.Limit))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query messages: %w", err)
+	}
+	messages, err := scanSQLMessages(rows)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(messages) > query.Limit {
+		messages = messages[:query.Limit]
+		nextCursor = messages[len(messages)-1].ID
+	}
+	slices.Reverse(messages)
+	return messages, nextCursor, nil
+}
+
+// AddMessage stores a new message in the specified chat and returns its ID. The ID of the given message
+// is kept as is, and the update time of the chat is moved to the message timestamp, if it's later.
+func (p Postgres) AddMessage(ctx context.Context, chatID string, message models.Message) (string, error) {
+	contents, err := json.Marshal(message.Contents)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message contents: %w", err)
+	}
+
+	err = withSQLTx(ctx, p.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO messages
+			(id, chat_id, role, contents, created_at, search_terms, input_tokens, output_tokens, cost, context_trim,
+			cache_read_tokens, cache_write_tokens, fallback_llm, error_kind, error_message, finish)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+			message.ID, chatID, message.Role, string(contents), message.Timestamp,
+			searchTermsColumn(message.SearchText()),
+			message.Usage.InputTokens, message.Usage.OutputTokens, message.Usage.Cost,
+			contextTrimColumn(message.ContextTrim),
+			message.Usage.CacheReadTokens, message.Usage.CacheWriteTokens, message.FallbackLLM,
+			message.Error.Kind, message.Error.Message, finishColumn(message.Finish)); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE chats SET updated_at = GREATEST(updated_at, $1) WHERE id = $2`,
+			message.Timestamp, chatID)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to insert message: %w", err)
+	}
+	return message.ID, nil
+}
+
+// UpdateMessage modifies an existing message in the specified chat. If the message doesn't exist, the
+// operation is silently ignored.
+func (p Postgres) UpdateMessage(ctx context.Context, chatID string, message models.Message) error {
+	contents, err := json.Marshal(message.Contents)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message contents: %w", err)
+	}
+
+	_, err = p.db.ExecContext(ctx, `UPDATE messages SET role = $1, contents = $2, created_at = $3, search_terms = $4,
+		input_tokens = $5, output_tokens = $6, cost = $7, context_trim = $8, cache_read_tokens = $9,
+		cache_write_tokens = $10, fallback_llm = $11, error_kind = $12, error_message = $13,
+		finish = $14
+		WHERE chat_id = $15 AND id = $16`,
+		message.Role, string(contents), message.Timestamp, searchTermsColumn(message.SearchText()),
+		message.Usage.InputTokens, message.Usage.OutputTokens, message.Usage.Cost,
+		contextTrimColumn(message.ContextTrim), message.Usage.CacheReadTokens, message.Usage.CacheWriteTokens,
+		message.FallbackLLM, message.Error.Kind, message.Error.Message, finishColumn(message.Finish),
+		chatID, message.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+	return nil
+}
+
+// ChatUsage returns the total usage of the messages of the specified chat.
+func (p Postgres) ChatUsage(ctx context.Context, chatID string) (models.Usage, error) {
+	var usage models.Usage
+	err := p.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
+		COALESCE(SUM(cost), 0), COALESCE(SUM(cache_read_tokens), 0), COALESCE(SUM(cache_write_tokens), 0)
+		FROM messages WHERE chat_id = $1`, chatID).
+		Scan(&usage.InputTokens, &usage.OutputTokens, &usage.Cost, &usage.CacheReadTokens, &usage.CacheWriteTokens)
+	if err != nil {
+		return models.Usage{}, fmt.Errorf("failed to query chat usage: %w", err)
+	}
+	return usage, nil
+}
+
+// UsageByChat returns the total usage of each chat with a non-zero usage, from the most expensive chat.
+func (p Postgres) UsageByChat(ctx context.Context) ([]models.ChatUsage, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT c.id, c.title, SUM(m.input_tokens), SUM(m.output_tokens),
+		SUM(m.cost), SUM(m.cache_read_tokens), SUM(m.cache_write_tokens) FROM chats c JOIN messages m ON m.chat_id = c.id
+		GROUP BY c.id, c.title HAVING SUM(m.input_tokens + m.output_tokens) > 0`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usages: %w", err)
+	}
+	return scanSQLChatUsages(rows)
+}
+
+// Personas retrieves the stored personas sorted by name.
+func (p Postgres) Personas(ctx context.Context) ([]models.Persona, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT data::text FROM personas ORDER BY name, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query personas: %w", err)
+	}
+	return scanSQLPersonas(rows)
+}
+
+// SavePersona stores the persona, replacing the stored persona with the same ID.
+func (p Postgres) SavePersona(ctx context.Context, persona models.Persona) error {
+	data, err := personaColumn(persona)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, `INSERT INTO personas (id, name, data) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, data = excluded.data`,
+		persona.ID, persona.Name, data)
+	if err != nil {
+		return fmt.Errorf("failed to save persona: %w", err)
+	}
+	return nil
+}
+
+// DeletePersona deletes the persona with the given ID. If the persona doesn't exist, the operation is
+// silently ignored.
+func (p Postgres) DeletePersona(ctx context.Context, personaID string) error {
+	if _, err := p.db.ExecContext(ctx, `DELETE FROM personas WHERE id = $1`, personaID); err != nil {
+		return fmt.Errorf("failed to delete persona: %w", err)
+	}
+	return nil
+}
+
+// SearchChats returns the chat titles and messages that contain all the terms of query, with the last
+// term matched as a prefix. Results are ordered from the most recent chat to the oldest one, and from
+// the first message to the last one within a chat, and at most limit results are returned.
+func (p Postgres) SearchChats(ctx context.Context, query string, limit int) ([]models.SearchResult, error) {
+	terms := models.SearchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var limitArg any
+	if limit > 0 {
+		limitArg = limit
+	}
+
+	// Both parts of the union use the same patterns, so the placeholders are shared between them.
+	conds := make([]string, len(terms))
+	for i := range terms {
+		conds[i] = fmt.Sprintf("%%[1]s LIKE $%d", i+1)
+	}
+	where := func(column string) string {
+		return fmt.Sprintf(strings.Join(conds, " AND "), column)
+	}
+
+	q := fmt.Sprintf(`SELECT id, title, ''::text, ''::text, seq, 0::bigint FROM chats WHERE %s
+		UNION ALL
+		SELECT c.id, c.title, m.id, m.contents::text, c.seq, m.seq FROM messages m JOIN chats c ON c.id = m.chat_id
+		WHERE %s
+		ORDER BY 5 DESC, 6 LIMIT $%d`, where("search_terms"), where("m.search_terms"), len(terms)+1)
+	args := append(searchTermsPatterns(terms), limitArg)
+
+	rows, err := p.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search chats: %w", err)
+	}
+	return scanSQLSearchResults(rows, terms)
+}
@@ -0,0 +1,397 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/tmaxmax/go-sse"
+)
+
+// PostgresSSE is a go-sse Provider that fans out SSE messages to every server replica sharing the same
+// Postgres database. Published messages are stored in the sse_events table and announced with NOTIFY,
+// and every replica LISTENs for the announcements and publishes the stored messages to its own
+// subscribers through a local sse.Joe.
+//
+// Messages are stored in a table instead of being sent as the NOTIFY payload because rendered messages
+// can easily exceed the payload size limit of Postgres. Stored messages are deleted after
+// sseEventsRetention, as they are only needed until every replica has received them.
+//
+// A message is published for every chunk of a streamed answer, so the messages aren't stored one by
+// one: they are buffered for sseBatchDelay, then stored in a single statement with a single NOTIFY
+// announcing all of them.
+type PostgresSSE struct {
+	store  Postgres
+	joe    *sse.Joe
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	pending []sseEvent
+	closed  bool
+	// flush signals the batching goroutine that messages are pending.
+	flush chan struct{}
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// sseEvent is a published message waiting to be stored.
+type sseEvent struct {
+	topics []string
+	text   string
+}
+
+const (
+	sseEventsChannel   = "mcpwebui_sse_events"
+	sseEventsRetention = time.Minute
+
+	sseBatchDelay = 50 * time.Millisecond
+	// sseMaxBatchSize keeps the IDs of a batch within the NOTIFY payload size limit.
+	sseMaxBatchSize = 100
+
+	sseReconnectDelay = time.Second
+)
+
+// NewPostgresSSE creates a PostgresSSE that uses the database of the given store, and starts listening
+// for the messages published by every replica. The listening connection is re-established if it's lost,
+// and the messages published while it was down are caught up once it's back.
+func NewPostgresSSE(store Postgres, logger *slog.Logger) *PostgresSSE {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PostgresSSE{
+		store:  store,
+		joe:    &sse.Joe{},
+		logger: logger.With(slog.String("module", "postgres_sse")),
+		flush:  make(chan struct{}, 1),
+		cancel: cancel,
+	}
+	p.wg.Add(2)
+	go p.listen(ctx)
+	go p.storeBatches(ctx)
+	return p
+}
+
+// Subscribe subscribes to the messages published by every replica.
+func (p *PostgresSSE) Subscribe(ctx context.Context, sub sse.Subscription) error {
+	return p.joe.Subscribe(ctx, sub)
+}
+
+// Publish queues the message to be stored and announced to every replica, including this one, which
+// publish it to their subscribers of the given topics. The messages are stored in the background, so
+// the failures to store them are logged instead of returned.
+func (p *PostgresSSE) Publish(msg *sse.Message, topics []string) error {
+	if len(topics) == 0 {
+		return sse.ErrNoTopic
+	}
+	text, err := msg.MarshalText()
+	if err != nil {
+		return fmt.Errorf("failed to marshal sse message: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return sse.ErrProviderClosed
+	}
+	p.pending = append(p.pending, sseEvent{topics: slices.Clone(topics), text: string(text)})
+	select {
+	case p.flush <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Shutdown stops listening for the published messages and shuts down the local subscribers.
+// The messages still pending are stored before it returns.
+func (p *PostgresSSE) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.joe.Shutdown(ctx)
+}
+
+// storeBatches stores the pending messages in batches until the context is canceled, and then stores
+// the remaining ones.
+func (p *PostgresSSE) storeBatches(ctx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.storePending(context.Background())
+			return
+		case <-p.flush:
+		}
+		// The messages published right after the first one are stored in the same batch.
+		select {
+		case <-ctx.Done():
+		case <-time.After(sseBatchDelay):
+		}
+		p.storePending(context.Background())
+	}
+}
+
+func (p *PostgresSSE) storePending(ctx context.Context) {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+
+	for batch := range slices.Chunk(pending, sseMaxBatchSize) {
+		if err := p.storeBatch(ctx, batch); err != nil {
+			p.logger.Error("Failed to publish sse messages",
+				slog.Int("count", len(batch)),
+				slog.String("err", err.Error()))
+		}
+	}
+}
+
+// storeBatch stores the messages and announces their IDs in a single notification, separated by commas.
+func (p *PostgresSSE) storeBatch(ctx context.Context, batch []sseEvent) error {
+	values := make([]string, len(batch))
+	args := make([]any, 0, 2*len(batch)+1)
+	args = append(args, sseEventsChannel)
+	for i, event := range batch {
+		values[i] = fmt.Sprintf("($%d::text[], $%d)", 2*i+2, 2*i+3)
+		args = append(args, event.topics, event.text)
+	}
+
+	_, err := p.store.db.ExecContext(ctx, `WITH e AS (
+		INSERT INTO sse_events (topics, message) VALUES `+strings.Join(values, ", ")+` RETURNING id
+	) SELECT pg_notify($1, (SELECT string_agg(id::text, ',' ORDER BY id) FROM e))`, args...)
+	return err
+}
+
+func (p *PostgresSSE) listen(ctx context.Context) {
+	defer p.wg.Done()
+
+	// The messages stored before this replica started are not published, so they are considered
+	// published already.
+	published := newPublishedEvents()
+	if err := published.addStored(ctx, p.store); err != nil {
+		p.logger.Error("Failed to get stored sse events", slog.String("err", err.Error()))
+	}
+
+	cleanup := time.NewTicker(sseEventsRetention)
+	defer cleanup.Stop()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-cleanup.C:
+				if _, err := p.store.db.ExecContext(ctx, `DELETE FROM sse_events WHERE created_at < $1`,
+					time.Now().Add(-sseEventsRetention)); err != nil {
+					p.logger.Error("Failed to delete old sse events", slog.String("err", err.Error()))
+				}
+			}
+		}
+	}()
+
+	for {
+		err := p.listenConn(ctx, published)
+		if ctx.Err() != nil {
+			return
+		}
+		p.logger.Error("Lost sse events listener connection, reconnecting", slog.String("err", err.Error()))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sseReconnectDelay):
+		}
+	}
+}
+
+// listenConn listens for the published messages on a dedicated connection until it fails, and records
+// the messages it has published to the local subscribers in published.
+func (p *PostgresSSE) listenConn(ctx context.Context, published *publishedEvents) error {
+	conn, err := pgx.Connect(ctx, p.store.connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+sseEventsChannel); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	// Catch up with the messages published while this replica wasn't listening. The notifications of
+	// the caught up messages may still be received afterwards, so they are skipped.
+	if err := p.catchUp(ctx, conn, published); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		var ids []int64
+		for _, field := range strings.Split(n.Payload, ",") {
+			id, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				p.logger.Error("Invalid sse event notification", slog.String("payload", n.Payload))
+				continue
+			}
+			if !published.has(id) {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		if err := p.publishEvents(ctx, conn, ids, published); err != nil {
+			return err
+		}
+		published.prune()
+	}
+}
+
+// catchUp publishes the stored messages that weren't published yet. The IDs of the messages are
+// assigned when they are inserted, but the messages of concurrent transactions are committed in any
+// order, so a message may be committed after a message with a greater ID. All the stored messages are
+// checked instead of the ones after the last published ID, which is cheap as the table only holds the
+// messages of the last retention periods.
+func (p *PostgresSSE) catchUp(ctx context.Context, conn *pgx.Conn, published *publishedEvents) error {
+	rows, err := conn.Query(ctx, `SELECT id, topics, message FROM sse_events ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to query sse events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var topics []string
+		var text string
+		if err := rows.Scan(&id, &topics, &text); err != nil {
+			return fmt.Errorf("failed to scan sse event: %w", err)
+		}
+		if published.has(id) {
+			continue
+		}
+		p.publishLocal(id, topics, text)
+		published.add(id)
+	}
+	return rows.Err()
+}
+
+// publishEvents publishes the stored messages with the given IDs, in the order of their IDs.
+func (p *PostgresSSE) publishEvents(
+	ctx context.Context,
+	conn *pgx.Conn,
+	ids []int64,
+	published *publishedEvents,
+) error {
+	rows, err := conn.Query(ctx, `SELECT id, topics, message FROM sse_events WHERE id = ANY($1) ORDER BY id`, ids)
+	if err != nil {
+		return fmt.Errorf("failed to query sse events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var topics []string
+		var text string
+		if err := rows.Scan(&id, &topics, &text); err != nil {
+			return fmt.Errorf("failed to scan sse event: %w", err)
+		}
+		p.publishLocal(id, topics, text)
+		published.add(id)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query sse events: %w", err)
+	}
+
+	for _, id := range ids {
+		if !published.has(id) {
+			// The event was already deleted, which only happens if this replica lagged behind for longer
+			// than the retention, so there is nothing left to publish.
+			p.logger.Warn("SSE event not found", slog.Int64("id", id))
+			published.add(id)
+		}
+	}
+	return nil
+}
+
+func (p *PostgresSSE) publishLocal(id int64, topics []string, text string) {
+	var msg sse.Message
+	if err := msg.UnmarshalText([]byte(text)); err != nil {
+		p.logger.Error("Failed to unmarshal sse event",
+			slog.Int64("id", id),
+			slog.String("err", err.Error()))
+		return
+	}
+	if err := p.joe.Publish(&msg, topics); err != nil {
+		p.logger.Error("Failed to publish sse event",
+			slog.Int64("id", id),
+			slog.String("err", err.Error()))
+	}
+}
+
+// publishedEvents records when the stored messages were published to the local subscribers, by ID. The
+// IDs are kept until the messages are deleted from the table, which takes up to twice the retention.
+type publishedEvents struct {
+	ids    map[int64]time.Time
+	pruned time.Time
+}
+
+func newPublishedEvents() *publishedEvents {
+	return &publishedEvents{ids: make(map[int64]time.Time), pruned: time.Now()}
+}
+
+func (e *publishedEvents) add(id int64) {
+	e.ids[id] = time.Now()
+}
+
+func (e *publishedEvents) has(id int64) bool {
+	_, ok := e.ids[id]
+	return ok
+}
+
+func (e *publishedEvents) addStored(ctx context.Context, store Postgres) error {
+	rows, err := store.db.QueryContext(ctx, `SELECT id FROM sse_events`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		e.add(id)
+	}
+	return rows.Err()
+}
+
+// prune forgets the messages that were deleted from the table, once per retention.
+func (e *publishedEvents) prune() {
+	if time.Since(e.pruned) < sseEventsRetention {
+		return
+	}
+	e.pruned = time.Now()
+	for id, t := range e.ids {
+		if time.Since(t) > 3*sseEventsRetention {
+			delete(e.ids, id)
+		}
+	}
+}
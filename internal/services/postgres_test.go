@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/tmaxmax/go-sse"
+)
+
+// The Postgres tests run against the database of TEST_DATABASE_URL, and are skipped if it's not set. Each
+// test creates its own schema, which is dropped at the end of the test.
+const postgresTestURLEnv = "TEST_DATABASE_URL"
+
+func TestPostgres(t *testing.T) {
+	testStore(t, newPostgresTestStore(t))
+}
+
+func TestPostgresSSE(t *testing.T) {
+	store := newPostgresTestStore(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Two replicas share the database: the messages published by one reach the subscribers of both.
+	publisher := NewPostgresSSE(store, logger)
+	t.Cleanup(func() { _ = publisher.Shutdown(context.Background()) })
+	replica := NewPostgresSSE(store, logger)
+	t.Cleanup(func() { _ = replica.Shutdown(context.Background()) })
+
+	local := subscribeTestSSE(t, publisher, "chat")
+	remote := subscribeTestSSE(t, replica, "chat")
+	other := subscribeTestSSE(t, replica, "other")
+	// The replicas start listening in the background, and skip the messages stored before they did.
+	time.Sleep(time.Second)
+
+	var want []string
+	for i := range 150 {
+		data := fmt.Sprintf("chunk %d", i)
+		msg := &sse.Message{Type: sse.Type("messages")}
+		msg.AppendData(data)
+		if err := publisher.Publish(msg, []string{"chat"}); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, data)
+	}
+
+	for name, sub := range map[string]*testSSESubscriber{"local": local, "remote": remote} {
+		if got := sub.wait(t, len(want)); !slices.Equal(got, want) {
+			t.Errorf("%s subscriber received %v, want %v", name, got, want)
+		}
+	}
+	if got := other.received(); len(got) != 0 {
+		t.Errorf("subscriber of another topic received %v", got)
+	}
+
+	// The messages are stored in batches rather than one by one.
+	var batches int
+	if err := store.db.QueryRow(`SELECT COUNT(DISTINCT created_at) FROM sse_events`).Scan(&batches); err != nil {
+		t.Fatal(err)
+	}
+	if batches >= len(want) {
+		t.Errorf("messages stored in %d transactions, want them batched", batches)
+	}
+}
+
+func TestPostgresSSECatchUp(t *testing.T) {
+	ctx := context.Background()
+	store := newPostgresTestStore(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	p := &PostgresSSE{store: store, joe: &sse.Joe{}, logger: logger}
+	t.Cleanup(func() { _ = p.joe.Shutdown(context.Background()) })
+	sub := subscribeTestSSE(t, p, "chat")
+
+	// The message with the lowest ID is committed last, after the other messages were published, so
+	// it's caught up although a greater ID was already published.
+	late, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTestSSEEvent(t, late, "late")
+	var published []int64
+	for _, data := range []string{"first", "second"} {
+		published = append(published, insertTestSSEEvent(t, store.db, data))
+	}
+	if err := late.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := pgx.Connect(ctx, store.connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close(context.Background()) })
+
+	events := newPublishedEvents()
+	for _, id := range published {
+		events.add(id)
+	}
+	if err := p.catchUp(ctx, conn, events); err != nil {
+		t.Fatal(err)
+	}
+	if got := sub.wait(t, 1); !slices.Equal(got, []string{"late"}) {
+		t.Errorf("caught up %v, want only the late message", got)
+	}
+
+	// The caught up messages aren't published again.
+	if err := p.catchUp(ctx, conn, events); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := sub.received(); len(got) != 1 {
+		t.Errorf("received %v after catching up twice, want the late message once", got)
+	}
+}
+
+// newPostgresTestStore returns a store in a new schema of the test database.
+func newPostgresTestStore(t *testing.T) Postgres {
+	t.Helper()
+
+	url := os.Getenv(postgresTestURLEnv)
+	if url == "" {
+		t.Skipf("%s is not set", postgresTestURLEnv)
+	}
+	ctx := context.Background()
+
+	admin, err := sql.Open("pgx", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = admin.Close() })
+	schema := fmt.Sprintf("mcpwebui_test_%d", time.Now().UnixNano())
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Errorf("failed to drop the test schema: %v", err)
+		}
+	})
+
+	// The search path is passed as a runtime parameter, in the form of the connection string.
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		sep := "?"
+		if strings.Contains(url, "?") {
+			sep = "&"
+		}
+		url += sep + "search_path=" + schema
+	} else {
+		url += " search_path=" + schema
+	}
+	store, err := NewPostgres(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The store is closed before the schema is dropped.
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+// sqlQueryRower is either a database or a transaction.
+type sqlQueryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// insertTestSSEEvent stores a message of the chat topic, as published by a replica, and returns its ID.
+func insertTestSSEEvent(t *testing.T, db sqlQueryRower, data string) int64 {
+	t.Helper()
+
+	msg := &sse.Message{Type: sse.Type("messages")}
+	msg.AppendData(data)
+	text, err := msg.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	if err := db.QueryRow(`INSERT INTO sse_events (topics, message) VALUES ($1, $2) RETURNING id`,
+		[]string{"chat"}, string(text)).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// testSSESubscriber records the data of the messages it receives.
+type testSSESubscriber struct {
+	mu   sync.Mutex
+	data []string
+}
+
+func subscribeTestSSE(t *testing.T, p *PostgresSSE, topic string) *testSSESubscriber {
+	t.Helper()
+
+	sub := &testSSESubscriber{}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = p.Subscribe(ctx, sse.Subscription{Client: sub, Topics: []string{topic}})
+	}()
+	// Joe registers the subscription asynchronously.
+	time.Sleep(50 * time.Millisecond)
+	return sub
+}
+
+func (s *testSSESubscriber) Send(msg *sse.Message) error {
+	text, err := msg.MarshalText()
+	if err != nil {
+		return err
+	}
+	var data []string
+	for _, line := range strings.Split(string(text), "\n") {
+		if d, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, d)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append(s.data, strings.Join(data, "\n"))
+	return nil
+}
+
+func (s *testSSESubscriber) Flush() error {
+	return nil
+}
+
+func (s *testSSESubscriber) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.data)
+}
+
+// wait waits until the subscriber received n messages, and returns them.
+func (s *testSSESubscriber) wait(t *testing.T, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := s.received(); len(got) >= n {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("received %d messages, want %d", len(s.received()), n)
+	return nil
+}
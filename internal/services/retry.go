@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/ollama/ollama/api"
+	goopenai "github.com/sashabaranov/go-openai"
+)
+
+// RetryPolicy configures the retries of the LLM requests that fail with a transient error, such as a
+// rate limit, an overloaded provider or a network error. The delay before each retry is the one asked by
+// the provider with the Retry-After header, or an exponential backoff with jitter.
+//
+// Only the requests are retried, a stream that fails after the LLM started answering isn't.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of retries of a request, zero disables the retries.
+	MaxRetries int
+	// InitialBackoff is the backoff before the first retry, doubled before each following retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponential backoff.
+	MaxBackoff time.Duration
+}
+
+// statusError is the error of an LLM request answered with an unexpected HTTP status.
+type statusError struct {
+	statusCode int
+	retryAfter time.Duration
+	// message is the error message of the response body.
+	message string
+}
+
+// DefaultRetryPolicy is the retry policy of the LLMs that aren't configured with another one.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// errStreamStopped is returned by RetryPolicy.retry when the consumer of the LLM stream stopped reading
+// it while the request was retried, so nothing should be yielded anymore.
+var errStreamStopped = errors.New("llm stream stopped")
+
+// retry calls do until it succeeds, fails with an error that isn't transient, or the retries are
+// exhausted, and returns the last error, classified as an LLMError. Before each retry, the status of the
+// retry is passed to onStatus, if it's not nil, which the LLM streams yield so the user knows why the
+// answer is delayed. errStreamStopped is returned if onStatus returns false.
+func (p RetryPolicy) retry(
+	ctx context.Context,
+	provider string,
+	do func() error,
+	onStatus func(models.Content) bool,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := do()
+		if err == nil {
+			return nil
+		}
+		reason, retryAfter, ok := transientError(err)
+		if !ok || attempt > p.MaxRetries {
+			return newLLMError(err)
+		}
+
+		delay := p.backoff(attempt, retryAfter)
+		if onStatus != nil && !onStatus(models.Content{
+			Type: models.ContentTypeStatus,
+			Text: fmt.Sprintf("%s is unavailable (%s), retrying in %s (attempt %d of %d)…",
+				provider, reason, roundDelay(delay), attempt, p.MaxRetries),
+		}) {
+			return errStreamStopped
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the delay before the given retry attempt: the delay asked by the provider if any,
+// otherwise the exponential backoff, of which a random half is used as jitter so the retries of
+// concurrent chats are spread out.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	backoff := p.InitialBackoff << (attempt - 1)
+	if backoff <= 0 || backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	half := backoff / 2
+	if half <= 0 {
+		return backoff
+	}
+	return half + rand.N(half)
+}
+
+// roundDelay rounds the delay shown to the user to the second, or to the millisecond if it's shorter.
+func roundDelay(delay time.Duration) time.Duration {
+	if delay < time.Second {
+		return delay.Round(time.Millisecond)
+	}
+	return delay.Round(time.Second)
+}
+
+// newStatusError returns the error of a response with an unexpected status, and closes its body. The
+// request isn't part of the error, as it's shown to the user.
+func newStatusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return &statusError{
+		statusCode: resp.StatusCode,
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		message:    errorBodyMessage(body),
+	}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d, body: %s", e.statusCode, e.message)
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or a date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// transientError reports whether err is a transient error worth retrying, with a short description of
+// it and the delay asked by the provider, if any.
+func transientError(err error) (string, time.Duration, bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "", 0, false
+	}
+	if code, retryAfter, ok := httpStatus(err); ok {
+		return statusReason(code), retryAfter, transientStatus(code)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network error", 0, true
+	}
+	return "", 0, false
+}
+
+// httpStatus returns the HTTP status of the response that failed with err, and the delay asked by the
+// provider, if any. It reports false if err isn't the error of a response.
+func httpStatus(err error) (int, time.Duration, bool) {
+	var sErr *statusError
+	if errors.As(err, &sErr) {
+		return sErr.statusCode, sErr.retryAfter, true
+	}
+	var apiErr *goopenai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode, 0, true
+	}
+	var reqErr *goopenai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode, 0, true
+	}
+	var ollamaErr api.StatusError
+	if errors.As(err, &ollamaErr) {
+		return ollamaErr.StatusCode, 0, true
+	}
+	return 0, 0, false
+}
+
+// transientStatus reports whether the HTTP status is a transient failure: a timeout, a rate limit, a
+// server error, or Anthropic's 529 overloaded status.
+func transientStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+		return true
+	default:
+		return false
+	}
+}
+
+func statusReason(code int) string {
+	if code == 529 {
+		return "HTTP 529 Overloaded"
+	}
+	return fmt.Sprintf("HTTP %d %s", code, http.StatusText(code))
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		min, max time.Duration
+	}{
+		{name: "empty", value: "", min: 0, max: 0},
+		{name: "seconds", value: "5", min: 5 * time.Second, max: 5 * time.Second},
+		{name: "zero seconds", value: "0", min: 0, max: 0},
+		{name: "invalid", value: "soon", min: 0, max: 0},
+		{
+			name:  "future date",
+			value: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat),
+			// The date has a precision of a second.
+			min: 8 * time.Second,
+			max: 10 * time.Second,
+		},
+		{name: "past date", value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), min: 0, max: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 10, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{name: "first retry", attempt: 1, min: 500 * time.Millisecond, max: time.Second},
+		{name: "doubled", attempt: 2, min: time.Second, max: 2 * time.Second},
+		{name: "capped", attempt: 4, min: 2500 * time.Millisecond, max: 5 * time.Second},
+		{name: "overflow capped", attempt: 100, min: 2500 * time.Millisecond, max: 5 * time.Second},
+		{name: "retry after", attempt: 1, retryAfter: 42 * time.Second, min: 42 * time.Second, max: 42 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delays := make(map[time.Duration]struct{})
+			for range 100 {
+				got := policy.backoff(tt.attempt, tt.retryAfter)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("backoff(%d, %s) = %s, want between %s and %s",
+						tt.attempt, tt.retryAfter, got, tt.min, tt.max)
+				}
+				delays[got] = struct{}{}
+			}
+			// The backoff is jittered, but the delay asked by the provider is kept as is.
+			if jittered := len(delays) > 1; jittered != (tt.retryAfter == 0) {
+				t.Errorf("backoff(%d, %s) returned %d distinct delays", tt.attempt, tt.retryAfter, len(delays))
+			}
+		})
+	}
+}
+
+func TestRetryPolicyRetry(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	overloaded := &statusError{statusCode: http.StatusServiceUnavailable, message: "Overloaded"}
+	badRequest := &statusError{statusCode: http.StatusBadRequest, message: "Bad request"}
+
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		errs     []error
+		stop     bool
+		calls    int
+		statuses int
+		wantKind models.ErrorKind
+		wantErr  error
+	}{
+		{name: "success", policy: policy, errs: []error{nil}, calls: 1},
+		{name: "success after retries", policy: policy, errs: []error{overloaded, overloaded, nil}, calls: 3, statuses: 2},
+		{
+			name:     "retries exhausted",
+			policy:   policy,
+			errs:     []error{overloaded, overloaded, overloaded, nil},
+			calls:    3,
+			statuses: 2,
+			wantKind: models.ErrorKindOverloaded,
+		},
+		{
+			name:     "not transient",
+			policy:   policy,
+			errs:     []error{badRequest, nil},
+			calls:    1,
+			wantKind: models.ErrorKindInvalidRequest,
+		},
+		{
+			name:     "retries disabled",
+			policy:   RetryPolicy{},
+			errs:     []error{overloaded, nil},
+			calls:    1,
+			wantKind: models.ErrorKindOverloaded,
+		},
+		{
+			name:     "stream stopped",
+			policy:   policy,
+			errs:     []error{overloaded, nil},
+			stop:     true,
+			calls:    1,
+			statuses: 1,
+			wantErr:  errStreamStopped,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls, statuses int
+			err := tt.policy.retry(context.Background(), "Test", func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			}, func(status models.Content) bool {
+				statuses++
+				if status.Type != models.ContentTypeStatus || !strings.Contains(status.Text, "Test is unavailable") {
+					t.Errorf("status = %+v, want the status of the retry", status)
+				}
+				return !tt.stop
+			})
+
+			if calls != tt.calls || statuses != tt.statuses {
+				t.Errorf("retry() made %d calls with %d statuses, want %d calls with %d statuses",
+					calls, statuses, tt.calls, tt.statuses)
+			}
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("retry() = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantKind != "":
+				var llmErr *LLMError
+				if !errors.As(err, &llmErr) || llmErr.Kind != tt.wantKind {
+					t.Errorf("retry() = %v, want an LLMError of kind %s", err, tt.wantKind)
+				}
+			case err != nil:
+				t.Errorf("retry() = %v, want no error", err)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxRetries: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+
+	var calls int
+	err := policy.retry(ctx, "Test", func() error {
+		calls++
+		return &statusError{statusCode: http.StatusTooManyRequests}
+	}, func(models.Content) bool {
+		cancel()
+		return true
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("retry() = %v after %d calls, want the cancellation during the first backoff", err, calls)
+	}
+}
+
+func TestRetryNotAfterStreamStarted(t *testing.T) {
+	// The stream fails with an overloaded error after the first text, which isn't retried as the text was
+	// already yielded.
+	srv := newRecordingServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []struct{ name, data string }{
+			{"message_start", `{"type": "message_start", "message": {"model": "claude-test", "usage": {}}}`},
+			{"content_block_start", `{"type": "content_block_start", "index": 0, "content_block": {"type": "text"}}`},
+			{"content_block_delta", `{"type": "content_block_delta", "index": 0, ` +
+				`"delta": {"type": "text_delta", "text": "Hello"}}`},
+			{"error", `{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`},
+		} {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.data)
+		}
+	})
+	anthropic := NewAnthropic("test-key", "claude-test", "", srv.URL, 1024, models.LLMParameters{}, slog.Default()).
+		WithRetry(RetryPolicy{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	var text string
+	var streamErr error
+	for content, err := range anthropic.Chat(context.Background(), []models.Message{{
+		Role:     models.RoleUser,
+		Contents: []models.Content{{Type: models.ContentTypeText, Text: "Hi"}},
+	}}, nil, models.ChatOptions{}) {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		if content.Type == models.ContentTypeStatus {
+			t.Errorf("stream yielded the retry status %q", content.Text)
+		}
+		text += content.Text
+	}
+
+	if text != "Hello" {
+		t.Errorf("stream text = %q, want %q", text, "Hello")
+	}
+	var llmErr *LLMError
+	if !errors.As(streamErr, &llmErr) || llmErr.Kind != models.ErrorKindOverloaded {
+		t.Errorf("stream error = %v, want an overloaded LLMError", streamErr)
+	}
+	if n := srv.requestCount(); n != 1 {
+		t.Errorf("server received %d requests, want 1", n)
+	}
+}
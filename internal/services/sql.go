@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// sqlMigration upgrades the schema and records of a SQL store from the previous version.
+type sqlMigration func(ctx context.Context, tx *sql.Tx) error
+
+// execMigration returns a migration that executes the given statements.
+func execMigration(query string) sqlMigration {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+}
+
+func withSQLTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// searchTermsColumn returns the value of the search_terms columns. The terms are separated and
+// surrounded by spaces, so a term can be matched exactly with LIKE '% term %', or as a prefix with
+// LIKE '% term%'.
+func searchTermsColumn(text string) string {
+	terms := models.SearchTerms(text)
+	if len(terms) == 0 {
+		return ""
+	}
+	return " " + strings.Join(terms, " ") + " "
+}
+
+// searchTermsPatterns returns the LIKE patterns matching the search_terms columns against terms. Every
+// term but the last one must match a whole word, while the last one is matched as a prefix, as the user
+// may still be typing it.
+func searchTermsPatterns(terms []string) []any {
+	patterns := make([]any, len(terms))
+	for i, term := range terms {
+		if i == len(terms)-1 {
+			patterns[i] = "% " + term + "%"
+		} else {
+			patterns[i] = "% " + term + " %"
+		}
+	}
+	return patterns
+}
+
+// sqlTime scans a time stored either as a timestamp, or as Unix nanoseconds, as SQLite doesn't have a
+// timestamp type that sorts chronologically.
+type sqlTime struct {
+	time.Time
+}
+
+// Scan implements the sql.Scanner interface.
+func (t *sqlTime) Scan(src any) error {
+	switch v := src.(type) {
+	case time.Time:
+		t.Time = v
+	case int64:
+		t.Time = time.Unix(0, v)
+	default:
+		return fmt.Errorf("unsupported time value of type %T", src)
+	}
+	return nil
+}
+
+// sqlFolders scans the JSON array of the folders column.
+type sqlFolders []string
+
+// Scan implements the sql.Scanner interface.
+func (f *sqlFolders) Scan(src any) error {
+	var v []byte
+	switch src := src.(type) {
+	case string:
+		v = []byte(src)
+	case []byte:
+		v = src
+	default:
+		return fmt.Errorf("unsupported folders value of type %T", src)
+	}
+	return json.Unmarshal(v, (*[]string)(f))
+}
+
+// foldersColumn returns the value of the folders column.
+func foldersColumn(folders []string) string {
+	if len(folders) == 0 {
+		return "[]"
+	}
+	v, _ := json.Marshal(folders)
+	return string(v)
+}
+
+// sqlParameters scans the JSON object of the parameters column.
+type sqlParameters models.LLMParameters
+
+// Scan implements the sql.Scanner interface.
+func (p *sqlParameters) Scan(src any) error {
+	var v []byte
+	switch src := src.(type) {
+	case string:
+		v = []byte(src)
+	case []byte:
+		v = src
+	default:
+		return fmt.Errorf("unsupported parameters value of type %T", src)
+	}
+	return json.Unmarshal(v, (*models.LLMParameters)(p))
+}
+
+// parametersColumn returns the value of the parameters column.
+func parametersColumn(params models.LLMParameters) string {
+	v, _ := json.Marshal(params)
+	return string(v)
+}
+
+// sqlContextTrim scans the JSON object of the context_trim column.
+type sqlContextTrim models.ContextTrim
+
+// Scan implements the sql.Scanner interface.
+func (t *sqlContextTrim) Scan(src any) error {
+	var v []byte
+	switch src := src.(type) {
+	case string:
+		v = []byte(src)
+	case []byte:
+		v = src
+	default:
+		return fmt.Errorf("unsupported context trim value of type %T", src)
+	}
+	return json.Unmarshal(v, (*models.ContextTrim)(t))
+}
+
+// contextTrimColumn returns the value of the context_trim column.
+func contextTrimColumn(trim models.ContextTrim) string {
+	v, _ := json.Marshal(trim)
+	return string(v)
+}
+
+// sqlFinish scans the JSON object of the finish column.
+type sqlFinish models.Finish
+
+// Scan implements the sql.Scanner interface.
+func (f *sqlFinish) Scan(src any) error {
+	var v []byte
+	switch src := src.(type) {
+	case string:
+		v = []byte(src)
+	case []byte:
+		v = src
+	default:
+		return fmt.Errorf("unsupported finish value of type %T", src)
+	}
+	return json.Unmarshal(v, (*models.Finish)(f))
+}
+
+// finishColumn returns the value of the finish column.
+func finishColumn(finish models.Finish) string {
+	v, _ := json.Marshal(finish)
+	return string(v)
+}
+
+type sqlRowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanSQLChat scans a chat from a row of the columns: id, title, created_at, updated_at, pinned,
+// archived, folders, llm_profile, persona_id, parameters and model.
+func scanSQLChat(row sqlRowScanner) (models.Chat, error) {
+	var chat models.Chat
+	var createdAt, updatedAt sqlTime
+	var folders sqlFolders
+	if err := row.Scan(&chat.ID, &chat.Title, &createdAt, &updatedAt, &chat.Pinned, &chat.Archived,
+		&folders, &chat.LLMProfile, &chat.PersonaID, (*sqlParameters)(&chat.Parameters), &chat.Model); err != nil {
+		return models.Chat{}, err
+	}
+	chat.CreatedAt = createdAt.Time
+	chat.UpdatedAt = updatedAt.Time
+	if len(folders) > 0 {
+		chat.Folders = folders
+	}
+	return chat, nil
+}
+
+func scanSQLChats(rows *sql.Rows) ([]models.Chat, error) {
+	defer rows.Close()
+
+	var chats []models.Chat
+	for rows.Next() {
+		chat, err := scanSQLChat(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan chat: %w", err)
+		}
+		chats = append(chats, chat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate chats: %w", err)
+	}
+	return chats, nil
+}
+
+func scanSQLFolders(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var folders []string
+	for rows.Next() {
+		var folder string
+		if err := rows.Scan(&folder); err != nil {
+			return nil, fmt.Errorf("failed to scan folder: %w", err)
+		}
+		folders = append(folders, folder)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate folders: %w", err)
+	}
+	return folders, nil
+}
+
+// scanSQLMessages scans the messages from rows of the columns: id, role, contents, created_at,
+// input_tokens, output_tokens, cost, context_trim, cache_read_tokens, cache_write_tokens, fallback_llm,
+// error_kind, error_message and finish.
+func scanSQLMessages(rows *sql.Rows) ([]models.Message, error) {
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		var message models.Message
+		var contents string
+		if err := rows.Scan(&message.ID, &message.Role, &contents, &message.Timestamp,
+			&message.Usage.InputTokens, &message.Usage.OutputTokens, &message.Usage.Cost,
+			(*sqlContextTrim)(&message.ContextTrim),
+			&message.Usage.CacheReadTokens, &message.Usage.CacheWriteTokens, &message.FallbackLLM,
+			&message.Error.Kind, &message.Error.Message, (*sqlFinish)(&message.Finish)); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		if err := json.Unmarshal([]byte(contents), &message.Contents); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message contents: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate messages: %w", err)
+	}
+	return messages, nil
+}
+
+func scanSQLSearchResults(rows *sql.Rows, terms []string) ([]models.SearchResult, error) {
+	defer rows.Close()
+
+	var results []models.SearchResult
+	for rows.Next() {
+		var res models.SearchResult
+		var contents string
+		var chatSeq, messageSeq int64
+		if err := rows.Scan(&res.ChatID, &res.ChatTitle, &res.MessageID, &contents, &chatSeq, &messageSeq); err != nil {
+			return nil, fmt.Errorf("failed to scan search result: %w", err)
+		}
+
+		if res.MessageID == "" {
+			res.Snippet = res.ChatTitle
+			results = append(results, res)
+			continue
+		}
+
+		var message models.Message
+		if err := json.Unmarshal([]byte(contents), &message.Contents); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message contents: %w", err)
+		}
+		res.Snippet = models.Snippet(message.SearchText(), terms)
+		results = append(results, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate search results: %w", err)
+	}
+	return results, nil
+}
+
+// personaColumn returns the value of the data column of the personas, which holds the whole persona.
+func personaColumn(persona models.Persona) (string, error) {
+	v, err := json.Marshal(persona)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal persona: %w", err)
+	}
+	return string(v), nil
+}
+
+// scanSQLPersonas scans the personas from rows of the data column.
+func scanSQLPersonas(rows *sql.Rows) ([]models.Persona, error) {
+	defer rows.Close()
+
+	var personas []models.Persona
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to scan persona: %w", err)
+		}
+		var persona models.Persona
+		if err := json.Unmarshal([]byte(data), &persona); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal persona: %w", err)
+		}
+		personas = append(personas, persona)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate personas: %w", err)
+	}
+	return personas, nil
+}
+
+// scanSQLChatUsages scans the usages from rows of the columns: chat id, chat title, and the sums of
+// input_tokens, output_tokens, cost, cache_read_tokens and cache_write_tokens.
+func scanSQLChatUsages(rows *sql.Rows) ([]models.ChatUsage, error) {
+	defer rows.Close()
+
+	var usages []models.ChatUsage
+	for rows.Next() {
+		var usage models.ChatUsage
+		if err := rows.Scan(&usage.ChatID, &usage.ChatTitle,
+			&usage.Usage.InputTokens, &usage.Usage.OutputTokens, &usage.Usage.Cost,
+			&usage.Usage.CacheReadTokens, &usage.Usage.CacheWriteTokens); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		usages = append(usages, usage)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate usages: %w", err)
+	}
+	sortChatUsages(usages)
+	return usages, nil
+}
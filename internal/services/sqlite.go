@@ -0,0 +1,482 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	_ "modernc.org/sqlite" // Register the pure-Go sqlite driver.
+)
+
+// SQLite implements the Store interface using a SQLite database. Unlike BoltDB, the database file isn't
+// locked exclusively, so it can be inspected with other tools while the server is running, and the
+// ordering of chats and messages is kept in dedicated sequence columns instead of being parsed from the
+// IDs.
+type SQLite struct {
+	db *sql.DB
+}
+
+// sqliteMigrations are the schema migrations of the SQLite store, applied in order. The version of a
+// migration is its index plus one, and applied versions are recorded in the schema_migrations table.
+// Migrations must never be changed once released, new schema changes are appended as new migrations.
+var sqliteMigrations = []sqlMigration{
+	execMigration(`CREATE TABLE chats (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		title TEXT NOT NULL DEFAULT '',
+		search_terms TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE messages (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL,
+		chat_id TEXT NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+		role TEXT NOT NULL,
+		contents TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		search_terms TEXT NOT NULL DEFAULT '',
+		UNIQUE (chat_id, id)
+	);
+	CREATE INDEX messages_chat_id_seq ON messages (chat_id, seq);`),
+	migrateSQLiteChatMetadata,
+	execMigration(`ALTER TABLE chats ADD COLUMN llm_profile TEXT NOT NULL DEFAULT '';`),
+	execMigration(`ALTER TABLE chats ADD COLUMN persona_id TEXT NOT NULL DEFAULT '';
+	CREATE TABLE personas (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		data TEXT NOT NULL
+	);`),
+	execMigration(`ALTER TABLE chats ADD COLUMN parameters TEXT NOT NULL DEFAULT '{}';`),
+	execMigration(`ALTER TABLE messages ADD COLUMN input_tokens INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN output_tokens INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN cost REAL NOT NULL DEFAULT 0;`),
+	execMigration(`ALTER TABLE messages ADD COLUMN context_trim TEXT NOT NULL DEFAULT '{}';`),
+	execMigration(`ALTER TABLE messages ADD COLUMN cache_read_tokens INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN cache_write_tokens INTEGER NOT NULL DEFAULT 0;`),
+	execMigration(`ALTER TABLE messages ADD COLUMN fallback_llm TEXT NOT NULL DEFAULT '';`),
+	execMigration(`ALTER TABLE messages ADD COLUMN error_kind TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN error_message TEXT NOT NULL DEFAULT '';`),
+	execMigration(`ALTER TABLE messages ADD COLUMN finish TEXT NOT NULL DEFAULT '{}';`),
+	execMigration(`ALTER TABLE chats ADD COLUMN model TEXT NOT NULL DEFAULT '';`),
+}
+
+// migrateSQLiteChatMetadata adds the metadata columns to the chats, and sets the creation and update
+// times of the existing chats to the timestamps of their first and last messages. Times are stored as
+// Unix nanoseconds, so they sort chronologically.
+func migrateSQLiteChatMetadata(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE chats ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE chats ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE chats ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE chats ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE chats ADD COLUMN folders TEXT NOT NULL DEFAULT '[]';
+		CREATE INDEX chats_list ON chats (archived, pinned, updated_at, id);`); err != nil {
+		return err
+	}
+
+	// The message timestamps are aggregated here, as SQLite can't compare the stored timestamps.
+	rows, err := tx.QueryContext(ctx, `SELECT chat_id, created_at FROM messages`)
+	if err != nil {
+		return err
+	}
+	first := make(map[string]time.Time)
+	last := make(map[string]time.Time)
+	for rows.Next() {
+		var chatID string
+		var createdAt time.Time
+		if err := rows.Scan(&chatID, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		if t, ok := first[chatID]; !ok || createdAt.Before(t) {
+			first[chatID] = createdAt
+		}
+		if t, ok := last[chatID]; !ok || createdAt.After(t) {
+			last[chatID] = createdAt
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for chatID, createdAt := range first {
+		if _, err := tx.ExecContext(ctx, `UPDATE chats SET created_at = ?, updated_at = ? WHERE id = ?`,
+			createdAt.UnixNano(), last[chatID].UnixNano(), chatID); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UnixNano()
+	_, err = tx.ExecContext(ctx, `UPDATE chats SET created_at = ?, updated_at = ? WHERE created_at = 0`, now, now)
+	return err
+}
+
+const sqliteChatColumns = "id, title, created_at, updated_at, pinned, archived, folders, llm_profile, persona_id, " +
+	"parameters, model"
+
+const sqliteMessageColumns = "id, role, contents, created_at, input_tokens, output_tokens, cost, " +
+	"context_trim, cache_read_tokens, cache_write_tokens, fallback_llm, error_kind, error_message, " +
+	"finish"
+
+// NewSQLite opens the SQLite database at the specified path, creating it if it doesn't exist, and applies
+// the pending schema migrations.
+func NewSQLite(path string) (SQLite, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return SQLite{}, fmt.Errorf("failed to open sqlite db: %w", err)
+	}
+	// SQLite only allows a single writer, so we serialize the access instead of retrying on busy errors.
+	db.SetMaxOpenConns(1)
+
+	s := SQLite{db: db}
+	if err := s.migrate(context.Background()); err != nil {
+		_ = db.Close()
+		return SQLite{}, err
+	}
+	return s, nil
+}
+
+// Close closes the underlying database.
+func (s SQLite) Close() error {
+	return s.db.Close()
+}
+
+func (s SQLite) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	var current int
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	for i := current; i < len(sqliteMigrations); i++ {
+		version := i + 1
+		err := withSQLTx(ctx, s.db, func(tx *sql.Tx) error {
+			if err := sqliteMigrations[i](ctx, tx); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// Chats retrieves all stored chats, from the most recently created to the oldest one.
+func (s SQLite) Chats(ctx context.Context) ([]models.Chat, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteChatColumns+` FROM chats ORDER BY seq DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chats: %w", err)
+	}
+	return scanSQLChats(rows)
+}
+
+// Chat retrieves the chat with the given ID. If the chat doesn't exist, a zero Chat is returned
+// without an error.
+func (s SQLite) Chat(ctx context.Context, chatID string) (models.Chat, error) {
+	chat, err := scanSQLChat(s.db.QueryRowContext(ctx,
+		`SELECT `+sqliteChatColumns+` FROM chats WHERE id = ?`, chatID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Chat{}, nil
+	}
+	if err != nil {
+		return models.Chat{}, fmt.Errorf("failed to query chat: %w", err)
+	}
+	return chat, nil
+}
+
+// ChatsPage retrieves a page of the chats that match the query filters, with the pinned chats first,
+// then from the most recently updated one. The cursor of a page holds the sort key of its last chat, and
+// the returned next cursor is empty when there are no chats left.
+func (s SQLite) ChatsPage(ctx context.Context, query models.ChatsQuery) ([]models.Chat, string, error) {
+	var after models.Chat
+	if query.Cursor != "" {
+		var err error
+		after, err = parseChatsCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = -1
+	} else {
+		// We fetch one more chat to know whether there is a next page.
+		limit++
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteChatColumns+` FROM chats
+		WHERE archived = ?
+		AND (? = '' OR EXISTS (SELECT 1 FROM json_each(chats.folders) WHERE value = ?))
+		AND (? = '' OR (pinned, updated_at, id) < (?, ?, ?))
+		ORDER BY pinned DESC, updated_at DESC, id DESC LIMIT ?`,
+		query.Archived, query.Folder, query.Folder,
+		query.Cursor, after.Pinned, after.UpdatedAt.UnixNano(), after.ID, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query chats: %w", err)
+	}
+	chats, err := scanSQLChats(rows)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if query.Limit > 0 && len(chats) > query.Limit {
+		chats = chats[:query.Limit]
+		return chats, chatsCursor(chats[len(chats)-1]), nil
+	}
+	return chats, "", nil
+}
+
+// Folders retrieves the sorted names of the folders that contain at least one chat.
+func (s SQLite) Folders(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT f.value FROM chats, json_each(chats.folders) AS f
+		ORDER BY f.value`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query folders: %w", err)
+	}
+	return scanSQLFolders(rows)
+}
+
+// AddChat stores a new chat and returns its ID. The ID of the given chat is kept as is, and the creation
+// and update times default to the current time.
+func (s SQLite) AddChat(ctx context.Context, chat models.Chat) (string, error) {
+	if chat.CreatedAt.IsZero() {
+		chat.CreatedAt = time.Now()
+	}
+	if chat.UpdatedAt.IsZero() {
+		chat.UpdatedAt = chat.CreatedAt
+	}
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO chats
+		(id, title, search_terms, created_at, updated_at, pinned, archived, folders, llm_profile, persona_id,
+		parameters, model)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		chat.ID, chat.Title, searchTermsColumn(chat.Title), chat.CreatedAt.UnixNano(), chat.UpdatedAt.UnixNano(),
+		chat.Pinned, chat.Archived, foldersColumn(chat.Folders), chat.LLMProfile, chat.PersonaID,
+		parametersColumn(chat.Parameters), chat.Model)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert chat: %w", err)
+	}
+	return chat.ID, nil
+}
+
+// UpdateChat modifies an existing chat. If the chat doesn't exist, the operation is silently ignored.
+// The creation time can't be changed, and the update time is never moved backwards, so updating a chat
+// read before a message was added doesn't revert the activity recorded by AddMessage.
+func (s SQLite) UpdateChat(ctx context.Context, chat models.Chat) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE chats SET title = ?, search_terms = ?,
+		updated_at = MAX(updated_at, ?), pinned = ?, archived = ?, folders = ?, llm_profile = ?, persona_id = ?,
+		parameters = ?, model = ?
+		WHERE id = ?`,
+		chat.Title, searchTermsColumn(chat.Title), chat.UpdatedAt.UnixNano(), chat.Pinned, chat.Archived,
+		foldersColumn(chat.Folders), chat.LLMProfile, chat.PersonaID, parametersColumn(chat.Parameters), chat.Model,
+		chat.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update chat: %w", err)
+	}
+	return nil
+}
+
+// Messages retrieves all messages of the specified chat in their stored order.
+func (s SQLite) Messages(ctx context.Context, chatID string) ([]models.Message, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteMessageColumns+` FROM messages
+		WHERE chat_id = ? ORDER BY seq`, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	return scanSQLMessages(rows)
+}
+
+// MessagesPage retrieves a page of messages of the specified chat, starting from the latest message and
+// going backwards. The messages within the page are in their stored order. The cursor of a page is the
+// ID of its oldest message, and the returned next cursor is empty when there are no older messages left.
+func (s SQLite) MessagesPage(
+	ctx context.Context,
+	chatID string,
+	query models.MessagesQuery,
+) ([]models.Message, string, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = -1
+	} else {
+		// We fetch one more message to know whether there is a next page.
+		limit++
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteMessageColumns+` FROM messages
+		WHERE chat_id = ? AND (? = '' OR seq < (SELECT seq FROM messages WHERE chat_id = ? AND id = ?))
+		ORDER BY seq DESC LIMIT ?`, chatID, query.Cursor, chatID, query.Cursor, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query messages: %w", err)
+	}
+	messages, err := scanSQLMessages(rows)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(messages) > query.Limit {
+		messages = messages[:query.Limit]
+		nextCursor = messages[len(messages)-1].ID
+	}
+	slices.Reverse(messages)
+	return messages, nextCursor, nil
+}
+
+// AddMessage stores a new message in the specified chat and returns its ID. The ID of the given message
+// is kept as is, and the update time of the chat is moved to the message timestamp, if it's later.
+func (s SQLite) AddMessage(ctx context.Context, chatID string, message models.Message) (string, error) {
+	contents, err := json.Marshal(message.Contents)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message contents: %w", err)
+	}
+
+	err = withSQLTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO messages
+			(id, chat_id, role, contents, created_at, search_terms, input_tokens, output_tokens, cost, context_trim,
+			cache_read_tokens, cache_write_tokens, fallback_llm, error_kind, error_message, finish)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.ID, chatID, message.Role, string(contents), message.Timestamp,
+			searchTermsColumn(message.SearchText()),
+			message.Usage.InputTokens, message.Usage.OutputTokens, message.Usage.Cost,
+			contextTrimColumn(message.ContextTrim),
+			message.Usage.CacheReadTokens, message.Usage.CacheWriteTokens, message.FallbackLLM,
+			message.Error.Kind, message.Error.Message, finishColumn(message.Finish)); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE chats SET updated_at = MAX(updated_at, ?) WHERE id = ?`,
+			message.Timestamp.UnixNano(), chatID)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to insert message: %w", err)
+	}
+	return message.ID, nil
+}
+
+// UpdateMessage modifies an existing message in the specified chat. If the message doesn't exist, the
+// operation is silently ignored.
+func (s SQLite) UpdateMessage(ctx context.Context, chatID string, message models.Message) error {
+	contents, err := json.Marshal(message.Contents)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message contents: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `UPDATE messages SET role = ?, contents = ?, created_at = ?, search_terms = ?,
+		input_tokens = ?, output_tokens = ?, cost = ?, context_trim = ?, cache_read_tokens = ?, cache_write_tokens = ?,
+		fallback_llm = ?, error_kind = ?, error_message = ?, finish = ?
+		WHERE chat_id = ? AND id = ?`,
+		message.Role, string(contents), message.Timestamp, searchTermsColumn(message.SearchText()),
+		message.Usage.InputTokens, message.Usage.OutputTokens, message.Usage.Cost,
+		contextTrimColumn(message.ContextTrim), message.Usage.CacheReadTokens, message.Usage.CacheWriteTokens,
+		message.FallbackLLM, message.Error.Kind, message.Error.Message, finishColumn(message.Finish),
+		chatID, message.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+	return nil
+}
+
+// ChatUsage returns the total usage of the messages of the specified chat.
+func (s SQLite) ChatUsage(ctx context.Context, chatID string) (models.Usage, error) {
+	var usage models.Usage
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
+		COALESCE(SUM(cost), 0), COALESCE(SUM(cache_read_tokens), 0), COALESCE(SUM(cache_write_tokens), 0)
+		FROM messages WHERE chat_id = ?`, chatID).
+		Scan(&usage.InputTokens, &usage.OutputTokens, &usage.Cost, &usage.CacheReadTokens, &usage.CacheWriteTokens)
+	if err != nil {
+		return models.Usage{}, fmt.Errorf("failed to query chat usage: %w", err)
+	}
+	return usage, nil
+}
+
+// UsageByChat returns the total usage of each chat with a non-zero usage, from the most expensive chat.
+func (s SQLite) UsageByChat(ctx context.Context) ([]models.ChatUsage, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT c.id, c.title, SUM(m.input_tokens), SUM(m.output_tokens),
+		SUM(m.cost), SUM(m.cache_read_tokens), SUM(m.cache_write_tokens) FROM chats c JOIN messages m ON m.chat_id = c.id
+		GROUP BY c.id, c.title HAVING SUM(m.input_tokens + m.output_tokens) > 0`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usages: %w", err)
+	}
+	return scanSQLChatUsages(rows)
+}
+
+// Personas retrieves the stored personas sorted by name.
+func (s SQLite) Personas(ctx context.Context) ([]models.Persona, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM personas ORDER BY name, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query personas: %w", err)
+	}
+	return scanSQLPersonas(rows)
+}
+
+// SavePersona stores the persona, replacing the stored persona with the same ID.
+func (s SQLite) SavePersona(ctx context.Context, persona models.Persona) error {
+	data, err := personaColumn(persona)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO personas (id, name, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, data = excluded.data`,
+		persona.ID, persona.Name, data)
+	if err != nil {
+		return fmt.Errorf("failed to save persona: %w", err)
+	}
+	return nil
+}
+
+// DeletePersona deletes the persona with the given ID. If the persona doesn't exist, the operation is
+// silently ignored.
+func (s SQLite) DeletePersona(ctx context.Context, personaID string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM personas WHERE id = ?`, personaID); err != nil {
+		return fmt.Errorf("failed to delete persona: %w", err)
+	}
+	return nil
+}
+
+// SearchChats returns the chat titles and messages that contain all the terms of query, with the last
+// term matched as a prefix. Results are ordered from the most recent chat to the oldest one, and from
+// the first message to the last one within a chat, and at most limit results are returned.
+func (s SQLite) SearchChats(ctx context.Context, query string, limit int) ([]models.SearchResult, error) {
+	terms := models.SearchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+
+	patterns := searchTermsPatterns(terms)
+	where := func(column string) string {
+		return strings.Repeat(" AND "+column+" LIKE ?", len(terms))[len(" AND "):]
+	}
+
+	q := fmt.Sprintf(`SELECT id, title, '', '', seq, 0 FROM chats WHERE %s
+		UNION ALL
+		SELECT c.id, c.title, m.id, m.contents, c.seq, m.seq FROM messages m JOIN chats c ON c.id = m.chat_id
+		WHERE %s
+		ORDER BY 5 DESC, 6 LIMIT ?`, where("search_terms"), where("m.search_terms"))
+	args := slices.Concat(patterns, patterns, []any{limit})
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search chats: %w", err)
+	}
+	return scanSQLSearchResults(rows, terms)
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLite(t *testing.T) {
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "store.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	testStore(t, db)
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.sqlite")
+	first := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	last := first.Add(time.Hour)
+
+	// The store is created at the first schema version, with a chat with messages and one without.
+	s := SQLite{db: openSQLiteTestDB(t, path)}
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	err := withSQLTx(ctx, s.db, func(tx *sql.Tx) error {
+		if err := sqliteMigrations[0](ctx, tx); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (1, ?)`,
+			time.Now()); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO chats (id, title) VALUES ('old', 'Old chat'),
+			('empty', 'Empty chat')`); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO messages (id, chat_id, role, contents, created_at) VALUES
+			('answer', 'old', 'assistant', '[]', ?), ('question', 'old', 'user', '[]', ?)`, last, first)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	beforeMigration := time.Now()
+	s, err = NewSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("schema version = %d, want %d", version, len(sqliteMigrations))
+	}
+
+	// The chat times are set from the messages, and the chats without messages are set to the migration time.
+	chat, err := s.Chat(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chat.CreatedAt.Equal(first) || !chat.UpdatedAt.Equal(last) {
+		t.Errorf("chat times = %s, %s, want %s, %s", chat.CreatedAt, chat.UpdatedAt, first, last)
+	}
+	if chat.Pinned || chat.Archived || len(chat.Folders) != 0 || chat.LLMProfile != "" || chat.Model != "" {
+		t.Errorf("chat = %+v, want the default values of the added columns", chat)
+	}
+	empty, err := s.Chat(ctx, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.CreatedAt.Before(beforeMigration) || !empty.UpdatedAt.Equal(empty.CreatedAt) {
+		t.Errorf("empty chat times = %s, %s, want the migration time", empty.CreatedAt, empty.UpdatedAt)
+	}
+	messages, err := s.Messages(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Usage.InputTokens != 0 || messages[0].Finish.StopReason != "" {
+		t.Errorf("messages = %+v, want the default values of the added columns", messages)
+	}
+
+	// Reopening the store doesn't apply the migrations again.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewSQLite(path)
+	if err != nil {
+		t.Fatalf("failed to reopen the migrated store: %v", err)
+	}
+	var applied int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(sqliteMigrations) {
+		t.Errorf("%d migrations recorded, want %d", applied, len(sqliteMigrations))
+	}
+}
+
+func openSQLiteTestDB(t *testing.T, path string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+)
+
+// testedStore is the store API shared by the stores, which testStore checks.
+type testedStore interface {
+	Chats(ctx context.Context) ([]models.Chat, error)
+	Chat(ctx context.Context, chatID string) (models.Chat, error)
+	ChatsPage(ctx context.Context, query models.ChatsQuery) ([]models.Chat, string, error)
+	Folders(ctx context.Context) ([]string, error)
+	AddChat(ctx context.Context, chat models.Chat) (string, error)
+	UpdateChat(ctx context.Context, chat models.Chat) error
+	Messages(ctx context.Context, chatID string) ([]models.Message, error)
+	MessagesPage(ctx context.Context, chatID string, query models.MessagesQuery) ([]models.Message, string, error)
+	AddMessage(ctx context.Context, chatID string, message models.Message) (string, error)
+	UpdateMessage(ctx context.Context, chatID string, message models.Message) error
+	ChatUsage(ctx context.Context, chatID string) (models.Usage, error)
+	UsageByChat(ctx context.Context) ([]models.ChatUsage, error)
+	Personas(ctx context.Context) ([]models.Persona, error)
+	SavePersona(ctx context.Context, persona models.Persona) error
+	DeletePersona(ctx context.Context, personaID string) error
+	SearchChats(ctx context.Context, query string, limit int) ([]models.SearchResult, error)
+}
+
+// testStore checks the chats, messages, usages, personas and search of an empty store.
+func testStore(t *testing.T, s testedStore) {
+	ctx := context.Background()
+	start := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	// ids are the IDs given by the store to the chats and messages, by the IDs they were added with.
+	ids := make(map[string]string)
+	storedIDs := func(added ...string) []string {
+		stored := make([]string, len(added))
+		for i, id := range added {
+			stored[i] = ids[id]
+		}
+		return stored
+	}
+
+	t.Run("Chats", func(t *testing.T) {
+		chats := []models.Chat{
+			{ID: "planning", Title: "Trip planning", CreatedAt: start, Folders: []string{"travel"}},
+			{ID: "recipes", Title: "Bread recipes", CreatedAt: start.Add(time.Minute), Pinned: true},
+			{ID: "taxes", Title: "Taxes", CreatedAt: start.Add(2 * time.Minute), Folders: []string{"admin", "travel"}},
+			{ID: "old", Title: "Old chat", CreatedAt: start.Add(3 * time.Minute), Archived: true},
+		}
+		for _, chat := range chats {
+			id, err := s.AddChat(ctx, chat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := storedID(s, chat.ID, len(ids)+1); id != want {
+				t.Errorf("AddChat() = %q, want %q", id, want)
+			}
+			ids[chat.ID] = id
+		}
+
+		got, err := s.Chats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := chatIDs(got); !slices.Equal(ids, storedIDs("old", "taxes", "recipes", "planning")) {
+			t.Errorf("Chats() = %v, want them from the most recently created one", ids)
+		}
+
+		// The pinned chats come first, then the most recently updated ones, without the archived ones.
+		page, cursor, err := s.ChatsPage(ctx, models.ChatsQuery{Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := chatIDs(page); !slices.Equal(ids, storedIDs("recipes", "taxes")) || cursor == "" {
+			t.Errorf("first ChatsPage() = %v, %q, want [recipes taxes] and a cursor", ids, cursor)
+		}
+		page, cursor, err = s.ChatsPage(ctx, models.ChatsQuery{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := chatIDs(page); !slices.Equal(ids, storedIDs("planning")) || cursor != "" {
+			t.Errorf("second ChatsPage() = %v, %q, want [planning] and no cursor", ids, cursor)
+		}
+		page, _, err = s.ChatsPage(ctx, models.ChatsQuery{Folder: "travel"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := chatIDs(page); !slices.Equal(ids, storedIDs("taxes", "planning")) {
+			t.Errorf("ChatsPage() of the travel folder = %v, want [taxes planning]", ids)
+		}
+		page, _, err = s.ChatsPage(ctx, models.ChatsQuery{Archived: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := chatIDs(page); !slices.Equal(ids, storedIDs("old")) {
+			t.Errorf("ChatsPage() of the archived chats = %v, want [old]", ids)
+		}
+
+		folders, err := s.Folders(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(folders, []string{"admin", "travel"}) {
+			t.Errorf("Folders() = %v, want [admin travel]", folders)
+		}
+
+		// Updating a chat read before a later activity doesn't move its update time backwards.
+		chat := chats[0]
+		chat.ID = ids[chat.ID]
+		chat.Title = "Summer trip"
+		chat.LLMProfile = "local"
+		chat.Model = "llama3.2"
+		chat.Parameters = models.LLMParameters{Temperature: ptrTo[float32](0.2)}
+		chat.UpdatedAt = start.Add(-time.Hour)
+		if err := s.UpdateChat(ctx, chat); err != nil {
+			t.Fatal(err)
+		}
+		updated, err := s.Chat(ctx, chat.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Title != chat.Title || updated.LLMProfile != chat.LLMProfile || updated.Model != chat.Model ||
+			updated.Parameters.Temperature == nil || *updated.Parameters.Temperature != 0.2 {
+			t.Errorf("Chat() = %+v after the update, want %+v", updated, chat)
+		}
+		if !updated.CreatedAt.Equal(start) || !updated.UpdatedAt.Equal(start) {
+			t.Errorf("Chat() times = %s, %s, want both at %s", updated.CreatedAt, updated.UpdatedAt, start)
+		}
+
+		missing, err := s.Chat(ctx, "missing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if missing.ID != "" {
+			t.Errorf("Chat() of a missing chat = %+v, want a zero chat", missing)
+		}
+	})
+
+	t.Run("Messages", func(t *testing.T) {
+		chatID, err := s.AddChat(ctx, models.Chat{ID: "messages", Title: "Messages", CreatedAt: start})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids["messages"] = chatID
+		var want []models.Message
+		for i, text := range []string{"Hello there", "Hi, how can I help?", "Tell me about sourdough"} {
+			msg := models.Message{
+				ID:        string(rune('a' + i)),
+				Role:      []models.Role{models.RoleUser, models.RoleAssistant}[i%2],
+				Contents:  []models.Content{{Type: models.ContentTypeText, Text: text}},
+				Timestamp: start.Add(time.Duration(i+1) * time.Minute),
+			}
+			if msg.Role == models.RoleAssistant {
+				msg.Usage = models.Usage{InputTokens: 100, OutputTokens: 50, CacheReadTokens: 20, Cost: 0.25}
+				msg.FallbackLLM = "backup"
+				msg.Finish = models.Finish{StopReason: models.StopReasonEnd}
+			}
+			id, err := s.AddMessage(ctx, chatID, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantID := storedID(s, msg.ID, i+1); id != wantID {
+				t.Errorf("AddMessage() = %q, want %q", id, wantID)
+			}
+			ids[msg.ID] = id
+			msg.ID = id
+			want = append(want, msg)
+		}
+
+		// Adding a message moves the update time of the chat to its timestamp.
+		chat, err := s.Chat(ctx, chatID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !chat.UpdatedAt.Equal(want[2].Timestamp) {
+			t.Errorf("chat updated at %s, want the time of its last message %s", chat.UpdatedAt, want[2].Timestamp)
+		}
+
+		want[1].Contents[0].Text = "Hi, what can I do for you?"
+		want[1].Error = models.MessageError{Kind: models.ErrorKindOverloaded, Message: "Try again later"}
+		if err := s.UpdateMessage(ctx, chatID, want[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.Messages(ctx, chatID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Messages() returned %d messages, want %d", len(got), len(want))
+		}
+		for i, msg := range got {
+			w := want[i]
+			if msg.ID != w.ID || msg.Role != w.Role || msg.Contents[0].Text != w.Contents[0].Text ||
+				!msg.Timestamp.Equal(w.Timestamp) || msg.Usage != w.Usage || msg.FallbackLLM != w.FallbackLLM ||
+				msg.Error != w.Error || msg.Finish.StopReason != w.Finish.StopReason {
+				t.Errorf("Messages()[%d] = %+v, want %+v", i, msg, w)
+			}
+		}
+
+		page, cursor, err := s.MessagesPage(ctx, chatID, models.MessagesQuery{Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := messageIDs(page); !slices.Equal(ids, storedIDs("b", "c")) || cursor != want[1].ID {
+			t.Errorf("first MessagesPage() = %v, %q, want [b c] and the cursor b", ids, cursor)
+		}
+		page, cursor, err = s.MessagesPage(ctx, chatID, models.MessagesQuery{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := messageIDs(page); !slices.Equal(ids, storedIDs("a")) || cursor != "" {
+			t.Errorf("second MessagesPage() = %v, %q, want [a] and no cursor", ids, cursor)
+		}
+
+		usage, err := s.ChatUsage(ctx, chatID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage != want[1].Usage {
+			t.Errorf("ChatUsage() = %+v, want %+v", usage, want[1].Usage)
+		}
+		usages, err := s.UsageByChat(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantUsages := []models.ChatUsage{{ChatID: chatID, ChatTitle: "Messages", Usage: want[1].Usage}}
+		if !slices.Equal(usages, wantUsages) {
+			t.Errorf("UsageByChat() = %+v, want %+v", usages, wantUsages)
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		results, err := s.SearchChats(ctx, "sourd", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].ChatID != ids["messages"] || results[0].MessageID != ids["c"] {
+			t.Errorf("SearchChats() = %+v, want the last message of the messages chat", results)
+		}
+		results, err = s.SearchChats(ctx, "summer trip", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].ChatID != ids["planning"] || results[0].MessageID != "" {
+			t.Errorf("SearchChats() = %+v, want the title of the planning chat", results)
+		}
+		// The replaced content of a message isn't found anymore.
+		results, err = s.SearchChats(ctx, "help", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 0 {
+			t.Errorf("SearchChats() = %+v, want no results for the replaced content", results)
+		}
+		results, err = s.SearchChats(ctx, "a", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 0 {
+			t.Errorf("SearchChats() = %+v, want no results for a query without terms", results)
+		}
+	})
+
+	t.Run("Personas", func(t *testing.T) {
+		personas := []models.Persona{
+			{ID: "writer", Name: "Writer", SystemPrompt: "Write well.", Tools: []string{"search"}},
+			{ID: "coder", Name: "Coder", SystemPrompt: "Write code."},
+		}
+		for _, persona := range personas {
+			if err := s.SavePersona(ctx, persona); err != nil {
+				t.Fatal(err)
+			}
+		}
+		personas[1].SystemPrompt = "Write tested code."
+		if err := s.SavePersona(ctx, personas[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.Personas(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || got[0].ID != "coder" || got[0].SystemPrompt != "Write tested code." ||
+			got[1].ID != "writer" || !slices.Equal(got[1].Tools, []string{"search"}) {
+			t.Errorf("Personas() = %+v, want the personas sorted by name", got)
+		}
+
+		if err := s.DeletePersona(ctx, "coder"); err != nil {
+			t.Fatal(err)
+		}
+		got, err = s.Personas(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].ID != "writer" {
+			t.Errorf("Personas() = %+v after the deletion, want only the writer", got)
+		}
+	})
+}
+
+// storedID returns the ID given by the store to the nth chat, or the nth message of a chat, added with the ID.
+// BoltDB prefixes it with a sequence number, which keeps the records in the order they were added.
+func storedID(s testedStore, id string, n int) string {
+	if _, ok := s.(BoltDB); ok {
+		return fmt.Sprintf("%d-%s", n, id)
+	}
+	return id
+}
+
+func chatIDs(chats []models.Chat) []string {
+	ids := make([]string, len(chats))
+	for i, chat := range chats {
+		ids[i] = chat.ID
+	}
+	return ids
+}
+
+func messageIDs(messages []models.Message) []string {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
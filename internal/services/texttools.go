@@ -0,0 +1,270 @@
+package services
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"strings"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+const (
+	toolCallOpenTag  = "<tool_call>"
+	toolCallCloseTag = "</tool_call>"
+)
+
+// textToolCall is the JSON object of a tool call in text, between the tool call tags.
+type textToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// textToolsChat streams the answer of the LLM to the chat with the tools described in the system prompt,
+// for the models that can't call tools natively. The model calls a tool by answering with a tool call
+// block, which is parsed out of the streamed text into a call tool content, so the tool is called like the
+// native tool calls. The earlier tool calls and results of the chat are sent to the model as text.
+//
+// Only the first tool call of an answer is called, and the text the model streams after it is dropped, as
+// the model can't know the result of the tool yet.
+func (c Capabilities) textToolsChat(
+	ctx context.Context,
+	messages []models.Message,
+	tools []mcp.Tool,
+	opts models.ChatOptions,
+) iter.Seq2[models.Content, error] {
+	return func(yield func(models.Content, error) bool) {
+		opts.SystemPrompt = textToolsPrompt(cmp.Or(opts.SystemPrompt, c.systemPrompt), tools)
+
+		var splitter toolCallSplitter
+		var callTool *models.Content
+		for content, err := range c.llm.Chat(ctx, textToolMessages(messages), nil, opts) {
+			if err != nil {
+				yield(content, err)
+				return
+			}
+			switch content.Type {
+			case models.ContentTypeText:
+				if callTool != nil {
+					continue
+				}
+				var text string
+				text, callTool = splitter.split(content.Text)
+				if text != "" && !yield(models.Content{Type: models.ContentTypeText, Text: text}, nil) {
+					return
+				}
+				continue
+			case models.ContentTypeFinish:
+				if callTool == nil {
+					// The model may omit the closing tag of its tool call at the end of its answer.
+					var text string
+					text, callTool = splitter.flush()
+					if text != "" && !yield(models.Content{Type: models.ContentTypeText, Text: text}, nil) {
+						return
+					}
+				}
+				if callTool != nil && content.Finish != nil {
+					finish := *content.Finish
+					finish.StopReason = models.StopReasonToolUse
+					content.Finish = &finish
+				}
+			}
+			if !yield(content, nil) {
+				return
+			}
+		}
+
+		if callTool == nil {
+			text, call := splitter.flush()
+			if text != "" && !yield(models.Content{Type: models.ContentTypeText, Text: text}, nil) {
+				return
+			}
+			if call == nil {
+				return
+			}
+			callTool = call
+		}
+		// The call tool is yielded last, like the native tool calls.
+		yield(*callTool, nil)
+	}
+}
+
+// textToolsPrompt returns the system prompt describing the tools and how to call them in text.
+func textToolsPrompt(systemPrompt string, tools []mcp.Tool) string {
+	if len(tools) == 0 {
+		return systemPrompt
+	}
+
+	var sb strings.Builder
+	if systemPrompt != "" {
+		sb.WriteString(systemPrompt)
+		sb.WriteString("\n\n")
+	}
+	sb.WriteString("You can call the following tools. To call a tool, end your answer with a block of this form, ")
+	sb.WriteString("with the arguments matching the input schema of the tool:\n")
+	sb.WriteString(toolCallOpenTag + "\n")
+	sb.WriteString(`{"name": "tool_name", "arguments": {"argument": "value"}}` + "\n")
+	sb.WriteString(toolCallCloseTag + "\n")
+	sb.WriteString("Call one tool at a time, and stop after the block. The result of the tool is then sent to you ")
+	sb.WriteString("in a <tool_result> block.\n\nTools:")
+	for _, tool := range tools {
+		fmt.Fprintf(&sb, "\n- %s: %s", tool.Name, tool.Description)
+		if len(tool.InputSchema) > 0 {
+			fmt.Fprintf(&sb, "\n  Input schema: %s", tool.InputSchema)
+		}
+	}
+	return sb.String()
+}
+
+// textToolMessages returns the messages with their tool calls and results replaced by text. The tool calls
+// are written as the tool call blocks of the model, and each tool result ends the assistant message, and
+// is sent as a user message, so the model answers it.
+func textToolMessages(messages []models.Message) []models.Message {
+	var result []models.Message
+	for _, msg := range messages {
+		if msg.Role != models.RoleAssistant {
+			result = append(result, msg)
+			continue
+		}
+
+		current := models.Message{ID: msg.ID, Role: models.RoleAssistant, Timestamp: msg.Timestamp}
+		toolNames := make(map[string]string)
+		for _, ct := range msg.Contents {
+			switch ct.Type {
+			case models.ContentTypeCallTool:
+				toolNames[ct.CallToolID] = ct.ToolName
+				current.Contents = append(current.Contents, models.Content{
+					Type: models.ContentTypeText,
+					Text: formatTextToolCall(ct),
+				})
+			case models.ContentTypeToolResult:
+				result = append(result, current, models.Message{
+					Role: models.RoleUser,
+					Contents: []models.Content{{
+						Type: models.ContentTypeText,
+						Text: formatTextToolResult(ct, toolNames[ct.CallToolID]),
+					}},
+				})
+				current = models.Message{ID: msg.ID, Role: models.RoleAssistant, Timestamp: msg.Timestamp}
+			default:
+				current.Contents = append(current.Contents, ct)
+			}
+		}
+		if len(current.Contents) > 0 {
+			result = append(result, current)
+		}
+	}
+	return result
+}
+
+func formatTextToolCall(ct models.Content) string {
+	call, err := json.Marshal(textToolCall{Name: ct.ToolName, Arguments: ct.ToolInput})
+	if err != nil {
+		call, _ = json.Marshal(textToolCall{Name: ct.ToolName, Arguments: json.RawMessage("{}")})
+	}
+	return fmt.Sprintf("%s\n%s\n%s", toolCallOpenTag, call, toolCallCloseTag)
+}
+
+func formatTextToolResult(ct models.Content, toolName string) string {
+	status := "succeeded"
+	if ct.CallToolFailed {
+		status = "failed"
+	}
+	return fmt.Sprintf("<tool_result name=%q status=%q>\n%s\n</tool_result>", toolName, status, ct.ToolResult)
+}
+
+// toolCallSplitter splits the streamed text of the models calling tools in text into the text and the
+// first tool call block. Like thinkTagSplitter, a chunk ending with the beginning of the opening tag is
+// held back until the next chunk tells whether it's the tag. The blocks that aren't valid tool calls are
+// kept in the text as is.
+type toolCallSplitter struct {
+	pending string
+	// block is the text of the tool call block streamed so far, after its opening tag.
+	block  string
+	inCall bool
+}
+
+// split returns the text of the streamed chunk, and the tool call once its block is complete.
+func (s *toolCallSplitter) split(chunk string) (string, *models.Content) {
+	if s.inCall {
+		s.block += chunk
+		return s.closeBlock("")
+	}
+
+	text := s.pending + chunk
+	s.pending = ""
+	i := strings.Index(text, toolCallOpenTag)
+	if i < 0 {
+		n := tagPrefixSuffix(text, toolCallOpenTag)
+		s.pending = text[len(text)-n:]
+		return text[:len(text)-n], nil
+	}
+	s.inCall = true
+	s.block = text[i+len(toolCallOpenTag):]
+	return s.closeBlock(text[:i])
+}
+
+// closeBlock returns the text before the block and the tool call if the block is complete, or the block
+// as text if it isn't a valid tool call, followed by the text after it.
+func (s *toolCallSplitter) closeBlock(before string) (string, *models.Content) {
+	i := strings.Index(s.block, toolCallCloseTag)
+	if i < 0 {
+		return before, nil
+	}
+	block, rest := s.block[:i], s.block[i+len(toolCallCloseTag):]
+	s.inCall = false
+	s.block = ""
+	if call, ok := parseTextToolCall(block); ok {
+		return before, &call
+	}
+
+	raw := toolCallOpenTag + block + toolCallCloseTag
+	text, call := s.split(rest)
+	return before + raw + text, call
+}
+
+// flush returns the text held back at the end of the stream, or the tool call of an unclosed block if it's
+// a valid tool call.
+func (s *toolCallSplitter) flush() (string, *models.Content) {
+	if !s.inCall {
+		text := s.pending
+		s.pending = ""
+		return text, nil
+	}
+	block := s.block
+	s.inCall = false
+	s.block = ""
+	if call, ok := parseTextToolCall(block); ok {
+		return "", &call
+	}
+	return toolCallOpenTag + block, nil
+}
+
+// parseTextToolCall parses the JSON object of a tool call block, which the models sometimes wrap in a
+// Markdown code block. The call is given a new ID, as the models calling tools in text don't name their
+// calls, and the tool results are matched to their calls by ID.
+func parseTextToolCall(block string) (models.Content, bool) {
+	block = strings.TrimSpace(block)
+	block = strings.TrimPrefix(block, "```json")
+	block = strings.TrimPrefix(block, "```")
+	block = strings.TrimSuffix(block, "```")
+
+	var call textToolCall
+	if err := json.Unmarshal([]byte(block), &call); err != nil || call.Name == "" {
+		return models.Content{}, false
+	}
+	args := call.Arguments
+	if len(args) == 0 || string(args) == "null" {
+		args = json.RawMessage("{}")
+	}
+	return models.Content{
+		Type:       models.ContentTypeCallTool,
+		ToolName:   call.Name,
+		ToolInput:  args,
+		CallToolID: uuid.New().String(),
+	}, true
+}
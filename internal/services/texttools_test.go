@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/MegaGrindStone/go-mcp"
+	"github.com/MegaGrindStone/mcp-web-ui/internal/models"
+	"github.com/google/uuid"
+)
+
+func TestToolCallSplitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []string
+		wantText string
+		// wantTool and wantInput are the name and arguments of the tool call, if any.
+		wantTool  string
+		wantInput string
+	}{
+		{name: "text", chunks: []string{"Hello ", "world"}, wantText: "Hello world"},
+		{
+			name: "tool call",
+			chunks: []string{
+				"Let me search.\n<tool_call>\n",
+				`{"name": "search", "arguments": {"query": "go"}}`,
+				"\n</tool_call>",
+			},
+			wantText:  "Let me search.\n",
+			wantTool:  "search",
+			wantInput: `{"query": "go"}`,
+		},
+		{
+			name: "tags split across chunks",
+			chunks: []string{
+				"Checking.<tool", "_ca", `ll>{"name": "now", "arguments": {}}</tool`, "_call>",
+			},
+			wantText:  "Checking.",
+			wantTool:  "now",
+			wantInput: `{}`,
+		},
+		{
+			name:     "tag prefix that isn't a tag",
+			chunks:   []string{"a <tool", "s> b <", "tool_", "x>"},
+			wantText: "a <tools> b <tool_x>",
+		},
+		{
+			name: "json fences",
+			chunks: []string{
+				"<tool_call>\n```json\n",
+				`{"name": "search", "arguments": {"query": "go"}}`,
+				"\n```\n</tool_call>",
+			},
+			wantTool:  "search",
+			wantInput: `{"query": "go"}`,
+		},
+		{
+			name:     "invalid json kept as text",
+			chunks:   []string{"Before <tool_call>{not json}</tool_call> after"},
+			wantText: "Before <tool_call>{not json}</tool_call> after",
+		},
+		{
+			name:      "call after an invalid block",
+			chunks:    []string{`<tool_call>oops</tool_call> then <tool_call>{"name": "now"}</tool_call>`},
+			wantText:  "<tool_call>oops</tool_call> then ",
+			wantTool:  "now",
+			wantInput: `{}`,
+		},
+		{
+			name:      "text after the call dropped",
+			chunks:    []string{`<tool_call>{"name": "now"}</tool_call>`, "The time is noon."},
+			wantTool:  "now",
+			wantInput: `{}`,
+		},
+		{
+			name:      "unclosed block",
+			chunks:    []string{"Sure.<tool_call>", `{"name": "search", "arguments": {"query": "go"}}`},
+			wantText:  "Sure.",
+			wantTool:  "search",
+			wantInput: `{"query": "go"}`,
+		},
+		{
+			name:     "unclosed invalid block",
+			chunks:   []string{"Sure.<tool_call>", "{"},
+			wantText: "Sure.<tool_call>{",
+		},
+		{name: "pending tag prefix flushed", chunks: []string{"End <tool_"}, wantText: "End <tool_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var splitter toolCallSplitter
+			var text strings.Builder
+			var call *models.Content
+			for _, chunk := range tt.chunks {
+				if call != nil {
+					break
+				}
+				var chunkText string
+				chunkText, call = splitter.split(chunk)
+				text.WriteString(chunkText)
+			}
+			if call == nil {
+				var flushed string
+				flushed, call = splitter.flush()
+				text.WriteString(flushed)
+			}
+
+			if text.String() != tt.wantText {
+				t.Errorf("text = %q, want %q", text.String(), tt.wantText)
+			}
+			switch {
+			case tt.wantTool == "" && call != nil:
+				t.Errorf("tool call = %+v, want none", call)
+			case tt.wantTool != "" && call == nil:
+				t.Errorf("no tool call, want %s", tt.wantTool)
+			case tt.wantTool != "":
+				if call.ToolName != tt.wantTool || string(call.ToolInput) != tt.wantInput {
+					t.Errorf("tool call = %s %s, want %s %s", call.ToolName, call.ToolInput, tt.wantTool, tt.wantInput)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTextToolCall(t *testing.T) {
+	tests := []struct {
+		name      string
+		block     string
+		wantOK    bool
+		wantTool  string
+		wantInput string
+	}{
+		{
+			name:      "call",
+			block:     `{"name": "search", "arguments": {"query": "go"}}`,
+			wantOK:    true,
+			wantTool:  "search",
+			wantInput: `{"query": "go"}`,
+		},
+		{
+			name:      "json fences",
+			block:     "\n```json\n{\"name\": \"search\", \"arguments\": {\"query\": \"go\"}}\n```\n",
+			wantOK:    true,
+			wantTool:  "search",
+			wantInput: `{"query": "go"}`,
+		},
+		{
+			name:      "plain fences",
+			block:     "```\n{\"name\": \"now\", \"arguments\": {}}\n```",
+			wantOK:    true,
+			wantTool:  "now",
+			wantInput: `{}`,
+		},
+		{name: "null arguments", block: `{"name": "now", "arguments": null}`, wantOK: true, wantTool: "now", wantInput: `{}`},
+		{name: "missing arguments", block: `{"name": "now"}`, wantOK: true, wantTool: "now", wantInput: `{}`},
+		{name: "invalid json", block: `{"name": "search", "arguments": {`},
+		{name: "missing name", block: `{"arguments": {"query": "go"}}`},
+		{name: "not an object", block: `["search"]`},
+		{name: "empty", block: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call, ok := parseTextToolCall(tt.block)
+			if ok != tt.wantOK {
+				t.Fatalf("parseTextToolCall() ok = %t, want %t", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if call.Type != models.ContentTypeCallTool || call.ToolName != tt.wantTool ||
+				string(call.ToolInput) != tt.wantInput {
+				t.Errorf("parseTextToolCall() = %s %s, want %s %s", call.ToolName, call.ToolInput, tt.wantTool, tt.wantInput)
+			}
+			if _, err := uuid.Parse(call.CallToolID); err != nil {
+				t.Errorf("CallToolID = %q, want a UUID", call.CallToolID)
+			}
+		})
+	}
+
+	// Each call has its own ID, so their results aren't mixed up.
+	first, _ := parseTextToolCall(`{"name": "now"}`)
+	second, _ := parseTextToolCall(`{"name": "now"}`)
+	if first.CallToolID == second.CallToolID {
+		t.Errorf("both calls have the ID %s", first.CallToolID)
+	}
+}
+
+func TestTextToolsChat(t *testing.T) {
+	llm := scriptedLLM{contents: []models.Content{
+		{Type: models.ContentTypeText, Text: "Let me check.<tool_"},
+		{Type: models.ContentTypeText, Text: `call>{"name": "weather", "arguments": {"city": "Paris"}}</tool_call>`},
+		{Type: models.ContentTypeText, Text: "It's sunny."},
+		finishContent("ollama", "test-model", "stop"),
+	}}
+	capabilities := NewCapabilities(llm, "test-model", ConfiguredCapabilities{Tools: ptrTo(false)}, slog.Default()).
+		WithTextTools("Be brief.")
+	tools := []mcp.Tool{{Name: "weather", InputSchema: json.RawMessage(`{"type": "object"}`)}}
+
+	var contents []models.Content
+	for content, err := range capabilities.Chat(context.Background(), nil, tools, models.ChatOptions{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, content)
+	}
+
+	if len(contents) != 3 {
+		t.Fatalf("Chat() = %+v, want the text, the finish and the tool call", contents)
+	}
+	if contents[0].Text != "Let me check." {
+		t.Errorf("text = %q, want the text before the call", contents[0].Text)
+	}
+	if finish := contents[1].Finish; finish == nil || finish.StopReason != models.StopReasonToolUse {
+		t.Errorf("finish = %+v, want a tool use", finish)
+	}
+	if call := contents[2]; call.ToolName != "weather" || string(call.ToolInput) != `{"city": "Paris"}` ||
+		call.CallToolID == "" {
+		t.Errorf("tool call = %+v, want weather in Paris with an ID", call)
+	}
+}
@@ -207,7 +207,23 @@ function showResourceModal(resourceIndex) {
     new bootstrap.Modal(document.getElementById('resourceModal')).show();
 }
 
+function markActiveChat() {
+    // Chats published through SSE are rendered for every client, so the active chat is marked here
+    const chatID = new URLSearchParams(window.location.search).get('chat_id');
+    document.querySelectorAll('#pinned-chat-list > .list-group-item, #chat-list > .list-group-item').forEach(item => {
+        item.classList.toggle('active', chatID !== null && item.id === `chat-${chatID}`);
+    });
+}
+
+document.addEventListener('htmx:sseMessage', markActiveChat);
+
 document.addEventListener('DOMContentLoaded', function() {
+    // Start at the latest message, older messages are loaded as the user scrolls up
+    const chatMessages = document.getElementById('chat-messages');
+    if (chatMessages && !window.location.hash) {
+        chatMessages.scrollTop = chatMessages.scrollHeight;
+    }
+
     // Fix any trailing commas in arrays
     for (let i = 0; i < promptsList.length; i++) {
         if (promptsList[i].arguments && promptsList[i].arguments.length > 0) {